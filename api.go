@@ -2,15 +2,17 @@ package main
 
 import (
 	"database/sql"
-	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 
+	"fdurand/standalone_dhcp/pool"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/go-ini/ini"
 	"github.com/gorilla/mux"
@@ -21,24 +23,43 @@ import (
 
 // Node struct
 type Node struct {
-	Mac    string    `json:"mac"`
-	IP     string    `json:"ip"`
-	EndsAt time.Time `json:"ends_at"`
+	Mac      string    `json:"mac"`
+	IP       string    `json:"ip"`
+	EndsAt   time.Time `json:"ends_at"`
+	BootFile string    `json:"boot_file,omitempty"`
 }
 
 // Stats struct
 type Stats struct {
 	EthernetName string            `json:"interface"`
 	Net          string            `json:"network"`
+	Shared       string            `json:"shared_network,omitempty"`
+	Type         string            `json:"type,omitempty"`
 	Free         int               `json:"free"`
 	PercentFree  int               `json:"percentfree"`
 	Used         int               `json:"used"`
+	Partner      int               `json:"partner,omitempty"`
+	Excluded     int               `json:"excluded"` // Part of an exclusion range
+	Unusable     int               `json:"unusable"` // Declined or found in use
 	PercentUsed  int               `json:"percentused"`
 	Category     string            `json:"category"`
 	Options      map[string]string `json:"options"`
 	Members      []Node            `json:"members"`
 	Status       string            `json:"status"`
 	Size         int               `json:"size"`
+	Ranges       []RangeStats      `json:"ranges,omitempty"` // Usage of every address range
+	Algorithm    string            `json:"algorithm,omitempty"`
+	Policy       string            `json:"client_policy,omitempty"`
+	Denied       uint64            `json:"denied,omitempty"` // Packets refused by the client policy
+}
+
+// RangeStats is the usage of an address range of a network
+type RangeStats struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+	Size  int    `json:"size"`
+	Free  int    `json:"free"`
+	Used  int    `json:"used"`
 }
 
 type Items struct {
@@ -75,20 +96,28 @@ func encodeJSON(res http.ResponseWriter, data interface{}) {
 
 // ConfigSection represents a network configuration section
 type ConfigSection struct {
-	Network              string `json:"network"`
-	DNS                  string `json:"dns"`
-	Gateway              string `json:"gateway"`
-	DHCPStart            string `json:"dhcp_start"`
-	DHCPEnd              string `json:"dhcp_end"`
-	Netmask              string `json:"netmask"`
-	DomainName           string `json:"domain_name,omitempty"`
-	DHCPDefaultLeaseTime string `json:"dhcp_default_lease_time"`
-	DHCPMaxLeaseTime     string `json:"dhcp_max_lease_time"`
-	DHCPEnabled          string `json:"dhcpd"`
-	IPReserved           string `json:"ip_reserved,omitempty"`
-	IPAssigned           string `json:"ip_assigned,omitempty"`
-	Algorithm            string `json:"algorithm,omitempty"`
-	NextHop              string `json:"next_hop,omitempty"`
+	Network              string   `json:"network"`
+	DNS                  string   `json:"dns"`
+	Gateway              string   `json:"gateway"`
+	DHCPStart            string   `json:"dhcp_start"`
+	DHCPEnd              string   `json:"dhcp_end"`
+	Ranges               []string `json:"ranges,omitempty"` // start-end, replace dhcp_start and dhcp_end
+	Netmask              string   `json:"netmask"`
+	DomainName           string   `json:"domain_name,omitempty"`
+	DHCPDefaultLeaseTime string   `json:"dhcp_default_lease_time"`
+	DHCPMaxLeaseTime     string   `json:"dhcp_max_lease_time"`
+	DHCPMinLeaseTime     string   `json:"dhcp_min_lease_time,omitempty"`
+	DHCPEnabled          string   `json:"dhcpd"`
+	IPReserved           string   `json:"ip_reserved,omitempty"`
+	IPAssigned           string   `json:"ip_assigned,omitempty"`
+	Algorithm            string   `json:"algorithm,omitempty"` // random, sequential, mac-hash or least-recently-released
+	NextHop              string   `json:"next_hop,omitempty"`
+	SharedNetwork        string   `json:"shared_network,omitempty"`
+	Stickiness           string   `json:"stickiness,omitempty"`    // Seconds
+	ClientPolicy         string   `json:"client_policy,omitempty"` // allow, known or deny
+	DeniedReply          string   `json:"denied_reply,omitempty"`  // ignore or nak
+	NextServer           string   `json:"next_server,omitempty"`
+	BootFilename         string   `json:"boot_filename,omitempty"`
 }
 
 // ConfigResponse represents the full configuration
@@ -154,7 +183,7 @@ func handleAllStats(res http.ResponseWriter, req *http.Request) {
 		result.Items = append(result.Items, Stats{})
 	}
 	for _, i := range NetInterfaces {
-		if h, ok := intNametoInterface[i]; ok {
+		if h, ok := lookupInterface(i); ok {
 			stat := h.handleApiReq(ApiReq{Req: "stats", NetInterface: i, NetWork: ""})
 			for _, s := range stat.([]Stats) {
 				result.Items = append(result.Items, s)
@@ -174,10 +203,82 @@ func handleAllStats(res http.ResponseWriter, req *http.Request) {
 	return
 }
 
+func handleIP6ToClient(res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	ip := net.ParseIP(vars["ip"])
+	if !IsIPv6(ip) {
+		unifiedapierrors.Error(res, "Invalid IPv6 address", http.StatusBadRequest)
+		return
+	}
+
+	if node, found := DHCPConfig.lookup6(ip); found {
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(http.StatusOK)
+		encodeJSON(res, node)
+		return
+	}
+	unifiedapierrors.Error(res, "Cannot find match for this IP address", http.StatusNotFound)
+}
+
+func handleClient6(res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	client := strings.ToLower(vars["client"])
+
+	nodes := DHCPConfig.bindings6(client)
+	if len(nodes) == 0 {
+		unifiedapierrors.Error(res, "Cannot find match for this client", http.StatusNotFound)
+		return
+	}
+
+	response := map[string]interface{}{
+		"status": "success",
+		"client": client,
+		"items":  nodes,
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, response)
+}
+
+func handleReleaseClient6(res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	client := strings.ToLower(vars["client"])
+
+	released := DHCPConfig.release6(client)
+	if len(released) == 0 {
+		unifiedapierrors.Error(res, "Cannot find an active lease for this client", http.StatusNotFound)
+		return
+	}
+
+	response := map[string]interface{}{
+		"status":   "ACK",
+		"client":   client,
+		"released": released,
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, response)
+}
+
+// handleFailoverStatus handles GET /api/v1/failover
+func handleFailoverStatus(res http.ResponseWriter, req *http.Request) {
+	if failover == nil {
+		unifiedapierrors.Error(res, "Failover is not configured", http.StatusNotFound)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, failover.status())
+}
+
 func handleStats(res http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 
-	if h, ok := intNametoInterface[vars["int"]]; ok {
+	if h, ok := lookupInterface(vars["int"]); ok {
 		stat := h.handleApiReq(ApiReq{Req: "stats", NetInterface: vars["int"], NetWork: vars["network"]})
 
 		outgoingJSON, err := json.Marshal(stat)
@@ -198,7 +299,12 @@ func handleStats(res http.ResponseWriter, req *http.Request) {
 func handleDebug(res http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 
-	if h, ok := intNametoInterface[vars["int"]]; ok {
+	if vars["role"] != noClass && lookupClientClass(vars["role"]) == nil {
+		unifiedapierrors.Error(res, "Class not found", http.StatusNotFound)
+		return
+	}
+
+	if h, ok := lookupInterface(vars["int"]); ok {
 		stat := h.handleApiReq(ApiReq{Req: "debug", NetInterface: vars["int"], Role: vars["role"]})
 
 		outgoingJSON, err := json.Marshal(stat)
@@ -233,12 +339,110 @@ func handleReleaseIP(res http.ResponseWriter, req *http.Request) {
 	encodeJSON(res, result)
 }
 
+// pageSize reads the limit parameter of a list request
+func pageSize(req *http.Request, defaultSize, maxSize int) (int, error) {
+	value := req.URL.Query().Get("limit")
+	if value == "" {
+		return defaultSize, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 || limit > maxSize {
+		return 0, fmt.Errorf("invalid limit %q, must be between 1 and %d", value, maxSize)
+	}
+	return limit, nil
+}
+
+// handleListLeases handles GET /api/v1/dhcp/leases
+func handleListLeases(res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	filter := LeaseFilter{
+		Network:   query.Get("network"),
+		Interface: query.Get("interface"),
+		MACPrefix: query.Get("mac"),
+		Hostname:  query.Get("hostname"),
+		State:     query.Get("state"),
+	}
+	if filter.State != "" && !validLeaseState(filter.State) {
+		unifiedapierrors.Error(res, "Invalid state parameter. Must be 'offered', 'bound' or 'static'", http.StatusBadRequest)
+		return
+	}
+	if value := query.Get("expires_before"); value != "" {
+		expiresBefore, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			unifiedapierrors.Error(res, "Invalid expires_before parameter, must be an RFC 3339 date: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter.ExpiresBefore = expiresBefore
+	}
+	limit, err := pageSize(req, defaultLeasePageSize, maxLeasePageSize)
+	if err != nil {
+		unifiedapierrors.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sortSpec := query.Get("sort")
+	if sortSpec == "" {
+		sortSpec = "ip"
+	}
+
+	leases, err := collectLeases(DHCPConfig.interfaces(), filter)
+	if err != nil {
+		unifiedapierrors.Error(res, "Failed to list leases: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	total := len(leases)
+	page, next, err := pageLeases(leases, sortSpec, query.Get("cursor"), limit)
+	if err != nil {
+		unifiedapierrors.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response := map[string]interface{}{
+		"status": "success",
+		"total":  total,
+		"count":  len(page),
+		"leases": page,
+	}
+	if next != "" {
+		response["next_cursor"] = next
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, response)
+}
+
+// handleLeaseHistory handles GET /api/v1/dhcp/mac/{mac}/history
+func handleLeaseHistory(res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	limit, err := pageSize(req, defaultLeasePageSize, maxLeasePageSize)
+	if err != nil {
+		unifiedapierrors.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	history, err := ListLeaseHistory(strings.ToLower(vars["mac"]), limit)
+	if err != nil {
+		unifiedapierrors.Error(res, "Failed to list the lease history: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"status":  "success",
+		"count":   len(history),
+		"history": history,
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, response)
+}
+
 func (h *Interface) handleApiReq(Request ApiReq) interface{} {
 	var stats []Stats
 
 	// Send back stats
 	if Request.Req == "stats" {
-		for _, v := range h.network {
+		for _, v := range h.networks() {
 			ipv4Addr, _, erro := net.ParseCIDR(Request.NetWork + "/32")
 			if erro == nil {
 				if !(v.network.Contains(ipv4Addr)) {
@@ -266,14 +470,24 @@ func (h *Interface) handleApiReq(Request ApiReq) interface{} {
 			Count = 0
 			for i, item := range members {
 				Count++
-				result := make(net.IP, 4)
-				binary.BigEndian.PutUint32(result, binary.BigEndian.Uint32(v.dhcpHandler.start.To4())+uint32(item.Object.(int)))
-				Members = append(Members, Node{IP: result.String(), Mac: i, EndsAt: time.Unix(0, item.Expiration)})
+				Members = append(Members, Node{IP: v.dhcpHandler.ipAt(item.Object.(int)).String(), Mac: i, EndsAt: time.Unix(0, item.Expiration), BootFile: v.dhcpHandler.boundClient(i).bootFile})
 			}
-			_, reserved := IPsFromRange(v.dhcpHandler.ipReserved)
-			if reserved != 1 {
-				Count = Count + reserved
+			// Addresses set aside for the failover partner, excluded, or
+			// unusable for a while
+			var Partner, Excluded, Unusable int
+			for index := 0; index < v.dhcpHandler.leaseRange; index++ {
+				_, owner, err := v.dhcpHandler.available.GetMACIndex(safeIntToUint64(index))
+				switch {
+				case err != nil:
+				case owner == PeerMac:
+					Partner++
+				case owner == ExcludedMac:
+					Excluded++
+				case owner == FakeMac:
+					Unusable++
+				}
 			}
+			Count = Count + Partner + Excluded + Unusable
 
 			availableCount := safeUint64ToInt(v.dhcpHandler.available.FreeIPsRemaining())
 			usedCount := (v.dhcpHandler.leaseRange - availableCount)
@@ -286,17 +500,39 @@ func (h *Interface) handleApiReq(Request ApiReq) interface{} {
 				Status = "Calculated available IP " + strconv.Itoa(v.dhcpHandler.leaseRange-Count) + " is different than what we have available in the pool " + strconv.Itoa(availableCount)
 			}
 
-			stats = append(stats, Stats{EthernetName: Request.NetInterface, Net: v.network.String(), Free: availableCount, Category: v.dhcpHandler.role, Options: Options, Members: Members, Status: Status, Size: v.dhcpHandler.leaseRange, Used: usedCount, PercentFree: percentfree, PercentUsed: percentused})
+			stats = append(stats, Stats{EthernetName: Request.NetInterface, Net: v.network.String(), Shared: v.shared, Free: availableCount, Category: v.dhcpHandler.role, Options: Options, Members: Members, Status: Status, Size: v.dhcpHandler.leaseRange, Used: usedCount, Partner: Partner, Excluded: Excluded, Unusable: Unusable, PercentFree: percentfree, PercentUsed: percentused, Ranges: v.dhcpHandler.available.usage(), Algorithm: v.dhcpHandler.available.algorithm, Policy: v.dhcpHandler.policy.String(), Denied: v.dhcpHandler.policy.deniedCount()})
+		}
+		// The IPv6 scopes are only reported when no IPv4 network is asked for
+		if Request.NetWork == "" {
+			for _, v := range h.networks6() {
+				stats = append(stats, v.dhcpHandler.stats(Request.NetInterface, v.network)...)
+			}
 		}
 		return stats
 	}
-	// Debug
+	// Debug, the bindings of the clients of a class
 	if Request.Req == "debug" {
-		for _, v := range h.network {
-			if Request.Role == v.dhcpHandler.role {
-				spew.Dump(v.dhcpHandler.hwcache)
-				stats = append(stats, Stats{EthernetName: Request.NetInterface, Net: v.network.String(), Free: safeUint64ToInt(v.dhcpHandler.available.FreeIPsRemaining()), Category: v.dhcpHandler.role, Status: "Debug finished"})
+		class := lookupClientClass(Request.Role)
+		for _, v := range h.networks() {
+			var Members []Node
+			for mac, item := range v.dhcpHandler.hwcache.Items() {
+				client := v.dhcpHandler.boundClient(mac)
+				if client.role != class.role() {
+					continue
+				}
+				Members = append(Members, Node{IP: v.dhcpHandler.ipAt(item.Object.(int)).String(), Mac: mac, EndsAt: time.Unix(0, item.Expiration), BootFile: client.bootFile})
 			}
+			spew.Dump(Members)
+			Free := safeUint64ToInt(v.dhcpHandler.available.FreeIPsRemaining())
+			if first, last, ok := class.indexRange(v.dhcpHandler); ok {
+				Free = 0
+				for index := first; index <= last; index++ {
+					if v.dhcpHandler.available.IsFreeIPAtIndex(safeIntToUint64(index)) {
+						Free++
+					}
+				}
+			}
+			stats = append(stats, Stats{EthernetName: Request.NetInterface, Net: v.network.String(), Free: Free, Category: class.role(), Members: Members, Status: "Debug finished"})
 		}
 		return stats
 	}
@@ -306,7 +542,7 @@ func (h *Interface) handleApiReq(Request ApiReq) interface{} {
 
 // handleGetConfig returns the current DHCP configuration
 func handleGetConfig(res http.ResponseWriter, req *http.Request) {
-	cfg, err := ini.Load(configFilePath)
+	cfg, err := ini.ShadowLoad(configFilePath)
 	if err != nil {
 		unifiedapierrors.Error(res, "Failed to load configuration: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -339,15 +575,23 @@ func handleGetConfig(res http.ResponseWriter, req *http.Request) {
 				Gateway:              sec.Key("gateway").String(),
 				DHCPStart:            sec.Key("dhcp_start").String(),
 				DHCPEnd:              sec.Key("dhcp_end").String(),
+				Ranges:               configRanges(sec),
 				Netmask:              sec.Key("netmask").String(),
 				DomainName:           sec.Key("domain-name").String(),
 				DHCPDefaultLeaseTime: sec.Key("dhcp_default_lease_time").String(),
 				DHCPMaxLeaseTime:     sec.Key("dhcp_max_lease_time").String(),
+				DHCPMinLeaseTime:     sec.Key("dhcp_min_lease_time").String(),
 				DHCPEnabled:          sec.Key("dhcpd").String(),
 				IPReserved:           sec.Key("ip_reserved").String(),
 				IPAssigned:           sec.Key("ip_assigned").String(),
 				Algorithm:            sec.Key("algorithm").String(),
 				NextHop:              sec.Key("next_hop").String(),
+				SharedNetwork:        sec.Key("shared_network").String(),
+				Stickiness:           sec.Key("stickiness").String(),
+				ClientPolicy:         sec.Key("client_policy").String(),
+				DeniedReply:          sec.Key("denied_reply").String(),
+				NextServer:           sec.Key("next_server").String(),
+				BootFilename:         sec.Key("boot_filename").String(),
 			}
 			configResponse.Networks = append(configResponse.Networks, configSection)
 		}
@@ -366,72 +610,69 @@ func handleUpdateConfig(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// Create new INI file
-	cfg := ini.Empty()
+	for _, network := range configRequest.Networks {
+		if _, err := pool.StrategyName(network.Algorithm); err != nil {
+			unifiedapierrors.Error(res, "Network "+network.Network+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if seconds, err := strconv.Atoi(network.Stickiness); network.Stickiness != "" && (err != nil || seconds < 0) {
+			unifiedapierrors.Error(res, "Network "+network.Network+": invalid stickiness "+strconv.Quote(network.Stickiness), http.StatusBadRequest)
+			return
+		}
+	}
 
-	// Add interfaces section
-	interfacesSec, err := cfg.NewSection("interfaces")
+	// Start from the current file so the sections and keys the editor does not
+	// manage (IPv6 scopes, client classes, failover...) are kept
+	cfg, err := ini.ShadowLoad(configFilePath)
 	if err != nil {
-		unifiedapierrors.Error(res, "Failed to create interfaces section: "+err.Error(), http.StatusInternalServerError)
-		return
+		if _, statErr := os.Stat(configFilePath); !os.IsNotExist(statErr) {
+			unifiedapierrors.Error(res, "Failed to load configuration: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		cfg = ini.Empty()
 	}
 
-	if len(configRequest.Interfaces) > 0 {
-		interfacesSec.Key("listen").SetValue(strings.Join(configRequest.Interfaces, ","))
-	}
+	// Add interfaces section
+	interfacesSec := cfg.Section("interfaces")
+	setConfigKey(interfacesSec, "listen", strings.Join(configRequest.Interfaces, ","))
+	setConfigKey(interfacesSec, "relay", strings.Join(configRequest.Relay, ","))
 
-	if len(configRequest.Relay) > 0 {
-		interfacesSec.Key("relay").SetValue(strings.Join(configRequest.Relay, ","))
+	// Drop the networks removed in the editor
+	kept := make(map[string]bool)
+	for _, network := range configRequest.Networks {
+		kept["network "+network.Network] = true
+	}
+	for _, section := range cfg.SectionStrings() {
+		if strings.HasPrefix(section, "network ") && !kept[section] {
+			cfg.DeleteSection(section)
+		}
 	}
 
 	// Add network sections
 	for _, network := range configRequest.Networks {
-		sectionName := "network " + network.Network
-		sec, err := cfg.NewSection(sectionName)
-		if err != nil {
-			unifiedapierrors.Error(res, "Failed to create network section: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		if network.DNS != "" {
-			sec.Key("dns").SetValue(network.DNS)
-		}
-		if network.Gateway != "" {
-			sec.Key("gateway").SetValue(network.Gateway)
-		}
-		if network.DHCPStart != "" {
-			sec.Key("dhcp_start").SetValue(network.DHCPStart)
-		}
-		if network.DHCPEnd != "" {
-			sec.Key("dhcp_end").SetValue(network.DHCPEnd)
-		}
-		if network.Netmask != "" {
-			sec.Key("netmask").SetValue(network.Netmask)
-		}
-		if network.DomainName != "" {
-			sec.Key("domain-name").SetValue(network.DomainName)
-		}
-		if network.DHCPDefaultLeaseTime != "" {
-			sec.Key("dhcp_default_lease_time").SetValue(network.DHCPDefaultLeaseTime)
-		}
-		if network.DHCPMaxLeaseTime != "" {
-			sec.Key("dhcp_max_lease_time").SetValue(network.DHCPMaxLeaseTime)
-		}
-		if network.DHCPEnabled != "" {
-			sec.Key("dhcpd").SetValue(network.DHCPEnabled)
-		}
-		if network.IPReserved != "" {
-			sec.Key("ip_reserved").SetValue(network.IPReserved)
-		}
-		if network.IPAssigned != "" {
-			sec.Key("ip_assigned").SetValue(network.IPAssigned)
-		}
-		if network.Algorithm != "" {
-			sec.Key("algorithm").SetValue(network.Algorithm)
-		}
-		if network.NextHop != "" {
-			sec.Key("next_hop").SetValue(network.NextHop)
-		}
+		sec := cfg.Section("network " + network.Network)
+
+		setConfigKey(sec, "dns", network.DNS)
+		setConfigKey(sec, "gateway", network.Gateway)
+		setConfigKey(sec, "dhcp_start", network.DHCPStart)
+		setConfigKey(sec, "dhcp_end", network.DHCPEnd)
+		setConfigRanges(sec, network.Ranges)
+		setConfigKey(sec, "netmask", network.Netmask)
+		setConfigKey(sec, "domain-name", network.DomainName)
+		setConfigKey(sec, "dhcp_default_lease_time", network.DHCPDefaultLeaseTime)
+		setConfigKey(sec, "dhcp_max_lease_time", network.DHCPMaxLeaseTime)
+		setConfigKey(sec, "dhcp_min_lease_time", network.DHCPMinLeaseTime)
+		setConfigKey(sec, "dhcpd", network.DHCPEnabled)
+		setConfigKey(sec, "ip_reserved", network.IPReserved)
+		setConfigKey(sec, "ip_assigned", network.IPAssigned)
+		setConfigKey(sec, "algorithm", network.Algorithm)
+		setConfigKey(sec, "next_hop", network.NextHop)
+		setConfigKey(sec, "shared_network", network.SharedNetwork)
+		setConfigKey(sec, "stickiness", network.Stickiness)
+		setConfigKey(sec, "client_policy", network.ClientPolicy)
+		setConfigKey(sec, "denied_reply", network.DeniedReply)
+		setConfigKey(sec, "next_server", network.NextServer)
+		setConfigKey(sec, "boot_filename", network.BootFilename)
 	}
 
 	// Save to file
@@ -442,10 +683,59 @@ func handleUpdateConfig(res http.ResponseWriter, req *http.Request) {
 
 	response := map[string]string{
 		"status":  "success",
-		"message": "Configuration updated successfully. Restart the service to apply changes.",
+		"message": "Configuration updated successfully. Reload the configuration to apply changes.",
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	encodeJSON(res, response)
+}
+
+// setConfigKey sets a key of the configuration, an empty value removes it
+func setConfigKey(sec *ini.Section, key, value string) {
+	if value == "" {
+		sec.DeleteKey(key)
+		return
+	}
+	sec.Key(key).SetValue(value)
+}
+
+// configRanges returns the range entries of a network section
+func configRanges(sec *ini.Section) []string {
+	if !sec.HasKey("range") {
+		return nil
+	}
+	return sec.Key("range").ValueWithShadows()
+}
+
+// setConfigRanges replaces the range entries of a network section, one line
+// per range
+func setConfigRanges(sec *ini.Section, ranges []string) {
+	sec.DeleteKey("range")
+	for i, r := range ranges {
+		if i == 0 {
+			sec.Key("range").SetValue(r)
+		} else {
+			sec.Key("range").AddShadow(r)
+		}
+	}
+}
+
+// handleReloadConfig handles POST /api/v1/config/reload
+func handleReloadConfig(res http.ResponseWriter, req *http.Request) {
+	summary, err := DHCPConfig.reload()
+	if err != nil {
+		unifiedapierrors.Error(res, "Failed to reload configuration: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"status":  "success",
+		"message": "Configuration reloaded successfully",
+		"changes": summary,
 	}
 
 	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
 	encodeJSON(res, response)
 }
 
@@ -645,3 +935,688 @@ func handleGetOptionOverride(res http.ResponseWriter, req *http.Request) {
 	res.WriteHeader(http.StatusOK)
 	encodeJSON(res, override)
 }
+
+// handleListClientClasses handles GET /api/v1/dhcp/classes
+func handleListClientClasses(res http.ResponseWriter, req *http.Request) {
+	classes := clientClasses()
+
+	response := map[string]interface{}{
+		"status":  "success",
+		"count":   len(classes),
+		"classes": classes,
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, response)
+}
+
+// handleGetClientClass handles GET /api/v1/dhcp/classes/{name}
+func handleGetClientClass(res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	class := lookupClientClass(vars["name"])
+	if class == nil {
+		unifiedapierrors.Error(res, fmt.Sprintf("No class %s found", vars["name"]), http.StatusNotFound)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, class)
+}
+
+// handleSaveClientClass handles POST /api/v1/dhcp/classes/{name}
+func handleSaveClientClass(res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	var class ClientClass
+	if err := json.NewDecoder(req.Body).Decode(&class); err != nil {
+		unifiedapierrors.Error(res, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	class.Name = vars["name"]
+
+	if existing := lookupClientClass(class.Name); existing != nil && existing.Source == "ini" {
+		unifiedapierrors.Error(res, fmt.Sprintf("Class %s is defined in the configuration file", class.Name), http.StatusConflict)
+		return
+	}
+	if err := class.compile(); err != nil {
+		unifiedapierrors.Error(res, "Invalid class: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := SaveClientClass(class); err != nil {
+		unifiedapierrors.Error(res, "Failed to save class: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := loadClientClasses(); err != nil {
+		unifiedapierrors.Error(res, "Failed to load classes: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"status":  "success",
+		"message": fmt.Sprintf("Class %s saved", class.Name),
+		"class":   lookupClientClass(class.Name),
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, response)
+}
+
+// handleDeleteClientClass handles DELETE /api/v1/dhcp/classes/{name}
+func handleDeleteClientClass(res http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	name := vars["name"]
+
+	if existing := lookupClientClass(name); existing != nil && existing.Source == "ini" {
+		unifiedapierrors.Error(res, fmt.Sprintf("Class %s is defined in the configuration file", name), http.StatusConflict)
+		return
+	}
+
+	if err := DeleteClientClass(name); err != nil {
+		if err == sql.ErrNoRows {
+			unifiedapierrors.Error(res, fmt.Sprintf("No class %s found", name), http.StatusNotFound)
+			return
+		}
+		unifiedapierrors.Error(res, "Failed to delete class: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := loadClientClasses(); err != nil {
+		unifiedapierrors.Error(res, "Failed to load classes: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"status":  "success",
+		"message": fmt.Sprintf("Class %s removed", name),
+		"name":    name,
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, response)
+}
+
+// handleListReservations handles GET /api/v1/dhcp/reservations
+func handleListReservations(res http.ResponseWriter, req *http.Request) {
+	reservations, err := ListReservations(req.URL.Query().Get("network"))
+	if err != nil {
+		unifiedapierrors.Error(res, "Failed to list reservations: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"status":       "success",
+		"count":        len(reservations),
+		"reservations": reservations,
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, response)
+}
+
+// handleGetReservation handles GET /api/v1/dhcp/reservations/{mac}
+func handleGetReservation(res http.ResponseWriter, req *http.Request) {
+	mac := strings.ToLower(mux.Vars(req)["mac"])
+
+	reservation, err := GetReservation(mac)
+	if err == sql.ErrNoRows {
+		unifiedapierrors.Error(res, fmt.Sprintf("No reservation found for %s", mac), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		unifiedapierrors.Error(res, "Failed to get reservation: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, reservation)
+}
+
+// handleSaveReservation handles POST /api/v1/dhcp/reservations/{mac}, the
+// address is reserved in its pool right away
+func handleSaveReservation(res http.ResponseWriter, req *http.Request) {
+	var reservation Reservation
+	if err := json.NewDecoder(req.Body).Decode(&reservation); err != nil {
+		unifiedapierrors.Error(res, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	reservation.MAC = strings.ToLower(mux.Vars(req)["mac"])
+	if net.ParseIP(reservation.IP).To4() == nil {
+		unifiedapierrors.Error(res, fmt.Sprintf("Invalid ip %q", reservation.IP), http.StatusBadRequest)
+		return
+	}
+	for _, opt := range reservation.Options {
+		if _, _, err := ConvertOptionToDHCP(opt); err != nil {
+			unifiedapierrors.Error(res, fmt.Sprintf("Invalid option %d: %s", opt.OptionCode, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	saved, err := applyReservation(reservation)
+	if conflict, ok := err.(*ReservationConflict); ok {
+		response := map[string]interface{}{
+			"status":   "conflict",
+			"message":  "Cannot reserve " + reservation.IP + ": " + conflict.Error(),
+			"conflict": conflict,
+		}
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(http.StatusConflict)
+		encodeJSON(res, response)
+		return
+	}
+	if err == errNoReservationScope {
+		unifiedapierrors.Error(res, "Cannot reserve "+reservation.IP+": "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		unifiedapierrors.Error(res, "Failed to save reservation: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"status":      "success",
+		"message":     fmt.Sprintf("Reserved %s for %s", saved.IP, saved.MAC),
+		"reservation": saved,
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, response)
+}
+
+// handleDeleteReservation handles DELETE /api/v1/dhcp/reservations/{mac}
+func handleDeleteReservation(res http.ResponseWriter, req *http.Request) {
+	mac := strings.ToLower(mux.Vars(req)["mac"])
+
+	if err := removeReservation(mac); err != nil {
+		if err == sql.ErrNoRows {
+			unifiedapierrors.Error(res, fmt.Sprintf("No reservation found for %s", mac), http.StatusNotFound)
+			return
+		}
+		unifiedapierrors.Error(res, "Failed to delete reservation: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"status":  "success",
+		"message": fmt.Sprintf("Reservation of %s removed", mac),
+		"mac":     mac,
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, response)
+}
+
+// handleLogin handles POST /api/v1/auth/login, it opens a session for the web UI
+func handleLogin(res http.ResponseWriter, req *http.Request) {
+	var credentials struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&credentials); err != nil {
+		unifiedapierrors.Error(res, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	identity, err := verifyAPIUser(credentials.Username, credentials.Password, apiSource(req))
+	if errors.Is(err, errAPIThrottled) {
+		log.LoggerWContext(ctx).Warn("Throttled API login for " + credentials.Username + ": " + err.Error())
+		throttledResponse(res, err)
+		return
+	}
+	if err != nil {
+		log.LoggerWContext(ctx).Warn("Failed API login for " + credentials.Username)
+		unifiedapierrors.Error(res, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	token := newAPISecret()
+	apiSessions.Set(token, identity, 0)
+
+	response := map[string]interface{}{
+		"status":   "success",
+		"token":    token,
+		"username": identity.Username,
+		"role":     identity.Role,
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, response)
+}
+
+// handleLogout handles POST /api/v1/auth/logout
+func handleLogout(res http.ResponseWriter, req *http.Request) {
+	if token, found := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); found {
+		apiSessions.Delete(token)
+	}
+
+	response := map[string]interface{}{
+		"status":  "success",
+		"message": "Logged out",
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, response)
+}
+
+// handleWhoami handles GET /api/v1/auth/whoami
+func handleWhoami(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, identityFromRequest(req))
+}
+
+// checkAdminRemains refuses a change that would leave credentials without any
+// admin among them, nobody could manage the API anymore
+func checkAdminRemains(res http.ResponseWriter, removedAdmin bool) bool {
+	total, admins, err := CountAPICredentials()
+	if err != nil {
+		unifiedapierrors.Error(res, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if removedAdmin && admins == 1 && total > 1 {
+		unifiedapierrors.Error(res, "The last admin cannot be removed while other credentials exist", http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// handleListAPIUsers handles GET /api/v1/auth/users
+func handleListAPIUsers(res http.ResponseWriter, req *http.Request) {
+	if identityFromRequest(req).Role != apiRoleAdmin {
+		unifiedapierrors.Error(res, "Admin role required", http.StatusForbidden)
+		return
+	}
+	users, err := ListAPIUsers()
+	if err != nil {
+		unifiedapierrors.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, users)
+}
+
+// handleSaveAPIUser handles POST /api/v1/auth/users/{username}
+func handleSaveAPIUser(res http.ResponseWriter, req *http.Request) {
+	username := mux.Vars(req)["username"]
+
+	var user struct {
+		Password string `json:"password"`
+		Role     string `json:"role"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&user); err != nil {
+		unifiedapierrors.Error(res, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !validAPIRole(user.Role) {
+		unifiedapierrors.Error(res, "Invalid role "+user.Role+", use readonly or admin", http.StatusBadRequest)
+		return
+	}
+
+	existing, err := GetAPIUser(username)
+	if err != nil && err != sql.ErrNoRows {
+		unifiedapierrors.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if existing == nil && user.Password == "" {
+		unifiedapierrors.Error(res, "A password is required", http.StatusBadRequest)
+		return
+	}
+	if identityFromRequest(req).Setup && user.Role != apiRoleAdmin {
+		unifiedapierrors.Error(res, "The first user must be an admin", http.StatusBadRequest)
+		return
+	}
+	if !checkAdminRemains(res, existing != nil && existing.Role == apiRoleAdmin && user.Role != apiRoleAdmin) {
+		return
+	}
+
+	var hash string
+	if user.Password != "" {
+		if hash, err = hashPassword(user.Password); err != nil {
+			unifiedapierrors.Error(res, "Failed to hash the password: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := SaveAPIUser(username, hash, user.Role); err != nil {
+		unifiedapierrors.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	forgetAPIUser(username)
+
+	response := map[string]interface{}{
+		"status":  "success",
+		"message": fmt.Sprintf("User %s saved", username),
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, response)
+}
+
+// handleDeleteAPIUser handles DELETE /api/v1/auth/users/{username}
+func handleDeleteAPIUser(res http.ResponseWriter, req *http.Request) {
+	username := mux.Vars(req)["username"]
+
+	existing, err := GetAPIUser(username)
+	if err == sql.ErrNoRows {
+		unifiedapierrors.Error(res, fmt.Sprintf("No user %s found", username), http.StatusNotFound)
+		return
+	} else if err != nil {
+		unifiedapierrors.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !checkAdminRemains(res, existing.Role == apiRoleAdmin) {
+		return
+	}
+	if err := DeleteAPIUser(username); err != nil {
+		unifiedapierrors.Error(res, "Failed to delete user: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	forgetAPIUser(username)
+
+	response := map[string]interface{}{
+		"status":  "success",
+		"message": fmt.Sprintf("User %s removed", username),
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, response)
+}
+
+// handleListAPITokens handles GET /api/v1/auth/tokens
+func handleListAPITokens(res http.ResponseWriter, req *http.Request) {
+	if identityFromRequest(req).Role != apiRoleAdmin {
+		unifiedapierrors.Error(res, "Admin role required", http.StatusForbidden)
+		return
+	}
+	tokens, err := ListAPITokens()
+	if err != nil {
+		unifiedapierrors.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, tokens)
+}
+
+// handleCreateAPIToken handles POST /api/v1/auth/tokens/{name}, the token is
+// only returned by this call
+func handleCreateAPIToken(res http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+
+	var token APIToken
+	if err := json.NewDecoder(req.Body).Decode(&token); err != nil {
+		unifiedapierrors.Error(res, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !validAPIRole(token.Role) {
+		unifiedapierrors.Error(res, "Invalid role "+token.Role+", use readonly or admin", http.StatusBadRequest)
+		return
+	}
+	if identityFromRequest(req).Setup && token.Role != apiRoleAdmin {
+		unifiedapierrors.Error(res, "The first token must be an admin one", http.StatusBadRequest)
+		return
+	}
+
+	token.Name = name
+	token.Token = newAPISecret()
+	token.CreatedAt = time.Now()
+	if err := CreateAPIToken(name, hashAPIToken(token.Token), token.Role); err != nil {
+		if err == errAPITokenExists {
+			unifiedapierrors.Error(res, fmt.Sprintf("Token %s already exists", name), http.StatusConflict)
+			return
+		}
+		unifiedapierrors.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"status": "success",
+		"token":  token,
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, response)
+}
+
+// handleDeleteAPIToken handles DELETE /api/v1/auth/tokens/{name}
+func handleDeleteAPIToken(res http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["name"]
+
+	tokens, err := ListAPITokens()
+	if err != nil {
+		unifiedapierrors.Error(res, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, token := range tokens {
+		if token.Name == name && !checkAdminRemains(res, token.Role == apiRoleAdmin) {
+			return
+		}
+	}
+	if err := DeleteAPIToken(name); err != nil {
+		if err == sql.ErrNoRows {
+			unifiedapierrors.Error(res, fmt.Sprintf("No token %s found", name), http.StatusNotFound)
+			return
+		}
+		unifiedapierrors.Error(res, "Failed to delete token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"status":  "success",
+		"message": fmt.Sprintf("Token %s removed", name),
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, response)
+}
+
+// handleListExclusions handles GET /api/v1/dhcp/exclusions, the ranges of
+// the configuration file are listed with the ones made through the API
+func handleListExclusions(res http.ResponseWriter, req *http.Request) {
+	exclusions := listExclusions(req.URL.Query().Get("network"))
+
+	response := map[string]interface{}{
+		"status":     "success",
+		"count":      len(exclusions),
+		"exclusions": exclusions,
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, response)
+}
+
+// handleGetExclusion handles GET /api/v1/dhcp/exclusions/{id}
+func handleGetExclusion(res http.ResponseWriter, req *http.Request) {
+	id, _ := strconv.ParseInt(mux.Vars(req)["id"], 10, 64)
+
+	exclusion, err := GetExclusion(id)
+	if err == sql.ErrNoRows {
+		unifiedapierrors.Error(res, fmt.Sprintf("No exclusion found with id %d", id), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		unifiedapierrors.Error(res, "Failed to get exclusion: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, exclusion)
+}
+
+// handleSaveExclusion handles POST /api/v1/dhcp/exclusions to create an
+// exclusion range and POST /api/v1/dhcp/exclusions/{id} to update one, the
+// range is applied to its pool right away
+func handleSaveExclusion(res http.ResponseWriter, req *http.Request) {
+	var exclusion Exclusion
+	if err := json.NewDecoder(req.Body).Decode(&exclusion); err != nil {
+		unifiedapierrors.Error(res, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	exclusion.ID, _ = strconv.ParseInt(mux.Vars(req)["id"], 10, 64)
+	if exclusion.End == "" {
+		exclusion.End = exclusion.Start
+	}
+	start, end := net.ParseIP(exclusion.Start).To4(), net.ParseIP(exclusion.End).To4()
+	if start == nil || end == nil || dhcp.IPRange(start, end) < 1 {
+		unifiedapierrors.Error(res, fmt.Sprintf("Invalid range %q-%q", exclusion.Start, exclusion.End), http.StatusBadRequest)
+		return
+	}
+	if exclusion.ExpiresAt != nil && !exclusion.ExpiresAt.After(time.Now()) {
+		unifiedapierrors.Error(res, "The expiry must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	saved, held, err := applyExclusion(exclusion)
+	if err == sql.ErrNoRows {
+		unifiedapierrors.Error(res, fmt.Sprintf("No exclusion found with id %d", exclusion.ID), http.StatusNotFound)
+		return
+	}
+	if err == errNoExclusionScope {
+		unifiedapierrors.Error(res, "Cannot exclude "+exclusion.Start+"-"+exclusion.End+": "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		unifiedapierrors.Error(res, "Failed to save exclusion: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"status":    "success",
+		"message":   fmt.Sprintf("Excluded %s-%s", saved.Start, saved.End),
+		"exclusion": saved,
+		"in_use":    held,
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, response)
+}
+
+// handleListMACList handles GET /api/v1/dhcp/maclists/{list}, the network
+// parameter limits it to the entries applying to a network
+func handleListMACList(res http.ResponseWriter, req *http.Request) {
+	list := mux.Vars(req)["list"]
+
+	entries, err := ListMACListEntries(list, req.URL.Query().Get("network"))
+	if err != nil {
+		unifiedapierrors.Error(res, "Failed to list the "+list+"-list: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"status":  "success",
+		"count":   len(entries),
+		"entries": entries,
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, response)
+}
+
+// handleAddMACListEntry handles POST /api/v1/dhcp/maclists/{list}, the
+// pattern is a MAC address, an OUI or octets with * wildcards
+func handleAddMACListEntry(res http.ResponseWriter, req *http.Request) {
+	var entry MACListEntry
+	if err := json.NewDecoder(req.Body).Decode(&entry); err != nil {
+		unifiedapierrors.Error(res, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	entry.List = mux.Vars(req)["list"]
+	pattern, err := normalizeMACPattern(entry.Pattern)
+	if err != nil {
+		unifiedapierrors.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entry.Pattern = pattern
+	if entry.Network != "" {
+		network := net.ParseIP(entry.Network).To4()
+		if network == nil {
+			unifiedapierrors.Error(res, fmt.Sprintf("Invalid network %q", entry.Network), http.StatusBadRequest)
+			return
+		}
+		entry.Network = network.String()
+	}
+
+	saved, err := addMACListEntry(entry)
+	if err != nil {
+		unifiedapierrors.Error(res, "Failed to save "+entry.List+"-list entry: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"status":  "success",
+		"message": fmt.Sprintf("%s added to the %s-list", saved.Pattern, saved.List),
+		"entry":   saved,
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, response)
+}
+
+// handleDeleteMACListEntry handles DELETE /api/v1/dhcp/maclists/{list}/{id}
+func handleDeleteMACListEntry(res http.ResponseWriter, req *http.Request) {
+	list := mux.Vars(req)["list"]
+	id, _ := strconv.ParseInt(mux.Vars(req)["id"], 10, 64)
+
+	if err := removeMACListEntry(list, id); err != nil {
+		if err == sql.ErrNoRows {
+			unifiedapierrors.Error(res, fmt.Sprintf("No %s-list entry found with id %d", list, id), http.StatusNotFound)
+			return
+		}
+		unifiedapierrors.Error(res, "Failed to delete "+list+"-list entry: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"status":  "success",
+		"message": fmt.Sprintf("Entry %d of the %s-list removed", id, list),
+		"id":      id,
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, response)
+}
+
+// handleDeleteExclusion handles DELETE /api/v1/dhcp/exclusions/{id}
+func handleDeleteExclusion(res http.ResponseWriter, req *http.Request) {
+	id, _ := strconv.ParseInt(mux.Vars(req)["id"], 10, 64)
+
+	if err := removeExclusion(id); err != nil {
+		if err == sql.ErrNoRows {
+			unifiedapierrors.Error(res, fmt.Sprintf("No exclusion found with id %d", id), http.StatusNotFound)
+			return
+		}
+		unifiedapierrors.Error(res, "Failed to delete exclusion: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"status":  "success",
+		"message": fmt.Sprintf("Exclusion %d removed", id),
+		"id":      id,
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, response)
+}
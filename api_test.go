@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
@@ -26,10 +27,64 @@ func setupTestAPI(t *testing.T) (*mux.Router, string) {
 	router.HandleFunc("/api/v1/dhcp/options/mac/{mac:(?:[0-9A-Fa-f]{2}:){5}[0-9A-Fa-f]{2}}", handleRemoveOptions).Methods("DELETE")
 	router.HandleFunc("/api/v1/dhcp/options", handleListOptionOverrides).Methods("GET")
 	router.HandleFunc("/api/v1/dhcp/options/{type}/{target}", handleGetOptionOverride).Methods("GET")
+	router.HandleFunc("/api/v1/dhcp/classes", handleListClientClasses).Methods("GET")
+	router.HandleFunc("/api/v1/dhcp/classes/{name:[A-Za-z0-9_.-]+}", handleGetClientClass).Methods("GET")
+	router.HandleFunc("/api/v1/dhcp/classes/{name:[A-Za-z0-9_.-]+}", handleSaveClientClass).Methods("POST")
+	router.HandleFunc("/api/v1/dhcp/classes/{name:[A-Za-z0-9_.-]+}", handleDeleteClientClass).Methods("DELETE")
+	router.HandleFunc("/api/v1/dhcp/leases", handleListLeases).Methods("GET")
+	router.HandleFunc("/api/v1/dhcp/mac/{mac:(?:[0-9A-Fa-f]{2}:){5}[0-9A-Fa-f]{2}}/history", handleLeaseHistory).Methods("GET")
+	router.HandleFunc("/api/v1/dhcp/reservations", handleListReservations).Methods("GET")
+	router.HandleFunc("/api/v1/dhcp/reservations/{mac:(?:[0-9A-Fa-f]{2}:){5}[0-9A-Fa-f]{2}}", handleGetReservation).Methods("GET")
+	router.HandleFunc("/api/v1/dhcp/reservations/{mac:(?:[0-9A-Fa-f]{2}:){5}[0-9A-Fa-f]{2}}", handleSaveReservation).Methods("POST")
+	router.HandleFunc("/api/v1/dhcp/reservations/{mac:(?:[0-9A-Fa-f]{2}:){5}[0-9A-Fa-f]{2}}", handleDeleteReservation).Methods("DELETE")
+	router.HandleFunc("/api/v1/dhcp/exclusions", handleListExclusions).Methods("GET")
+	router.HandleFunc("/api/v1/dhcp/exclusions", handleSaveExclusion).Methods("POST")
+	router.HandleFunc("/api/v1/dhcp/exclusions/{id:[0-9]+}", handleGetExclusion).Methods("GET")
+	router.HandleFunc("/api/v1/dhcp/exclusions/{id:[0-9]+}", handleSaveExclusion).Methods("POST")
+	router.HandleFunc("/api/v1/dhcp/exclusions/{id:[0-9]+}", handleDeleteExclusion).Methods("DELETE")
+	router.HandleFunc("/api/v1/dhcp/maclists/{list:allow|deny}", handleListMACList).Methods("GET")
+	router.HandleFunc("/api/v1/dhcp/maclists/{list:allow|deny}", handleAddMACListEntry).Methods("POST")
+	router.HandleFunc("/api/v1/dhcp/maclists/{list:allow|deny}/{id:[0-9]+}", handleDeleteMACListEntry).Methods("DELETE")
+	router.HandleFunc("/api/v1/dhcp/throttled", handleListThrottled).Methods("GET")
+	router.HandleFunc("/api/v1/dhcp/throttled", handleClearAllThrottled).Methods("DELETE")
+	router.HandleFunc("/api/v1/dhcp/throttled/{client:[0-9A-Fa-f:.]+}", handleClearThrottled).Methods("DELETE")
+	router.HandleFunc("/api/v1/auth/login", handleLogin).Methods("POST")
+	router.HandleFunc("/api/v1/auth/logout", handleLogout).Methods("POST")
+	router.HandleFunc("/api/v1/auth/whoami", handleWhoami).Methods("GET")
+	router.HandleFunc("/api/v1/auth/users", handleListAPIUsers).Methods("GET")
+	router.HandleFunc("/api/v1/auth/users/{username:[A-Za-z0-9_.@-]+}", handleSaveAPIUser).Methods("POST")
+	router.HandleFunc("/api/v1/auth/users/{username:[A-Za-z0-9_.@-]+}", handleDeleteAPIUser).Methods("DELETE")
+	router.HandleFunc("/api/v1/auth/tokens", handleListAPITokens).Methods("GET")
+	router.HandleFunc("/api/v1/auth/tokens/{name:[A-Za-z0-9_.-]+}", handleCreateAPIToken).Methods("POST")
+	router.HandleFunc("/api/v1/auth/tokens/{name:[A-Za-z0-9_.-]+}", handleDeleteAPIToken).Methods("DELETE")
+	// The test requests are local unless they say otherwise
+	router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if _, found := req.Context().Value(apiLocalKey{}).(bool); !found {
+				req = req.WithContext(context.WithValue(req.Context(), apiLocalKey{}, true))
+			}
+			next.ServeHTTP(res, req)
+		})
+	})
+	router.Use(authMiddleware)
 
 	return router, dbPath
 }
 
+// apiRequest sends a request to the router, the body encoded in JSON, and
+// returns the status code and the decoded answer
+func apiRequest(router http.Handler, method, url string, body interface{}) (int, map[string]interface{}) {
+	var payload bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&payload).Encode(body)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(method, url, &payload))
+	var answer map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &answer)
+	return rr.Code, answer
+}
+
 func TestHandleOverrideNetworkOptions(t *testing.T) {
 	router, dbPath := setupTestAPI(t)
 	defer teardownTestDB(t, dbPath)
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ini/ini"
+	"github.com/inverse-inc/packetfence/go/log"
+)
+
+// defaultAPIListen is where the API is served without an [api] section
+const defaultAPIListen = "127.0.0.1:22227"
+
+// apiListener is an address the API is served on
+type apiListener struct {
+	network string // tcp or unix
+	address string
+}
+
+func (l apiListener) String() string {
+	if l.network == "unix" {
+		return "unix:" + l.address
+	}
+	return l.address
+}
+
+// apiConfig holds the [api] section
+type apiConfig struct {
+	listeners    []apiListener
+	certFile     string // TLS is enabled on the TCP listeners when set
+	keyFile      string
+	clientCAFile string // Clients must present a certificate signed by this CA when set
+}
+
+// readAPIConfig reads the [api] section of the configuration file
+func readAPIConfig(path string) (*apiConfig, error) {
+	cfg, err := ini.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read file: %w", err)
+	}
+	sec := cfg.Section("api")
+
+	c := &apiConfig{
+		certFile:     sec.Key("tls_cert").String(),
+		keyFile:      sec.Key("tls_key").String(),
+		clientCAFile: sec.Key("tls_client_ca").String(),
+	}
+	for _, address := range strings.Split(sec.Key("listen").MustString(defaultAPIListen), ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		if socket, found := strings.CutPrefix(address, "unix:"); found {
+			c.listeners = append(c.listeners, apiListener{network: "unix", address: socket})
+			continue
+		}
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return nil, fmt.Errorf("invalid api listen address %s: %w", address, err)
+		}
+		c.listeners = append(c.listeners, apiListener{network: "tcp", address: address})
+	}
+	if len(c.listeners) == 0 {
+		return nil, errors.New("no api listen address")
+	}
+	if (c.certFile == "") != (c.keyFile == "") {
+		return nil, errors.New("tls_cert and tls_key must be set together")
+	}
+	if c.clientCAFile != "" && c.certFile == "" {
+		return nil, errors.New("tls_client_ca requires tls_cert and tls_key")
+	}
+	return c, nil
+}
+
+// certReloader serves the certificate and client CA of the files, reloaded
+// when they change
+type certReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	lock         sync.Mutex
+	stamp        string // Modification times and sizes of the loaded files
+	config       *tls.Config
+}
+
+// newCertReloader loads the certificate, key and client CA
+func newCertReloader(certFile, keyFile, clientCAFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	if _, err := r.current(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// fileStamp identifies the version of the files on disk
+func (r *certReloader) fileStamp() string {
+	var stamp strings.Builder
+	for _, file := range []string{r.certFile, r.keyFile, r.clientCAFile} {
+		if file == "" {
+			continue
+		}
+		if info, err := os.Stat(file); err == nil {
+			fmt.Fprintf(&stamp, "%d:%d;", info.ModTime().UnixNano(), info.Size())
+		}
+	}
+	return stamp.String()
+}
+
+// current returns the TLS configuration of the files, loading them again
+// when they changed. A broken update keeps the previous configuration.
+func (r *certReloader) current() (*tls.Config, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	stamp := r.fileStamp()
+	if r.config != nil && stamp == r.stamp {
+		return r.config, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return r.keep(fmt.Errorf("failed to load the API certificate: %w", err))
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}
+	if r.clientCAFile != "" {
+		pem, err := os.ReadFile(r.clientCAFile)
+		if err != nil {
+			return r.keep(fmt.Errorf("failed to read the API client CA: %w", err))
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return r.keep(errors.New("no certificate found in the API client CA " + r.clientCAFile))
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if r.config != nil {
+		log.LoggerWContext(ctx).Info("Reloaded the API certificate " + r.certFile)
+	}
+	r.config, r.stamp = config, stamp
+	return config, nil
+}
+
+// keep falls back on the configuration already loaded, if any
+func (r *certReloader) keep(err error) (*tls.Config, error) {
+	if r.config == nil {
+		return nil, err
+	}
+	log.LoggerWContext(ctx).Error(err.Error() + ", keeping the previous one")
+	return r.config, nil
+}
+
+// tlsConfig returns the configuration of the TLS listeners, every handshake
+// picks up the files as they are on disk
+func (r *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current()
+		},
+	}
+}
+
+// listen opens the listeners of the API, TLS ones when a certificate is
+// configured. Unix sockets are never wrapped in TLS.
+func (c *apiConfig) listen() ([]net.Listener, error) {
+	var reloader *certReloader
+	if c.certFile != "" {
+		var err error
+		if reloader, err = newCertReloader(c.certFile, c.keyFile, c.clientCAFile); err != nil {
+			return nil, err
+		}
+	}
+	var listeners []net.Listener
+	for _, l := range c.listeners {
+		var err error
+		if l.network == "unix" {
+			err = removeStaleSocket(l.address)
+		}
+		var listener net.Listener
+		if err == nil {
+			listener, err = net.Listen(l.network, l.address)
+		}
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("failed to listen on %s: %w", l, err)
+		}
+		if l.network == "unix" {
+			os.Chmod(l.address, 0660)
+		} else if reloader != nil {
+			listener = tls.NewListener(listener, reloader.tlsConfig())
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// removeStaleSocket removes the socket left by a previous run, it refuses to
+// remove a file that is not a socket
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return errors.New(path + " exists and is not a socket")
+	}
+	return os.Remove(path)
+}
+
+// serveAPI serves the handler on every listener of the configuration until
+// one of them fails
+func serveAPI(c *apiConfig, handler http.Handler) error {
+	listeners, err := c.listen()
+	if err != nil {
+		return err
+	}
+	errs := make(chan error, len(listeners))
+	for i, listener := range listeners {
+		srv := &http.Server{
+			IdleTimeout: 5 * time.Second,
+			Handler:     handler,
+			ConnContext: localConnContext,
+		}
+		log.LoggerWContext(ctx).Info("API listening on " + c.listeners[i].String())
+		go func(listener net.Listener) {
+			errs <- srv.Serve(listener)
+		}(listener)
+	}
+	return <-errs
+}
+
+// probe checks the API answers, on a unix socket or plain listener when there
+// is one. The watchdog has no client certificate of its own, so on a TLS
+// listener it only completes a handshake: TLS 1.3 lets the client finish it
+// before the server checks the client certificate, and nothing is sent.
+func (c *apiConfig) probe() error {
+	target := c.listeners[0]
+	for _, l := range c.listeners {
+		if l.network == "unix" || c.certFile == "" {
+			target = l
+			break
+		}
+	}
+	address := strings.Replace(target.address, "0.0.0.0:", "127.0.0.1:", 1)
+	address = strings.Replace(address, "[::]:", "[::1]:", 1)
+
+	if target.network == "tcp" && c.certFile != "" {
+		dialer := &tls.Dialer{
+			NetDialer: &net.Dialer{Timeout: 5 * time.Second},
+			Config:    &tls.Config{MinVersion: tls.VersionTLS13, InsecureSkipVerify: true},
+		}
+		conn, err := dialer.Dial("tcp", address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	transport := &http.Transport{DisableKeepAlives: true}
+	url := "http://" + address + "/"
+	if target.network == "unix" {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", target.address)
+		}
+		url = "http://localhost/"
+	}
+	client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
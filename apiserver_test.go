@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadAPIConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "godhcp.ini")
+		os.WriteFile(path, []byte(content), 0644)
+		return path
+	}
+
+	c, err := readAPIConfig(write("[interfaces]\nlisten=eth0\n"))
+	if err != nil || len(c.listeners) != 1 || c.listeners[0].address != defaultAPIListen {
+		t.Errorf("Expected the default listener, got %+v (%v)", c, err)
+	}
+
+	c, err = readAPIConfig(write("[api]\nlisten=0.0.0.0:22227, [::1]:22227,unix:/run/godhcp.sock\ntls_cert=/etc/godhcp/api.crt\ntls_key=/etc/godhcp/api.key\n"))
+	if err != nil {
+		t.Fatalf("readAPIConfig failed: %v", err)
+	}
+	expected := []apiListener{{"tcp", "0.0.0.0:22227"}, {"tcp", "[::1]:22227"}, {"unix", "/run/godhcp.sock"}}
+	if len(c.listeners) != len(expected) {
+		t.Fatalf("Unexpected listeners %+v", c.listeners)
+	}
+	for i := range expected {
+		if c.listeners[i] != expected[i] {
+			t.Errorf("Expected %+v, got %+v", expected[i], c.listeners[i])
+		}
+	}
+
+	for _, content := range []string{
+		"[api]\nlisten=22227\n",
+		"[api]\ntls_cert=/etc/godhcp/api.crt\n",
+		"[api]\ntls_client_ca=/etc/godhcp/ca.crt\n",
+	} {
+		if _, err := readAPIConfig(write(content)); err == nil {
+			t.Errorf("Expected %q to be refused", content)
+		}
+	}
+}
+
+// testCA issues the certificates of the TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "godhcp test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create the CA: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the PEM certificate and key of a leaf usable by servers and
+// clients
+func (ca *testCA) issue(t *testing.T, name string, serial int64) ([]byte, []byte) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Failed to issue %s: %v", name, err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// serveTestAPI opens the listeners of a configuration and records the
+// addresses they got
+func serveTestAPI(t *testing.T, c *apiConfig) {
+	listeners, err := c.listen()
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	handler := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusOK)
+	})
+	for i, listener := range listeners {
+		if c.listeners[i].network == "tcp" {
+			c.listeners[i].address = listener.Addr().String()
+		}
+		srv := &http.Server{Handler: handler}
+		go srv.Serve(listener)
+		t.Cleanup(func() { srv.Close() })
+	}
+}
+
+func TestAPIServerTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile, caFile := filepath.Join(dir, "api.crt"), filepath.Join(dir, "api.key"), filepath.Join(dir, "ca.crt")
+	serverCert, serverKey := ca.issue(t, "server-1", 2)
+	os.WriteFile(certFile, serverCert, 0644)
+	os.WriteFile(keyFile, serverKey, 0600)
+	os.WriteFile(caFile, ca.pem, 0644)
+
+	c := &apiConfig{listeners: []apiListener{{"tcp", "127.0.0.1:0"}}, certFile: certFile, keyFile: keyFile, clientCAFile: caFile}
+	serveTestAPI(t, c)
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+	clientPEM, clientKey := ca.issue(t, "client", 3)
+	clientCert, _ := tls.X509KeyPair(clientPEM, clientKey)
+	get := func(certificates []tls.Certificate) (*http.Response, error) {
+		client := &http.Client{Transport: &http.Transport{
+			DisableKeepAlives: true,
+			TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: certificates},
+		}}
+		return client.Get("https://" + c.listeners[0].address + "/")
+	}
+
+	if _, err := get(nil); err == nil {
+		t.Error("Expected a client without certificate to be refused")
+	}
+	resp, err := get([]tls.Certificate{clientCert})
+	if err != nil {
+		t.Fatalf("Expected the client certificate to be accepted: %v", err)
+	}
+	if resp.TLS.PeerCertificates[0].Subject.CommonName != "server-1" {
+		t.Errorf("Unexpected server certificate %s", resp.TLS.PeerCertificates[0].Subject.CommonName)
+	}
+	resp.Body.Close()
+
+	// A new certificate is served without restarting
+	serverCert, serverKey = ca.issue(t, "server-2", 4)
+	os.WriteFile(certFile, serverCert, 0644)
+	os.WriteFile(keyFile, serverKey, 0600)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	resp, err = get([]tls.Certificate{clientCert})
+	if err != nil {
+		t.Fatalf("Request failed after the reload: %v", err)
+	}
+	if resp.TLS.PeerCertificates[0].Subject.CommonName != "server-2" {
+		t.Errorf("Expected the new certificate, got %s", resp.TLS.PeerCertificates[0].Subject.CommonName)
+	}
+	resp.Body.Close()
+
+	// A broken update keeps the loaded certificate
+	os.WriteFile(certFile, []byte("garbage"), 0644)
+	if resp, err := get([]tls.Certificate{clientCert}); err != nil {
+		t.Errorf("Expected the previous certificate to be kept: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+
+	// The watchdog completes a handshake without a client certificate
+	os.WriteFile(certFile, serverCert, 0644)
+	if err := c.probe(); err != nil {
+		t.Errorf("Expected the watchdog probe to succeed: %v", err)
+	}
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	listener.Close()
+	stopped := &apiConfig{listeners: []apiListener{{"tcp", listener.Addr().String()}}, certFile: certFile, keyFile: keyFile}
+	if err := stopped.probe(); err == nil {
+		t.Error("Expected the watchdog probe to fail without a listener")
+	}
+}
+
+func TestAPIServerUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "api.sock")
+	c := &apiConfig{listeners: []apiListener{{"tcp", "127.0.0.1:0"}, {"unix", socket}}}
+	serveTestAPI(t, c)
+
+	if info, err := os.Stat(socket); err != nil || info.Mode().Perm() != 0660 {
+		t.Errorf("Unexpected socket %v (%v)", info, err)
+	}
+	if err := c.probe(); err != nil {
+		t.Errorf("Expected the watchdog probe to succeed: %v", err)
+	}
+	resp, err := http.Get("http://" + c.listeners[0].address + "/")
+	if err != nil {
+		t.Fatalf("Request on the TCP listener failed: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestAPIServerStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	// The socket of a previous run is replaced
+	socket := filepath.Join(dir, "api.sock")
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	c := &apiConfig{listeners: []apiListener{{"unix", socket}}}
+	listeners, err := c.listen()
+	if err != nil {
+		t.Fatalf("Expected the stale socket to be replaced: %v", err)
+	}
+	listeners[0].Close()
+
+	// Any other file is kept
+	file := filepath.Join(dir, "api.conf")
+	os.WriteFile(file, []byte("keep"), 0644)
+	c = &apiConfig{listeners: []apiListener{{"unix", file}}}
+	if _, err := c.listen(); err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Errorf("Expected a regular file to be refused, got %v", err)
+	}
+	if content, _ := os.ReadFile(file); string(content) != "keep" {
+		t.Error("Expected the file to be kept")
+	}
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"context"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cache "github.com/fdurand/go-cache"
+	"github.com/inverse-inc/packetfence/go/api-frontend/unifiedapierrors"
+	"github.com/inverse-inc/packetfence/go/log"
+)
+
+// Roles of the API credentials: read-only ones can only use GET requests
+const (
+	apiRoleReadOnly = "readonly"
+	apiRoleAdmin    = "admin"
+)
+
+// pbkdf2Iterations is the cost of the password hashes
+const pbkdf2Iterations = 600000
+
+// The failed password checks of a source address or of a username are
+// limited by a token bucket, the hash is not computed past it
+const (
+	apiFailureBurst = 10  // Failures let through at once
+	apiFailureRate  = 0.1 // Failures per second afterwards
+)
+
+// errAPIThrottled is returned by verifyAPIUser when the client failed too
+// often, a throttledError tells how long it must wait
+var errAPIThrottled = errors.New("too many failed authentications")
+
+// throttledError is errAPIThrottled with the time to wait before trying again
+type throttledError struct {
+	retryAfter time.Duration
+}
+
+func (e throttledError) Error() string {
+	return errAPIThrottled.Error() + ", retry in " + e.retryAfter.Round(time.Second).String()
+}
+
+func (e throttledError) Unwrap() error {
+	return errAPIThrottled
+}
+
+// APIUser is an account of the API, authenticated with HTTP basic auth or
+// through a session opened with its password
+type APIUser struct {
+	Username     string    `json:"username"`
+	Role         string    `json:"role"`
+	CreatedAt    time.Time `json:"created_at"`
+	passwordHash string
+}
+
+// APIToken is a bearer token of the API, only its hash is stored
+type APIToken struct {
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	Token     string    `json:"token,omitempty"` // Only returned when created
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// apiIdentity is who sent an API request
+type apiIdentity struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	Setup    bool   `json:"setup,omitempty"` // No credential exists yet
+}
+
+type apiIdentityKey struct{}
+
+// apiLocalKey marks the connections of a unix socket or a loopback address,
+// the only ones served while no credential exists
+type apiLocalKey struct{}
+
+var (
+	// apiSessions holds the sessions opened by the web UI, by token
+	apiSessions = cache.New(12*time.Hour, 10*time.Minute)
+	// apiVerified caches the basic auth credentials already checked, to not
+	// compute a password hash on every request
+	apiVerified = cache.New(5*time.Minute, 10*time.Minute)
+	// apiFailures holds the buckets of the failed password checks, by source
+	// address and by username, until they are full again
+	apiFailures     = cache.New(time.Duration(apiFailureBurst/apiFailureRate)*time.Second, 10*time.Minute)
+	apiFailuresLock sync.Mutex
+)
+
+// apiCredentialCount caches CountAPICredentials, which every request needs.
+// The writes of credentials invalidate it by bumping the generation.
+var apiCredentialCount struct {
+	sync.Mutex
+	generation    uint64
+	valid         bool
+	total, admins int
+}
+
+// forgetAPICredentialCount invalidates the cached count of credentials
+func forgetAPICredentialCount() {
+	apiCredentialCount.Lock()
+	apiCredentialCount.valid = false
+	apiCredentialCount.generation++
+	apiCredentialCount.Unlock()
+}
+
+// validAPIRole tells if a role exists
+func validAPIRole(role string) bool {
+	return role == apiRoleReadOnly || role == apiRoleAdmin
+}
+
+// newAPISecret returns a random token
+func newAPISecret() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// hashAPIToken returns the hash a token is stored as, tokens are random so a
+// plain digest is enough
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// hashPassword returns the PBKDF2 hash of a password, with its parameters
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, pbkdf2Iterations, 32)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", pbkdf2Iterations, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// checkPassword verifies a password against a hash built by hashPassword
+func checkPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(expected))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+// verifyAPIUser checks the password of a user, sent from a source address
+// (empty for the unix socket), and returns its identity. It returns a
+// throttledError without checking it when the source or the user failed too
+// often.
+func verifyAPIUser(username, password, source string) (*apiIdentity, error) {
+	key := hashAPIToken(username + "\x00" + password)
+	if identity, found := apiVerified.Get(key); found {
+		return identity.(*apiIdentity), nil
+	}
+	keys := []string{"user:" + username}
+	if source != "" {
+		keys = append(keys, "source:"+source)
+	}
+	if wait := apiFailureWait(keys, time.Now()); wait > 0 {
+		return nil, throttledError{retryAfter: wait}
+	}
+	user, err := GetAPIUser(username)
+	if err != nil || !checkPassword(user.passwordHash, password) {
+		apiFailure(keys, time.Now())
+		return nil, errors.New("invalid username or password")
+	}
+	identity := &apiIdentity{Username: user.Username, Role: user.Role}
+	apiVerified.Set(key, identity, cache.DefaultExpiration)
+	return identity, nil
+}
+
+// apiFailureWait returns how long the clients must wait before their
+// password can be checked again, 0 when it can now
+func apiFailureWait(keys []string, now time.Time) time.Duration {
+	apiFailuresLock.Lock()
+	defer apiFailuresLock.Unlock()
+
+	var wait time.Duration
+	for _, key := range keys {
+		if bucket, found := apiFailures.Get(key); found {
+			wait = max(wait, bucket.(*tokenBucket).wait(now, apiFailureRate, apiFailureBurst))
+		}
+	}
+	return wait
+}
+
+// apiFailure counts a failed password check of the clients
+func apiFailure(keys []string, now time.Time) {
+	apiFailuresLock.Lock()
+	defer apiFailuresLock.Unlock()
+
+	for _, key := range keys {
+		bucket := &tokenBucket{}
+		if found, ok := apiFailures.Get(key); ok {
+			bucket = found.(*tokenBucket)
+		}
+		bucket.take(now, apiFailureRate, apiFailureBurst)
+		apiFailures.Set(key, bucket, cache.DefaultExpiration)
+	}
+}
+
+// apiSource returns the address a request came from, empty for the unix
+// socket
+func apiSource(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// throttledResponse refuses a request of a client that failed to
+// authenticate too often
+func throttledResponse(res http.ResponseWriter, err error) {
+	var throttled throttledError
+	if errors.As(err, &throttled) {
+		res.Header().Set("Retry-After", strconv.Itoa(int(throttled.retryAfter.Seconds())+1))
+	}
+	unifiedapierrors.Error(res, "Too many failed authentications, try again later", http.StatusTooManyRequests)
+}
+
+// forgetAPIUser closes the sessions of a user and drops its cached
+// credentials, after it changed or was removed
+func forgetAPIUser(username string) {
+	apiVerified.Flush()
+	for token, item := range apiSessions.Items() {
+		if item.Object.(*apiIdentity).Username == username {
+			apiSessions.Delete(token)
+		}
+	}
+}
+
+// errAPIUnauthenticated is returned by authenticate for a request without
+// valid credentials
+var errAPIUnauthenticated = errors.New("authentication required")
+
+// authenticate returns who sent a request, from its bearer token or its
+// basic auth credentials
+func authenticate(req *http.Request) (*apiIdentity, error) {
+	if username, password, ok := req.BasicAuth(); ok {
+		identity, err := verifyAPIUser(username, password, apiSource(req))
+		if err != nil && !errors.Is(err, errAPIThrottled) {
+			return nil, errAPIUnauthenticated
+		}
+		return identity, err
+	}
+	token, found := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !found || token == "" {
+		return nil, errAPIUnauthenticated
+	}
+	if identity, found := apiSessions.Get(token); found {
+		return identity.(*apiIdentity), nil
+	}
+	apiToken, err := GetAPIToken(hashAPIToken(token))
+	if err != nil {
+		return nil, errAPIUnauthenticated
+	}
+	return &apiIdentity{Username: "token:" + apiToken.Name, Role: apiToken.Role}, nil
+}
+
+// localConnContext marks the context of the connections of a unix socket or
+// from a loopback address
+func localConnContext(ctx context.Context, conn net.Conn) context.Context {
+	local := false
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.UnixAddr:
+		local = true
+	case *net.TCPAddr:
+		local = addr.IP.IsLoopback()
+	}
+	return context.WithValue(ctx, apiLocalKey{}, local)
+}
+
+// localRequest tells if a request came through a connection marked by
+// localConnContext
+func localRequest(req *http.Request) bool {
+	local, _ := req.Context().Value(apiLocalKey{}).(bool)
+	return local
+}
+
+// publicAPIPath tells if a path is served without authentication: the web UI
+// files and the login endpoint
+func publicAPIPath(path string) bool {
+	if path == "/api/v1/auth/login" {
+		return true
+	}
+	return !strings.HasPrefix(path, "/api/") && path != "/metrics"
+}
+
+// authMiddleware authenticates the API requests and enforces the role of the
+// credentials. Until a first credential is created the API stays open, to the
+// local connections only.
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if publicAPIPath(req.URL.Path) {
+			next.ServeHTTP(res, req)
+			return
+		}
+		total, _, err := CountAPICredentials()
+		if err != nil {
+			unifiedapierrors.Error(res, "Failed to check the credentials: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		identity := &apiIdentity{Role: apiRoleAdmin, Setup: true}
+		if total > 0 || !localRequest(req) {
+			if identity, err = authenticate(req); errors.Is(err, errAPIThrottled) {
+				log.LoggerWContext(ctx).Warn("Throttled the authentication of " + req.RemoteAddr + ": " + err.Error())
+				throttledResponse(res, err)
+				return
+			} else if err != nil {
+				res.Header().Set("WWW-Authenticate", `Bearer realm="godhcp"`)
+				unifiedapierrors.Error(res, "Authentication required", http.StatusUnauthorized)
+				return
+			}
+		}
+		if identity.Role != apiRoleAdmin && req.Method != http.MethodGet && req.Method != http.MethodHead {
+			log.LoggerWContext(ctx).Warn("Refused " + req.Method + " " + req.URL.Path + " to read-only " + identity.Username)
+			unifiedapierrors.Error(res, "Admin role required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(res, req.WithContext(context.WithValue(req.Context(), apiIdentityKey{}, identity)))
+	})
+}
+
+// identityFromRequest returns who sent a request that went through
+// authMiddleware
+func identityFromRequest(req *http.Request) *apiIdentity {
+	identity, _ := req.Context().Value(apiIdentityKey{}).(*apiIdentity)
+	return identity
+}
+
+// errAPITokenExists is returned when creating a token whose name is taken
+var errAPITokenExists = errors.New("token already exists")
+
+// SaveAPIUser creates or updates a user, an empty hash keeps the current
+// password
+func SaveAPIUser(username, passwordHash, role string) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	query := `
+		INSERT INTO dhcp_api_users (username, password_hash, role, updated_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(username) DO UPDATE SET
+			password_hash = CASE WHEN excluded.password_hash = '' THEN password_hash ELSE excluded.password_hash END,
+			role = excluded.role,
+			updated_at = CURRENT_TIMESTAMP
+	`
+
+	if _, err := db.Exec(query, username, passwordHash, role); err != nil {
+		return fmt.Errorf("failed to save user: %w", err)
+	}
+	forgetAPICredentialCount()
+
+	return nil
+}
+
+// GetAPIUser returns a user
+func GetAPIUser(username string) (*APIUser, error) {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	var user APIUser
+	err := db.QueryRow(`SELECT username, password_hash, role, created_at FROM dhcp_api_users WHERE username = ?`, username).
+		Scan(&user.Username, &user.passwordHash, &user.Role, &user.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// DeleteAPIUser deletes a user
+func DeleteAPIUser(username string) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	result, err := db.Exec(`DELETE FROM dhcp_api_users WHERE username = ?`, username)
+	if err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+	forgetAPICredentialCount()
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// ListAPIUsers lists the users
+func ListAPIUsers() ([]APIUser, error) {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	rows, err := db.Query(`SELECT username, role, created_at FROM dhcp_api_users ORDER BY username`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	defer rows.Close()
+
+	users := []APIUser{}
+	for rows.Next() {
+		var user APIUser
+		if err := rows.Scan(&user.Username, &user.Role, &user.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+// CreateAPIToken stores the hash of a new token
+func CreateAPIToken(name, tokenHash, role string) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	result, err := db.Exec(`INSERT INTO dhcp_api_tokens (name, token_hash, role) VALUES (?, ?, ?) ON CONFLICT(name) DO NOTHING`, name, tokenHash, role)
+	if err != nil {
+		return fmt.Errorf("failed to create token: %w", err)
+	}
+	forgetAPICredentialCount()
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return errAPITokenExists
+	}
+
+	return nil
+}
+
+// GetAPIToken returns the token with the given hash
+func GetAPIToken(tokenHash string) (*APIToken, error) {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	var token APIToken
+	err := db.QueryRow(`SELECT name, role, created_at FROM dhcp_api_tokens WHERE token_hash = ?`, tokenHash).
+		Scan(&token.Name, &token.Role, &token.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// DeleteAPIToken deletes a token
+func DeleteAPIToken(name string) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	result, err := db.Exec(`DELETE FROM dhcp_api_tokens WHERE name = ?`, name)
+	if err != nil {
+		return fmt.Errorf("failed to delete token: %w", err)
+	}
+	forgetAPICredentialCount()
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// ListAPITokens lists the tokens, without their value
+func ListAPITokens() ([]APIToken, error) {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	rows, err := db.Query(`SELECT name, role, created_at FROM dhcp_api_tokens ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tokens: %w", err)
+	}
+	defer rows.Close()
+
+	tokens := []APIToken{}
+	for rows.Next() {
+		var token APIToken
+		if err := rows.Scan(&token.Name, &token.Role, &token.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		tokens = append(tokens, token)
+	}
+
+	return tokens, rows.Err()
+}
+
+// CountAPICredentials returns the number of users and tokens, and how many
+// of them are admins. The count is cached until a credential is written.
+func CountAPICredentials() (int, int, error) {
+	apiCredentialCount.Lock()
+	if apiCredentialCount.valid {
+		defer apiCredentialCount.Unlock()
+		return apiCredentialCount.total, apiCredentialCount.admins, nil
+	}
+	generation := apiCredentialCount.generation
+	apiCredentialCount.Unlock()
+
+	dbMutex.RLock()
+	var total, admins int
+	err := db.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(role = 'admin'), 0) FROM (
+			SELECT role FROM dhcp_api_users
+			UNION ALL
+			SELECT role FROM dhcp_api_tokens
+		)
+	`).Scan(&total, &admins)
+	dbMutex.RUnlock()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to count credentials: %w", err)
+	}
+
+	// Only cache a count no write happened during
+	apiCredentialCount.Lock()
+	if apiCredentialCount.generation == generation {
+		apiCredentialCount.valid = true
+		apiCredentialCount.total, apiCredentialCount.admins = total, admins
+	}
+	apiCredentialCount.Unlock()
+
+	return total, admins, nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPasswordHash(t *testing.T) {
+	hash, err := hashPassword("s3cret")
+	if err != nil {
+		t.Fatalf("hashPassword failed: %v", err)
+	}
+	if !checkPassword(hash, "s3cret") {
+		t.Error("Expected the password to match")
+	}
+	if checkPassword(hash, "secret") || checkPassword("plain", "plain") {
+		t.Error("Expected the password to be refused")
+	}
+	if other, _ := hashPassword("s3cret"); other == hash {
+		t.Error("Expected a random salt")
+	}
+}
+
+func TestAPIAuth(t *testing.T) {
+	router, dbPath := setupTestAPI(t)
+	defer teardownTestDB(t, dbPath)
+	apiSessions.Flush()
+	apiVerified.Flush()
+	apiFailures.Flush()
+
+	request := func(method, path string, body interface{}, auth func(*http.Request)) *httptest.ResponseRecorder {
+		var payload []byte
+		if body != nil {
+			payload, _ = json.Marshal(body)
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+		if auth != nil {
+			auth(req)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	basic := func(username, password string) func(*http.Request) {
+		return func(req *http.Request) { req.SetBasicAuth(username, password) }
+	}
+	bearer := func(token string) func(*http.Request) {
+		return func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }
+	}
+
+	// The API is open to the local connections until a first credential
+	// exists, which must be an admin
+	remote := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/v1/dhcp/options", nil)
+	router.ServeHTTP(remote, req.WithContext(context.WithValue(req.Context(), apiLocalKey{}, false)))
+	if remote.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a remote connection to be refused, got %d", remote.Code)
+	}
+	if rr := request("GET", "/api/v1/dhcp/options", nil, nil); rr.Code != http.StatusOK {
+		t.Errorf("Expected the API to be open, got %d", rr.Code)
+	}
+	if rr := request("POST", "/api/v1/auth/users/viewer", map[string]string{"password": "viewer", "role": apiRoleReadOnly}, nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected a read-only first user to be refused, got %d", rr.Code)
+	}
+	if rr := request("POST", "/api/v1/auth/users/admin", map[string]string{"password": "s3cret", "role": apiRoleAdmin}, nil); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the admin to be created, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	if rr := request("GET", "/api/v1/dhcp/options", nil, nil); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected credentials to be required, got %d", rr.Code)
+	}
+	if rr := request("GET", "/api/v1/dhcp/options", nil, basic("admin", "wrong")); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a wrong password to be refused, got %d", rr.Code)
+	}
+	if rr := request("GET", "/api/v1/dhcp/options", nil, basic("admin", "s3cret")); rr.Code != http.StatusOK {
+		t.Errorf("Expected basic auth to be accepted, got %d", rr.Code)
+	}
+
+	// A read-only token can read but not write
+	rr := request("POST", "/api/v1/auth/tokens/grafana", APIToken{Role: apiRoleReadOnly}, basic("admin", "s3cret"))
+	var created struct {
+		Token APIToken `json:"token"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &created)
+	if rr.Code != http.StatusOK || len(created.Token.Token) != 64 {
+		t.Fatalf("Expected the token to be created, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := request("POST", "/api/v1/auth/tokens/grafana", APIToken{Role: apiRoleReadOnly}, basic("admin", "s3cret")); rr.Code != http.StatusConflict {
+		t.Errorf("Expected a duplicate token to be refused, got %d", rr.Code)
+	}
+	readonly := bearer(created.Token.Token)
+	if rr := request("GET", "/api/v1/dhcp/options", nil, readonly); rr.Code != http.StatusOK {
+		t.Errorf("Expected the token to read, got %d", rr.Code)
+	}
+	if rr := request("POST", "/api/v1/dhcp/options/mac/00:11:22:33:44:55", []DHCPOption{{OptionCode: 66, OptionValue: "x", OptionType: "string"}}, readonly); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected the read-only token to be refused a write, got %d", rr.Code)
+	}
+	if rr := request("GET", "/api/v1/auth/tokens", nil, readonly); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected the read-only token to be refused the credentials, got %d", rr.Code)
+	}
+	rr = request("GET", "/api/v1/auth/tokens", nil, basic("admin", "s3cret"))
+	if rr.Code != http.StatusOK || bytes.Contains(rr.Body.Bytes(), []byte(created.Token.Token)) {
+		t.Errorf("Expected the tokens to be listed without their value, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// Sessions of the web UI
+	rr = request("POST", "/api/v1/auth/login", map[string]string{"username": "admin", "password": "s3cret"}, nil)
+	var login struct {
+		Token string `json:"token"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &login)
+	if rr.Code != http.StatusOK || login.Token == "" {
+		t.Fatalf("Expected the login to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = request("GET", "/api/v1/auth/whoami", nil, bearer(login.Token))
+	var identity apiIdentity
+	json.Unmarshal(rr.Body.Bytes(), &identity)
+	if identity.Username != "admin" || identity.Role != apiRoleAdmin {
+		t.Errorf("Unexpected identity %+v", identity)
+	}
+	request("POST", "/api/v1/auth/logout", nil, bearer(login.Token))
+	if rr := request("GET", "/api/v1/auth/whoami", nil, bearer(login.Token)); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the session to be closed, got %d", rr.Code)
+	}
+	if rr := request("POST", "/api/v1/auth/login", map[string]string{"username": "admin", "password": "wrong"}, nil); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a wrong password to be refused, got %d", rr.Code)
+	}
+
+	// The last admin cannot go while the read-only token remains
+	if rr := request("DELETE", "/api/v1/auth/users/admin", nil, basic("admin", "s3cret")); rr.Code != http.StatusConflict {
+		t.Errorf("Expected the last admin to be kept, got %d", rr.Code)
+	}
+	if rr := request("DELETE", "/api/v1/auth/tokens/grafana", nil, basic("admin", "s3cret")); rr.Code != http.StatusOK {
+		t.Errorf("Expected the token to be removed, got %d", rr.Code)
+	}
+	if rr := request("GET", "/api/v1/dhcp/options", nil, readonly); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the removed token to be refused, got %d", rr.Code)
+	}
+
+	if publicAPIPath("/api/v1/dhcp/stats") || publicAPIPath("/metrics") || !publicAPIPath("/stats.html") || !publicAPIPath("/api/v1/auth/login") {
+		t.Error("Unexpected public paths")
+	}
+}
+
+func TestAPIAuthThrottle(t *testing.T) {
+	router, dbPath := setupTestAPI(t)
+	defer teardownTestDB(t, dbPath)
+	apiVerified.Flush()
+	apiFailures.Flush()
+	defer apiFailures.Flush()
+
+	hash, _ := hashPassword("s3cret")
+	SaveAPIUser("admin", hash, apiRoleAdmin)
+	SaveAPIUser("viewer", hash, apiRoleReadOnly)
+	request := func(username, password, source string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/dhcp/options", nil)
+		req.RemoteAddr = source + ":40000"
+		req.SetBasicAuth(username, password)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Credentials already checked are not throttled
+	if rr := request("viewer", "s3cret", "192.0.2.1"); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the viewer to be accepted, got %d", rr.Code)
+	}
+
+	for i := 0; i < apiFailureBurst; i++ {
+		if rr := request("admin", "wrong", "192.0.2.1"); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("Failure %d: expected a wrong password to be refused, got %d", i, rr.Code)
+		}
+	}
+	rr := request("admin", "wrong", "192.0.2.1")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected the source to be throttled, got %d", rr.Code)
+	}
+	// The user is throttled from another source too, the source for another
+	// user
+	if rr := request("admin", "s3cret", "192.0.2.2"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the user to be throttled, got %d", rr.Code)
+	}
+	if rr := request("nobody", "wrong", "192.0.2.1"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the source to be throttled for every user, got %d", rr.Code)
+	}
+	if rr := request("viewer", "s3cret", "192.0.2.1"); rr.Code != http.StatusOK {
+		t.Errorf("Expected the verified credentials to be accepted, got %d", rr.Code)
+	}
+
+	// The buckets refill over time
+	keys := []string{"user:admin", "source:192.0.2.1"}
+	if wait := apiFailureWait(keys, time.Now()); wait <= 0 || wait > time.Duration(1/apiFailureRate)*time.Second {
+		t.Errorf("Expected to wait for a single token, got %s", wait)
+	}
+	if wait := apiFailureWait(keys, time.Now().Add(time.Duration(1/apiFailureRate)*time.Second)); wait != 0 {
+		t.Errorf("Expected a token to be available again, got %s", wait)
+	}
+}
+
+func TestLocalConnContext(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	defer conn.Close()
+	if local, _ := localConnContext(context.Background(), conn).Value(apiLocalKey{}).(bool); !local {
+		t.Error("Expected a loopback connection to be local")
+	}
+
+	server, other := net.Pipe()
+	defer server.Close()
+	defer other.Close()
+	if local, _ := localConnContext(context.Background(), server).Value(apiLocalKey{}).(bool); local {
+		t.Error("Expected a connection without a loopback address not to be local")
+	}
+}
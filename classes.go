@@ -0,0 +1,484 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fdurand/standalone_dhcp/pool"
+	"github.com/go-ini/ini"
+	"github.com/inverse-inc/packetfence/go/log"
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// ClientClass groups the clients matching all of its criteria. A class can
+// carry its own options, lease time and sub-range of the pool of a network.
+type ClientClass struct {
+	Name        string       `json:"name"`
+	Network     string       `json:"network,omitempty"`      // Only match in this network
+	VendorClass string       `json:"vendor_class,omitempty"` // Regex on option 60
+	UserClass   string       `json:"user_class,omitempty"`   // Regex on option 77
+	Hostname    string       `json:"hostname,omitempty"`     // Regex on option 12
+	MACPrefix   string       `json:"mac_prefix,omitempty"`   // Comma-separated OUI prefixes
+	CircuitID   string       `json:"circuit_id,omitempty"`   // Regex on the option 82 circuit-id
+	RemoteID    string       `json:"remote_id,omitempty"`    // Regex on the option 82 remote-id
+	Options     []DHCPOption `json:"options,omitempty"`
+	LeaseTime   int          `json:"lease_time,omitempty"` // Seconds
+	RangeStart  string       `json:"range_start,omitempty"`
+	RangeEnd    string       `json:"range_end,omitempty"`
+	Source      string       `json:"source"` // ini or database
+
+	vendorClass *regexp.Regexp
+	userClass   *regexp.Regexp
+	hostname    *regexp.Regexp
+	circuitID   *regexp.Regexp
+	remoteID    *regexp.Regexp
+	macPrefixes []string
+	rangeStart  net.IP
+	rangeEnd    net.IP
+}
+
+// noClass is the role of the clients matching no class
+const noClass = "none"
+
+var (
+	// The classes of the configuration file come first, then the ones of
+	// the database
+	iniClientClasses []*ClientClass
+	dbClientClasses  []*ClientClass
+	clientClassLock  sync.RWMutex
+)
+
+// compile validates a class and prepares its matchers
+func (c *ClientClass) compile() error {
+	if c.Name == "" || c.Name == noClass {
+		return fmt.Errorf("invalid class name %q", c.Name)
+	}
+	var err error
+	for _, matcher := range []struct {
+		expr  string
+		regex **regexp.Regexp
+	}{
+		{c.VendorClass, &c.vendorClass},
+		{c.UserClass, &c.userClass},
+		{c.Hostname, &c.hostname},
+		{c.CircuitID, &c.circuitID},
+		{c.RemoteID, &c.remoteID},
+	} {
+		*matcher.regex = nil
+		if matcher.expr == "" {
+			continue
+		}
+		if *matcher.regex, err = regexp.Compile(matcher.expr); err != nil {
+			return fmt.Errorf("invalid regex %q: %w", matcher.expr, err)
+		}
+	}
+
+	c.macPrefixes = nil
+	for _, prefix := range strings.Split(c.MACPrefix, ",") {
+		prefix = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(prefix), "-", ":"))
+		if prefix != "" {
+			c.macPrefixes = append(c.macPrefixes, prefix)
+		}
+	}
+
+	if c.vendorClass == nil && c.userClass == nil && c.hostname == nil && c.circuitID == nil && c.remoteID == nil && len(c.macPrefixes) == 0 {
+		return errors.New("a class needs at least one match criterion")
+	}
+
+	if c.Network != "" && net.ParseIP(c.Network).To4() == nil {
+		return fmt.Errorf("invalid network %q", c.Network)
+	}
+
+	c.rangeStart, c.rangeEnd = nil, nil
+	if c.RangeStart != "" || c.RangeEnd != "" {
+		c.rangeStart = net.ParseIP(c.RangeStart).To4()
+		c.rangeEnd = net.ParseIP(c.RangeEnd).To4()
+		if c.rangeStart == nil || c.rangeEnd == nil || dhcp.IPRange(c.rangeStart, c.rangeEnd) < 1 {
+			return fmt.Errorf("invalid range %s-%s", c.RangeStart, c.RangeEnd)
+		}
+	}
+
+	if c.LeaseTime < 0 {
+		return fmt.Errorf("invalid lease time %d", c.LeaseTime)
+	}
+	for _, option := range c.Options {
+		if _, _, err := ConvertOptionToDHCP(option); err != nil {
+			return fmt.Errorf("invalid option %d: %w", option.OptionCode, err)
+		}
+	}
+	return nil
+}
+
+// userClasses decodes option 77, a list of length prefixed user classes
+// (RFC 3004). Clients sending a single unprefixed user class are common, the
+// option is then taken as is.
+func userClasses(b []byte) []string {
+	var classes []string
+	for i := 0; i < len(b); {
+		length := int(b[i])
+		if length == 0 || i+1+length > len(b) {
+			return []string{string(b)}
+		}
+		classes = append(classes, string(b[i+1:i+1+length]))
+		i += 1 + length
+	}
+	return classes
+}
+
+// matches tells if a request belongs to the class
+func (c *ClientClass) matches(options dhcp.Options, mac string, info *RelayAgentInfo, networkIP string) bool {
+	if c.Network != "" && c.Network != networkIP {
+		return false
+	}
+	if c.vendorClass != nil && !c.vendorClass.Match(options[dhcp.OptionVendorClassIdentifier]) {
+		return false
+	}
+	if c.userClass != nil {
+		found := false
+		for _, class := range userClasses(options[dhcp.OptionUserClass]) {
+			if c.userClass.MatchString(class) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if c.hostname != nil && !c.hostname.Match(options[dhcp.OptionHostName]) {
+		return false
+	}
+	if len(c.macPrefixes) > 0 {
+		found := false
+		for _, prefix := range c.macPrefixes {
+			if strings.HasPrefix(mac, prefix) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if c.circuitID != nil && (info == nil || !c.circuitID.MatchString(relayAgentID(info.CircuitID))) {
+		return false
+	}
+	if c.remoteID != nil && (info == nil || !c.remoteID.MatchString(relayAgentID(info.RemoteID))) {
+		return false
+	}
+	return true
+}
+
+// role returns the name of a class, none for the clients matching no class
+func (c *ClientClass) role() string {
+	if c == nil {
+		return noClass
+	}
+	return c.Name
+}
+
+// apply layers the options and lease time of the class over the options of
+// a network. The lease time of the class is authoritative, as an override of
+// option 51 is.
+func (c *ClientClass) apply(options dhcp.Options) {
+	if c == nil {
+		return
+	}
+	for _, option := range c.Options {
+		code, value, err := ConvertOptionToDHCP(option)
+		if err != nil {
+			log.LoggerWContext(ctx).Error(fmt.Sprintf("Failed to convert option %d of class %s: %s", option.OptionCode, c.Name, err))
+			continue
+		}
+		options[code] = value
+	}
+	if c.LeaseTime > 0 {
+		options[dhcp.OptionIPAddressLeaseTime] = dhcp.OptionsLeaseTime(time.Duration(c.LeaseTime) * time.Second)
+	}
+}
+
+// indexRange returns the indexes of the sub-range of the class in the pool of
+// a scope, ok is false when the class has no range in this pool or is bound
+// to another network
+func (c *ClientClass) indexRange(h *DHCPHandler) (int, int, bool) {
+	if c == nil || c.rangeStart == nil || (c.Network != "" && c.Network != h.network) {
+		return 0, 0, false
+	}
+	return h.available.span(c.rangeStart, c.rangeEnd)
+}
+
+// clientClasses returns a snapshot of the defined classes
+func clientClasses() []*ClientClass {
+	clientClassLock.RLock()
+	defer clientClassLock.RUnlock()
+	return append(append([]*ClientClass(nil), iniClientClasses...), dbClientClasses...)
+}
+
+// lookupClientClass returns the class with the given name
+func lookupClientClass(name string) *ClientClass {
+	for _, class := range clientClasses() {
+		if class.Name == name {
+			return class
+		}
+	}
+	return nil
+}
+
+// matchClientClass returns the first class a request belongs to, nil when it
+// matches none
+func matchClientClass(options dhcp.Options, mac string, info *RelayAgentInfo, networkIP string) *ClientClass {
+	for _, class := range clientClasses() {
+		if class.matches(options, mac, info, networkIP) {
+			return class
+		}
+	}
+	return nil
+}
+
+// inClassRange tells if an index is part of the sub-range of a class, such an
+// index is only handed out to the members of the class
+func (h *DHCPHandler) inClassRange(index int) bool {
+	for _, class := range clientClasses() {
+		if first, last, ok := class.indexRange(h); ok && index >= first && index <= last {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedIndex tells if an index can be handed out to a member of a class
+func (h *DHCPHandler) allowedIndex(index int, class *ClientClass) bool {
+	if first, last, ok := class.indexRange(h); ok {
+		return index >= first && index <= last
+	}
+	return !h.inClassRange(index)
+}
+
+// allowedSpans returns the indexes of the scope that can be handed out to a
+// member of a class, sorted and disjoint: the sub-range of its class, else
+// the indexes outside of the sub-ranges. All is true when they are all allowed.
+func (h *DHCPHandler) allowedSpans(class *ClientClass) (spans []pool.Span, all bool) {
+	if first, last, ok := class.indexRange(h); ok {
+		return []pool.Span{{First: safeIntToUint64(first), Last: safeIntToUint64(last)}}, false
+	}
+
+	var taken []pool.Span
+	for _, other := range clientClasses() {
+		if first, last, ok := other.indexRange(h); ok {
+			taken = append(taken, pool.Span{First: safeIntToUint64(first), Last: safeIntToUint64(last)})
+		}
+	}
+	if len(taken) == 0 {
+		return nil, true
+	}
+	sort.Slice(taken, func(i, j int) bool { return taken[i].First < taken[j].First })
+	next := uint64(0)
+	for _, span := range taken {
+		if span.First > next {
+			spans = append(spans, pool.Span{First: next, Last: span.First - 1})
+		}
+		next = max(next, span.Last+1)
+	}
+	if capacity := h.available.Capacity(); next < capacity {
+		spans = append(spans, pool.Span{First: next, Last: capacity - 1})
+	}
+	return spans, false
+}
+
+// allocateIndex reserves a free index for a client, chosen by the allocation
+// strategy of the scope. The members of a class with a sub-range get an
+// address of it, the other clients an address outside of the sub-ranges.
+func (h *DHCPHandler) allocateIndex(mac string, class *ClientClass) (int, error) {
+	spans, all := h.allowedSpans(class)
+	if all {
+		index, _, err := h.available.GetFreeIPIndex(mac)
+		return safeUint64ToInt(index), err
+	}
+	index, _, err := h.available.GetFreeIPIndexIn(mac, spans)
+	if err != nil {
+		if _, _, ok := class.indexRange(h); ok {
+			return 0, errors.New("no address left in the range of class " + class.Name)
+		}
+		return 0, err
+	}
+	return safeUint64ToInt(index), nil
+}
+
+// boundClient is what a scope remembers of a bound client
+type boundClient struct {
+	role     string // Client class
+	bootFile string
+}
+
+// setBoundClient records the class and boot file of a bound client
+func (h *DHCPHandler) setBoundClient(mac string, client boundClient, duration time.Duration) {
+	if h.clients != nil {
+		h.clients.Set(mac, client, duration)
+	}
+}
+
+// boundClient returns the class and boot file of a bound client
+func (h *DHCPHandler) boundClient(mac string) boundClient {
+	if h.clients != nil {
+		if client, found := h.clients.Get(mac); found {
+			return client.(boundClient)
+		}
+	}
+	return boundClient{role: noClass}
+}
+
+// readClientClasses reads the [class NAME] sections of the configuration
+func readClientClasses(cfg *ini.File) []*ClientClass {
+	var classes []*ClientClass
+	optionKey := regexp.MustCompile(`^option_([0-9]{1,3})$`)
+	for _, name := range cfg.SectionStrings() {
+		if !strings.HasPrefix(name, "class ") {
+			continue
+		}
+		sec := cfg.Section(name)
+		class := &ClientClass{
+			Name:        strings.TrimSpace(strings.TrimPrefix(name, "class ")),
+			Network:     sec.Key("network").String(),
+			VendorClass: sec.Key("vendor_class").String(),
+			UserClass:   sec.Key("user_class").String(),
+			Hostname:    sec.Key("hostname").String(),
+			MACPrefix:   sec.Key("mac_prefix").String(),
+			CircuitID:   sec.Key("circuit_id").String(),
+			RemoteID:    sec.Key("remote_id").String(),
+			RangeStart:  sec.Key("dhcp_start").String(),
+			RangeEnd:    sec.Key("dhcp_end").String(),
+			Source:      "ini",
+		}
+		if value := sec.Key("dhcp_default_lease_time").String(); value != "" {
+			class.LeaseTime, _ = strconv.Atoi(value)
+		}
+		// option_CODE=TYPE:VALUE, e.g. option_66=string:tftp.example.org
+		for _, key := range sec.KeyStrings() {
+			code := optionKey.FindStringSubmatch(key)
+			if code == nil {
+				continue
+			}
+			optionCode, _ := strconv.Atoi(code[1])
+			optionType, optionValue, _ := strings.Cut(sec.Key(key).String(), ":")
+			class.Options = append(class.Options, DHCPOption{OptionCode: optionCode, OptionType: optionType, OptionValue: optionValue})
+		}
+		if err := class.compile(); err != nil {
+			log.LoggerWContext(ctx).Error("Wrong configuration, check your " + name + ": " + err.Error())
+			continue
+		}
+		classes = append(classes, class)
+	}
+	return classes
+}
+
+// setIniClientClasses replaces the classes of the configuration file
+func setIniClientClasses(classes []*ClientClass) {
+	clientClassLock.Lock()
+	defer clientClassLock.Unlock()
+	iniClientClasses = classes
+}
+
+// loadClientClasses refreshes the classes of the database
+func loadClientClasses() error {
+	classes, err := ListClientClasses()
+	if err != nil {
+		return err
+	}
+	compiled := make([]*ClientClass, 0, len(classes))
+	for i := range classes {
+		class := &classes[i]
+		if err := class.compile(); err != nil {
+			log.LoggerWContext(ctx).Error("Ignoring class " + class.Name + " of the database: " + err.Error())
+			continue
+		}
+		compiled = append(compiled, class)
+	}
+	clientClassLock.Lock()
+	defer clientClassLock.Unlock()
+	dbClientClasses = compiled
+	return nil
+}
+
+// SaveClientClass saves or updates a class of the database
+func SaveClientClass(class ClientClass) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	class.Source = "database"
+	definition, err := json.Marshal(class)
+	if err != nil {
+		return fmt.Errorf("failed to marshal class: %w", err)
+	}
+
+	query := `
+		INSERT INTO dhcp_client_classes (name, definition, updated_at)
+		VALUES (?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(name) DO UPDATE SET
+			definition = excluded.definition,
+			updated_at = CURRENT_TIMESTAMP
+	`
+
+	if _, err = db.Exec(query, class.Name, string(definition)); err != nil {
+		return fmt.Errorf("failed to save class: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteClientClass deletes a class of the database
+func DeleteClientClass(name string) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	result, err := db.Exec(`DELETE FROM dhcp_client_classes WHERE name = ?`, name)
+	if err != nil {
+		return fmt.Errorf("failed to delete class: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// ListClientClasses lists the classes of the database
+func ListClientClasses() ([]ClientClass, error) {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	rows, err := db.Query(`SELECT definition FROM dhcp_client_classes ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list classes: %w", err)
+	}
+	defer rows.Close()
+
+	var classes []ClientClass
+	for rows.Next() {
+		var definition string
+		if err := rows.Scan(&definition); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		var class ClientClass
+		if err := json.Unmarshal([]byte(definition), &class); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal class: %w", err)
+		}
+		classes = append(classes, class)
+	}
+
+	return classes, rows.Err()
+}
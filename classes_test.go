@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"fdurand/standalone_dhcp/pool"
+	"github.com/go-ini/ini"
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+const classTestConfig = `
+[class phones]
+mac_prefix=00:04:F2,00-90-7a
+dhcp_default_lease_time=600
+option_66=string:tftp.example.org
+option_42=ips:192.168.1.1
+
+[class ipxe]
+user_class=^iPXE$
+network=192.168.1.0
+dhcp_start=192.168.1.10
+dhcp_end=192.168.1.12
+
+[class broken]
+hostname=([
+`
+
+func TestReadClientClasses(t *testing.T) {
+	cfg, err := ini.Load([]byte(classTestConfig))
+	if err != nil {
+		t.Fatalf("Failed to load configuration: %v", err)
+	}
+	classes := readClientClasses(cfg)
+	if len(classes) != 2 {
+		t.Fatalf("Expected the invalid class to be skipped, got %d classes", len(classes))
+	}
+
+	phones := classes[0]
+	if phones.Name != "phones" || phones.LeaseTime != 600 || phones.Source != "ini" {
+		t.Errorf("Unexpected class %+v", phones)
+	}
+	if len(phones.macPrefixes) != 2 || phones.macPrefixes[1] != "00:90:7a" {
+		t.Errorf("Expected normalized MAC prefixes, got %v", phones.macPrefixes)
+	}
+	options := dhcp.Options{}
+	phones.apply(options)
+	if string(options[66]) != "tftp.example.org" || !bytes.Equal(options[42], []byte{192, 168, 1, 1}) {
+		t.Errorf("Unexpected class options %v", options)
+	}
+	if lease := binary.BigEndian.Uint32(options[dhcp.OptionIPAddressLeaseTime]); lease != 600 {
+		t.Errorf("Expected the class lease time, got %d", lease)
+	}
+}
+
+func TestMatchClientClass(t *testing.T) {
+	cfg, _ := ini.Load([]byte(`
+[class voip]
+vendor_class=^Cisco
+mac_prefix=00:04:f2
+
+[class printers]
+hostname=^prn-
+
+[class lab]
+circuit_id=^Gi1/0/
+network=10.0.0.0
+
+[class ipxe]
+user_class=^iPXE$
+`))
+	prev := iniClientClasses
+	defer setIniClientClasses(prev)
+	setIniClientClasses(readClientClasses(cfg))
+
+	tests := []struct {
+		name    string
+		options dhcp.Options
+		mac     string
+		info    *RelayAgentInfo
+		network string
+		class   string
+	}{
+		{"vendor class and OUI", dhcp.Options{dhcp.OptionVendorClassIdentifier: []byte("Cisco Systems")}, "00:04:f2:00:00:01", nil, "192.168.1.0", "voip"},
+		{"vendor class, other OUI", dhcp.Options{dhcp.OptionVendorClassIdentifier: []byte("Cisco Systems")}, "00:11:22:00:00:01", nil, "192.168.1.0", noClass},
+		{"hostname", dhcp.Options{dhcp.OptionHostName: []byte("prn-2nd-floor")}, "00:11:22:00:00:02", nil, "192.168.1.0", "printers"},
+		{"circuit-id", dhcp.Options{}, "00:11:22:00:00:03", &RelayAgentInfo{CircuitID: []byte("Gi1/0/12")}, "10.0.0.0", "lab"},
+		{"circuit-id, other network", dhcp.Options{}, "00:11:22:00:00:03", &RelayAgentInfo{CircuitID: []byte("Gi1/0/12")}, "192.168.1.0", noClass},
+		{"raw user class", dhcp.Options{dhcp.OptionUserClass: []byte("iPXE")}, "00:11:22:00:00:04", nil, "192.168.1.0", "ipxe"},
+		{"RFC 3004 user class", dhcp.Options{dhcp.OptionUserClass: []byte("\x03foo\x04iPXE")}, "00:11:22:00:00:05", nil, "192.168.1.0", "ipxe"},
+		{"no match", dhcp.Options{}, "00:11:22:00:00:06", nil, "192.168.1.0", noClass},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if class := matchClientClass(tt.options, tt.mac, tt.info, tt.network); class.role() != tt.class {
+				t.Errorf("Expected class %s, got %s", tt.class, class.role())
+			}
+		})
+	}
+}
+
+func TestClientClassRange(t *testing.T) {
+	cfg, _ := ini.Load([]byte("[class ipxe]\nuser_class=iPXE\ndhcp_start=192.168.1.10\ndhcp_end=192.168.1.12\n"))
+	prev := iniClientClasses
+	defer setIniClientClasses(prev)
+	setIniClientClasses(readClientClasses(cfg))
+	class := lookupClientClass("ipxe")
+
+	// The sequential strategy makes the indexes handed out predictable
+	start := net.ParseIP("192.168.1.10").To4()
+	ranges := []*poolRange{{start: start, end: net.ParseIP("192.168.1.19").To4(), size: 10}}
+	handler := &DHCPHandler{leaseRange: 10, available: newRangePool(ranges, pool.StrategySequential), network: "192.168.1.0"}
+
+	for i := 0; i < 7; i++ {
+		index, err := handler.allocateIndex("00:11:22:00:00:01", nil)
+		if err != nil {
+			t.Fatalf("Allocation %d failed: %v", i, err)
+		}
+		if index < 3 {
+			t.Errorf("A client outside of the class got index %d of its range", index)
+		}
+	}
+	if _, err := handler.allocateIndex("00:11:22:00:00:01", nil); err == nil {
+		t.Error("Expected the pool to be full for the clients outside of the class")
+	}
+	if free := handler.available.FreeIPsRemaining(); free != 3 {
+		t.Errorf("Expected the range of the class to be left free, got %d free addresses", free)
+	}
+
+	for i := 0; i < 3; i++ {
+		if index, err := handler.allocateIndex("00:11:22:00:00:02", class); err != nil || index != i {
+			t.Errorf("Expected index %d for the class, got %d (%v)", i, index, err)
+		}
+	}
+	if _, err := handler.allocateIndex("00:11:22:00:00:02", class); err == nil {
+		t.Error("Expected the range of the class to be exhausted")
+	}
+
+	if handler.allowedIndex(1, nil) || !handler.allowedIndex(5, nil) || !handler.allowedIndex(1, class) || handler.allowedIndex(5, class) {
+		t.Error("Unexpected allowed indexes")
+	}
+
+	// The range of a class of another network is not set aside
+	class.Network = "10.0.0.0"
+	if !handler.allowedIndex(1, nil) {
+		t.Error("Expected the range of a class of another network to be ignored")
+	}
+	if spans, all := handler.allowedSpans(nil); !all || spans != nil {
+		t.Errorf("Expected every index to be allowed, got %v", spans)
+	}
+}
+
+func TestClientClassOptionLayers(t *testing.T) {
+	dbPath := setupTestDB(t)
+	defer teardownTestDB(t, dbPath)
+	if err := InitDatabase(dbPath); err != nil {
+		t.Fatalf("InitDatabase failed: %v", err)
+	}
+
+	const mac = "00:04:f2:00:00:01"
+	SaveOptionOverride("network", "192.168.1.0", []DHCPOption{{OptionCode: 66, OptionValue: "network", OptionType: "string"}, {OptionCode: 67, OptionValue: "network.cfg", OptionType: "string"}})
+	SaveOptionOverride("mac", mac, []DHCPOption{{OptionCode: 67, OptionValue: "mac.cfg", OptionType: "string"}})
+	class := &ClientClass{Name: "phones", MACPrefix: "00:04:f2", Options: []DHCPOption{{OptionCode: 66, OptionValue: "class", OptionType: "string"}, {OptionCode: 67, OptionValue: "class.cfg", OptionType: "string"}}}
+	if err := class.compile(); err != nil {
+		t.Fatalf("compile failed: %v", err)
+	}
+
+	options := applyOptionOverrides(dhcp.Options{66: []byte("default")}, "192.168.1.0", mac, class)
+	if string(options[66]) != "class" {
+		t.Errorf("Expected the class to override the network, got %s", options[66])
+	}
+	if string(options[67]) != "mac.cfg" {
+		t.Errorf("Expected the MAC override to win over the class, got %s", options[67])
+	}
+}
+
+func TestClientClassAPI(t *testing.T) {
+	router, dbPath := setupTestAPI(t)
+	defer teardownTestDB(t, dbPath)
+
+	request := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		payload, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := request("POST", "/api/v1/dhcp/classes/cameras", ClientClass{VendorClass: "(["}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid regex to be refused, got %d", rr.Code)
+	}
+	if rr := request("POST", "/api/v1/dhcp/classes/cameras", ClientClass{}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected a class without criterion to be refused, got %d", rr.Code)
+	}
+
+	class := ClientClass{MACPrefix: "00:40:8c", LeaseTime: 300, Options: []DHCPOption{{OptionCode: 42, OptionValue: "10.0.0.1", OptionType: "ip"}}}
+	if rr := request("POST", "/api/v1/dhcp/classes/cameras", class); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the class to be saved, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if matched := matchClientClass(dhcp.Options{}, "00:40:8c:12:34:56", nil, "192.168.1.0"); matched.role() != "cameras" {
+		t.Errorf("Expected the saved class to be applied live, got %s", matched.role())
+	}
+
+	rr := request("GET", "/api/v1/dhcp/classes/cameras", nil)
+	var saved ClientClass
+	json.Unmarshal(rr.Body.Bytes(), &saved)
+	if rr.Code != http.StatusOK || saved.Source != "database" || saved.LeaseTime != 300 {
+		t.Errorf("Unexpected class %d %+v", rr.Code, saved)
+	}
+
+	// The classes of the database survive a restart
+	if err := InitDatabase(dbPath); err != nil {
+		t.Fatalf("InitDatabase failed: %v", err)
+	}
+	if lookupClientClass("cameras") == nil {
+		t.Error("Expected the class to be loaded from the database")
+	}
+
+	if rr := request("DELETE", "/api/v1/dhcp/classes/cameras", nil); rr.Code != http.StatusOK {
+		t.Errorf("Expected the class to be deleted, got %d", rr.Code)
+	}
+	if rr := request("DELETE", "/api/v1/dhcp/classes/cameras", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 on a missing class, got %d", rr.Code)
+	}
+	if lookupClientClass("cameras") != nil {
+		t.Error("Expected the class to be gone")
+	}
+
+	prev := iniClientClasses
+	defer setIniClientClasses(prev)
+	setIniClientClasses([]*ClientClass{{Name: "phones", MACPrefix: "00:04:f2", Source: "ini"}})
+	if rr := request("DELETE", "/api/v1/dhcp/classes/phones", nil); rr.Code != http.StatusConflict {
+		t.Errorf("Expected the classes of the configuration file to be read-only, got %d", rr.Code)
+	}
+}
+
+// TestClientClassLeaseTime checks the lease time of a class goes through the
+// lease time negotiation as an override
+func TestClientClassLeaseTime(t *testing.T) {
+	handler := &DHCPHandler{leaseDuration: time.Hour, minLeaseDuration: time.Minute, maxLeaseDuration: 2 * time.Hour}
+	class := &ClientClass{Name: "short", LeaseTime: 300}
+	options := dhcp.Options{}
+	class.apply(options)
+	if lease := handler.grantLease(options, leaseOption(7200)); lease != 5*time.Minute {
+		t.Errorf("Expected the lease time of the class, got %v", lease)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-ini/ini"
+	"github.com/inverse-inc/packetfence/go/log"
+)
+
+// The client policies of a network
+const (
+	policyAllow = "allow" // Every client is served
+	policyKnown = "known" // Only the clients with a static assignment or on the allow-list
+	policyDeny  = "deny"  // Every client but the ones on the deny-list
+)
+
+// The MAC address lists
+const (
+	listAllow = "allow"
+	listDeny  = "deny"
+)
+
+// clientPolicy decides which clients a scope serves
+type clientPolicy struct {
+	mode   string
+	nak    bool          // Denied requests are answered with a NAK instead of being ignored
+	denied atomic.Uint64 // Packets refused
+}
+
+// readClientPolicy reads the client_policy and denied_reply keys of a
+// network section
+func readClientPolicy(sec *ini.Section) (*clientPolicy, error) {
+	p := &clientPolicy{mode: sec.Key("client_policy").MustString(policyAllow)}
+	switch p.mode {
+	case policyAllow, policyKnown, policyDeny:
+	default:
+		return nil, fmt.Errorf("invalid client_policy %q, must be allow, known or deny", p.mode)
+	}
+	switch reply := sec.Key("denied_reply").MustString("ignore"); reply {
+	case "ignore":
+	case "nak":
+		p.nak = true
+	default:
+		return nil, fmt.Errorf("invalid denied_reply %q, must be ignore or nak", reply)
+	}
+	return p, nil
+}
+
+// String returns the mode of the policy
+func (p *clientPolicy) String() string {
+	if p == nil {
+		return policyAllow
+	}
+	return p.mode
+}
+
+// deniedCount returns the number of packets refused
+func (p *clientPolicy) deniedCount() uint64 {
+	if p == nil {
+		return 0
+	}
+	return p.denied.Load()
+}
+
+// admits tells if the client policy of the scope lets a client be served
+func (h *DHCPHandler) admits(mac string, info *RelayAgentInfo, network string) bool {
+	if h.policy == nil {
+		return true
+	}
+	switch h.policy.mode {
+	case policyKnown:
+		if _, static := h.staticIndex(mac, info); static {
+			return true
+		}
+		return onMACList(listAllow, mac, network)
+	case policyDeny:
+		return !onMACList(listDeny, mac, network)
+	}
+	return true
+}
+
+// MACListEntry is an entry of the allow-list or of the deny-list
+type MACListEntry struct {
+	ID        int64     `json:"id"`
+	List      string    `json:"list"`
+	Pattern   string    `json:"pattern"`           // A MAC address, an OUI or octets with * wildcards
+	Network   string    `json:"network,omitempty"` // Every network when empty
+	Comment   string    `json:"comment,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// normalizeMACPattern validates a MAC address pattern and writes it in
+// lowercase with colons. Fewer than six octets match the MAC addresses
+// starting with them, and an octet can be a * wildcard.
+func normalizeMACPattern(pattern string) (string, error) {
+	octets := strings.FieldsFunc(strings.ToLower(strings.TrimSpace(pattern)), func(r rune) bool {
+		return r == ':' || r == '-'
+	})
+	if len(octets) == 0 || len(octets) > 6 {
+		return "", fmt.Errorf("invalid pattern %q, must be one to six octets", pattern)
+	}
+	for _, octet := range octets {
+		if octet == "*" {
+			continue
+		}
+		if _, err := hex.DecodeString(octet); err != nil || len(octet) != 2 {
+			return "", fmt.Errorf("invalid pattern %q, %q is not an octet", pattern, octet)
+		}
+	}
+	return strings.Join(octets, ":"), nil
+}
+
+// matches tells if a MAC address matches the pattern of the entry
+func (e *MACListEntry) matches(mac string) bool {
+	octets := strings.Split(mac, ":")
+	for i, octet := range strings.Split(e.Pattern, ":") {
+		if i >= len(octets) || (octet != "*" && octet != octets[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	macListLock sync.RWMutex
+	macLists    []MACListEntry // Mirror of the dhcp_mac_lists table
+)
+
+// loadMACLists refreshes the allow-list and the deny-list from the database
+func loadMACLists() error {
+	entries, err := ListMACListEntries("", "")
+	if err != nil {
+		return err
+	}
+	macListLock.Lock()
+	defer macListLock.Unlock()
+	macLists = entries
+	return nil
+}
+
+// onMACList tells if a MAC address is on a list, for a network or for every
+// network
+func onMACList(list string, mac string, network string) bool {
+	macListLock.RLock()
+	defer macListLock.RUnlock()
+	for i := range macLists {
+		e := &macLists[i]
+		if e.List == list && (e.Network == "" || e.Network == network) && e.matches(mac) {
+			return true
+		}
+	}
+	return false
+}
+
+// addMACListEntry stores an entry and applies it right away, an entry of the
+// same pattern and network is updated
+func addMACListEntry(e MACListEntry) (*MACListEntry, error) {
+	saved, err := SaveMACListEntry(e)
+	if err != nil {
+		return nil, err
+	}
+	if err := loadMACLists(); err != nil {
+		return nil, err
+	}
+	log.LoggerWContext(ctx).Info("Added " + saved.Pattern + " to the " + saved.List + "-list")
+	return saved, nil
+}
+
+// removeMACListEntry deletes an entry of a list
+func removeMACListEntry(list string, id int64) error {
+	if err := DeleteMACListEntry(list, id); err != nil {
+		return err
+	}
+	log.LoggerWContext(ctx).Info("Removed entry " + strconv.FormatInt(id, 10) + " of the " + list + "-list")
+	return loadMACLists()
+}
+
+// SaveMACListEntry creates an entry, or updates the comment of the entry of
+// the same list, pattern and network
+func SaveMACListEntry(e MACListEntry) (*MACListEntry, error) {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	query := `
+		INSERT INTO dhcp_mac_lists (list, pattern, network, comment)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(list, pattern, network) DO UPDATE SET
+			comment = excluded.comment
+	`
+	if _, err := db.Exec(query, e.List, e.Pattern, e.Network, e.Comment); err != nil {
+		return nil, fmt.Errorf("failed to save %s-list entry: %w", e.List, err)
+	}
+
+	return scanMACListEntry(db.QueryRow(`SELECT id, list, pattern, network, comment, created_at FROM dhcp_mac_lists WHERE list = ? AND pattern = ? AND network = ?`, e.List, e.Pattern, e.Network))
+}
+
+// scanMACListEntry reads an entry from a row
+func scanMACListEntry(row interface{ Scan(...interface{}) error }) (*MACListEntry, error) {
+	var e MACListEntry
+	if err := row.Scan(&e.ID, &e.List, &e.Pattern, &e.Network, &e.Comment, &e.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// DeleteMACListEntry deletes the entry of a list with an id
+func DeleteMACListEntry(list string, id int64) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	result, err := db.Exec(`DELETE FROM dhcp_mac_lists WHERE list = ? AND id = ?`, list, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete %s-list entry: %w", list, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// ListMACListEntries lists the entries, optionally limited to a list and to
+// the ones applying to a network
+func ListMACListEntries(list string, network string) ([]MACListEntry, error) {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	query := `SELECT id, list, pattern, network, comment, created_at FROM dhcp_mac_lists WHERE 1 = 1`
+	var args []interface{}
+	if list != "" {
+		query += ` AND list = ?`
+		args = append(args, list)
+	}
+	if network != "" {
+		query += ` AND (network = ? OR network = '')`
+		args = append(args, network)
+	}
+	query += ` ORDER BY list, pattern, network`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list mac list entries: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []MACListEntry{}
+	for rows.Next() {
+		e, err := scanMACListEntry(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		entries = append(entries, *e)
+	}
+
+	return entries, rows.Err()
+}
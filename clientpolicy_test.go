@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	cache "github.com/fdurand/go-cache"
+	"github.com/go-ini/ini"
+	"github.com/inverse-inc/packetfence/go/timedlock"
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+func TestNormalizeMACPattern(t *testing.T) {
+	for pattern, expected := range map[string]string{
+		"AA:BB:CC:DD:EE:FF": "aa:bb:cc:dd:ee:ff",
+		"00-04-F2":          "00:04:f2",
+		"00:04:f2:*:*:01":   "00:04:f2:*:*:01",
+	} {
+		if got, err := normalizeMACPattern(pattern); err != nil || got != expected {
+			t.Errorf("Expected %s to be %s, got %s (%v)", pattern, expected, got, err)
+		}
+	}
+	for _, pattern := range []string{"", "aa:bb:cc:dd:ee:ff:00", "aa:b", "aa:zz", "aabbcc"} {
+		if _, err := normalizeMACPattern(pattern); err == nil {
+			t.Errorf("Expected %q to be refused", pattern)
+		}
+	}
+
+	e := MACListEntry{Pattern: "00:04:f2:*:*:01"}
+	if !e.matches("00:04:f2:12:34:01") || e.matches("00:04:f2:12:34:02") || e.matches("00:04:f3:12:34:01") {
+		t.Errorf("Unexpected matches of %s", e.Pattern)
+	}
+}
+
+func TestReadClientPolicy(t *testing.T) {
+	cfg, _ := ini.Load([]byte("[default]\n[known]\nclient_policy=known\ndenied_reply=nak\n[bad]\nclient_policy=strict\n[badreply]\ndenied_reply=drop\n"))
+
+	if p, err := readClientPolicy(cfg.Section("default")); err != nil || p.mode != policyAllow || p.nak {
+		t.Errorf("Expected every client to be served by default, got %+v (%v)", p, err)
+	}
+	if p, err := readClientPolicy(cfg.Section("known")); err != nil || p.mode != policyKnown || !p.nak {
+		t.Errorf("Expected the known clients only, answered with a NAK, got %+v (%v)", p, err)
+	}
+	for _, name := range []string{"bad", "badreply"} {
+		if _, err := readClientPolicy(cfg.Section(name)); err == nil {
+			t.Errorf("Expected section %s to be refused", name)
+		}
+	}
+}
+
+func TestClientPolicy(t *testing.T) {
+	dbPath := setupTestDB(t)
+	defer teardownTestDB(t, dbPath)
+	if err := InitDatabase(dbPath); err != nil {
+		t.Fatalf("InitDatabase failed: %v", err)
+	}
+
+	for _, e := range []MACListEntry{
+		{List: listAllow, Pattern: "00:04:f2"},
+		{List: listAllow, Pattern: "aa:bb:cc:00:00:05", Network: "192.168.2.0"},
+		{List: listDeny, Pattern: "de:ad:*:*:*:01"},
+	} {
+		if _, err := addMACListEntry(e); err != nil {
+			t.Fatalf("addMACListEntry failed: %v", err)
+		}
+	}
+
+	handler := &DHCPHandler{ipAssigned: map[string]uint32{"aa:bb:cc:00:00:01": 0}, policy: &clientPolicy{mode: policyKnown}}
+	for mac, expected := range map[string]bool{
+		"aa:bb:cc:00:00:01": true,  // Static
+		"00:04:f2:11:22:33": true,  // On the allow-list
+		"aa:bb:cc:00:00:05": false, // On the allow-list of another network
+		"aa:bb:cc:00:00:02": false,
+	} {
+		if got := handler.admits(mac, nil, "192.168.1.0"); got != expected {
+			t.Errorf("Known clients only: expected %v for %s, got %v", expected, mac, got)
+		}
+	}
+	if !handler.admits("aa:bb:cc:00:00:05", nil, "192.168.2.0") {
+		t.Error("Expected the allow-list entry of 192.168.2.0 to apply to it")
+	}
+
+	handler.policy.mode = policyDeny
+	if handler.admits("de:ad:be:ef:00:01", nil, "192.168.1.0") || !handler.admits("de:ad:be:ef:00:02", nil, "192.168.1.0") {
+		t.Error("Expected the clients of the deny-list only to be refused")
+	}
+
+	entries, _ := ListMACListEntries(listAllow, "192.168.1.0")
+	if len(entries) != 1 || entries[0].Pattern != "00:04:f2" {
+		t.Errorf("Expected the allow-list entries of every network, got %+v", entries)
+	}
+	if err := removeMACListEntry(listDeny, entries[0].ID); err == nil {
+		t.Error("Expected an entry of another list to be refused")
+	}
+
+	// The lists are reloaded with the database
+	CloseDatabase()
+	if err := InitDatabase(dbPath); err != nil {
+		t.Fatalf("InitDatabase failed: %v", err)
+	}
+	if !onMACList(listAllow, "00:04:f2:11:22:33", "192.168.1.0") {
+		t.Error("Expected the allow-list to be loaded from the database")
+	}
+}
+
+func TestServeDHCPClientPolicy(t *testing.T) {
+	dbPath := setupTestDB(t)
+	defer teardownTestDB(t, dbPath)
+	if err := InitDatabase(dbPath); err != nil {
+		t.Fatalf("InitDatabase failed: %v", err)
+	}
+	prevCache, prevLock := GlobalTransactionCache, GlobalTransactionLock
+	defer func() { GlobalTransactionCache, GlobalTransactionLock = prevCache, prevLock }()
+	GlobalTransactionCache = cache.New(5*time.Minute, 10*time.Minute)
+	GlobalTransactionLock = timedlock.NewRWLock()
+
+	cfg, _ := ini.ShadowLoad([]byte(`
+[network 192.168.1.0]
+netmask=255.255.255.0
+gateway=192.168.1.1
+dhcp_start=192.168.1.10
+dhcp_end=192.168.1.19
+dhcp_default_lease_time=3600
+ip_assigned=aa:bb:cc:00:00:01:192.168.1.15
+client_policy=known
+denied_reply=nak
+`))
+	sec := cfg.Section("network 192.168.1.0")
+	ranges, _ := parseRanges(sec)
+	I := &Interface{Name: "eth0", InterfaceType: "server"}
+	I.network = append(I.network, newNetwork("network 192.168.1.0", sec, "192.168.1.0", ranges, net.ParseIP("192.168.1.1"), I.Name))
+	policy := I.networks()[0].dhcpHandler.policy
+
+	packet := func(mac string, msgType dhcp.MessageType) dhcp.Packet {
+		p := newTestPacket(t, mac)
+		p.SetXId([]byte{5, 4, 3, byte(msgType)})
+		p.AddOption(dhcp.OptionDHCPMessageType, []byte{byte(msgType)})
+		return p
+	}
+
+	// The static client is known
+	answer := I.ServeDHCP(context.Background(), packet("aa:bb:cc:00:00:01", dhcp.Discover), dhcp.Discover, nil, nil)
+	if answer.D == nil || !answer.D.YIAddr().Equal(net.ParseIP("192.168.1.15")) {
+		t.Fatal("Expected the static client to get an offer")
+	}
+
+	// An unknown client is ignored, its requests are answered with a NAK
+	if answer := I.ServeDHCP(context.Background(), packet("aa:bb:cc:00:00:02", dhcp.Discover), dhcp.Discover, nil, nil); answer.D != nil {
+		t.Error("Expected the discover of an unknown client to be ignored")
+	}
+	request := packet("aa:bb:cc:00:00:02", dhcp.Request)
+	request.AddOption(dhcp.OptionRequestedIPAddress, net.ParseIP("192.168.1.12").To4())
+	answer = I.ServeDHCP(context.Background(), request, dhcp.Request, nil, nil)
+	if answer.D == nil || dhcp.MessageType(answer.D.ParseOptions()[dhcp.OptionDHCPMessageType][0]) != dhcp.NAK {
+		t.Error("Expected the request of an unknown client to be answered with a NAK")
+	}
+	if policy.deniedCount() != 2 {
+		t.Errorf("Expected 2 denied packets, got %d", policy.deniedCount())
+	}
+
+	policy.nak = false
+	request.SetXId([]byte{5, 4, 4, byte(dhcp.Request)})
+	if answer := I.ServeDHCP(context.Background(), request, dhcp.Request, nil, nil); answer.D != nil {
+		t.Error("Expected the request to be ignored")
+	}
+}
+
+func TestMACListAPI(t *testing.T) {
+	router, dbPath := setupTestAPI(t)
+	defer teardownTestDB(t, dbPath)
+
+	code, answer := apiRequest(router, "POST", "/api/v1/dhcp/maclists/deny", map[string]string{"pattern": "DE-AD-BE", "network": "192.168.1.0", "comment": "rogue"})
+	if code != http.StatusOK {
+		t.Fatalf("Expected the entry to be saved, got %d %v", code, answer)
+	}
+	entry := answer["entry"].(map[string]interface{})
+	if entry["pattern"] != "de:ad:be" || entry["list"] != "deny" {
+		t.Errorf("Unexpected entry %v", entry)
+	}
+	if !onMACList(listDeny, "de:ad:be:00:00:01", "192.168.1.0") {
+		t.Error("Expected the entry to apply right away")
+	}
+
+	// Saving the same pattern again updates it
+	code, answer = apiRequest(router, "POST", "/api/v1/dhcp/maclists/deny", map[string]string{"pattern": "de:ad:be", "network": "192.168.1.0", "comment": "rogue devices"})
+	if code != http.StatusOK || answer["entry"].(map[string]interface{})["id"] != entry["id"] {
+		t.Errorf("Expected the entry to be updated, got %d %v", code, answer)
+	}
+
+	for _, body := range []map[string]string{{"pattern": "de:ad:zz"}, {"pattern": "de:ad:be", "network": "lan"}} {
+		if code, _ := apiRequest(router, "POST", "/api/v1/dhcp/maclists/deny", body); code != http.StatusBadRequest {
+			t.Errorf("Expected %v to be refused, got %d", body, code)
+		}
+	}
+	if code, _ := apiRequest(router, "POST", "/api/v1/dhcp/maclists/grey", map[string]string{"pattern": "de:ad:be"}); code != http.StatusNotFound && code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected an unknown list to be refused, got %d", code)
+	}
+
+	code, answer = apiRequest(router, "GET", "/api/v1/dhcp/maclists/deny?network=192.168.1.0", nil)
+	if code != http.StatusOK || answer["count"].(float64) != 1 {
+		t.Errorf("Expected one entry, got %d %v", code, answer)
+	}
+	if _, answer := apiRequest(router, "GET", "/api/v1/dhcp/maclists/allow", nil); answer["count"].(float64) != 0 {
+		t.Errorf("Expected an empty allow-list, got %v", answer)
+	}
+
+	id := int(entry["id"].(float64))
+	url := "/api/v1/dhcp/maclists/deny/" + strconv.Itoa(id)
+	if code, _ := apiRequest(router, "DELETE", url, nil); code != http.StatusOK {
+		t.Errorf("Expected the entry to be removed, got %d", code)
+	}
+	if code, _ := apiRequest(router, "DELETE", url, nil); code != http.StatusNotFound {
+		t.Errorf("Expected a removed entry to be unknown, got %d", code)
+	}
+	if onMACList(listDeny, "de:ad:be:00:00:01", "192.168.1.0") {
+		t.Error("Expected the removed entry to no longer apply")
+	}
+}
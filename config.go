@@ -1,17 +1,18 @@
 package main
 
 import (
-	"encoding/binary"
+	"context"
+	"database/sql"
 	"fmt"
 	"net"
-	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	cache "github.com/fdurand/go-cache"
-	"github.com/fdurand/standalone_dhcp/pool"
 	"github.com/go-ini/ini"
 	"github.com/inverse-inc/packetfence/go/log"
 	dhcp "github.com/krolaw/dhcp4"
@@ -19,40 +20,59 @@ import (
 
 // DHCPHandler struct
 type DHCPHandler struct {
-	ip            net.IP // Server IP to use
-	vip           net.IP
-	options       dhcp.Options  // Options to send to DHCP Clients
-	start         net.IP        // Start of IP range to distribute
-	leaseRange    int           // Number of IPs to distribute (starting from start)
-	leaseDuration time.Duration // Lease period
-	hwcache       *cache.Cache
-	xid           *cache.Cache
-	available     *pool.DHCPPool // DHCPPool keeps track of the available IPs in the pool
-	layer2        bool
-	role          string
-	ipReserved    string
-	ipAssigned    map[string]uint32
+	ip               net.IP // Server IP to use
+	vip              net.IP
+	options          dhcp.Options  // Options to send to DHCP Clients
+	leaseRange       int           // Number of IPs to distribute, over every range
+	leaseDuration    time.Duration // Lease period
+	minLeaseDuration time.Duration // Shortest lease period a client can ask for
+	maxLeaseDuration time.Duration // Longest lease period a client can ask for
+	hwcache          *cache.Cache
+	xid              *cache.Cache
+	available        *rangePool // Keeps track of the available IPs of the ranges
+	layer2           bool
+	role             string
+	ipAssigned       map[string]uint32
+	reservations     *reservationSet   // Static assignments made through the API
+	exclusions       *exclusionSet     // Ranges never handed out, from ip_reserved and the API
+	clients          *cache.Cache      // Class and boot file of the bound clients
+	peerBound        *cache.Cache      // MACs whose binding was copied from the failover partner
+	boot             *bootConfig       // Network boot settings, nil when disabled
+	ddns             *ddnsConfig       // Dynamic DNS settings, nil when disabled
+	circuitAssigned  map[string]uint32 // Static assignments by option 82 circuit-id
+	remoteAssigned   map[string]uint32 // Static assignments by option 82 remote-id
+	policy           *clientPolicy     // Clients served, nil serves every client
+	signature        string            // Fingerprint of the configuration the scope was built from
+	network          string            // Address of the network of the scope
 }
 
 type Interfaces struct {
-	intsNet []Interface
+	intsNet []*Interface
+	jobs    chan job
+	kept    map[string]Network  // Live scopes readConfig reuses when unchanged, by scope name
+	kept6   map[string]Network6 // Live IPv6 scopes readConfig reuses when unchanged, by scope name
 }
 
 type Interface struct {
-	Name          string
-	intNet        *net.Interface
-	network       []Network
-	layer2        []*net.IPNet
-	Ipv4          net.IP
-	Ipv6          net.IP
-	InterfaceType string
-	relayIP       net.IP
-	listenPort    int
+	Name              string
+	intNet            *net.Interface
+	network           []Network
+	network6          []Network6
+	layer2            []*net.IPNet
+	Ipv4              net.IP
+	Ipv6              net.IP
+	InterfaceType     string
+	relayIP           net.IP
+	circuitIDTemplate string // Option 82 circuit-id inserted by a relay interface
+	listenPort        int
+	lock              sync.RWMutex
+	cancel            context.CancelFunc
 }
 
 type Network struct {
 	network     net.IPNet
 	dhcpHandler *DHCPHandler
+	shared      string // Shared network the subnet is part of
 }
 
 const bootp_client = 68
@@ -63,12 +83,87 @@ func newDHCPConfig() *Interfaces {
 	return &p
 }
 
-func (d *Interfaces) readConfig() {
+// interfacesLock guards the live interface list and intNametoInterface, which
+// are swapped by a configuration reload.
+var interfacesLock sync.RWMutex
 
-	cfg, err := ini.Load(configFilePath)
+// lookupInterface returns the live interface with the given name
+func lookupInterface(name string) (*Interface, bool) {
+	interfacesLock.RLock()
+	defer interfacesLock.RUnlock()
+	I, ok := intNametoInterface[name]
+	return I, ok
+}
+
+// interfaces returns a snapshot of the live interfaces
+func (d *Interfaces) interfaces() []*Interface {
+	interfacesLock.RLock()
+	defer interfacesLock.RUnlock()
+	return append([]*Interface(nil), d.intsNet...)
+}
+
+// networks returns a snapshot of the scopes served on the interface
+func (I *Interface) networks() []Network {
+	I.lock.RLock()
+	defer I.lock.RUnlock()
+	return I.network
+}
+
+// setNetworks replaces the scopes served on the interface
+func (I *Interface) setNetworks(networks []Network) {
+	I.lock.Lock()
+	defer I.lock.Unlock()
+	I.network = networks
+}
+
+// keepScopes makes readConfig reuse the scopes of a live configuration whose
+// section did not change instead of building them again
+func (d *Interfaces) keepScopes(live *Interfaces) {
+	d.kept = make(map[string]Network)
+	d.kept6 = make(map[string]Network6)
+	for _, I := range live.interfaces() {
+		for _, v := range I.networks() {
+			d.kept[scopeName(I, v)] = v
+		}
+		for _, v := range I.networks6() {
+			d.kept6[scopeName6(I, v)] = v
+		}
+	}
+}
+
+// network returns the scope of a network section: the live one when its
+// configuration did not change, else a new one, see newNetwork
+func (d *Interfaces) network(key string, sec *ini.Section, network string, ranges []*poolRange, serverIP net.IP, ifName string) Network {
+	ipNet := net.IPNet{IP: net.ParseIP(network), Mask: net.IPMask(net.ParseIP(sec.Key("netmask").String()))}
+	if v, found := d.kept[ifName+" "+ipNet.String()]; found && v.dhcpHandler.signature == scopeSignature(sec, serverIP.To4()) {
+		return v
+	}
+	return newNetwork(key, sec, network, ranges, serverIP, ifName)
+}
+
+// scopeSignature fingerprints the configuration a scope is built from so a
+// reload can tell the unchanged scopes apart from the ones to rebuild. The
+// empty keys, which reading a missing key creates, are left out.
+func scopeSignature(sec *ini.Section, serverIP net.IP) string {
+	keys := sec.KeyStrings()
+	sort.Strings(keys)
+	signature := serverIP.String()
+	for _, key := range keys {
+		value := strings.Join(sec.Key(key).ValueWithShadows(), ",")
+		if value == "" {
+			continue
+		}
+		signature += "\n" + key + "=" + value
+	}
+	return signature
+}
+
+func (d *Interfaces) readConfig() error {
+
+	// Shadows keep the several range entries of a network
+	cfg, err := ini.ShadowLoad(configFilePath)
 	if err != nil {
-		fmt.Printf("Fail to read file: %v", err)
-		os.Exit(1)
+		return fmt.Errorf("fail to read file: %w", err)
 	}
 
 	Interfaces := cfg.Section("interfaces").Key("listen").String()
@@ -77,10 +172,15 @@ func (d *Interfaces) readConfig() {
 	networks := cfg.SectionStrings()
 	networkKey, err := regexp.Compile("^network (?P<Net>.*)$")
 	if err != nil {
-		fmt.Printf("Fail to compile regex: %v", err)
-		os.Exit(1)
+		return fmt.Errorf("fail to compile regex: %w", err)
+	}
+	network6Key, err := regexp.Compile("^network6 (?P<Net>.*)$")
+	if err != nil {
+		return fmt.Errorf("fail to compile regex: %w", err)
 	}
 
+	setIniClientClasses(readClientClasses(cfg))
+
 	for _, v := range NetInterfaces {
 		eth, err := net.InterfaceByName(v)
 		if err != nil {
@@ -91,7 +191,7 @@ func (d *Interfaces) readConfig() {
 			continue
 		}
 
-		var ethIf Interface
+		ethIf := &Interface{}
 
 		ethIf.intNet = eth
 		ethIf.Name = eth.Name
@@ -110,6 +210,37 @@ func (d *Interfaces) readConfig() {
 			}
 			if IsIPv6(IP) {
 				ethIf.Ipv6 = IP
+				if IP.IsLinkLocalUnicast() {
+					continue
+				}
+				for _, key := range networks {
+					if !network6Key.MatchString(key) {
+						continue
+					}
+					sec := cfg.Section(key)
+					if sec.Key("dhcpd").String() == "disabled" {
+						continue
+					}
+					_, prefix, err := net.ParseCIDR(network6Key.FindStringSubmatch(key)[1])
+					if err != nil || prefix.IP.To4() != nil {
+						log.LoggerWContext(ctx).Error("Invalid network6 section format: " + key)
+						continue
+					}
+					if !prefix.Contains(IP) || ethIf.hasNetwork6(*prefix) {
+						continue
+					}
+					if v, found := d.kept6[ethIf.Name+" "+prefix.String()]; found && v.dhcpHandler.signature == scopeSignature(sec, net.IP(duidLL(eth.HardwareAddr))) {
+						ethIf.network6 = append(ethIf.network6, v)
+						continue
+					}
+					DHCPScope, err := newDHCPv6Handler(sec, *prefix, duidLL(eth.HardwareAddr))
+					if err != nil {
+						log.LoggerWContext(ctx).Error("Wrong configuration, check your network6 " + key + ": " + err.Error())
+						continue
+					}
+					DHCPScope.restore()
+					ethIf.network6 = append(ethIf.network6, Network6{network: *prefix, dhcpHandler: DHCPScope})
+				}
 				continue
 			}
 			if IsIPv4(IP) {
@@ -129,74 +260,22 @@ func (d *Interfaces) readConfig() {
 					if sec.Key("dhcpd").String() == "disabled" {
 						continue
 					}
-					dhcpStart := net.ParseIP(sec.Key("dhcp_start").String())
-					dhcpEnd := net.ParseIP(sec.Key("dhcp_end").String())
-					if (NetIP.Contains(dhcpStart) && NetIP.Contains(dhcpEnd)) || NetIP.Contains(net.ParseIP(sec.Key("next_hop").String())) {
-						// dhcp_start/dhcp_end must be valid IPv4 addresses before we
-						// can compute the pool range; a malformed value would
-						// otherwise panic when converted with binary.BigEndian.
-						if dhcpStart.To4() == nil || dhcpEnd.To4() == nil {
-							log.LoggerWContext(ctx).Error("Missing or invalid dhcp_start/dhcp_end, check your network " + key)
-							continue
-						}
-						if binary.BigEndian.Uint32(dhcpStart.To4()) > binary.BigEndian.Uint32(dhcpEnd.To4()) {
-							log.LoggerWContext(ctx).Error("Wrong configuration, check your network " + key)
+					ranges, rangesErr := parseRanges(sec)
+					if (rangesErr == nil && rangesWithin(ranges, NetIP)) || NetIP.Contains(net.ParseIP(sec.Key("next_hop").String())) {
+						// The ranges must be valid before we can compute the
+						// pool indexes
+						if rangesErr != nil {
+							log.LoggerWContext(ctx).Error("Missing or invalid address range (" + rangesErr.Error() + "), check your network " + key)
 							continue
 						}
 
-						var DHCPNet Network
-						var DHCPScope *DHCPHandler
-						DHCPScope = &DHCPHandler{}
-						DHCPNet.network.IP = net.ParseIP(netWork[1])
-						DHCPNet.network.Mask = net.IPMask(net.ParseIP(sec.Key("netmask").String()))
-						DHCPScope.ip = IP.To4()
-
-						DHCPScope.role = "none"
-						DHCPScope.start = dhcpStart
-						seconds, _ := strconv.Atoi(sec.Key("dhcp_default_lease_time").String())
-						DHCPScope.leaseDuration = time.Duration(seconds) * time.Second
-						DHCPScope.leaseRange = dhcp.IPRange(dhcpStart, dhcpEnd)
-						algorithm, _ := strconv.Atoi(sec.Key("algorithm").String())
-						// Initialize dhcp pool
-						available := pool.NewDHCPPool(safeIntToUint64(dhcp.IPRange(dhcpStart, dhcpEnd)), algorithm)
-						DHCPScope.available = available
-
-						// Initialize hardware cache
-						hwcache := cache.New(time.Duration(seconds)*time.Second, 10*time.Second)
-
-						hwcache.OnEvicted(func(nic string, pool interface{}) {
-							go func() {
-								// Always wait 30 seconds before releasing the IP again
-								time.Sleep(30 * time.Second)
-								log.LoggerWContext(ctx).Info(nic + " " + dhcp.IPAdd(DHCPScope.start, pool.(int)).String() + " Added back in the pool " + DHCPScope.role + " on index " + strconv.Itoa(pool.(int)))
-								DHCPScope.available.FreeIPIndex(safeIntToUint64(pool.(int)))
-							}()
-						})
-
-						DHCPScope.hwcache = hwcache
-
-						xid := cache.New(time.Duration(4)*time.Second, 2*time.Second)
-
-						DHCPScope.xid = xid
-						ExcludeIP(DHCPScope, sec.Key("ip_reserved").String())
-						DHCPScope.ipReserved = sec.Key("ip_reserved").String()
-						DHCPScope.ipAssigned, _ = AssignIP(DHCPScope, sec.Key("ip_assigned").String())
-						DHCPScope.layer2 = true
-						var options = make(map[dhcp.OptionCode][]byte)
-
-						options[dhcp.OptionSubnetMask] = []byte(net.ParseIP(sec.Key("netmask").String()).To4())
-						options[dhcp.OptionDomainNameServer] = ShuffleDNS(sec)
-						options[dhcp.OptionRouter] = ShuffleGateway(sec)
-						options[dhcp.OptionDomainName] = []byte(sec.Key("domain-name").String())
-						DHCPScope.options = options
-						DHCPNet.dhcpHandler = DHCPScope
-
-						ethIf.network = append(ethIf.network, DHCPNet)
+						ethIf.network = append(ethIf.network, d.network(key, sec, netWork[1], ranges, IP, ethIf.Name))
 					}
 				}
 			}
 		}
-		if len(ethIf.network) > 0 {
+		ethIf.addSharedMembers(cfg, networkKey, d)
+		if len(ethIf.network) > 0 || len(ethIf.network6) > 0 {
 			d.intsNet = append(d.intsNet, ethIf)
 		}
 	}
@@ -207,8 +286,9 @@ func (d *Interfaces) readConfig() {
 		if result[i] == "" {
 			continue
 		}
-		var ethIf Interface
+		ethIf := &Interface{}
 		ethIf.InterfaceType = "relay"
+		ethIf.circuitIDTemplate = cfg.Section("interfaces").Key("relay_circuit_id").String()
 
 		interfaceConfig := strings.Split(result[i], ":")
 		if len(interfaceConfig) < 2 {
@@ -239,6 +319,99 @@ func (d *Interfaces) readConfig() {
 		}
 		d.intsNet = append(d.intsNet, ethIf)
 	}
+	return nil
+}
+
+// newNetwork builds the scope of a network section, served from serverIP on
+// the interface ifName
+func newNetwork(key string, sec *ini.Section, network string, ranges []*poolRange, serverIP net.IP, ifName string) Network {
+	var DHCPNet Network
+	var DHCPScope *DHCPHandler
+	DHCPScope = &DHCPHandler{}
+	DHCPNet.network.IP = net.ParseIP(network)
+	DHCPNet.network.Mask = net.IPMask(net.ParseIP(sec.Key("netmask").String()))
+	DHCPNet.shared = sec.Key("shared_network").String()
+	DHCPScope.ip = serverIP.To4()
+	DHCPScope.network = network
+
+	DHCPScope.role = "none"
+	DHCPScope.signature = scopeSignature(sec, DHCPScope.ip)
+	seconds, _ := strconv.Atoi(sec.Key("dhcp_default_lease_time").String())
+	DHCPScope.leaseDuration = time.Duration(seconds) * time.Second
+	DHCPScope.minLeaseDuration, DHCPScope.maxLeaseDuration = leaseBounds(sec, DHCPScope.leaseDuration)
+	algorithm, err := readAlgorithm(sec)
+	if err != nil {
+		log.LoggerWContext(ctx).Error("Addresses handed out at random, check your network " + key + ": " + err.Error())
+	}
+	// Initialize the pools of the ranges
+	DHCPScope.available = newRangePool(ranges, algorithm)
+	stickiness, err := readStickiness(sec)
+	if err != nil {
+		log.LoggerWContext(ctx).Error("Stickiness disabled, check your network " + key + ": " + err.Error())
+	}
+	DHCPScope.available.setStickiness(stickiness)
+	DHCPScope.leaseRange = DHCPScope.available.capacity
+
+	// Initialize hardware cache
+	hwcache := cache.New(time.Duration(seconds)*time.Second, 10*time.Second)
+
+	networkIP := DHCPNet.network.IP.String()
+	hwcache.OnEvicted(func(nic string, pool interface{}) {
+		go func() {
+			// The binding is gone, forget the persisted lease. There is none
+			// for an offer never acknowledged, nor for a binding released,
+			// declined or dropped by the partner, which unbound it already.
+			err := DeleteLease(networkIP, nic)
+			if err != nil && err != sql.ErrNoRows {
+				log.LoggerWContext(ctx).Error("Unable to delete the lease of " + nic + ": " + err.Error())
+			}
+			// The partner ends the bindings it made and reports them itself
+			if !DHCPScope.takePeerBound(nic) && err != sql.ErrNoRows {
+				DHCPScope.unbind(networkIP, nic, DHCPScope.ipAt(pool.(int)), leaseEndExpired)
+				publishLeaseEvent(EventExpiry, ifName, networkIP, nic, DHCPScope.ipAt(pool.(int)), "", 0)
+			}
+			// Always wait 30 seconds before releasing the IP again
+			time.Sleep(30 * time.Second)
+			log.LoggerWContext(ctx).Info(nic + " " + DHCPScope.ipAt(pool.(int)).String() + " Added back in the pool " + DHCPScope.role + " on index " + strconv.Itoa(pool.(int)))
+			freeIndex(DHCPScope, pool.(int))
+		}()
+	})
+
+	DHCPScope.hwcache = hwcache
+	DHCPScope.clients = cache.New(time.Duration(seconds)*time.Second, 10*time.Minute)
+	DHCPScope.peerBound = cache.New(cache.NoExpiration, 0)
+
+	xid := cache.New(time.Duration(4)*time.Second, 2*time.Second)
+
+	DHCPScope.xid = xid
+	DHCPScope.exclusions = newExclusionSet()
+	ExcludeIP(DHCPScope, sec.Key("ip_reserved").String())
+	loadExclusions(DHCPScope, networkIP)
+	DHCPScope.ipAssigned, _ = AssignIP(DHCPScope, sec.Key("ip_assigned").String())
+	DHCPScope.circuitAssigned = AssignRelayAgentIP(DHCPScope, sec.Key("ip_assigned_circuit_id").String())
+	DHCPScope.remoteAssigned = AssignRelayAgentIP(DHCPScope, sec.Key("ip_assigned_remote_id").String())
+	DHCPScope.layer2 = true
+	loadReservations(DHCPScope, networkIP)
+	restoreLeases(DHCPScope, networkIP)
+	failover.claim(DHCPScope)
+	var options = make(map[dhcp.OptionCode][]byte)
+
+	options[dhcp.OptionSubnetMask] = []byte(net.ParseIP(sec.Key("netmask").String()).To4())
+	options[dhcp.OptionDomainNameServer] = ShuffleDNS(sec)
+	options[dhcp.OptionRouter] = ShuffleGateway(sec)
+	options[dhcp.OptionDomainName] = []byte(sec.Key("domain-name").String())
+	DHCPScope.options = options
+	DHCPScope.boot = readBootConfig(sec)
+	if DHCPScope.policy, err = readClientPolicy(sec); err != nil {
+		// Fail closed rather than serve every client
+		log.LoggerWContext(ctx).Error("Only the known clients are served, check your network " + key + ": " + err.Error())
+		DHCPScope.policy = &clientPolicy{mode: policyKnown}
+	}
+	if DHCPScope.ddns, err = readDDNSConfig(sec, DHCPNet.network); err != nil {
+		log.LoggerWContext(ctx).Error("Dynamic DNS disabled, check your network " + key + ": " + err.Error())
+	}
+	DHCPNet.dhcpHandler = DHCPScope
+	return DHCPNet
 }
 
 // AssignIP static IP address to a mac address and remove it from the pool
@@ -259,7 +432,12 @@ func AssignIP(dhcpHandler *DHCPHandler, ipRange string) (map[string]uint32, []ne
 					log.LoggerWContext(ctx).Error("Invalid IP assignment format: " + rangeip)
 					continue
 				}
-				position := uint32(binary.BigEndian.Uint32(net.ParseIP(result[2]).To4())) - uint32(binary.BigEndian.Uint32(dhcpHandler.start.To4()))
+				index := dhcpHandler.indexOf(net.ParseIP(result[2]))
+				if index < 0 {
+					log.LoggerWContext(ctx).Error("IP assignment outside of the ranges of the network: " + rangeip)
+					continue
+				}
+				position := uint32(index)
 				// Remove the position in the roaming bitmap
 				dhcpHandler.available.ReserveIPIndex(safeUint32ToUint64(position), result[1])
 				couple[result[1]] = position
@@ -6,7 +6,6 @@ import (
 	"testing"
 
 	dhcp "github.com/krolaw/dhcp4"
-	"github.com/fdurand/standalone_dhcp/pool"
 )
 
 func TestAssignIP(t *testing.T) {
@@ -14,10 +13,9 @@ func TestAssignIP(t *testing.T) {
 	startIP := net.ParseIP("192.168.1.10").To4()
 	endIP := net.ParseIP("192.168.1.254").To4()
 	poolSize := uint64(dhcp.IPRange(startIP, endIP))
-	available := pool.NewDHCPPool(poolSize, 1)
+	available := newTestRangePool(startIP, int(poolSize))
 
 	handler := &DHCPHandler{
-		start:     startIP,
 		available: available,
 	}
 
@@ -66,7 +64,7 @@ func TestAssignIP(t *testing.T) {
 			// Verify MAC to position mapping
 			if tt.expectedCount > 0 {
 				for mac, position := range macToIP {
-					expectedIP := binary.BigEndian.Uint32(handler.start) + position
+					expectedIP := binary.BigEndian.Uint32(startIP) + position
 					calculatedIP := make(net.IP, 4)
 					binary.BigEndian.PutUint32(calculatedIP, expectedIP)
 
@@ -92,10 +90,9 @@ func TestAssignIPPosition(t *testing.T) {
 	startIP := net.ParseIP("192.168.1.10").To4()
 	endIP := net.ParseIP("192.168.1.254").To4()
 	poolSize := uint64(dhcp.IPRange(startIP, endIP))
-	available := pool.NewDHCPPool(poolSize, 1)
+	available := newTestRangePool(startIP, int(poolSize))
 
 	handler := &DHCPHandler{
-		start:     startIP,
 		available: available,
 	}
 
@@ -104,7 +101,7 @@ func TestAssignIPPosition(t *testing.T) {
 
 	// Calculate expected position
 	expectedPos := uint32(binary.BigEndian.Uint32(net.ParseIP("192.168.1.100").To4())) -
-		uint32(binary.BigEndian.Uint32(handler.start))
+		uint32(binary.BigEndian.Uint32(startIP))
 
 	if position, exists := macToIP["aa:bb:cc:dd:ee:ff"]; exists {
 		if position != expectedPos {
@@ -4,7 +4,6 @@ import (
 	"database/sql"
 	"encoding/binary"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"net"
 	"strconv"
@@ -22,12 +21,22 @@ var (
 	dbMutex sync.RWMutex
 
 	// overrideCache memoizes option override lookups so the DHCP hot path does
-	// not hit SQLite on every packet. A nil value is a valid (negative) entry
-	// meaning "no override exists for this target". Invalidated on writes.
-	overrideCache   = make(map[string]*OptionOverride)
+	// not hit the lease store on every packet. A nil override is a valid
+	// (negative) entry meaning "no override exists for this target".
+	// Invalidated on writes.
+	overrideCache   = make(map[string]cachedOverride)
 	overrideCacheMu sync.RWMutex
+	// overrideCacheTTL bounds the age of the entries, zero keeps them until
+	// they are invalidated
+	overrideCacheTTL time.Duration
 )
 
+// cachedOverride is an entry of the override cache
+type cachedOverride struct {
+	override *OptionOverride
+	expires  time.Time // Zero when the entry does not expire
+}
+
 func overrideCacheKey(overrideType, target string) string {
 	return overrideType + "\x00" + target
 }
@@ -45,9 +54,10 @@ func cachedGetOptionOverride(overrideType, target string) (*OptionOverride, erro
 
 	overrideCacheMu.RLock()
 	cached, ok := overrideCache[key]
+	ttl := overrideCacheTTL
 	overrideCacheMu.RUnlock()
-	if ok {
-		return cached, nil
+	if ok && (cached.expires.IsZero() || time.Now().Before(cached.expires)) {
+		return cached.override, nil
 	}
 
 	override, err := GetOptionOverride(overrideType, target)
@@ -55,13 +65,26 @@ func cachedGetOptionOverride(overrideType, target string) (*OptionOverride, erro
 		return nil, err
 	}
 
+	entry := cachedOverride{override: override}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
 	overrideCacheMu.Lock()
-	overrideCache[key] = override
+	overrideCache[key] = entry
 	overrideCacheMu.Unlock()
 
 	return override, nil
 }
 
+// resetOverrideCache empties the override cache and sets the age of its
+// entries
+func resetOverrideCache(ttl time.Duration) {
+	overrideCacheMu.Lock()
+	overrideCache = make(map[string]cachedOverride)
+	overrideCacheTTL = ttl
+	overrideCacheMu.Unlock()
+}
+
 // DHCPOption represents a DHCP option override
 type DHCPOption struct {
 	OptionCode  int    `json:"option_code"`
@@ -79,13 +102,15 @@ type OptionOverride struct {
 	UpdatedAt time.Time    `json:"updated_at"`
 }
 
-// InitDatabase initializes the SQLite database for option overrides
+// InitDatabase initializes the SQLite database, it stores the option
+// overrides and the leases until openLeaseStore selects another backend
 func InitDatabase(dbPath string) error {
 	var err error
 	db, err = sql.Open("sqlite3", dbPath)
 	if err != nil {
 		return fmt.Errorf("failed to open database: %w", err)
 	}
+	forgetAPICredentialCount()
 
 	// Set connection pool settings
 	db.SetMaxOpenConns(25)
@@ -105,24 +130,134 @@ func InitDatabase(dbPath string) error {
 	);
 
 	CREATE INDEX IF NOT EXISTS idx_type_target ON dhcp_option_overrides(type, target);
+
+	CREATE TABLE IF NOT EXISTS dhcp_leases (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		mac TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		network TEXT NOT NULL,
+		hostname TEXT NOT NULL DEFAULT '',
+		expires_at DATETIME NOT NULL,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		dns_name TEXT NOT NULL DEFAULT '',
+		dns_forward BOOLEAN NOT NULL DEFAULT 0,
+		partner BOOLEAN NOT NULL DEFAULT 0,
+		UNIQUE(network, mac)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_leases_network_ip ON dhcp_leases(network, ip);
+	CREATE INDEX IF NOT EXISTS idx_leases_expires_at ON dhcp_leases(expires_at);
+
+	CREATE TABLE IF NOT EXISTS dhcp_lease_history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		mac TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		network TEXT NOT NULL,
+		interface TEXT NOT NULL DEFAULT '',
+		hostname TEXT NOT NULL DEFAULT '',
+		started_at DATETIME NOT NULL,
+		renewed_at DATETIME NOT NULL,
+		ended_at DATETIME,
+		end_reason TEXT NOT NULL DEFAULT ''
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_lease_history_mac ON dhcp_lease_history(mac, started_at);
+	CREATE INDEX IF NOT EXISTS idx_lease_history_open ON dhcp_lease_history(network, mac, ended_at);
+
+	CREATE TABLE IF NOT EXISTS dhcp_reservations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		mac TEXT NOT NULL UNIQUE,
+		ip TEXT NOT NULL UNIQUE,
+		network TEXT NOT NULL,
+		hostname TEXT NOT NULL DEFAULT '',
+		options TEXT NOT NULL DEFAULT '[]',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS dhcp_exclusions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		network TEXT NOT NULL,
+		start_ip TEXT NOT NULL,
+		end_ip TEXT NOT NULL,
+		comment TEXT NOT NULL DEFAULT '',
+		expires_at DATETIME NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_exclusions_network ON dhcp_exclusions(network);
+
+	CREATE TABLE IF NOT EXISTS dhcp_client_classes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		definition TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS dhcp_mac_lists (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		list TEXT NOT NULL CHECK(list IN ('allow', 'deny')),
+		pattern TEXT NOT NULL,
+		network TEXT NOT NULL DEFAULT '',
+		comment TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(list, pattern, network)
+	);
+
+	CREATE TABLE IF NOT EXISTS dhcp_api_users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL UNIQUE,
+		password_hash TEXT NOT NULL,
+		role TEXT NOT NULL CHECK(role IN ('readonly', 'admin')),
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS dhcp_api_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		token_hash TEXT NOT NULL UNIQUE,
+		role TEXT NOT NULL CHECK(role IN ('readonly', 'admin')),
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
 	`
 
 	_, err = db.Exec(schema)
 	if err != nil {
 		return fmt.Errorf("failed to create schema: %w", err)
 	}
+	if err = upgradeLeaseTable(db); err != nil {
+		return err
+	}
+
+	if store != nil {
+		store.Close()
+	}
+	store = newSQLiteStore(db)
 
 	// The override cache mirrors the database; reopening the database must
 	// start from a clean cache.
-	overrideCacheMu.Lock()
-	overrideCache = make(map[string]*OptionOverride)
-	overrideCacheMu.Unlock()
+	resetOverrideCache(0)
+
+	// Same for the client classes it defines
+	if err = loadClientClasses(); err != nil {
+		return fmt.Errorf("failed to load client classes: %w", err)
+	}
+	if err = loadMACLists(); err != nil {
+		return fmt.Errorf("failed to load the mac lists: %w", err)
+	}
 
 	return nil
 }
 
-// CloseDatabase closes the database connection
+// CloseDatabase closes the database connection and the lease store
 func CloseDatabase() error {
+	if store != nil {
+		store.Close()
+		store = nil
+	}
 	if db != nil {
 		return db.Close()
 	}
@@ -131,25 +266,8 @@ func CloseDatabase() error {
 
 // SaveOptionOverride saves or updates an option override
 func SaveOptionOverride(overrideType, target string, options []DHCPOption) error {
-	dbMutex.Lock()
-	defer dbMutex.Unlock()
-
-	optionsJSON, err := json.Marshal(options)
-	if err != nil {
-		return fmt.Errorf("failed to marshal options: %w", err)
-	}
-
-	query := `
-		INSERT INTO dhcp_option_overrides (type, target, options, updated_at)
-		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
-		ON CONFLICT(type, target) DO UPDATE SET
-			options = excluded.options,
-			updated_at = CURRENT_TIMESTAMP
-	`
-
-	_, err = db.Exec(query, overrideType, target, string(optionsJSON))
-	if err != nil {
-		return fmt.Errorf("failed to save option override: %w", err)
+	if err := store.SaveOptionOverride(overrideType, target, options); err != nil {
+		return err
 	}
 
 	invalidateOverrideCache(overrideType, target)
@@ -159,61 +277,13 @@ func SaveOptionOverride(overrideType, target string, options []DHCPOption) error
 
 // GetOptionOverride retrieves an option override
 func GetOptionOverride(overrideType, target string) (*OptionOverride, error) {
-	dbMutex.RLock()
-	defer dbMutex.RUnlock()
-
-	query := `
-		SELECT id, type, target, options, created_at, updated_at
-		FROM dhcp_option_overrides
-		WHERE type = ? AND target = ?
-	`
-
-	var override OptionOverride
-	var optionsJSON string
-
-	err := db.QueryRow(query, overrideType, target).Scan(
-		&override.ID,
-		&override.Type,
-		&override.Target,
-		&optionsJSON,
-		&override.CreatedAt,
-		&override.UpdatedAt,
-	)
-
-	if err == sql.ErrNoRows {
-		return nil, nil
-	}
-	if err != nil {
-		return nil, fmt.Errorf("failed to get option override: %w", err)
-	}
-
-	err = json.Unmarshal([]byte(optionsJSON), &override.Options)
-	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal options: %w", err)
-	}
-
-	return &override, nil
+	return store.GetOptionOverride(overrideType, target)
 }
 
 // DeleteOptionOverride deletes an option override
 func DeleteOptionOverride(overrideType, target string) error {
-	dbMutex.Lock()
-	defer dbMutex.Unlock()
-
-	query := `DELETE FROM dhcp_option_overrides WHERE type = ? AND target = ?`
-
-	result, err := db.Exec(query, overrideType, target)
-	if err != nil {
-		return fmt.Errorf("failed to delete option override: %w", err)
-	}
-
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return fmt.Errorf("failed to get rows affected: %w", err)
-	}
-
-	if rowsAffected == 0 {
-		return sql.ErrNoRows
+	if err := store.DeleteOptionOverride(overrideType, target); err != nil {
+		return err
 	}
 
 	invalidateOverrideCache(overrideType, target)
@@ -223,61 +293,7 @@ func DeleteOptionOverride(overrideType, target string) error {
 
 // ListOptionOverrides lists all option overrides
 func ListOptionOverrides(overrideType string) ([]OptionOverride, error) {
-	dbMutex.RLock()
-	defer dbMutex.RUnlock()
-
-	var query string
-	var args []interface{}
-
-	if overrideType != "" {
-		query = `
-			SELECT id, type, target, options, created_at, updated_at
-			FROM dhcp_option_overrides
-			WHERE type = ?
-			ORDER BY created_at DESC
-		`
-		args = append(args, overrideType)
-	} else {
-		query = `
-			SELECT id, type, target, options, created_at, updated_at
-			FROM dhcp_option_overrides
-			ORDER BY type, created_at DESC
-		`
-	}
-
-	rows, err := db.Query(query, args...)
-	if err != nil {
-		return nil, fmt.Errorf("failed to list option overrides: %w", err)
-	}
-	defer rows.Close()
-
-	var overrides []OptionOverride
-
-	for rows.Next() {
-		var override OptionOverride
-		var optionsJSON string
-
-		err := rows.Scan(
-			&override.ID,
-			&override.Type,
-			&override.Target,
-			&optionsJSON,
-			&override.CreatedAt,
-			&override.UpdatedAt,
-		)
-		if err != nil {
-			return nil, fmt.Errorf("failed to scan row: %w", err)
-		}
-
-		err = json.Unmarshal([]byte(optionsJSON), &override.Options)
-		if err != nil {
-			return nil, fmt.Errorf("failed to unmarshal options: %w", err)
-		}
-
-		overrides = append(overrides, override)
-	}
-
-	return overrides, nil
+	return store.ListOptionOverrides(overrideType)
 }
 
 // ConvertOptionToDHCP converts a DHCPOption to dhcp.Options format
@@ -362,6 +378,12 @@ func ConvertOptionToDHCP(option DHCPOption) (dhcp.OptionCode, []byte, error) {
 
 // ApplyOptionOverrides applies option overrides to DHCP options
 func ApplyOptionOverrides(options dhcp.Options, networkIP, mac string) dhcp.Options {
+	return applyOptionOverrides(options, networkIP, mac, nil)
+}
+
+// applyOptionOverrides applies the network overrides, then the options of the
+// client class and the MAC overrides
+func applyOptionOverrides(options dhcp.Options, networkIP, mac string, class *ClientClass) dhcp.Options {
 	// Create a copy to avoid modifying the original
 	result := make(dhcp.Options)
 	for k, v := range options {
@@ -383,6 +405,8 @@ func ApplyOptionOverrides(options dhcp.Options, networkIP, mac string) dhcp.Opti
 		}
 	}
 
+	class.apply(result)
+
 	// Apply MAC-level overrides (these take precedence)
 	if mac != "" {
 		macOverride, err := cachedGetOptionOverride("mac", mac)
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ini/ini"
+	"github.com/inverse-inc/packetfence/go/log"
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/miekg/dns"
+)
+
+// OptionClientFQDN is the Client FQDN option (RFC 4702)
+const OptionClientFQDN dhcp.OptionCode = 81
+
+// Flags of the Client FQDN option
+const (
+	fqdnFlagS = 0x01 // The server performs the A update
+	fqdnFlagO = 0x02 // The server overrode the preference of the client
+	fqdnFlagE = 0x04 // The domain name is in the DNS wire format
+	fqdnFlagN = 0x08 // The server performs no update
+)
+
+// tsigFudge is the time difference allowed with the DNS server, in seconds
+const tsigFudge = 300
+
+// tsigAlgorithms are the supported TSIG algorithms
+var tsigAlgorithms = map[string]bool{
+	dns.HmacMD5:    true,
+	dns.HmacSHA1:   true,
+	dns.HmacSHA256: true,
+	dns.HmacSHA512: true,
+}
+
+// tsigKey signs the UPDATE messages
+type tsigKey struct {
+	name      string
+	algorithm string
+	secret    []byte
+}
+
+// ddnsRecord is a name registered for a client
+type ddnsRecord struct {
+	fqdn    string
+	ip      net.IP
+	forward bool // The A record was added, not only the PTR record
+	ttl     uint32
+}
+
+// ddnsConfig holds the dynamic DNS settings of a scope and the names it
+// registered
+type ddnsConfig struct {
+	server      string   // DNS server receiving the updates, host:port
+	zone        string   // Forward zone, fully qualified
+	reverseZone string   // Reverse zone, fully qualified
+	ttl         uint32   // TTL of the records, half the lease when 0
+	override    bool     // Update the A record even when the client wants to do it
+	key         *tsigKey // Nil when the updates are not signed
+	timeout     time.Duration
+	lock        sync.Mutex
+	records     map[string]ddnsRecord // Registered names by MAC
+}
+
+// readDDNSConfig reads the ddns_ keys of a network, it returns nil when the
+// dynamic DNS updates are not configured
+func readDDNSConfig(sec *ini.Section, network net.IPNet) (*ddnsConfig, error) {
+	server := sec.Key("ddns_server").String()
+	zone := sec.Key("ddns_zone").String()
+	if server == "" || zone == "" {
+		return nil, nil
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	d := &ddnsConfig{
+		server:      server,
+		zone:        fqdn(zone),
+		reverseZone: fqdn(sec.Key("ddns_reverse_zone").String()),
+		override:    sec.Key("ddns_override_client_update").String() == "enabled",
+		timeout:     2 * time.Second,
+		records:     make(map[string]ddnsRecord),
+	}
+	if d.reverseZone == "." {
+		d.reverseZone = reverseZone(network)
+	}
+	if value := sec.Key("ddns_ttl").String(); value != "" {
+		ttl, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ddns_ttl %s", value)
+		}
+		d.ttl = uint32(ttl)
+	}
+	if name := sec.Key("ddns_tsig_name").String(); name != "" {
+		secret, err := base64.StdEncoding.DecodeString(sec.Key("ddns_tsig_secret").String())
+		if err != nil || len(secret) == 0 {
+			return nil, errors.New("invalid ddns_tsig_secret, it must be encoded in base64")
+		}
+		algorithm := fqdn(sec.Key("ddns_tsig_algorithm").MustString("hmac-sha256"))
+		if algorithm == "hmac-md5." {
+			algorithm = dns.HmacMD5
+		}
+		if !tsigAlgorithms[algorithm] {
+			return nil, errors.New("unsupported ddns_tsig_algorithm " + algorithm)
+		}
+		d.key = &tsigKey{name: fqdn(name), algorithm: algorithm, secret: secret}
+	}
+	return d, nil
+}
+
+// fqdn returns a name, lowercased and fully qualified
+func fqdn(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".") + "."
+}
+
+// reverseZone returns the in-addr.arpa zone of the whole octets of a network
+func reverseZone(network net.IPNet) string {
+	ip := network.IP.To4()
+	ones, _ := network.Mask.Size()
+	octets := ones / 8
+	if octets == 0 {
+		octets = 1
+	}
+	zone := "in-addr.arpa."
+	for i := 0; i < octets && i < len(ip); i++ {
+		zone = strconv.Itoa(int(ip[i])) + "." + zone
+	}
+	return zone
+}
+
+// reverseName returns the PTR name of an address
+func reverseName(ip net.IP) string {
+	ip = ip.To4()
+	return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", ip[3], ip[2], ip[1], ip[0])
+}
+
+// hostLabel returns the first label of a name with the characters DNS
+// does not allow in a host name removed
+func hostLabel(name string) string {
+	label, _, _ := strings.Cut(strings.ToLower(name), ".")
+	var b strings.Builder
+	for _, c := range label {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' {
+			b.WriteRune(c)
+		}
+	}
+	result := strings.Trim(b.String(), "-")
+	if len(result) > 63 {
+		result = result[:63]
+	}
+	return result
+}
+
+// clientFQDN is the Client FQDN option sent by a client
+type clientFQDN struct {
+	flags byte
+	name  string
+}
+
+// parseClientFQDN decodes an option 81, it returns nil when absent or
+// malformed
+func parseClientFQDN(b []byte) *clientFQDN {
+	if len(b) < 3 {
+		return nil
+	}
+	option := &clientFQDN{flags: b[0]}
+	if option.flags&fqdnFlagE == 0 {
+		option.name = string(b[3:])
+		return option
+	}
+	var labels []string
+	for i := 3; i < len(b) && b[i] != 0; {
+		length := int(b[i])
+		if length > 63 || i+1+length > len(b) {
+			return nil
+		}
+		labels = append(labels, string(b[i+1:i+1+length]))
+		i += 1 + length
+	}
+	option.name = strings.Join(labels, ".")
+	return option
+}
+
+// replyFQDN builds the option 81 of a reply, in the encoding the client used
+func replyFQDN(flags byte, name string) []byte {
+	b := []byte{flags, 255, 255}
+	if flags&fqdnFlagE == 0 {
+		return append(b, strings.TrimSuffix(name, ".")...)
+	}
+	encoded, _ := appendName(b, name)
+	return encoded
+}
+
+// register adds the name of a client acknowledged on ip and returns the
+// option 81 of the reply, nil when the client did not send one. The updates
+// are sent in the background.
+func (d *ddnsConfig) register(ctx context.Context, mac string, ip net.IP, options dhcp.Options, lease time.Duration) []byte {
+	if d == nil {
+		return nil
+	}
+	record := ddnsRecord{ip: ip.To4(), forward: true, ttl: d.ttl}
+	if record.ttl == 0 {
+		record.ttl = uint32(lease / time.Second / 2)
+	}
+	name := string(options[dhcp.OptionHostName])
+	option := parseClientFQDN(options[OptionClientFQDN])
+	var flags byte
+	if option != nil {
+		name = option.name
+		flags = option.flags & fqdnFlagE
+		switch {
+		case option.flags&fqdnFlagN != 0:
+			// The client does not want the server to update anything, not
+			// even to keep a name registered on an earlier ACK
+			d.forget(ctx, mac)
+			return replyFQDN(flags|fqdnFlagN, name)
+		case option.flags&fqdnFlagS != 0:
+			flags |= fqdnFlagS
+		case d.override:
+			flags |= fqdnFlagS | fqdnFlagO
+		default:
+			// The client updates its A record itself
+			record.forward = false
+		}
+	}
+	label := hostLabel(name)
+	if label == "" {
+		d.forget(ctx, mac)
+		return nil
+	}
+	record.fqdn = label + "." + d.zone
+	var reply []byte
+	if option != nil {
+		reply = replyFQDN(flags, record.fqdn)
+	}
+
+	d.lock.Lock()
+	previous, found := d.records[mac]
+	d.records[mac] = record
+	d.lock.Unlock()
+	if found && previous.fqdn == record.fqdn && previous.ip.Equal(record.ip) && previous.forward == record.forward {
+		return reply
+	}
+	go func() {
+		if found {
+			d.logError(ctx, d.remove(previous))
+		}
+		if err := d.add(record); err != nil {
+			d.logError(ctx, err)
+		} else {
+			log.LoggerWContext(ctx).Info("Registered " + record.fqdn + " for " + record.ip.String() + " in DNS")
+		}
+	}()
+	return reply
+}
+
+// unregister removes the name registered for a client, if any
+func (d *ddnsConfig) unregister(ctx context.Context, mac string) {
+	if d == nil {
+		return
+	}
+	record, found := d.drop(mac)
+	if !found {
+		return
+	}
+	if err := d.remove(record); err != nil {
+		d.logError(ctx, err)
+	} else {
+		log.LoggerWContext(ctx).Info("Removed " + record.fqdn + " for " + record.ip.String() + " from DNS")
+	}
+}
+
+// forget removes the name registered for a client in the background
+func (d *ddnsConfig) forget(ctx context.Context, mac string) {
+	if record, found := d.drop(mac); found {
+		go func() {
+			d.logError(ctx, d.remove(record))
+		}()
+	}
+}
+
+// drop deletes the name registered for a client from the records and
+// returns it
+func (d *ddnsConfig) drop(mac string) (ddnsRecord, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	record, found := d.records[mac]
+	delete(d.records, mac)
+	return record, found
+}
+
+// registered returns the name registered for a client, the empty name and
+// false when there is none
+func (d *ddnsConfig) registered(mac string) (string, bool) {
+	if d == nil {
+		return "", false
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	record := d.records[mac]
+	return record.fqdn, record.forward
+}
+
+// restore records the name a client got before a restart or a reload
+// without updating the DNS server, so it is removed when the lease ends
+func (d *ddnsConfig) restore(mac string, ip net.IP, name string, forward bool) {
+	if d == nil || name == "" {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.records[mac] = ddnsRecord{fqdn: name, ip: ip.To4(), forward: forward}
+}
+
+func (d *ddnsConfig) logError(ctx context.Context, err error) {
+	if err != nil {
+		log.LoggerWContext(ctx).Error("Dynamic DNS update failed: " + err.Error())
+	}
+}
+
+// add replaces the A record of the name and the PTR record of the address
+func (d *ddnsConfig) add(record ddnsRecord) error {
+	if record.forward {
+		msg := new(dns.Msg)
+		msg.SetUpdate(d.zone)
+		msg.RemoveRRset([]dns.RR{&dns.A{Hdr: dns.RR_Header{Name: record.fqdn, Rrtype: dns.TypeA, Class: dns.ClassINET}}})
+		msg.Insert([]dns.RR{&dns.A{Hdr: dns.RR_Header{Name: record.fqdn, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: record.ttl}, A: record.ip}})
+		if err := d.update(msg); err != nil {
+			return fmt.Errorf("failed to add %s: %w", record.fqdn, err)
+		}
+	}
+	msg := new(dns.Msg)
+	msg.SetUpdate(d.reverseZone)
+	msg.RemoveRRset([]dns.RR{&dns.PTR{Hdr: dns.RR_Header{Name: reverseName(record.ip), Rrtype: dns.TypePTR, Class: dns.ClassINET}}})
+	msg.Insert([]dns.RR{&dns.PTR{Hdr: dns.RR_Header{Name: reverseName(record.ip), Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: record.ttl}, Ptr: record.fqdn}})
+	if err := d.update(msg); err != nil {
+		return fmt.Errorf("failed to add the PTR record of %s: %w", record.ip, err)
+	}
+	return nil
+}
+
+// remove deletes the A record of the name, only for this address, and the
+// PTR record of the address
+func (d *ddnsConfig) remove(record ddnsRecord) error {
+	if record.forward {
+		msg := new(dns.Msg)
+		msg.SetUpdate(d.zone)
+		msg.Remove([]dns.RR{&dns.A{Hdr: dns.RR_Header{Name: record.fqdn, Rrtype: dns.TypeA, Class: dns.ClassINET}, A: record.ip}})
+		if err := d.update(msg); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", record.fqdn, err)
+		}
+	}
+	msg := new(dns.Msg)
+	msg.SetUpdate(d.reverseZone)
+	msg.RemoveRRset([]dns.RR{&dns.PTR{Hdr: dns.RR_Header{Name: reverseName(record.ip), Rrtype: dns.TypePTR, Class: dns.ClassINET}}})
+	if err := d.update(msg); err != nil {
+		return fmt.Errorf("failed to remove the PTR record of %s: %w", record.ip, err)
+	}
+	return nil
+}
+
+// update sends an UPDATE message, signed when a key is set, and checks its
+// answer. The client verifies the TSIG of a signed answer; an unsigned one
+// is only accepted when it reports an error. A truncated answer is retried
+// over TCP.
+func (d *ddnsConfig) update(msg *dns.Msg) error {
+	client := &dns.Client{Net: "udp", Timeout: d.timeout}
+	if d.key != nil {
+		msg.SetTsig(d.key.name, d.key.algorithm, tsigFudge, time.Now().Unix())
+		client.TsigSecret = map[string]string{d.key.name: base64.StdEncoding.EncodeToString(d.key.secret)}
+	}
+	answer, _, err := client.Exchange(msg, d.server)
+	if err == nil && answer.Truncated {
+		client.Net = "tcp"
+		answer, _, err = client.Exchange(msg, d.server)
+	}
+	if err != nil {
+		return err
+	}
+	if answer.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("the DNS server answered with rcode %d (%s)", answer.Rcode, dns.RcodeToString[answer.Rcode])
+	}
+	if d.key != nil && answer.IsTsig() == nil {
+		return errors.New("the answer of the DNS server is not signed")
+	}
+	return nil
+}
+
+// appendName appends a name in the DNS wire format, without compression
+func appendName(b []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > 253 {
+		return nil, errors.New("name too long: " + name)
+	}
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if label == "" || len(label) > 63 {
+				return nil, errors.New("invalid name: " + name)
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0), nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+	dhcp "github.com/krolaw/dhcp4"
+	"github.com/miekg/dns"
+)
+
+// stubUpdate is an UPDATE message received by the DNS stub
+type stubUpdate struct {
+	zone   string
+	rrs    []dns.RR
+	signed bool
+}
+
+// startDNSStub answers the UPDATE messages it receives, refusing the ones
+// not signed with key when it is set and signing its answers with it
+func startDNSStub(t *testing.T, key *tsigKey) (string, chan stubUpdate) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	updates := make(chan stubUpdate, 16)
+	server := &dns.Server{PacketConn: conn, MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept }}
+	if key != nil {
+		server.TsigSecret = map[string]string{key.name: base64.StdEncoding.EncodeToString(key.secret)}
+	}
+	server.Handler = dns.HandlerFunc(func(w dns.ResponseWriter, msg *dns.Msg) {
+		update := stubUpdate{zone: msg.Question[0].Name, rrs: msg.Ns}
+		answer := new(dns.Msg)
+		answer.SetReply(msg)
+		if key != nil {
+			update.signed = msg.IsTsig() != nil && w.TsigStatus() == nil
+			if update.signed {
+				answer.SetTsig(key.name, key.algorithm, tsigFudge, time.Now().Unix())
+			} else {
+				answer.Rcode = dns.RcodeNotAuth
+			}
+		}
+		w.WriteMsg(answer)
+		updates <- update
+	})
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return conn.LocalAddr().String(), updates
+}
+
+func waitUpdate(t *testing.T, updates chan stubUpdate) stubUpdate {
+	select {
+	case update := <-updates:
+		return update
+	case <-time.After(2 * time.Second):
+		t.Fatal("No update received")
+	}
+	return stubUpdate{}
+}
+
+func TestReadDDNSConfig(t *testing.T) {
+	cfg, _ := ini.Load([]byte(`
+[network 192.168.1.0]
+ddns_server=10.0.0.53
+ddns_zone=Example.org
+ddns_tsig_name=dhcp-key
+ddns_tsig_secret=c2VjcmV0
+ddns_tsig_algorithm=hmac-sha512
+
+[network 192.168.2.0]
+ddns_server=10.0.0.53
+ddns_zone=example.org
+ddns_tsig_name=dhcp-key
+ddns_tsig_secret=c2VjcmV0
+ddns_tsig_algorithm=hmac-sha384
+
+[network 192.168.3.0]
+dns=10.0.0.53
+`))
+	_, network, _ := net.ParseCIDR("192.168.1.0/24")
+	d, err := readDDNSConfig(cfg.Section("network 192.168.1.0"), *network)
+	if err != nil || d == nil {
+		t.Fatalf("readDDNSConfig failed: %v", err)
+	}
+	if d.server != "10.0.0.53:53" || d.zone != "example.org." || d.reverseZone != "1.168.192.in-addr.arpa." {
+		t.Errorf("Unexpected configuration %+v", d)
+	}
+	if d.key == nil || d.key.name != "dhcp-key." || d.key.algorithm != "hmac-sha512." || string(d.key.secret) != "secret" {
+		t.Errorf("Unexpected TSIG key %+v", d.key)
+	}
+	if _, err := readDDNSConfig(cfg.Section("network 192.168.2.0"), *network); err == nil {
+		t.Error("Expected an unsupported algorithm to be refused")
+	}
+	if d, _ := readDDNSConfig(cfg.Section("network 192.168.3.0"), *network); d != nil {
+		t.Error("Expected dynamic DNS to be disabled")
+	}
+}
+
+func TestParseClientFQDN(t *testing.T) {
+	if option := parseClientFQDN([]byte("\x05\x00\x00\x06laptop\x07example\x03org\x00")); option == nil || option.name != "laptop.example.org" || option.flags != fqdnFlagS|fqdnFlagE {
+		t.Errorf("Unexpected option %+v", option)
+	}
+	if option := parseClientFQDN([]byte("\x00\x00\x00laptop")); option == nil || option.name != "laptop" {
+		t.Errorf("Unexpected option %+v", option)
+	}
+	if parseClientFQDN([]byte("\x04\x00\x00\x10abc")) != nil {
+		t.Error("Expected a truncated name to be refused")
+	}
+	if reply := replyFQDN(fqdnFlagE|fqdnFlagS, "laptop.example.org."); !bytes.Equal(reply, []byte("\x05\xff\xff\x06laptop\x07example\x03org\x00")) {
+		t.Errorf("Unexpected reply %q", reply)
+	}
+	if hostLabel("My_Laptop.lan") != "mylaptop" {
+		t.Errorf("Unexpected label %s", hostLabel("My_Laptop.lan"))
+	}
+}
+
+func TestDDNSRegister(t *testing.T) {
+	key := &tsigKey{name: "dhcp-key.", algorithm: "hmac-sha256.", secret: []byte("secret")}
+	server, updates := startDNSStub(t, key)
+	d := &ddnsConfig{server: server, zone: "example.org.", reverseZone: "1.168.192.in-addr.arpa.", key: key, timeout: time.Second, records: make(map[string]ddnsRecord)}
+	ctx := context.Background()
+	ip := net.ParseIP("192.168.1.10")
+
+	// Hostname only: the server adds both records
+	if reply := d.register(ctx, "00:11:22:33:44:55", ip, dhcp.Options{dhcp.OptionHostName: []byte("laptop")}, time.Hour); reply != nil {
+		t.Errorf("Expected no option 81 in the reply, got %v", reply)
+	}
+	forward := waitUpdate(t, updates)
+	if !forward.signed || forward.zone != "example.org." || len(forward.rrs) != 2 {
+		t.Fatalf("Unexpected forward update %+v", forward)
+	}
+	if add, ok := forward.rrs[1].(*dns.A); !ok || add.Hdr.Name != "laptop.example.org." || add.Hdr.Class != dns.ClassINET || add.Hdr.Ttl != 1800 || !add.A.Equal(ip) {
+		t.Errorf("Unexpected A record %v", forward.rrs[1])
+	}
+	reverse := waitUpdate(t, updates)
+	if reverse.zone != "1.168.192.in-addr.arpa." || len(reverse.rrs) != 2 {
+		t.Fatalf("Unexpected reverse update %+v", reverse)
+	}
+	if ptr, ok := reverse.rrs[1].(*dns.PTR); !ok || ptr.Hdr.Name != "10.1.168.192.in-addr.arpa." || ptr.Ptr != "laptop.example.org." {
+		t.Errorf("Unexpected PTR record %v", reverse.rrs[1])
+	}
+
+	// The eviction of the binding removes the records
+	d.unregister(ctx, "00:11:22:33:44:55")
+	if remove := waitUpdate(t, updates); len(remove.rrs) != 1 || remove.rrs[0].Header().Class != dns.ClassNONE || !remove.rrs[0].(*dns.A).A.Equal(ip) {
+		t.Errorf("Expected the A record of the address to be removed, got %+v", remove)
+	}
+	if remove := waitUpdate(t, updates); len(remove.rrs) != 1 || remove.rrs[0].Header().Class != dns.ClassANY || remove.rrs[0].Header().Rrtype != dns.TypePTR {
+		t.Errorf("Expected the PTR record to be removed, got %+v", remove)
+	}
+	d.unregister(ctx, "00:11:22:33:44:55")
+	select {
+	case update := <-updates:
+		t.Errorf("Unexpected update %+v", update)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// S=0: the client updates its A record, the server only the PTR record
+	reply := d.register(ctx, "00:11:22:33:44:66", net.ParseIP("192.168.1.11"), dhcp.Options{OptionClientFQDN: []byte("\x00\x00\x00desktop.example.org")}, time.Hour)
+	if !bytes.Equal(reply, []byte("\x00\xff\xffdesktop.example.org")) {
+		t.Errorf("Unexpected reply %q", reply)
+	}
+	if update := waitUpdate(t, updates); update.zone != "1.168.192.in-addr.arpa." {
+		t.Errorf("Expected only the PTR record to be updated, got %+v", update)
+	}
+
+	// N=1: no update at all, the name registered on an earlier ACK is removed
+	d.register(ctx, "00:11:22:33:44:77", net.ParseIP("192.168.1.12"), dhcp.Options{dhcp.OptionHostName: []byte("printer")}, time.Hour)
+	waitUpdate(t, updates)
+	waitUpdate(t, updates)
+	reply = d.register(ctx, "00:11:22:33:44:77", net.ParseIP("192.168.1.12"), dhcp.Options{OptionClientFQDN: []byte("\x08\x00\x00printer")}, time.Hour)
+	if len(reply) == 0 || reply[0] != fqdnFlagN {
+		t.Errorf("Unexpected reply %q", reply)
+	}
+	if remove := waitUpdate(t, updates); len(remove.rrs) != 1 || remove.rrs[0].Header().Class != dns.ClassNONE {
+		t.Errorf("Expected the A record to be removed, got %+v", remove)
+	}
+	if remove := waitUpdate(t, updates); len(remove.rrs) != 1 || remove.rrs[0].Header().Rrtype != dns.TypePTR {
+		t.Errorf("Expected the PTR record to be removed, got %+v", remove)
+	}
+	if name, _ := d.registered("00:11:22:33:44:77"); name != "" {
+		t.Errorf("Expected no name registered, got %s", name)
+	}
+
+	// S=0 overridden by the server
+	d.override = true
+	reply = d.register(ctx, "00:11:22:33:44:88", net.ParseIP("192.168.1.13"), dhcp.Options{OptionClientFQDN: []byte("\x00\x00\x00tablet")}, time.Hour)
+	if len(reply) == 0 || reply[0] != fqdnFlagS|fqdnFlagO {
+		t.Errorf("Unexpected reply %q", reply)
+	}
+	if update := waitUpdate(t, updates); update.zone != "example.org." {
+		t.Errorf("Expected the A record to be updated, got %+v", update)
+	}
+	waitUpdate(t, updates)
+	select {
+	case update := <-updates:
+		t.Errorf("Unexpected update %+v", update)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDDNSRefused(t *testing.T) {
+	server, _ := startDNSStub(t, &tsigKey{name: "dhcp-key.", algorithm: "hmac-sha256.", secret: []byte("secret")})
+	d := &ddnsConfig{server: server, zone: "example.org.", reverseZone: "1.168.192.in-addr.arpa.", key: &tsigKey{name: "dhcp-key.", algorithm: "hmac-sha256.", secret: []byte("wrong")}, timeout: time.Second}
+	if err := d.add(ddnsRecord{fqdn: "laptop.example.org.", ip: net.ParseIP("192.168.1.10").To4(), forward: true}); err == nil || !strings.Contains(err.Error(), "rcode 9") {
+		t.Errorf("Expected the update to be refused, got %v", err)
+	}
+
+	// An answer not signed with the key is not trusted
+	server, _ = startDNSStub(t, nil)
+	d.server, d.key.secret = server, []byte("secret")
+	if err := d.add(ddnsRecord{fqdn: "laptop.example.org.", ip: net.ParseIP("192.168.1.10").To4(), forward: true}); err == nil || !strings.Contains(err.Error(), "not signed") {
+		t.Errorf("Expected an unsigned answer to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// MessageType6 is the type of a DHCPv6 message (RFC 8415 section 7.3)
+type MessageType6 uint8
+
+const (
+	Solicit6            MessageType6 = 1
+	Advertise6          MessageType6 = 2
+	Request6            MessageType6 = 3
+	Confirm6            MessageType6 = 4
+	Renew6              MessageType6 = 5
+	Rebind6             MessageType6 = 6
+	Reply6              MessageType6 = 7
+	Release6            MessageType6 = 8
+	Decline6            MessageType6 = 9
+	Reconfigure6        MessageType6 = 10
+	InformationRequest6 MessageType6 = 11
+	RelayForw6          MessageType6 = 12
+	RelayRepl6          MessageType6 = 13
+)
+
+func (t MessageType6) String() string {
+	switch t {
+	case Solicit6:
+		return "SOLICIT"
+	case Advertise6:
+		return "ADVERTISE"
+	case Request6:
+		return "REQUEST"
+	case Confirm6:
+		return "CONFIRM"
+	case Renew6:
+		return "RENEW"
+	case Rebind6:
+		return "REBIND"
+	case Reply6:
+		return "REPLY"
+	case Release6:
+		return "RELEASE"
+	case Decline6:
+		return "DECLINE"
+	case Reconfigure6:
+		return "RECONFIGURE"
+	case InformationRequest6:
+		return "INFORMATION-REQUEST"
+	case RelayForw6:
+		return "RELAY-FORW"
+	case RelayRepl6:
+		return "RELAY-REPL"
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", uint8(t))
+}
+
+// OptionCode6 is the code of a DHCPv6 option (RFC 8415 section 21)
+type OptionCode6 uint16
+
+const (
+	OptionClientID6    OptionCode6 = 1
+	OptionServerID6    OptionCode6 = 2
+	OptionIANA6        OptionCode6 = 3
+	OptionIAAddr6      OptionCode6 = 5
+	OptionORO6         OptionCode6 = 6
+	OptionPreference6  OptionCode6 = 7
+	OptionElapsedTime6 OptionCode6 = 8
+	OptionRelayMsg6    OptionCode6 = 9
+	OptionStatusCode6  OptionCode6 = 13
+	OptionRapidCommit6 OptionCode6 = 14
+	OptionInterfaceID6 OptionCode6 = 18
+	OptionDNSServers6  OptionCode6 = 23
+	OptionDomainList6  OptionCode6 = 24
+	OptionIAPD6        OptionCode6 = 25
+	OptionIAPrefix6    OptionCode6 = 26
+)
+
+// StatusCode6 is a DHCPv6 status code (RFC 8415 section 21.13)
+type StatusCode6 uint16
+
+const (
+	StatusSuccess6       StatusCode6 = 0
+	StatusUnspecFail6    StatusCode6 = 1
+	StatusNoAddrsAvail6  StatusCode6 = 2
+	StatusNoBinding6     StatusCode6 = 3
+	StatusNotOnLink6     StatusCode6 = 4
+	StatusUseMulticast6  StatusCode6 = 5
+	StatusNoPrefixAvail6 StatusCode6 = 6
+)
+
+const dhcpv6ClientPort = 546
+const dhcpv6ServerPort = 547
+
+// AllDHCPRelayAgentsAndServers is the multicast group DHCPv6 servers listen on
+var AllDHCPRelayAgentsAndServers = net.ParseIP("ff02::1:2")
+
+// Option6 is a single DHCPv6 option
+type Option6 struct {
+	Code OptionCode6
+	Data []byte
+}
+
+// Options6 is an ordered list of DHCPv6 options, an option may be repeated
+type Options6 []Option6
+
+// Get returns the data of the first option with the given code
+func (o Options6) Get(code OptionCode6) []byte {
+	for _, opt := range o {
+		if opt.Code == code {
+			return opt.Data
+		}
+	}
+	return nil
+}
+
+// GetAll returns the data of every option with the given code
+func (o Options6) GetAll(code OptionCode6) [][]byte {
+	var all [][]byte
+	for _, opt := range o {
+		if opt.Code == code {
+			all = append(all, opt.Data)
+		}
+	}
+	return all
+}
+
+// Has returns whether an option with the given code is present
+func (o Options6) Has(code OptionCode6) bool {
+	for _, opt := range o {
+		if opt.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Add appends an option
+func (o *Options6) Add(code OptionCode6, data []byte) {
+	*o = append(*o, Option6{Code: code, Data: data})
+}
+
+func parseOptions6(b []byte) (Options6, error) {
+	var options Options6
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, errors.New("truncated option header")
+		}
+		code := OptionCode6(binary.BigEndian.Uint16(b[0:2]))
+		length := int(binary.BigEndian.Uint16(b[2:4]))
+		if len(b) < 4+length {
+			return nil, fmt.Errorf("truncated option %d", code)
+		}
+		options = append(options, Option6{Code: code, Data: b[4 : 4+length]})
+		b = b[4+length:]
+	}
+	return options, nil
+}
+
+func (o Options6) marshal() []byte {
+	var b []byte
+	for _, opt := range o {
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint16(header[0:2], uint16(opt.Code))
+		binary.BigEndian.PutUint16(header[2:4], uint16(len(opt.Data)))
+		b = append(b, header...)
+		b = append(b, opt.Data...)
+	}
+	return b
+}
+
+// Message6 is a DHCPv6 client/server message
+type Message6 struct {
+	Type          MessageType6
+	TransactionID [3]byte
+	Options       Options6
+}
+
+// ParseMessage6 decodes a client/server message
+func ParseMessage6(b []byte) (*Message6, error) {
+	if len(b) < 4 {
+		return nil, errors.New("message too short")
+	}
+	m := &Message6{Type: MessageType6(b[0])}
+	if m.Type == RelayForw6 || m.Type == RelayRepl6 {
+		return nil, errors.New("relay message")
+	}
+	copy(m.TransactionID[:], b[1:4])
+	options, err := parseOptions6(b[4:])
+	if err != nil {
+		return nil, err
+	}
+	m.Options = options
+	return m, nil
+}
+
+// Marshal encodes the message
+func (m *Message6) Marshal() []byte {
+	b := []byte{byte(m.Type), m.TransactionID[0], m.TransactionID[1], m.TransactionID[2]}
+	return append(b, m.Options.marshal()...)
+}
+
+// RelayMessage6 is a DHCPv6 Relay-forward or Relay-reply message
+type RelayMessage6 struct {
+	Type     MessageType6
+	HopCount uint8
+	LinkAddr net.IP
+	PeerAddr net.IP
+	Options  Options6
+}
+
+// ParseRelayMessage6 decodes a relay agent message
+func ParseRelayMessage6(b []byte) (*RelayMessage6, error) {
+	if len(b) < 34 {
+		return nil, errors.New("relay message too short")
+	}
+	m := &RelayMessage6{
+		Type:     MessageType6(b[0]),
+		HopCount: b[1],
+		LinkAddr: net.IP(append([]byte(nil), b[2:18]...)),
+		PeerAddr: net.IP(append([]byte(nil), b[18:34]...)),
+	}
+	if m.Type != RelayForw6 && m.Type != RelayRepl6 {
+		return nil, errors.New("not a relay message")
+	}
+	options, err := parseOptions6(b[34:])
+	if err != nil {
+		return nil, err
+	}
+	m.Options = options
+	return m, nil
+}
+
+// Marshal encodes the relay message
+func (m *RelayMessage6) Marshal() []byte {
+	b := []byte{byte(m.Type), m.HopCount}
+	b = append(b, m.LinkAddr.To16()...)
+	b = append(b, m.PeerAddr.To16()...)
+	return append(b, m.Options.marshal()...)
+}
+
+// IA6 is an IA_NA or IA_PD option
+type IA6 struct {
+	IAID    [4]byte
+	T1      uint32
+	T2      uint32
+	Options Options6
+}
+
+func parseIA6(b []byte) (*IA6, error) {
+	if len(b) < 12 {
+		return nil, errors.New("IA option too short")
+	}
+	ia := &IA6{
+		T1: binary.BigEndian.Uint32(b[4:8]),
+		T2: binary.BigEndian.Uint32(b[8:12]),
+	}
+	copy(ia.IAID[:], b[0:4])
+	options, err := parseOptions6(b[12:])
+	if err != nil {
+		return nil, err
+	}
+	ia.Options = options
+	return ia, nil
+}
+
+func (ia *IA6) marshal() []byte {
+	b := make([]byte, 12)
+	copy(b[0:4], ia.IAID[:])
+	binary.BigEndian.PutUint32(b[4:8], ia.T1)
+	binary.BigEndian.PutUint32(b[8:12], ia.T2)
+	return append(b, ia.Options.marshal()...)
+}
+
+// IAAddr6 is an IA Address option
+type IAAddr6 struct {
+	IP                net.IP
+	PreferredLifetime uint32
+	ValidLifetime     uint32
+	Options           Options6
+}
+
+func parseIAAddr6(b []byte) (*IAAddr6, error) {
+	if len(b) < 24 {
+		return nil, errors.New("IA address option too short")
+	}
+	options, err := parseOptions6(b[24:])
+	if err != nil {
+		return nil, err
+	}
+	return &IAAddr6{
+		IP:                net.IP(append([]byte(nil), b[0:16]...)),
+		PreferredLifetime: binary.BigEndian.Uint32(b[16:20]),
+		ValidLifetime:     binary.BigEndian.Uint32(b[20:24]),
+		Options:           options,
+	}, nil
+}
+
+func (a *IAAddr6) marshal() []byte {
+	b := make([]byte, 24)
+	copy(b[0:16], a.IP.To16())
+	binary.BigEndian.PutUint32(b[16:20], a.PreferredLifetime)
+	binary.BigEndian.PutUint32(b[20:24], a.ValidLifetime)
+	return append(b, a.Options.marshal()...)
+}
+
+// IAPrefix6 is an IA Prefix option
+type IAPrefix6 struct {
+	PreferredLifetime uint32
+	ValidLifetime     uint32
+	Prefix            *net.IPNet
+	Options           Options6
+}
+
+func parseIAPrefix6(b []byte) (*IAPrefix6, error) {
+	if len(b) < 25 {
+		return nil, errors.New("IA prefix option too short")
+	}
+	length := int(b[8])
+	if length > 128 {
+		return nil, errors.New("invalid prefix length")
+	}
+	options, err := parseOptions6(b[25:])
+	if err != nil {
+		return nil, err
+	}
+	return &IAPrefix6{
+		PreferredLifetime: binary.BigEndian.Uint32(b[0:4]),
+		ValidLifetime:     binary.BigEndian.Uint32(b[4:8]),
+		Prefix:            &net.IPNet{IP: net.IP(append([]byte(nil), b[9:25]...)), Mask: net.CIDRMask(length, 128)},
+		Options:           options,
+	}, nil
+}
+
+func (p *IAPrefix6) marshal() []byte {
+	b := make([]byte, 25)
+	binary.BigEndian.PutUint32(b[0:4], p.PreferredLifetime)
+	binary.BigEndian.PutUint32(b[4:8], p.ValidLifetime)
+	length, _ := p.Prefix.Mask.Size()
+	b[8] = byte(length)
+	copy(b[9:25], p.Prefix.IP.To16())
+	return append(b, p.Options.marshal()...)
+}
+
+func statusCode6(code StatusCode6, message string) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(code))
+	return append(b, []byte(message)...)
+}
+
+// parseStatusCode6 returns the status code carried by a list of options,
+// Success when there is none
+func parseStatusCode6(options Options6) StatusCode6 {
+	if b := options.Get(OptionStatusCode6); len(b) >= 2 {
+		return StatusCode6(binary.BigEndian.Uint16(b))
+	}
+	return StatusSuccess6
+}
+
+// duidLL builds a DUID based on a link-layer address (RFC 8415 section 11.4)
+func duidLL(hw net.HardwareAddr) []byte {
+	b := []byte{0, 3, 0, 1}
+	if len(hw) == 0 {
+		hw = make(net.HardwareAddr, 6)
+	}
+	return append(b, hw...)
+}
+
+// duidClientKey identifies a client by its DUID. Clients using a link-layer
+// based DUID are identified by their MAC address so they can be looked up like
+// IPv4 clients; any other DUID is identified by its hexadecimal form.
+func duidClientKey(duid []byte) string {
+	if len(duid) >= 4 && binary.BigEndian.Uint16(duid[2:4]) == 1 {
+		switch binary.BigEndian.Uint16(duid[0:2]) {
+		case 1: // DUID-LLT
+			if len(duid) == 14 {
+				return net.HardwareAddr(duid[8:14]).String()
+			}
+		case 3: // DUID-LL
+			if len(duid) == 10 {
+				return net.HardwareAddr(duid[4:10]).String()
+			}
+		}
+	}
+	return "duid:" + net.HardwareAddr(duid).String()
+}
+
+// encodeDomainList6 encodes domain names in the DNS wire format
+func encodeDomainList6(domains []string) []byte {
+	var b []byte
+	for _, domain := range domains {
+		for _, label := range splitDomain(domain) {
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+		b = append(b, 0)
+	}
+	return b
+}
+
+func splitDomain(domain string) []string {
+	var labels []string
+	start := 0
+	for i := 0; i <= len(domain); i++ {
+		if i == len(domain) || domain[i] == '.' {
+			if i > start {
+				labels = append(labels, domain[start:i])
+			}
+			start = i + 1
+		}
+	}
+	return labels
+}
@@ -0,0 +1,853 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"fdurand/standalone_dhcp/pool"
+	cache "github.com/fdurand/go-cache"
+	"github.com/go-ini/ini"
+	"github.com/inverse-inc/packetfence/go/log"
+	"golang.org/x/net/ipv6"
+)
+
+// maxPool6Size bounds the number of addresses or prefixes of an IPv6 pool,
+// every index of a pool is tracked in memory
+const maxPool6Size = 1 << 16
+
+// DHCPv6Handler serves the IA_NA addresses and IA_PD prefixes of an IPv6
+// scope
+type DHCPv6Handler struct {
+	serverDUID        []byte   // DUID of the interface, the server identifier
+	na                *ia6Pool // Addresses, nil when the scope only delegates prefixes
+	pd                *ia6Pool // Delegated prefixes, nil when the scope only assigns addresses
+	validLifetime     time.Duration
+	preferredLifetime time.Duration
+	dns               []net.IP
+	domains           []string
+	rapidCommit       bool
+	signature         string // Fingerprint of the configuration the scope was built from
+}
+
+type Network6 struct {
+	network     net.IPNet
+	dhcpHandler *DHCPv6Handler
+}
+
+// ia6Pool is a pool of addresses (length 128) or of prefixes of the same
+// length carved one after the other from start
+type ia6Pool struct {
+	network   string // Key the leases of the pool are persisted under
+	start     net.IP
+	length    int
+	size      int
+	available *pool.DHCPPool
+	cache     *cache.Cache // Bindings, client -> index
+}
+
+func newIA6Pool(network string, start net.IP, length int, size int, algorithm string, lifetime time.Duration) *ia6Pool {
+	strategy, err := pool.NewStrategy(algorithm)
+	if err != nil {
+		strategy, _ = pool.NewStrategy(pool.StrategyRandom)
+	}
+	p := &ia6Pool{
+		network:   network,
+		start:     start.To16(),
+		length:    length,
+		size:      size,
+		available: pool.NewDHCPPoolWithStrategy(safeIntToUint64(size), strategy),
+		cache:     cache.New(lifetime, 10*time.Second),
+	}
+	p.cache.OnEvicted(func(client string, index interface{}) {
+		// The binding is gone, forget the persisted lease
+		if err := DeleteLease(p.network, client); err != nil && err != sql.ErrNoRows {
+			log.LoggerWContext(ctx).Error("Unable to delete the lease of " + client + ": " + err.Error())
+		}
+		go func() {
+			// Always wait 30 seconds before releasing the address again
+			time.Sleep(30 * time.Second)
+			// A declined address is held by FakeMac and released later
+			if _, owner, _ := p.available.GetMACIndex(safeIntToUint64(index.(int))); owner != client {
+				return
+			}
+			log.LoggerWContext(ctx).Info(client + " " + p.text(index.(int)) + " Added back in the pool on index " + strconv.Itoa(index.(int)))
+			p.available.FreeIPIndex(safeIntToUint64(index.(int)))
+		}()
+	})
+	return p
+}
+
+func (p *ia6Pool) step() *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(128-p.length))
+}
+
+// at returns the address or prefix at the index
+func (p *ia6Pool) at(index int) net.IP {
+	n := new(big.Int).SetBytes(p.start)
+	n.Add(n, new(big.Int).Mul(big.NewInt(int64(index)), p.step()))
+	ip := make(net.IP, net.IPv6len)
+	n.FillBytes(ip)
+	return ip
+}
+
+// indexOf returns the index of an address or prefix, -1 when it is not part of
+// the pool
+func (p *ia6Pool) indexOf(ip net.IP) int {
+	if ip.To16() == nil || ip.To4() != nil {
+		return -1
+	}
+	diff := new(big.Int).Sub(new(big.Int).SetBytes(ip.To16()), new(big.Int).SetBytes(p.start))
+	if diff.Sign() < 0 {
+		return -1
+	}
+	index, remainder := new(big.Int).DivMod(diff, p.step(), new(big.Int))
+	if remainder.Sign() != 0 || !index.IsInt64() || index.Int64() >= int64(p.size) {
+		return -1
+	}
+	return int(index.Int64())
+}
+
+// text returns the address, or the prefix in CIDR notation, at the index
+func (p *ia6Pool) text(index int) string {
+	if p.length == 128 {
+		return p.at(index).String()
+	}
+	return p.at(index).String() + "/" + strconv.Itoa(p.length)
+}
+
+// lookup returns the index bound to the client
+func (p *ia6Pool) lookup(client string) (int, bool) {
+	if x, found := p.cache.Get(client); found {
+		if _, owner, _ := p.available.GetMACIndex(safeIntToUint64(x.(int))); owner == client {
+			return x.(int), true
+		}
+	}
+	return -1, false
+}
+
+// allocate returns the index bound to the client or reserves one, the hint
+// first when it is free
+func (p *ia6Pool) allocate(client string, hint int) (int, error) {
+	if index, found := p.lookup(client); found {
+		return index, nil
+	}
+	if hint >= 0 {
+		if err, _ := p.available.ReserveIPIndex(safeIntToUint64(hint), client); err == nil {
+			return hint, nil
+		}
+	}
+	index, _, err := p.available.GetFreeIPIndex(client)
+	if err != nil {
+		return -1, err
+	}
+	return safeUint64ToInt(index), nil
+}
+
+// bind commits the binding of the client and persists it
+func (p *ia6Pool) bind(client string, index int, lifetime time.Duration) error {
+	p.cache.Set(client, index, lifetime+(time.Duration(15)*time.Second))
+	return SaveLease(Lease{MAC: client, IP: p.text(index), Network: p.network, ExpiresAt: time.Now().Add(lifetime)})
+}
+
+// restore reloads the unexpired leases of the pool, see restoreLeases
+func (p *ia6Pool) restore() int {
+	leases, err := ListActiveLeases(p.network)
+	if err != nil {
+		log.LoggerWContext(ctx).Error("Unable to restore leases of network " + p.network + ": " + err.Error())
+		return 0
+	}
+
+	restored := 0
+	for _, lease := range leases {
+		ip := net.ParseIP(strings.SplitN(lease.IP, "/", 2)[0])
+		index := p.indexOf(ip)
+		if index < 0 {
+			log.LoggerWContext(ctx).Info("Lease " + lease.IP + " of " + lease.MAC + " is outside of the pool of network " + p.network + ", skipping")
+			continue
+		}
+		remaining := time.Until(lease.ExpiresAt)
+		if remaining <= 0 {
+			continue
+		}
+		if err, _ := p.available.ReserveIPIndex(safeIntToUint64(index), lease.MAC); err != nil {
+			log.LoggerWContext(ctx).Info("Unable to restore lease " + lease.IP + " of " + lease.MAC + ": " + err.Error())
+			continue
+		}
+		p.cache.Set(lease.MAC, index, remaining+(time.Duration(15)*time.Second))
+		restored++
+	}
+
+	if restored > 0 {
+		log.LoggerWContext(ctx).Info("Restored " + strconv.Itoa(restored) + " leases in network " + p.network)
+	}
+	return restored
+}
+
+// migrate copies the bindings of the pool into the pool rebuilt to replace it,
+// see migrateBindings
+func (p *ia6Pool) migrate(next *ia6Pool) int {
+	if next == nil {
+		return 0
+	}
+	migrated := 0
+	for client, item := range p.cache.Items() {
+		index, ok := item.Object.(int)
+		if !ok {
+			continue
+		}
+		remaining := time.Until(time.Unix(0, item.Expiration))
+		if remaining <= 0 {
+			continue
+		}
+		newIndex := next.indexOf(p.at(index))
+		if newIndex < 0 || next.length != p.length {
+			log.LoggerWContext(ctx).Info(client + " " + p.text(index) + " is no longer part of the pool, dropping the binding")
+			continue
+		}
+		if _, owner, _ := next.available.GetMACIndex(safeIntToUint64(newIndex)); owner != client {
+			if err, _ := next.available.ReserveIPIndex(safeIntToUint64(newIndex), client); err != nil {
+				log.LoggerWContext(ctx).Info(client + " " + p.text(index) + " cannot be kept: " + err.Error())
+				continue
+			}
+		}
+		next.cache.Set(client, newIndex, remaining)
+		migrated++
+	}
+	return migrated
+}
+
+// newDHCPv6Handler builds the scope of a [network6 <prefix>] section
+func newDHCPv6Handler(sec *ini.Section, network net.IPNet, serverDUID []byte) (*DHCPv6Handler, error) {
+	h := &DHCPv6Handler{
+		serverDUID:  serverDUID,
+		rapidCommit: sec.Key("rapid_commit").String() == "enabled",
+		signature:   scopeSignature(sec, net.IP(serverDUID)),
+	}
+
+	seconds, err := strconv.Atoi(sec.Key("dhcp_default_lease_time").MustString("3600"))
+	if err != nil || seconds <= 0 {
+		return nil, fmt.Errorf("invalid dhcp_default_lease_time %q", sec.Key("dhcp_default_lease_time").String())
+	}
+	h.validLifetime = time.Duration(seconds) * time.Second
+	h.preferredLifetime = h.validLifetime
+	if preferred := sec.Key("dhcp_preferred_lifetime").String(); preferred != "" {
+		seconds, err := strconv.Atoi(preferred)
+		if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > h.validLifetime {
+			return nil, fmt.Errorf("invalid dhcp_preferred_lifetime %q", preferred)
+		}
+		h.preferredLifetime = time.Duration(seconds) * time.Second
+	}
+	algorithm, err := readAlgorithm(sec)
+	if err != nil {
+		return nil, err
+	}
+	stickiness, err := readStickiness(sec)
+	if err != nil {
+		return nil, err
+	}
+
+	if sec.Key("dhcp_start").String() != "" || sec.Key("dhcp_end").String() != "" {
+		dhcpStart := net.ParseIP(sec.Key("dhcp_start").String())
+		dhcpEnd := net.ParseIP(sec.Key("dhcp_end").String())
+		if !IsIPv6(dhcpStart) || !IsIPv6(dhcpEnd) || !network.Contains(dhcpStart) || !network.Contains(dhcpEnd) {
+			return nil, fmt.Errorf("dhcp_start and dhcp_end must be IPv6 addresses of %s", network.String())
+		}
+		size := new(big.Int).Sub(new(big.Int).SetBytes(dhcpEnd.To16()), new(big.Int).SetBytes(dhcpStart.To16()))
+		size.Add(size, big.NewInt(1))
+		if size.Sign() <= 0 {
+			return nil, fmt.Errorf("dhcp_start is after dhcp_end")
+		}
+		if size.Cmp(big.NewInt(maxPool6Size)) > 0 {
+			return nil, fmt.Errorf("the address range holds more than %d addresses", maxPool6Size)
+		}
+		h.na = newIA6Pool(network.String(), dhcpStart, 128, int(size.Int64()), algorithm, h.validLifetime)
+	}
+
+	if prefix := sec.Key("pd_prefix").String(); prefix != "" {
+		_, pdNet, err := net.ParseCIDR(prefix)
+		if err != nil || pdNet.IP.To4() != nil {
+			return nil, fmt.Errorf("invalid pd_prefix %q", prefix)
+		}
+		pdBits, _ := pdNet.Mask.Size()
+		length, err := sec.Key("pd_length").Int()
+		if err != nil || length <= pdBits || length > 128 {
+			return nil, fmt.Errorf("pd_length must be between %d and 128", pdBits+1)
+		}
+		if length-pdBits > 16 {
+			return nil, fmt.Errorf("the prefix pool holds more than %d prefixes", maxPool6Size)
+		}
+		h.pd = newIA6Pool(pdNet.String(), pdNet.IP, length, 1<<uint(length-pdBits), algorithm, h.validLifetime)
+	}
+
+	if h.na == nil && h.pd == nil {
+		return nil, fmt.Errorf("neither an address range (dhcp_start/dhcp_end) nor a prefix pool (pd_prefix/pd_length) is configured")
+	}
+	for _, p := range []*ia6Pool{h.na, h.pd} {
+		if p != nil {
+			p.available.SetStickiness(stickiness)
+		}
+	}
+
+	for _, address := range strings.Split(sec.Key("dns").String(), ",") {
+		if ip := net.ParseIP(strings.TrimSpace(address)); IsIPv6(ip) {
+			h.dns = append(h.dns, ip)
+		}
+	}
+	for _, domain := range strings.Split(sec.Key("domain-name").String(), ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			h.domains = append(h.domains, domain)
+		}
+	}
+
+	return h, nil
+}
+
+// restore reloads the persisted leases of the scope
+func (h *DHCPv6Handler) restore() {
+	if h.na != nil {
+		h.na.restore()
+	}
+	if h.pd != nil {
+		h.pd.restore()
+	}
+}
+
+// retire detaches a scope that is no longer served, see DHCPHandler.retire
+func (h *DHCPv6Handler) retire() {
+	for _, p := range []*ia6Pool{h.na, h.pd} {
+		if p != nil {
+			p.cache.OnEvicted(nil)
+			p.cache.Flush()
+		}
+	}
+}
+
+// ServeDHCPv6 answers a client message, it returns nil when the message must
+// be ignored
+func (h *DHCPv6Handler) ServeDHCPv6(ctx context.Context, req *Message6) *Message6 {
+	clientID := req.Options.Get(OptionClientID6)
+	serverID := req.Options.Get(OptionServerID6)
+
+	// RFC 8415 section 16, messages that are not for us are discarded
+	switch req.Type {
+	case Solicit6, Rebind6, Confirm6:
+		if clientID == nil || serverID != nil {
+			return nil
+		}
+	case Request6, Renew6, Release6, Decline6:
+		if clientID == nil || !bytes.Equal(serverID, h.serverDUID) {
+			return nil
+		}
+	case InformationRequest6:
+		if serverID != nil && !bytes.Equal(serverID, h.serverDUID) {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	var client string
+	if clientID != nil {
+		client = duidClientKey(clientID)
+		ctx = log.AddToLogContext(ctx, "client", client)
+	}
+	log.LoggerWContext(ctx).Info("DHCPv6 " + req.Type.String() + " from " + client)
+
+	reply := &Message6{Type: Reply6, TransactionID: req.TransactionID}
+	msgType := req.Type
+	if msgType == Solicit6 {
+		if h.rapidCommit && req.Options.Has(OptionRapidCommit6) {
+			// Two message exchange, the Solicit commits like a Request
+			msgType = Request6
+			reply.Options.Add(OptionRapidCommit6, nil)
+		} else {
+			reply.Type = Advertise6
+		}
+	}
+	if clientID != nil {
+		reply.Options.Add(OptionClientID6, clientID)
+	}
+	reply.Options.Add(OptionServerID6, h.serverDUID)
+
+	switch msgType {
+	case Solicit6, Request6, Renew6, Rebind6:
+		for _, code := range []OptionCode6{OptionIANA6, OptionIAPD6} {
+			for i, data := range req.Options.GetAll(code) {
+				// A client gets a single binding per pool
+				if ia := h.serveIA(ctx, msgType, client, code, data, i == 0); ia != nil {
+					reply.Options.Add(code, ia)
+				}
+			}
+		}
+
+	case Release6, Decline6:
+		for _, code := range []OptionCode6{OptionIANA6, OptionIAPD6} {
+			for _, data := range req.Options.GetAll(code) {
+				h.releaseIA(ctx, msgType, client, code, data)
+			}
+		}
+		reply.Options.Add(OptionStatusCode6, statusCode6(StatusSuccess6, msgType.String()+" received"))
+
+	case Confirm6:
+		confirmed := false
+		for _, data := range req.Options.GetAll(OptionIANA6) {
+			ia, err := parseIA6(data)
+			if err != nil {
+				continue
+			}
+			for _, addrData := range ia.Options.GetAll(OptionIAAddr6) {
+				addr, err := parseIAAddr6(addrData)
+				if err != nil {
+					continue
+				}
+				if h.na == nil || h.na.indexOf(addr.IP) < 0 {
+					reply.Options.Add(OptionStatusCode6, statusCode6(StatusNotOnLink6, addr.IP.String()+" is not on link"))
+					return reply
+				}
+				confirmed = true
+			}
+		}
+		if !confirmed {
+			return nil
+		}
+		reply.Options.Add(OptionStatusCode6, statusCode6(StatusSuccess6, "All addresses are on link"))
+	}
+
+	if len(h.dns) > 0 {
+		var servers []byte
+		for _, ip := range h.dns {
+			servers = append(servers, ip.To16()...)
+		}
+		reply.Options.Add(OptionDNSServers6, servers)
+	}
+	if len(h.domains) > 0 {
+		reply.Options.Add(OptionDomainList6, encodeDomainList6(h.domains))
+	}
+
+	return reply
+}
+
+// serveIA answers an IA_NA or IA_PD option of a Solicit, Request, Renew or
+// Rebind
+func (h *DHCPv6Handler) serveIA(ctx context.Context, msgType MessageType6, client string, code OptionCode6, data []byte, first bool) []byte {
+	ia, err := parseIA6(data)
+	if err != nil {
+		log.LoggerWContext(ctx).Info("Ignoring invalid IA option: " + err.Error())
+		return nil
+	}
+
+	p, name, noneAvailable := h.na, "address", StatusNoAddrsAvail6
+	if code == OptionIAPD6 {
+		p, name, noneAvailable = h.pd, "prefix", StatusNoPrefixAvail6
+	}
+	answer := &IA6{IAID: ia.IAID}
+	if p == nil || !first {
+		answer.Options.Add(OptionStatusCode6, statusCode6(noneAvailable, "No "+name+" available"))
+		return answer.marshal()
+	}
+
+	// The addresses or prefixes the client holds or would like
+	var requested []int
+	for _, hint := range h.hints(p, code, ia) {
+		if index := p.indexOf(hint); index >= 0 {
+			requested = append(requested, index)
+		}
+	}
+	hint := -1
+	if len(requested) > 0 {
+		hint = requested[0]
+	}
+
+	index, bound := p.lookup(client)
+	switch msgType {
+	case Solicit6:
+		if !bound {
+			if index, err = p.allocate(client, hint); err != nil {
+				log.LoggerWContext(ctx).Info(client + " no " + name + " left in the pool " + p.network)
+				answer.Options.Add(OptionStatusCode6, statusCode6(noneAvailable, "No "+name+" available"))
+				return answer.marshal()
+			}
+			// Enough time to send a Request
+			p.cache.Set(client, index, time.Minute)
+		}
+		log.LoggerWContext(ctx).Info("DHCPv6 ADVERTISE " + p.text(index) + " to " + client)
+
+	case Request6:
+		if index, err = p.allocate(client, hint); err != nil {
+			log.LoggerWContext(ctx).Info(client + " no " + name + " left in the pool " + p.network)
+			answer.Options.Add(OptionStatusCode6, statusCode6(noneAvailable, "No "+name+" available"))
+			return answer.marshal()
+		}
+
+	case Renew6, Rebind6:
+		if !bound {
+			// The binding has been lost, recreate it when the address is free
+			if hint < 0 {
+				answer.Options.Add(OptionStatusCode6, statusCode6(StatusNoBinding6, "No binding for "+client))
+				return answer.marshal()
+			}
+			if err, _ := p.available.ReserveIPIndex(safeIntToUint64(hint), client); err != nil {
+				answer.Options.Add(OptionStatusCode6, statusCode6(StatusNoBinding6, "No binding for "+client))
+				return answer.marshal()
+			}
+			index = hint
+		}
+	}
+
+	if msgType != Solicit6 {
+		if err := p.bind(client, index, h.validLifetime); err != nil {
+			log.LoggerWContext(ctx).Error("Unable to persist the lease of " + client + ": " + err.Error())
+		}
+		log.LoggerWContext(ctx).Info("DHCPv6 REPLY " + p.text(index) + " to " + client)
+	}
+
+	preferred := uint32(h.preferredLifetime / time.Second)
+	valid := uint32(h.validLifetime / time.Second)
+	answer.T1 = preferred / 2
+	answer.T2 = preferred / 5 * 4
+	h.addLease(p, code, &answer.Options, index, preferred, valid)
+	// What the client holds but cannot keep expires right away
+	for _, other := range requested {
+		if other != index && msgType != Solicit6 {
+			h.addLease(p, code, &answer.Options, other, 0, 0)
+		}
+	}
+	return answer.marshal()
+}
+
+// releaseIA releases or declines the bindings listed in an IA_NA or IA_PD
+func (h *DHCPv6Handler) releaseIA(ctx context.Context, msgType MessageType6, client string, code OptionCode6, data []byte) {
+	ia, err := parseIA6(data)
+	if err != nil {
+		return
+	}
+	p := h.na
+	if code == OptionIAPD6 {
+		p = h.pd
+	}
+	if p == nil {
+		return
+	}
+	bound, found := p.lookup(client)
+	if !found {
+		return
+	}
+	for _, hint := range h.hints(p, code, ia) {
+		if p.indexOf(hint) != bound {
+			continue
+		}
+		if msgType == Decline6 {
+			log.LoggerWContext(ctx).Info("Temporarily declaring " + p.text(bound) + " as unusable")
+			p.available.FreeIPIndex(safeIntToUint64(bound))
+			p.available.ReserveIPIndex(safeIntToUint64(bound), FakeMac)
+			// Put it back into the available addresses in 10 minutes
+			go func(index int) {
+				time.Sleep(10 * time.Minute)
+				log.LoggerWContext(ctx).Info("Releasing previously declined " + p.text(index) + " back into the pool")
+				p.available.FreeIPIndex(safeIntToUint64(index))
+			}(bound)
+		} else {
+			log.LoggerWContext(ctx).Info("DHCPv6 RELEASE of " + p.text(bound) + " from " + client)
+		}
+		p.cache.Delete(client)
+		return
+	}
+}
+
+// hints returns the addresses or prefixes listed in an IA
+func (h *DHCPv6Handler) hints(p *ia6Pool, code OptionCode6, ia *IA6) []net.IP {
+	var hints []net.IP
+	if code == OptionIAPD6 {
+		for _, data := range ia.Options.GetAll(OptionIAPrefix6) {
+			if prefix, err := parseIAPrefix6(data); err == nil {
+				if length, _ := prefix.Prefix.Mask.Size(); length == p.length {
+					hints = append(hints, prefix.Prefix.IP)
+				}
+			}
+		}
+		return hints
+	}
+	for _, data := range ia.Options.GetAll(OptionIAAddr6) {
+		if addr, err := parseIAAddr6(data); err == nil {
+			hints = append(hints, addr.IP)
+		}
+	}
+	return hints
+}
+
+func (h *DHCPv6Handler) addLease(p *ia6Pool, code OptionCode6, options *Options6, index int, preferred uint32, valid uint32) {
+	if code == OptionIAPD6 {
+		prefix := &IAPrefix6{PreferredLifetime: preferred, ValidLifetime: valid, Prefix: &net.IPNet{IP: p.at(index), Mask: net.CIDRMask(p.length, 128)}}
+		options.Add(OptionIAPrefix6, prefix.marshal())
+		return
+	}
+	addr := &IAAddr6{IP: p.at(index), PreferredLifetime: preferred, ValidLifetime: valid}
+	options.Add(OptionIAAddr6, addr.marshal())
+}
+
+// networks6 returns a snapshot of the IPv6 scopes served on the interface
+func (I *Interface) networks6() []Network6 {
+	I.lock.RLock()
+	defer I.lock.RUnlock()
+	return I.network6
+}
+
+// setNetworks6 replaces the IPv6 scopes served on the interface
+func (I *Interface) setNetworks6(networks []Network6) {
+	I.lock.Lock()
+	defer I.lock.Unlock()
+	I.network6 = networks
+}
+
+// hasNetwork6 returns whether the interface already serves the prefix
+func (I *Interface) hasNetwork6(prefix net.IPNet) bool {
+	for _, v := range I.network6 {
+		if v.network.String() == prefix.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// scope6 returns the IPv6 scope of a link. Messages received directly from a
+// client (no link address) are served by the first scope of the interface.
+func (I *Interface) scope6(linkAddr net.IP) *DHCPv6Handler {
+	for _, v := range I.networks6() {
+		if linkAddr == nil || linkAddr.IsUnspecified() || v.network.Contains(linkAddr) {
+			return v.dhcpHandler
+		}
+	}
+	return nil
+}
+
+// serveDHCPv6 answers a datagram received on the interface. Relay-forward
+// messages are unwrapped, the scope is selected from the link address of the
+// relay closest to the client, and the reply is wrapped back in a Relay-reply.
+func (I *Interface) serveDHCPv6(ctx context.Context, b []byte, linkAddr net.IP) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+
+	if MessageType6(b[0]) == RelayForw6 {
+		relay, err := ParseRelayMessage6(b)
+		if err != nil {
+			log.LoggerWContext(ctx).Debug("Invalid DHCPv6 relay message: " + err.Error())
+			return nil
+		}
+		if !relay.LinkAddr.IsUnspecified() {
+			linkAddr = relay.LinkAddr
+		}
+		inner := I.serveDHCPv6(ctx, relay.Options.Get(OptionRelayMsg6), linkAddr)
+		if inner == nil {
+			return nil
+		}
+		answer := &RelayMessage6{Type: RelayRepl6, HopCount: relay.HopCount, LinkAddr: relay.LinkAddr, PeerAddr: relay.PeerAddr}
+		if interfaceID := relay.Options.Get(OptionInterfaceID6); interfaceID != nil {
+			answer.Options.Add(OptionInterfaceID6, interfaceID)
+		}
+		answer.Options.Add(OptionRelayMsg6, inner)
+		return answer.Marshal()
+	}
+
+	req, err := ParseMessage6(b)
+	if err != nil {
+		log.LoggerWContext(ctx).Debug("Invalid DHCPv6 message: " + err.Error())
+		return nil
+	}
+	handler := I.scope6(linkAddr)
+	if handler == nil {
+		return nil
+	}
+	if reply := handler.ServeDHCPv6(ctx, req); reply != nil {
+		return reply.Marshal()
+	}
+	return nil
+}
+
+// ServeDHCPv6 reads DHCPv6 messages from conn and writes the replies back to
+// their sender until the context is cancelled
+func (I *Interface) ServeDHCPv6(ctx context.Context, conn net.PacketConn) error {
+	// Closing the connection is what unblocks the read when the listener is
+	// stopped
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	buffer := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return err
+		}
+		if reply := I.serveDHCPv6(ctx, buffer[:n], nil); reply != nil {
+			if _, err := conn.WriteTo(reply, addr); err != nil {
+				log.LoggerWContext(ctx).Error("Unable to send the DHCPv6 reply to " + addr.String() + ": " + err.Error())
+			}
+		}
+	}
+}
+
+// runDHCPv6 is the DHCPv6 listener of the interface
+func (I *Interface) runDHCPv6(ctx context.Context) {
+	conn, err := dhcpv6Open(I.intNet, dhcpv6ServerPort)
+	if err != nil {
+		log.LoggerWContext(ctx).Error("DHCPv6 listener on " + I.Name + " cannot start: " + err.Error())
+		return
+	}
+	defer conn.Close()
+
+	if err := I.ServeDHCPv6(ctx, conn); err != nil {
+		if ctx.Err() != nil {
+			log.LoggerWContext(ctx).Info("DHCPv6 listener on " + I.Name + " stopped")
+			return
+		}
+		log.LoggerWContext(ctx).Error("DHCPv6 listener on " + I.Name + " stopped: " + err.Error())
+	}
+}
+
+// dhcpv6Open binds the DHCPv6 server port on the interface and joins the
+// All_DHCP_Relay_Agents_and_Servers group
+func dhcpv6Open(iface *net.Interface, port int) (net.PacketConn, error) {
+	s, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.SetsockoptInt(s, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		syscall.Close(s)
+		return nil, err
+	}
+	if err = syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 1); err != nil {
+		syscall.Close(s)
+		return nil, err
+	}
+	if err = syscall.SetsockoptString(s, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface.Name); err != nil {
+		syscall.Close(s)
+		return nil, err
+	}
+
+	lsa := syscall.SockaddrInet6{Port: port}
+	if err = syscall.Bind(s, &lsa); err != nil {
+		syscall.Close(s)
+		return nil, err
+	}
+	f := os.NewFile(uintptr(s), "")
+	c, err := net.FilePacketConn(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ipv6.NewPacketConn(c).JoinGroup(iface, &net.UDPAddr{IP: AllDHCPRelayAgentsAndServers}); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// stats reports the usage of the address and prefix pools of the scope
+func (h *DHCPv6Handler) stats(ifname string, network net.IPNet) []Stats {
+	var stats []Stats
+	for _, p := range []*ia6Pool{h.na, h.pd} {
+		if p == nil {
+			continue
+		}
+		Options := make(map[string]string)
+		Options["optionValidLifetime"] = h.validLifetime.String()
+		Options["optionPreferredLifetime"] = h.preferredLifetime.String()
+
+		var Members []Node
+		for client, item := range p.cache.Items() {
+			Members = append(Members, Node{IP: p.text(item.Object.(int)), Mac: client, EndsAt: time.Unix(0, item.Expiration)})
+		}
+
+		availableCount := safeUint64ToInt(p.available.FreeIPsRemaining())
+		usedCount := p.size - availableCount
+		Status := "Normal"
+		if len(Members) != usedCount {
+			Status = "Calculated available " + strconv.Itoa(p.size-len(Members)) + " is different than what we have available in the pool " + strconv.Itoa(availableCount)
+		}
+
+		stat := Stats{EthernetName: ifname, Net: network.String(), Type: "ia_na", Free: availableCount, Category: "none", Options: Options, Members: Members, Status: Status, Size: p.size, Used: usedCount, PercentFree: int((float64(availableCount) / float64(p.size)) * 100), PercentUsed: int((float64(usedCount) / float64(p.size)) * 100)}
+		if p == h.pd {
+			stat.Net = p.network
+			stat.Type = "ia_pd"
+		}
+		stats = append(stats, stat)
+	}
+	return stats
+}
+
+// pools6 returns the address and prefix pools of every live IPv6 scope
+func (d *Interfaces) pools6() []*ia6Pool {
+	var pools []*ia6Pool
+	for _, I := range d.interfaces() {
+		for _, v := range I.networks6() {
+			for _, p := range []*ia6Pool{v.dhcpHandler.na, v.dhcpHandler.pd} {
+				if p != nil {
+					pools = append(pools, p)
+				}
+			}
+		}
+	}
+	return pools
+}
+
+// lookup6 returns the binding of an address, or of the delegated prefix the
+// address belongs to
+func (d *Interfaces) lookup6(ip net.IP) (Node, bool) {
+	for _, p := range d.pools6() {
+		index := p.indexOf(ip.Mask(net.CIDRMask(p.length, 128)))
+		if index < 0 {
+			continue
+		}
+		_, owner, err := p.available.GetMACIndex(safeIntToUint64(index))
+		if err != nil {
+			continue
+		}
+		if x, expiresAt, found := p.cache.GetWithExpiration(owner); found && x.(int) == index {
+			return Node{Mac: owner, IP: p.text(index), EndsAt: expiresAt}, true
+		}
+	}
+	return Node{}, false
+}
+
+// bindings6 returns the addresses and prefixes bound to a client
+func (d *Interfaces) bindings6(client string) []Node {
+	var nodes []Node
+	for _, p := range d.pools6() {
+		if index, found := p.lookup(client); found {
+			_, expiresAt, _ := p.cache.GetWithExpiration(client)
+			nodes = append(nodes, Node{Mac: client, IP: p.text(index), EndsAt: expiresAt})
+		}
+	}
+	return nodes
+}
+
+// release6 drops the bindings of a client, the addresses and prefixes go back
+// to their pool. It returns what has been released.
+func (d *Interfaces) release6(client string) []string {
+	var released []string
+	for _, p := range d.pools6() {
+		if index, found := p.lookup(client); found {
+			released = append(released, p.text(index))
+			p.cache.Delete(client)
+			log.LoggerWContext(ctx).Info(client + " " + p.text(index) + " removed")
+		}
+	}
+	return released
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+var testClientDUID = duidLL(net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01})
+
+// setupDHCPv6Test builds an interface serving 2001:db8::/64 with a 16
+// addresses range and 2001:db8:100::/48 delegated as /56 prefixes
+func setupDHCPv6Test(t *testing.T) *Interface {
+	t.Helper()
+
+	dbPath := setupTestDB(t)
+	t.Cleanup(func() { teardownTestDB(t, dbPath) })
+	if err := InitDatabase(dbPath); err != nil {
+		t.Fatalf("InitDatabase failed: %v", err)
+	}
+
+	cfg := ini.Empty()
+	sec, _ := cfg.NewSection("network6 2001:db8::/64")
+	sec.Key("dhcp_start").SetValue("2001:db8::10")
+	sec.Key("dhcp_end").SetValue("2001:db8::1f")
+	sec.Key("pd_prefix").SetValue("2001:db8:100::/48")
+	sec.Key("pd_length").SetValue("56")
+	sec.Key("dns").SetValue("2001:db8::53")
+	sec.Key("domain-name").SetValue("example.com")
+	sec.Key("dhcp_default_lease_time").SetValue("3600")
+	sec.Key("dhcp_preferred_lifetime").SetValue("1800")
+
+	_, prefix, _ := net.ParseCIDR("2001:db8::/64")
+	handler, err := newDHCPv6Handler(sec, *prefix, duidLL(net.HardwareAddr{0, 1, 2, 3, 4, 5}))
+	if err != nil {
+		t.Fatalf("newDHCPv6Handler failed: %v", err)
+	}
+	t.Cleanup(handler.retire)
+
+	I := &Interface{Name: "lo", network6: []Network6{{network: *prefix, dhcpHandler: handler}}}
+	prevConfig := DHCPConfig
+	DHCPConfig = &Interfaces{intsNet: []*Interface{I}}
+	t.Cleanup(func() { DHCPConfig = prevConfig })
+	return I
+}
+
+func newIA6(code OptionCode6, hint []byte) []byte {
+	ia := &IA6{IAID: [4]byte{0, 0, 0, 1}}
+	if hint != nil {
+		if code == OptionIAPD6 {
+			ia.Options.Add(OptionIAPrefix6, hint)
+		} else {
+			ia.Options.Add(OptionIAAddr6, hint)
+		}
+	}
+	return ia.marshal()
+}
+
+func newClientMessage6(msgType MessageType6, serverID []byte) *Message6 {
+	m := &Message6{Type: msgType, TransactionID: [3]byte{1, 2, 3}}
+	m.Options.Add(OptionClientID6, testClientDUID)
+	if serverID != nil {
+		m.Options.Add(OptionServerID6, serverID)
+	}
+	m.Options.Add(OptionElapsedTime6, []byte{0, 0})
+	return m
+}
+
+// leases6 returns the address and the prefix of a reply
+func leases6(t *testing.T, reply *Message6) (*IAAddr6, *IAPrefix6) {
+	t.Helper()
+	var addr *IAAddr6
+	var prefix *IAPrefix6
+	if data := reply.Options.Get(OptionIANA6); data != nil {
+		ia, err := parseIA6(data)
+		if err != nil {
+			t.Fatalf("Invalid IA_NA: %v", err)
+		}
+		if b := ia.Options.Get(OptionIAAddr6); b != nil {
+			addr, _ = parseIAAddr6(b)
+		}
+	}
+	if data := reply.Options.Get(OptionIAPD6); data != nil {
+		ia, err := parseIA6(data)
+		if err != nil {
+			t.Fatalf("Invalid IA_PD: %v", err)
+		}
+		if b := ia.Options.Get(OptionIAPrefix6); b != nil {
+			prefix, _ = parseIAPrefix6(b)
+		}
+	}
+	return addr, prefix
+}
+
+func TestMessage6RoundTrip(t *testing.T) {
+	m := newClientMessage6(Solicit6, nil)
+	addr := &IAAddr6{IP: net.ParseIP("2001:db8::10"), PreferredLifetime: 10, ValidLifetime: 20}
+	m.Options.Add(OptionIANA6, newIA6(OptionIANA6, addr.marshal()))
+
+	relay := &RelayMessage6{Type: RelayForw6, HopCount: 1, LinkAddr: net.ParseIP("2001:db8::1"), PeerAddr: net.ParseIP("fe80::1")}
+	relay.Options.Add(OptionRelayMsg6, m.Marshal())
+
+	decodedRelay, err := ParseRelayMessage6(relay.Marshal())
+	if err != nil {
+		t.Fatalf("ParseRelayMessage6 failed: %v", err)
+	}
+	if !decodedRelay.LinkAddr.Equal(relay.LinkAddr) || !decodedRelay.PeerAddr.Equal(relay.PeerAddr) {
+		t.Errorf("Relay addresses not preserved: %+v", decodedRelay)
+	}
+
+	decoded, err := ParseMessage6(decodedRelay.Options.Get(OptionRelayMsg6))
+	if err != nil {
+		t.Fatalf("ParseMessage6 failed: %v", err)
+	}
+	if decoded.Type != Solicit6 || decoded.TransactionID != m.TransactionID {
+		t.Errorf("Header not preserved: %+v", decoded)
+	}
+	if !bytes.Equal(decoded.Options.Get(OptionClientID6), testClientDUID) {
+		t.Error("Client identifier not preserved")
+	}
+	got, _ := leases6(t, decoded)
+	if got == nil || !got.IP.Equal(addr.IP) || got.ValidLifetime != 20 {
+		t.Errorf("IA address not preserved: %+v", got)
+	}
+
+	if _, err := ParseMessage6([]byte{1, 0, 0, 0, 0, 1, 0, 8}); err == nil {
+		t.Error("Expected an error for a truncated option")
+	}
+	if key := duidClientKey(testClientDUID); key != "aa:bb:cc:dd:ee:01" {
+		t.Errorf("Expected the MAC address of a DUID-LL, got %s", key)
+	}
+	if key := duidClientKey([]byte{0, 4, 1, 2}); key != "duid:00:04:01:02" {
+		t.Errorf("Expected the hexadecimal form of a DUID-UUID, got %s", key)
+	}
+}
+
+// TestDHCPv6Exchange runs a client against the server over the loopback
+func TestDHCPv6Exchange(t *testing.T) {
+	I := setupDHCPv6Test(t)
+	handler := I.networks6()[0].dhcpHandler
+
+	server, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- I.ServeDHCPv6(ctx, server) }()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	client, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Fatalf("Unable to open the client socket: %v", err)
+	}
+	defer client.Close()
+
+	exchange := func(m *Message6) *Message6 {
+		t.Helper()
+		if _, err := client.WriteTo(m.Marshal(), server.LocalAddr()); err != nil {
+			t.Fatalf("Unable to send %s: %v", m.Type, err)
+		}
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buffer := make([]byte, 1500)
+		n, _, err := client.ReadFrom(buffer)
+		if err != nil {
+			t.Fatalf("No reply to %s: %v", m.Type, err)
+		}
+		reply, err := ParseMessage6(buffer[:n])
+		if err != nil {
+			t.Fatalf("Invalid reply to %s: %v", m.Type, err)
+		}
+		if reply.TransactionID != m.TransactionID {
+			t.Fatalf("Transaction ID not echoed")
+		}
+		return reply
+	}
+
+	solicit := newClientMessage6(Solicit6, nil)
+	solicit.Options.Add(OptionIANA6, newIA6(OptionIANA6, nil))
+	solicit.Options.Add(OptionIAPD6, newIA6(OptionIAPD6, nil))
+	advertise := exchange(solicit)
+	if advertise.Type != Advertise6 {
+		t.Fatalf("Expected an ADVERTISE, got %s", advertise.Type)
+	}
+	serverID := advertise.Options.Get(OptionServerID6)
+	if !bytes.Equal(serverID, handler.serverDUID) {
+		t.Fatalf("Expected the server DUID, got %x", serverID)
+	}
+	if dns := advertise.Options.Get(OptionDNSServers6); !net.IP(dns).Equal(net.ParseIP("2001:db8::53")) {
+		t.Errorf("Expected the DNS server, got %x", dns)
+	}
+	addr, prefix := leases6(t, advertise)
+	if addr == nil || handler.na.indexOf(addr.IP) < 0 {
+		t.Fatalf("Expected an address of the range, got %+v", addr)
+	}
+	if prefix == nil || handler.pd.indexOf(prefix.Prefix.IP) < 0 {
+		t.Fatalf("Expected a delegated prefix, got %+v", prefix)
+	}
+	if length, _ := prefix.Prefix.Mask.Size(); length != 56 {
+		t.Errorf("Expected a /56, got /%d", length)
+	}
+
+	// A Request without our server identifier is for another server
+	request := newClientMessage6(Request6, nil)
+	request.Options.Add(OptionIANA6, newIA6(OptionIANA6, addr.marshal()))
+	if reply := I.serveDHCPv6(context.Background(), request.Marshal(), nil); reply != nil {
+		t.Error("Expected a REQUEST without server identifier to be ignored")
+	}
+
+	request = newClientMessage6(Request6, serverID)
+	request.Options.Add(OptionIANA6, newIA6(OptionIANA6, addr.marshal()))
+	request.Options.Add(OptionIAPD6, newIA6(OptionIAPD6, prefix.marshal()))
+	reply := exchange(request)
+	if reply.Type != Reply6 {
+		t.Fatalf("Expected a REPLY, got %s", reply.Type)
+	}
+	boundAddr, boundPrefix := leases6(t, reply)
+	if boundAddr == nil || !boundAddr.IP.Equal(addr.IP) || boundAddr.ValidLifetime != 3600 || boundAddr.PreferredLifetime != 1800 {
+		t.Fatalf("Expected the advertised address to be bound, got %+v", boundAddr)
+	}
+	if boundPrefix == nil || !boundPrefix.Prefix.IP.Equal(prefix.Prefix.IP) {
+		t.Fatalf("Expected the advertised prefix to be bound, got %+v", boundPrefix)
+	}
+	ia, _ := parseIA6(reply.Options.Get(OptionIANA6))
+	if ia.T1 != 900 || ia.T2 != 1440 {
+		t.Errorf("Expected T1 900 and T2 1440, got %d and %d", ia.T1, ia.T2)
+	}
+
+	// The bindings are persisted and exposed to the API
+	leases, err := ListActiveLeases("2001:db8:100::/48")
+	if err != nil || len(leases) != 1 || leases[0].MAC != "aa:bb:cc:dd:ee:01" || leases[0].IP != prefix.Prefix.String() {
+		t.Errorf("Expected the delegated prefix to be persisted, got %+v (%v)", leases, err)
+	}
+	if node, found := DHCPConfig.lookup6(net.ParseIP("2001:db8::1")); found {
+		t.Errorf("Unexpected binding for an address outside of the range: %+v", node)
+	}
+	if node, found := DHCPConfig.lookup6(addr.IP); !found || node.Mac != "aa:bb:cc:dd:ee:01" {
+		t.Errorf("Expected the address to be found, got %+v", node)
+	}
+	if nodes := DHCPConfig.bindings6("aa:bb:cc:dd:ee:01"); len(nodes) != 2 {
+		t.Errorf("Expected an address and a prefix, got %+v", nodes)
+	}
+	stats := I.handleApiReq(ApiReq{Req: "stats", NetInterface: "lo"}).([]Stats)
+	if len(stats) != 2 || stats[0].Used != 1 || stats[0].Size != 16 || stats[1].Type != "ia_pd" || stats[1].Size != 256 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	renew := newClientMessage6(Renew6, serverID)
+	renew.Options.Add(OptionIANA6, newIA6(OptionIANA6, addr.marshal()))
+	if renewed, _ := leases6(t, exchange(renew)); renewed == nil || !renewed.IP.Equal(addr.IP) {
+		t.Errorf("Expected the address to be renewed, got %+v", renewed)
+	}
+
+	release := newClientMessage6(Release6, serverID)
+	release.Options.Add(OptionIANA6, newIA6(OptionIANA6, addr.marshal()))
+	reply = exchange(release)
+	if status := parseStatusCode6(reply.Options); status != StatusSuccess6 {
+		t.Errorf("Expected a successful release, got status %d", status)
+	}
+	if _, found := handler.na.lookup("aa:bb:cc:dd:ee:01"); found {
+		t.Error("Expected the address binding to be released")
+	}
+	if _, found := handler.pd.lookup("aa:bb:cc:dd:ee:01"); !found {
+		t.Error("Expected the prefix binding to be kept")
+	}
+}
+
+func TestDHCPv6Relayed(t *testing.T) {
+	I := setupDHCPv6Test(t)
+
+	solicit := newClientMessage6(Solicit6, nil)
+	solicit.Options.Add(OptionIANA6, newIA6(OptionIANA6, nil))
+
+	relay := &RelayMessage6{Type: RelayForw6, LinkAddr: net.ParseIP("2001:db8::1"), PeerAddr: net.ParseIP("fe80::1")}
+	relay.Options.Add(OptionInterfaceID6, []byte("eth1"))
+	relay.Options.Add(OptionRelayMsg6, solicit.Marshal())
+
+	b := I.serveDHCPv6(context.Background(), relay.Marshal(), nil)
+	if b == nil {
+		t.Fatal("Expected a reply to the relayed SOLICIT")
+	}
+	answer, err := ParseRelayMessage6(b)
+	if err != nil || answer.Type != RelayRepl6 {
+		t.Fatalf("Expected a RELAY-REPL, got %+v (%v)", answer, err)
+	}
+	if string(answer.Options.Get(OptionInterfaceID6)) != "eth1" || !answer.PeerAddr.Equal(relay.PeerAddr) {
+		t.Errorf("Expected the relay fields to be echoed, got %+v", answer)
+	}
+	advertise, err := ParseMessage6(answer.Options.Get(OptionRelayMsg6))
+	if err != nil || advertise.Type != Advertise6 {
+		t.Fatalf("Expected an ADVERTISE, got %+v (%v)", advertise, err)
+	}
+
+	// A link the server has no scope for is not answered
+	relay.LinkAddr = net.ParseIP("2001:db8:ffff::1")
+	if b := I.serveDHCPv6(context.Background(), relay.Marshal(), nil); b != nil {
+		t.Error("Expected a relayed message from an unknown link to be ignored")
+	}
+}
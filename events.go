@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ini/ini"
+	"github.com/inverse-inc/packetfence/go/api-frontend/unifiedapierrors"
+	"github.com/inverse-inc/packetfence/go/log"
+)
+
+// Types of the lease events
+const (
+	EventOffer    = "offer"
+	EventAck      = "ack"
+	EventNak      = "nak"
+	EventRelease  = "release"
+	EventDecline  = "decline"
+	EventExpiry   = "expiry"
+	EventConflict = "conflict"
+)
+
+// eventTypes lists the types of the lease events
+var eventTypes = []string{EventOffer, EventAck, EventNak, EventRelease, EventDecline, EventExpiry, EventConflict}
+
+// eventHistorySize is the number of events kept to resume a stream from its
+// Last-Event-ID
+const eventHistorySize = 1000
+
+// LeaseEvent is something that happened to the lease of a client
+type LeaseEvent struct {
+	ID        uint64    `json:"id"`
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	Interface string    `json:"interface,omitempty"`
+	Network   string    `json:"network,omitempty"`
+	MAC       string    `json:"mac"`
+	IP        string    `json:"ip,omitempty"`
+	Hostname  string    `json:"hostname,omitempty"`
+	LeaseTime int       `json:"lease_time,omitempty"` // Seconds, for the offers and acks
+}
+
+// eventSubscription receives the events of the types it asked for
+type eventSubscription struct {
+	events chan LeaseEvent
+	types  map[string]bool // nil for every type
+	bus    *eventBus
+}
+
+// eventBus dispatches the lease events to the subscribers. Publishing never
+// blocks, a subscriber that does not keep up loses events.
+type eventBus struct {
+	lock        sync.Mutex
+	lastID      uint64
+	history     []LeaseEvent
+	subscribers map[*eventSubscription]struct{}
+}
+
+var leaseEvents = newEventBus()
+
+func newEventBus() *eventBus {
+	return &eventBus{subscribers: make(map[*eventSubscription]struct{})}
+}
+
+// validEventTypes parses a comma separated list of event types, an empty
+// list means every type
+func validEventTypes(list string) (map[string]bool, error) {
+	var types map[string]bool
+	for _, t := range strings.Split(list, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+		known := false
+		for _, v := range eventTypes {
+			known = known || v == t
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown event type %q, must be one of %s", t, strings.Join(eventTypes, ", "))
+		}
+		if types == nil {
+			types = make(map[string]bool)
+		}
+		types[t] = true
+	}
+	return types, nil
+}
+
+// publish numbers an event and hands it to the subscribers
+func (b *eventBus) publish(e LeaseEvent) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.lastID++
+	e.ID = b.lastID
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.history = append(b.history, e)
+	if len(b.history) > eventHistorySize {
+		b.history = b.history[len(b.history)-eventHistorySize:]
+	}
+	for s := range b.subscribers {
+		if s.types != nil && !s.types[e.Type] {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			metrics.eventsDropped.Add(1)
+		}
+	}
+}
+
+// subscribe registers a subscriber with a queue of the given size. The
+// events published after the one with the id after, still in the history,
+// are returned so a stream can resume where it stopped.
+func (b *eventBus) subscribe(size int, types map[string]bool, after uint64) (*eventSubscription, []LeaseEvent) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	s := &eventSubscription{events: make(chan LeaseEvent, size), types: types, bus: b}
+	b.subscribers[s] = struct{}{}
+
+	var missed []LeaseEvent
+	if after > 0 {
+		for _, e := range b.history {
+			if e.ID > after && (types == nil || types[e.Type]) {
+				missed = append(missed, e)
+			}
+		}
+	}
+	return s, missed
+}
+
+// close stops the delivery of the events to the subscriber
+func (s *eventSubscription) close() {
+	s.bus.lock.Lock()
+	defer s.bus.lock.Unlock()
+	delete(s.bus.subscribers, s)
+}
+
+// webhookQueueSize is the number of events a webhook can have pending
+const webhookQueueSize = 1000
+
+// webhookMaxBackoff caps the delay between two delivery attempts
+const webhookMaxBackoff = 60 * time.Second
+
+// webhookBackoff is the delay before the first retry, doubled on each attempt
+var webhookBackoff = time.Second
+
+// webhook posts the lease events to an HTTP endpoint
+type webhook struct {
+	name       string
+	url        string
+	secret     string          // Key of the HMAC-SHA256 signature of the body, unsigned when empty
+	types      map[string]bool // nil for every type
+	timeout    time.Duration
+	maxRetries int
+	client     *http.Client
+}
+
+// readWebhooks reads the [webhook NAME] sections of the configuration file
+func readWebhooks(path string) ([]*webhook, error) {
+	cfg, err := ini.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read file: %w", err)
+	}
+	webhookKey := regexp.MustCompile("^webhook (.+)$")
+
+	var hooks []*webhook
+	for _, key := range cfg.SectionStrings() {
+		name := webhookKey.FindStringSubmatch(key)
+		if name == nil {
+			continue
+		}
+		sec := cfg.Section(key)
+		w := &webhook{name: name[1], url: sec.Key("url").String(), secret: sec.Key("secret").String()}
+		if u, err := url.Parse(w.url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid url %q for webhook %s", w.url, w.name)
+		}
+		if w.types, err = validEventTypes(sec.Key("events").String()); err != nil {
+			return nil, fmt.Errorf("invalid events for webhook %s: %w", w.name, err)
+		}
+		timeout, err := strconv.Atoi(sec.Key("timeout").MustString("5"))
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid timeout %q for webhook %s", sec.Key("timeout").String(), w.name)
+		}
+		w.timeout = time.Duration(timeout) * time.Second
+		if w.maxRetries, err = strconv.Atoi(sec.Key("max_retries").MustString("5")); err != nil || w.maxRetries < 0 {
+			return nil, fmt.Errorf("invalid max_retries %q for webhook %s", sec.Key("max_retries").String(), w.name)
+		}
+		if w.secret == "" {
+			log.LoggerWContext(ctx).Warn("No secret configured for webhook " + w.name + ", its requests are not signed")
+		}
+		w.client = &http.Client{Timeout: w.timeout}
+		hooks = append(hooks, w)
+	}
+	return hooks, nil
+}
+
+// sign returns the signature header of a body
+func (w *webhook) sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(w.secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// errWebhookRefused is returned when the endpoint refused an event, retrying
+// would not help
+var errWebhookRefused = errors.New("event refused")
+
+// post makes one delivery attempt of an event
+func (w *webhook) post(ctx context.Context, e LeaseEvent, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errWebhookRefused, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "godhcp")
+	req.Header.Set("X-Godhcp-Event", e.Type)
+	req.Header.Set("X-Godhcp-Delivery", strconv.FormatUint(e.ID, 10))
+	if w.secret != "" {
+		req.Header.Set("X-Godhcp-Signature", w.sign(body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return errors.New(resp.Status)
+	default:
+		return fmt.Errorf("%w: %s", errWebhookRefused, resp.Status)
+	}
+}
+
+// deliver posts an event, retrying with an exponential backoff when the
+// endpoint is unreachable or failing
+func (w *webhook) deliver(ctx context.Context, e LeaseEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	backoff := webhookBackoff
+	for attempt := 0; ; attempt++ {
+		err = w.post(ctx, e, body)
+		if err == nil || errors.Is(err, errWebhookRefused) || attempt >= w.maxRetries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, webhookMaxBackoff)
+	}
+}
+
+// run delivers the events of the subscription in order until the context is
+// done
+func (w *webhook) run(ctx context.Context, s *eventSubscription) {
+	defer s.close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-s.events:
+			if err := w.deliver(ctx, e); err != nil && ctx.Err() == nil {
+				metrics.webhookFailures.Add(1)
+				log.LoggerWContext(ctx).Error("Failed to deliver the " + e.Type + " event of " + e.MAC + " to webhook " + w.name + ": " + err.Error())
+			}
+		}
+	}
+}
+
+var (
+	webhooksLock   sync.Mutex
+	webhooksCancel context.CancelFunc
+)
+
+// startWebhooks subscribes the webhooks to the lease events, the ones
+// started before are stopped
+func startWebhooks(hooks []*webhook) {
+	webhooksLock.Lock()
+	defer webhooksLock.Unlock()
+
+	if webhooksCancel != nil {
+		webhooksCancel()
+	}
+	hooksCtx, cancel := context.WithCancel(ctx)
+	webhooksCancel = cancel
+	for _, w := range hooks {
+		s, _ := leaseEvents.subscribe(webhookQueueSize, w.types, 0)
+		go w.run(hooksCtx, s)
+		log.LoggerWContext(ctx).Info("Sending the lease events to webhook " + w.name + " " + w.url)
+	}
+}
+
+// publishLeaseEvent publishes an event of a scope
+func publishLeaseEvent(eventType, iface, network, mac string, ip net.IP, hostname string, lease time.Duration) {
+	e := LeaseEvent{Type: eventType, Interface: iface, Network: network, MAC: mac, Hostname: hostname, LeaseTime: int(lease.Seconds())}
+	if ip != nil && !ip.Equal(net.IPv4zero) {
+		e.IP = ip.String()
+	}
+	leaseEvents.publish(e)
+}
+
+// eventsKeepAlive is the interval of the comments keeping an idle stream
+// open through proxies
+const eventsKeepAlive = 15 * time.Second
+
+// handleEvents streams the lease events as Server-Sent Events, the type
+// parameter restricts them to a comma separated list of types
+func handleEvents(res http.ResponseWriter, req *http.Request) {
+	flusher, ok := res.(http.Flusher)
+	if !ok {
+		unifiedapierrors.Error(res, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	types, err := validEventTypes(req.URL.Query().Get("type"))
+	if err != nil {
+		unifiedapierrors.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	after, _ := strconv.ParseUint(req.Header.Get("Last-Event-ID"), 10, 64)
+
+	s, missed := leaseEvents.subscribe(100, types, after)
+	defer s.close()
+
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	write := func(e LeaseEvent) error {
+		data, _ := json.Marshal(e)
+		_, err := fmt.Fprintf(res, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+		return err
+	}
+	for _, e := range missed {
+		write(e)
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case e := <-s.events:
+			if err := write(e); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(res, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cache "github.com/fdurand/go-cache"
+	"github.com/go-ini/ini"
+	"github.com/inverse-inc/packetfence/go/timedlock"
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+func TestEventBus(t *testing.T) {
+	bus := newEventBus()
+	all, _ := bus.subscribe(10, nil, 0)
+	acks, _ := bus.subscribe(10, map[string]bool{EventAck: true}, 0)
+	full, _ := bus.subscribe(1, nil, 0)
+
+	bus.publish(LeaseEvent{Type: EventOffer, MAC: "00:11:22:33:44:55"})
+	bus.publish(LeaseEvent{Type: EventAck, MAC: "00:11:22:33:44:55"})
+
+	if e := <-all.events; e.ID != 1 || e.Type != EventOffer || e.Time.IsZero() {
+		t.Errorf("Unexpected first event %+v", e)
+	}
+	if e := <-all.events; e.ID != 2 || e.Type != EventAck {
+		t.Errorf("Unexpected second event %+v", e)
+	}
+	if e := <-acks.events; e.Type != EventAck || len(acks.events) != 0 {
+		t.Errorf("Expected only the ack, got %+v", e)
+	}
+	if len(full.events) != 1 {
+		t.Errorf("Expected the full subscriber to drop the second event")
+	}
+
+	// A stream resumes after the last event it got
+	resumed, missed := bus.subscribe(10, nil, 1)
+	if len(missed) != 1 || missed[0].ID != 2 {
+		t.Errorf("Expected to resume with the second event, got %+v", missed)
+	}
+
+	resumed.close()
+	bus.publish(LeaseEvent{Type: EventExpiry})
+	if len(resumed.events) != 0 {
+		t.Error("Expected a closed subscription to get no event")
+	}
+
+	if _, err := validEventTypes("ack, Release"); err != nil {
+		t.Errorf("Expected the types to be valid: %v", err)
+	}
+	if _, err := validEventTypes("ack,renew"); err == nil {
+		t.Error("Expected an unknown type to be refused")
+	}
+}
+
+func TestReadWebhooks(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "godhcp.ini")
+		os.WriteFile(path, []byte(content), 0644)
+		return path
+	}
+
+	hooks, err := readWebhooks(write("[webhook nac]\nurl=https://nac.example.com/dhcp\nsecret=s3cr3t\nevents=ack,release,expiry\ntimeout=3\n\n[webhook log]\nurl=http://127.0.0.1:8080/\n"))
+	if err != nil {
+		t.Fatalf("readWebhooks failed: %v", err)
+	}
+	if len(hooks) != 2 {
+		t.Fatalf("Expected 2 webhooks, got %d", len(hooks))
+	}
+	if hooks[0].name != "nac" || hooks[0].timeout != 3*time.Second || hooks[0].maxRetries != 5 || len(hooks[0].types) != 3 || !hooks[0].types[EventRelease] {
+		t.Errorf("Unexpected webhook %+v", hooks[0])
+	}
+	if hooks[1].types != nil || hooks[1].secret != "" {
+		t.Errorf("Expected every event unsigned, got %+v", hooks[1])
+	}
+
+	for _, content := range []string{
+		"[webhook nac]\n",
+		"[webhook nac]\nurl=ftp://nac.example.com/\n",
+		"[webhook nac]\nurl=https://nac.example.com/\nevents=renew\n",
+		"[webhook nac]\nurl=https://nac.example.com/\nmax_retries=-1\n",
+	} {
+		if _, err := readWebhooks(write(content)); err == nil {
+			t.Errorf("Expected %q to be refused", content)
+		}
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	prevBackoff := webhookBackoff
+	defer func() { webhookBackoff = prevBackoff }()
+	webhookBackoff = 10 * time.Millisecond
+
+	var attempts atomic.Int32
+	received := make(chan LeaseEvent, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		mac := hmac.New(sha256.New, []byte("s3cr3t"))
+		mac.Write(body)
+		if req.Header.Get("X-Godhcp-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("Bad signature %s", req.Header.Get("X-Godhcp-Signature"))
+		}
+		// The first attempt fails and is retried
+		if attempts.Add(1) == 1 {
+			res.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var e LeaseEvent
+		json.Unmarshal(body, &e)
+		if req.Header.Get("X-Godhcp-Event") != e.Type {
+			t.Errorf("Unexpected event header %s", req.Header.Get("X-Godhcp-Event"))
+		}
+		received <- e
+	}))
+	defer srv.Close()
+
+	w := &webhook{name: "test", url: srv.URL, secret: "s3cr3t", maxRetries: 2, client: srv.Client()}
+	bus := newEventBus()
+	s, _ := bus.subscribe(10, nil, 0)
+	runCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.run(runCtx, s)
+
+	bus.publish(LeaseEvent{Type: EventAck, MAC: "00:11:22:33:44:55", IP: "192.168.1.10", LeaseTime: 3600})
+	select {
+	case e := <-received:
+		if e.MAC != "00:11:22:33:44:55" || e.IP != "192.168.1.10" || e.LeaseTime != 3600 {
+			t.Errorf("Unexpected event %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The event was not delivered")
+	}
+	if attempts.Load() != 2 {
+		t.Errorf("Expected 2 attempts, got %d", attempts.Load())
+	}
+
+	// A refused event is not retried
+	refused := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		attempts.Add(1)
+		res.WriteHeader(http.StatusBadRequest)
+	}))
+	defer refused.Close()
+	attempts.Store(0)
+	w = &webhook{name: "test", url: refused.URL, maxRetries: 2, client: refused.Client()}
+	if err := w.deliver(context.Background(), LeaseEvent{Type: EventAck}); err == nil || attempts.Load() != 1 {
+		t.Errorf("Expected a single refused attempt, got %d (%v)", attempts.Load(), err)
+	}
+}
+
+func TestEventsStream(t *testing.T) {
+	prevEvents := leaseEvents
+	defer func() { leaseEvents = prevEvents }()
+	leaseEvents = newEventBus()
+	leaseEvents.publish(LeaseEvent{Type: EventOffer, MAC: "00:11:22:33:44:55"})
+
+	srv := httptest.NewServer(http.HandlerFunc(handleEvents))
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/api/v1/events?type=ack,expiry", nil)
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Unexpected content type %s", resp.Header.Get("Content-Type"))
+	}
+
+	publishLeaseEvent(EventOffer, "eth0", "192.168.1.0", "00:11:22:33:44:55", net.ParseIP("192.168.1.10"), "laptop", time.Hour)
+	publishLeaseEvent(EventAck, "eth0", "192.168.1.0", "00:11:22:33:44:55", net.ParseIP("192.168.1.10"), "laptop", time.Hour)
+
+	reader := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 3 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read the stream: %v", err)
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+	if lines[0] != "id: 3" || lines[1] != "event: ack" || !strings.HasPrefix(lines[2], "data: ") {
+		t.Fatalf("Unexpected event %q", lines)
+	}
+	var e LeaseEvent
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &e); err != nil {
+		t.Fatalf("Invalid data: %v", err)
+	}
+	if e.Interface != "eth0" || e.IP != "192.168.1.10" || e.Hostname != "laptop" || e.LeaseTime != 3600 {
+		t.Errorf("Unexpected event %+v", e)
+	}
+
+	// A reconnecting stream gets the events it missed
+	req, _ = http.NewRequest("GET", srv.URL+"/api/v1/events", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resp2, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp2.Body.Close()
+	reader = bufio.NewReader(resp2.Body)
+	if line, _ := reader.ReadString('\n'); line != "id: 2\n" {
+		t.Errorf("Expected to resume with the second event, got %q", line)
+	}
+
+	rr := httptest.NewRecorder()
+	handleEvents(rr, httptest.NewRequest("GET", "/api/v1/events?type=renew", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown type to be refused, got %d", rr.Code)
+	}
+}
+
+func TestReleaseIsNoExpiry(t *testing.T) {
+	dbPath := setupTestDB(t)
+	defer teardownTestDB(t, dbPath)
+	if err := InitDatabase(dbPath); err != nil {
+		t.Fatalf("InitDatabase failed: %v", err)
+	}
+	prevEvents, prevCache, prevLock := leaseEvents, GlobalTransactionCache, GlobalTransactionLock
+	defer func() { leaseEvents, GlobalTransactionCache, GlobalTransactionLock = prevEvents, prevCache, prevLock }()
+	leaseEvents = newEventBus()
+	GlobalTransactionCache = cache.New(5*time.Minute, 10*time.Minute)
+	GlobalTransactionLock = timedlock.NewRWLock()
+
+	cfg, _ := ini.ShadowLoad([]byte(`
+[network 192.168.1.0]
+netmask=255.255.255.0
+gateway=192.168.1.1
+dhcp_start=192.168.1.10
+dhcp_end=192.168.1.19
+dhcp_default_lease_time=3600
+algorithm=sequential
+`))
+	sec := cfg.Section("network 192.168.1.0")
+	ranges, _ := parseRanges(sec)
+	I := &Interface{Name: "eth0", InterfaceType: "server", intNet: &net.Interface{Name: "eth0"}}
+	I.network = append(I.network, newNetwork("network 192.168.1.0", sec, "192.168.1.0", ranges, net.ParseIP("192.168.1.1"), I.Name))
+	handler := I.networks()[0].dhcpHandler
+
+	// Two bound clients, the first releases its address, the lease of the
+	// second one runs out
+	bind := func(mac string, index int, ttl time.Duration) {
+		handler.available.ReserveIPIndex(safeIntToUint64(index), mac)
+		handler.hwcache.Set(mac, index, ttl)
+		SaveLease(Lease{MAC: mac, IP: handler.ipAt(index).String(), Network: "192.168.1.0", ExpiresAt: time.Now().Add(time.Hour)})
+		RecordLeaseHistory(LeaseHistory{MAC: mac, IP: handler.ipAt(index).String(), Network: "192.168.1.0"})
+	}
+	bind("aa:bb:cc:00:00:01", 0, time.Hour)
+	bind("aa:bb:cc:00:00:02", 1, time.Millisecond)
+
+	p := newTestPacket(t, "aa:bb:cc:00:00:01")
+	p.AddOption(dhcp.OptionDHCPMessageType, []byte{byte(dhcp.Release)})
+	p.SetCIAddr(net.ParseIP("192.168.1.10").To4())
+	I.ServeDHCP(context.Background(), p, dhcp.Release, nil, nil)
+	// A client releasing an address it does not hold unbinds nothing
+	p = newTestPacket(t, "aa:bb:cc:00:00:03")
+	p.AddOption(dhcp.OptionDHCPMessageType, []byte{byte(dhcp.Release)})
+	p.SetCIAddr(net.ParseIP("192.168.1.12").To4())
+	I.ServeDHCP(context.Background(), p, dhcp.Release, nil, nil)
+	time.Sleep(5 * time.Millisecond)
+	handler.hwcache.DeleteExpired()
+
+	count := func(eventType, mac string) int {
+		n := 0
+		for _, e := range leaseEvents.history {
+			if e.Type == eventType && e.MAC == mac {
+				n++
+			}
+		}
+		return n
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		leaseEvents.lock.Lock()
+		expired := count(EventExpiry, "aa:bb:cc:00:00:02")
+		leaseEvents.lock.Unlock()
+		if expired > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Let the eviction of the released client run
+	time.Sleep(100 * time.Millisecond)
+
+	leaseEvents.lock.Lock()
+	defer leaseEvents.lock.Unlock()
+	if n := count(EventRelease, "aa:bb:cc:00:00:01"); n != 1 {
+		t.Errorf("Expected a single release event, got %d", n)
+	}
+	if n := count(EventRelease, "aa:bb:cc:00:00:03"); n != 0 {
+		t.Errorf("Expected no release event for a client without a binding, got %d", n)
+	}
+	if n := count(EventExpiry, "aa:bb:cc:00:00:01"); n != 0 {
+		t.Errorf("Expected no expiry event for the released client, got %d", n)
+	}
+	if n := count(EventExpiry, "aa:bb:cc:00:00:02"); n != 1 {
+		t.Errorf("Expected a single expiry event for the client whose lease ran out, got %d", n)
+	}
+	history, _ := ListLeaseHistory("aa:bb:cc:00:00:01", 1)
+	if len(history) != 1 || history[0].EndReason != leaseEndReleased {
+		t.Errorf("Expected the history to be ended as released, got %+v", history)
+	}
+}
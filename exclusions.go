@@ -0,0 +1,423 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"fdurand/standalone_dhcp/pool"
+	"github.com/inverse-inc/packetfence/go/log"
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// ExcludedMac holds the addresses of an exclusion range in the pool
+const ExcludedMac = "ff:ff:ff:ff:ff:fd"
+
+func init() {
+	pool.RegisterSentinelMAC(ExcludedMac)
+}
+
+// Origins of the exclusion ranges
+const (
+	exclusionSourceConfig = "config" // ip_reserved of the configuration file
+	exclusionSourceAPI    = "api"    // Made through the API and stored in the database
+)
+
+// Exclusion is a range of addresses of a pool that is never handed out
+type Exclusion struct {
+	ID        int64      `json:"id,omitempty"` // Zero for the ranges of the configuration file
+	Network   string     `json:"network"`
+	Start     string     `json:"start"`
+	End       string     `json:"end"`
+	Comment   string     `json:"comment,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // Never expires when nil
+	Source    string     `json:"source"`
+	CreatedAt time.Time  `json:"created_at,omitempty"`
+	UpdatedAt time.Time  `json:"updated_at,omitempty"`
+}
+
+// exclusionRange is an exclusion with the pool indexes it covers
+type exclusionRange struct {
+	Exclusion
+	first, last int
+}
+
+// exclusionSet holds the exclusion ranges of a scope
+type exclusionSet struct {
+	lock   sync.RWMutex
+	ranges []exclusionRange
+}
+
+func newExclusionSet() *exclusionSet {
+	return &exclusionSet{}
+}
+
+// excluded tells if a pool index is part of an exclusion range
+func (s *exclusionSet) excluded(index int) bool {
+	if s == nil {
+		return false
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, r := range s.ranges {
+		if index >= r.first && index <= r.last {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the exclusion ranges of the scope
+func (s *exclusionSet) list() []Exclusion {
+	if s == nil {
+		return nil
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	exclusions := make([]Exclusion, 0, len(s.ranges))
+	for _, r := range s.ranges {
+		exclusions = append(exclusions, r.Exclusion)
+	}
+	return exclusions
+}
+
+func (s *exclusionSet) add(e Exclusion, first, last int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ranges = append(s.ranges, exclusionRange{Exclusion: e, first: first, last: last})
+}
+
+// remove drops the exclusion range with an id and returns it
+func (s *exclusionSet) remove(id int64) (exclusionRange, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, r := range s.ranges {
+		if r.ID == id {
+			s.ranges = append(s.ranges[:i], s.ranges[i+1:]...)
+			return r, true
+		}
+	}
+	return exclusionRange{}, false
+}
+
+// exclusionIndexes returns the pool indexes of the part of a range of
+// addresses that is in the ranges of a scope
+func exclusionIndexes(handler *DHCPHandler, start, end net.IP) (int, int, bool) {
+	return handler.available.span(start, end)
+}
+
+// excludeIndexes takes the free addresses of a range out of the pool. The
+// declined addresses and the ones found in use are taken over, the ones bound
+// to a client are excluded when they are released.
+func excludeIndexes(handler *DHCPHandler, first, last int) {
+	for index := first; index <= last; index++ {
+		_, owner, _ := handler.available.GetMACIndex(safeIntToUint64(index))
+		if owner == FakeMac {
+			handler.available.FreeIPIndex(safeIntToUint64(index))
+			owner = FreeMac
+		}
+		if owner == FreeMac {
+			handler.available.ReserveIPIndex(safeIntToUint64(index), ExcludedMac)
+		}
+	}
+}
+
+// unexcludeIndexes gives the addresses of a removed range back to the pool,
+// unless another range still excludes them
+func unexcludeIndexes(handler *DHCPHandler, first, last int) {
+	for index := first; index <= last; index++ {
+		if _, owner, _ := handler.available.GetMACIndex(safeIntToUint64(index)); owner == ExcludedMac && !handler.exclusions.excluded(index) {
+			freeIndex(handler, index)
+		}
+	}
+}
+
+// freeUnusable gives a declined address, or one found in use, back to the
+// pool unless it was excluded or bound since
+func freeUnusable(handler *DHCPHandler, index int) {
+	if _, owner, _ := handler.available.GetMACIndex(safeIntToUint64(index)); owner == FakeMac {
+		handler.available.FreeIPIndex(safeIntToUint64(index))
+	}
+}
+
+// loadExclusions applies the stored exclusion ranges of a network to its
+// scope, the expired ones are deleted
+func loadExclusions(handler *DHCPHandler, network string) {
+	exclusions, err := ListExclusions(network)
+	if err != nil {
+		log.LoggerWContext(ctx).Error("Unable to load the exclusions of network " + network + ": " + err.Error())
+		return
+	}
+	applied := 0
+	for _, e := range exclusions {
+		if e.ExpiresAt != nil && !e.ExpiresAt.After(time.Now()) {
+			if err := DeleteExclusion(e.ID); err != nil {
+				log.LoggerWContext(ctx).Error("Unable to delete the expired exclusion " + strconv.FormatInt(e.ID, 10) + ": " + err.Error())
+			}
+			continue
+		}
+		first, last, ok := exclusionIndexes(handler, net.ParseIP(e.Start).To4(), net.ParseIP(e.End).To4())
+		if !ok {
+			log.LoggerWContext(ctx).Error("Exclusion " + e.Start + "-" + e.End + " is outside of the pool of network " + network + ", skipping")
+			continue
+		}
+		handler.exclusions.add(e, first, last)
+		excludeIndexes(handler, first, last)
+		applied++
+	}
+	if applied > 0 {
+		log.LoggerWContext(ctx).Info("Applied " + strconv.Itoa(applied) + " exclusions in network " + network)
+	}
+}
+
+// errNoExclusionScope is returned for a range no single pool contains
+var errNoExclusionScope = errors.New("the range must be part of the pool of a single network of this server")
+
+// exclusionsLock serializes the changes of the exclusions
+var exclusionsLock sync.Mutex
+
+// applyExclusion stores an exclusion range, created when it has no id, and
+// applies it to the pool of its scope. It returns the stored exclusion with
+// the number of its addresses still held by clients, excluded when they are
+// released.
+func applyExclusion(e Exclusion) (*Exclusion, int, error) {
+	exclusionsLock.Lock()
+	defer exclusionsLock.Unlock()
+
+	start, end := net.ParseIP(e.Start).To4(), net.ParseIP(e.End).To4()
+	if start == nil || end == nil || dhcp.IPRange(start, end) < 1 {
+		return nil, 0, fmt.Errorf("invalid range %s-%s", e.Start, e.End)
+	}
+	handler, network, _, found := scopeOf(start)
+	if endHandler, _, _, endFound := scopeOf(end); !found || !endFound || endHandler != handler {
+		return nil, 0, errNoExclusionScope
+	}
+	first, last, ok := exclusionIndexes(handler, start, end)
+	if !ok {
+		return nil, 0, errNoExclusionScope
+	}
+	e.Start, e.End, e.Network, e.Source = start.String(), end.String(), network, exclusionSourceAPI
+
+	var previous *Exclusion
+	if e.ID != 0 {
+		var err error
+		if previous, err = GetExclusion(e.ID); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := SaveExclusion(&e); err != nil {
+		return nil, 0, err
+	}
+	saved, err := GetExclusion(e.ID)
+	if err != nil {
+		return nil, 0, err
+	}
+	// The addresses still covered by the updated range stay excluded
+	var previousHandler *DHCPHandler
+	var previousRange exclusionRange
+	if previous != nil {
+		previousHandler, previousRange, found = detachExclusion(previous)
+	}
+	handler.exclusions.add(*saved, first, last)
+	excludeIndexes(handler, first, last)
+	if previous != nil && found {
+		unexcludeIndexes(previousHandler, previousRange.first, previousRange.last)
+	}
+
+	held := 0
+	for index := first; index <= last; index++ {
+		if _, owner, _ := handler.available.GetMACIndex(safeIntToUint64(index)); owner != ExcludedMac {
+			held++
+		}
+	}
+	log.LoggerWContext(ctx).Info("Excluded " + saved.Start + "-" + saved.End + " from network " + network)
+	return saved, held, nil
+}
+
+// removeExclusion deletes an exclusion range and gives its addresses back to
+// the pool
+func removeExclusion(id int64) error {
+	exclusionsLock.Lock()
+	defer exclusionsLock.Unlock()
+
+	e, err := GetExclusion(id)
+	if err != nil {
+		return err
+	}
+	if err := DeleteExclusion(id); err != nil {
+		return err
+	}
+	if handler, r, found := detachExclusion(e); found {
+		unexcludeIndexes(handler, r.first, r.last)
+	}
+	log.LoggerWContext(ctx).Info("Removed the exclusion " + e.Start + "-" + e.End + " of network " + e.Network)
+	return nil
+}
+
+// detachExclusion removes an exclusion range from the exclusions of its
+// scope, its addresses are still held in the pool
+func detachExclusion(e *Exclusion) (*DHCPHandler, exclusionRange, bool) {
+	handler, _, _, found := scopeOf(net.ParseIP(e.Start).To4())
+	if !found {
+		return nil, exclusionRange{}, false
+	}
+	r, found := handler.exclusions.remove(e.ID)
+	return handler, r, found
+}
+
+// expireExclusions removes the exclusion ranges whose expiry is past
+func expireExclusions() {
+	now := time.Now()
+	for _, I := range DHCPConfig.interfaces() {
+		for _, v := range I.networks() {
+			for _, e := range v.dhcpHandler.exclusions.list() {
+				if e.ExpiresAt == nil || e.ExpiresAt.After(now) {
+					continue
+				}
+				if err := removeExclusion(e.ID); err != nil && err != sql.ErrNoRows {
+					log.LoggerWContext(ctx).Error("Unable to remove the expired exclusion " + e.Start + "-" + e.End + ": " + err.Error())
+				}
+			}
+		}
+	}
+}
+
+// listExclusions returns the exclusion ranges applied to the scopes,
+// optionally limited to a network
+func listExclusions(network string) []Exclusion {
+	exclusions := []Exclusion{}
+	for _, I := range DHCPConfig.interfaces() {
+		for _, v := range I.networks() {
+			networkIP := v.network.IP.String()
+			if network != "" && network != networkIP {
+				continue
+			}
+			for _, e := range v.dhcpHandler.exclusions.list() {
+				e.Network = networkIP
+				exclusions = append(exclusions, e)
+			}
+		}
+	}
+	return exclusions
+}
+
+// SaveExclusion creates an exclusion range, or updates the one with the same id
+func SaveExclusion(e *Exclusion) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	if e.ID == 0 {
+		query := `
+			INSERT INTO dhcp_exclusions (network, start_ip, end_ip, comment, expires_at)
+			VALUES (?, ?, ?, ?, ?)
+		`
+		result, err := db.Exec(query, e.Network, e.Start, e.End, e.Comment, e.ExpiresAt)
+		if err != nil {
+			return fmt.Errorf("failed to save exclusion: %w", err)
+		}
+		if e.ID, err = result.LastInsertId(); err != nil {
+			return fmt.Errorf("failed to get exclusion id: %w", err)
+		}
+		return nil
+	}
+
+	query := `
+		UPDATE dhcp_exclusions
+		SET network = ?, start_ip = ?, end_ip = ?, comment = ?, expires_at = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	result, err := db.Exec(query, e.Network, e.Start, e.End, e.Comment, e.ExpiresAt, e.ID)
+	if err != nil {
+		return fmt.Errorf("failed to save exclusion: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// scanExclusion reads an exclusion range from a row
+func scanExclusion(row interface{ Scan(...interface{}) error }) (*Exclusion, error) {
+	e := Exclusion{Source: exclusionSourceAPI}
+	var expiresAt sql.NullTime
+	if err := row.Scan(&e.ID, &e.Network, &e.Start, &e.End, &e.Comment, &expiresAt, &e.CreatedAt, &e.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		e.ExpiresAt = &expiresAt.Time
+	}
+	return &e, nil
+}
+
+// GetExclusion returns the exclusion range with an id
+func GetExclusion(id int64) (*Exclusion, error) {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	return scanExclusion(db.QueryRow(`SELECT id, network, start_ip, end_ip, comment, expires_at, created_at, updated_at FROM dhcp_exclusions WHERE id = ?`, id))
+}
+
+// DeleteExclusion deletes the exclusion range with an id
+func DeleteExclusion(id int64) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	result, err := db.Exec(`DELETE FROM dhcp_exclusions WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete exclusion: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// ListExclusions lists the stored exclusion ranges, optionally limited to a
+// network
+func ListExclusions(network string) ([]Exclusion, error) {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	query := `SELECT id, network, start_ip, end_ip, comment, expires_at, created_at, updated_at FROM dhcp_exclusions`
+	var args []interface{}
+	if network != "" {
+		query += ` WHERE network = ?`
+		args = append(args, network)
+	}
+	query += ` ORDER BY network, id`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list exclusions: %w", err)
+	}
+	defer rows.Close()
+
+	exclusions := []Exclusion{}
+	for rows.Next() {
+		e, err := scanExclusion(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		exclusions = append(exclusions, *e)
+	}
+
+	return exclusions, rows.Err()
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"fdurand/standalone_dhcp/pool"
+	"github.com/inverse-inc/packetfence/go/timedlock"
+)
+
+func TestExcludeIP(t *testing.T) {
+	_, handler := newReservationScope()
+	ExcludeIP(handler, "192.168.1.12, 192.168.1.15-192.168.1.17,192.168.1.5-192.168.1.10,10.0.0.1,garbage")
+
+	for index, excluded := range map[int]bool{0: true, 1: false, 2: true, 4: false, 5: true, 7: true, 8: false} {
+		_, owner, _ := handler.available.GetMACIndex(safeIntToUint64(index))
+		if (owner == ExcludedMac) != excluded || handler.exclusions.excluded(index) != excluded {
+			t.Errorf("Unexpected exclusion of index %d, owned by %s", index, owner)
+		}
+	}
+	if free := handler.available.FreeIPsRemaining(); free != 15 {
+		t.Errorf("Expected 5 excluded addresses, got %d free", free)
+	}
+	if exclusions := handler.exclusions.list(); len(exclusions) != 3 || exclusions[1].Start != "192.168.1.15" || exclusions[1].End != "192.168.1.17" || exclusions[1].Source != exclusionSourceConfig {
+		t.Errorf("Unexpected exclusions %+v", exclusions)
+	}
+}
+
+func TestExclusionsAPI(t *testing.T) {
+	router, dbPath := setupTestAPI(t)
+	defer teardownTestDB(t, dbPath)
+
+	prevConfig, prevLock := DHCPConfig, GlobalTransactionLock
+	defer func() { DHCPConfig, GlobalTransactionLock = prevConfig, prevLock }()
+	GlobalTransactionLock = timedlock.NewRWLock()
+	var handler *DHCPHandler
+	DHCPConfig, handler = newReservationScope()
+
+	owner := func(index int) string {
+		_, mac, _ := handler.available.GetMACIndex(safeIntToUint64(index))
+		return mac
+	}
+
+	// A leased address and a declined one in the range
+	handler.available.ReserveIPIndex(6, "aa:bb:cc:dd:ee:02")
+	handler.hwcache.Set("aa:bb:cc:dd:ee:02", 6, time.Hour)
+	handler.available.ReserveIPIndex(7, FakeMac)
+	handler.available.ReserveIPIndex(12, FakeMac)
+
+	code, answer := apiRequest(router, "POST", "/api/v1/dhcp/exclusions", map[string]interface{}{
+		"start":      "192.168.1.15",
+		"end":        "192.168.1.18",
+		"comment":    "printers",
+		"expires_at": time.Now().Add(time.Hour),
+	})
+	if code != http.StatusOK || answer["in_use"].(float64) != 1 {
+		t.Fatalf("Expected the exclusion to be saved, got %d %v", code, answer)
+	}
+	exclusion := answer["exclusion"].(map[string]interface{})
+	id := strconv.Itoa(int(exclusion["id"].(float64)))
+	if exclusion["network"] != "192.168.1.0" || exclusion["comment"] != "printers" || exclusion["source"] != exclusionSourceAPI || exclusion["expires_at"] == nil {
+		t.Errorf("Unexpected exclusion %v", exclusion)
+	}
+	if owner(5) != ExcludedMac || owner(6) != "aa:bb:cc:dd:ee:02" || owner(7) != ExcludedMac || owner(8) != ExcludedMac {
+		t.Errorf("Expected the free and declined addresses to be excluded, owners %s %s %s %s", owner(5), owner(6), owner(7), owner(8))
+	}
+
+	stats := DHCPConfig.intsNet[0].handleApiReq(ApiReq{Req: "stats", NetInterface: "eth0"}).([]Stats)
+	if len(stats) != 1 || stats[0].Excluded != 3 || stats[0].Unusable != 1 || stats[0].Used != 5 || stats[0].Status != "Normal" {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	// The leased address is excluded once released
+	freeIndex(handler, 6)
+	if owner(6) != ExcludedMac {
+		t.Errorf("Expected the released address to be excluded, owned by %s", owner(6))
+	}
+	code, answer = apiRequest(router, "POST", "/api/v1/dhcp/reservations/aa:bb:cc:dd:ee:03", map[string]interface{}{"ip": "192.168.1.16"})
+	if conflict, _ := answer["conflict"].(map[string]interface{}); code != http.StatusConflict || conflict["reason"] != conflictExcluded {
+		t.Errorf("Expected an excluded address to be refused, got %d %v", code, answer)
+	}
+
+	// Shrinking the range gives the other addresses back
+	if code, answer = apiRequest(router, "POST", "/api/v1/dhcp/exclusions/"+id, map[string]interface{}{"start": "192.168.1.15"}); code != http.StatusOK {
+		t.Fatalf("Expected the exclusion to be updated, got %d %v", code, answer)
+	}
+	if owner(5) != ExcludedMac || owner(6) != FreeMac || owner(8) != FreeMac {
+		t.Errorf("Expected only index 5 to stay excluded, owners %s %s %s", owner(5), owner(6), owner(8))
+	}
+	if code, answer = apiRequest(router, "GET", "/api/v1/dhcp/exclusions/"+id, nil); code != http.StatusOK || answer["end"] != "192.168.1.15" || answer["expires_at"] != nil {
+		t.Errorf("Unexpected exclusion %d %v", code, answer)
+	}
+	if code, answer = apiRequest(router, "GET", "/api/v1/dhcp/exclusions?network=192.168.1.0", nil); code != http.StatusOK || answer["count"].(float64) != 1 {
+		t.Errorf("Unexpected list %d %v", code, answer)
+	}
+
+	for _, body := range []map[string]interface{}{
+		{"start": "192.168.1.18", "end": "192.168.1.15"},
+		{"start": "192.168.1.25", "end": "192.168.1.35"},
+		{"start": "10.0.0.1"},
+		{"start": "192.168.1.15", "expires_at": time.Now().Add(-time.Hour)},
+	} {
+		if code, _ := apiRequest(router, "POST", "/api/v1/dhcp/exclusions", body); code != http.StatusBadRequest {
+			t.Errorf("Expected %v to be refused, got %d", body, code)
+		}
+	}
+
+	if code, _ = apiRequest(router, "DELETE", "/api/v1/dhcp/exclusions/"+id, nil); code != http.StatusOK {
+		t.Fatalf("Expected the exclusion to be removed, got %d", code)
+	}
+	if owner(5) != FreeMac {
+		t.Errorf("Expected index 5 to be free, owned by %s", owner(5))
+	}
+	if code, _ = apiRequest(router, "DELETE", "/api/v1/dhcp/exclusions/"+id, nil); code != http.StatusNotFound {
+		t.Errorf("Expected a missing exclusion, got %d", code)
+	}
+	if code, _ = apiRequest(router, "POST", "/api/v1/dhcp/exclusions/"+id, map[string]interface{}{"start": "192.168.1.15"}); code != http.StatusNotFound {
+		t.Errorf("Expected a missing exclusion, got %d", code)
+	}
+
+	// Expired exclusions are removed
+	expired := time.Now().Add(-time.Minute)
+	if _, _, err := applyExclusion(Exclusion{Start: "192.168.1.20", End: "192.168.1.21", ExpiresAt: &expired}); err != nil {
+		t.Fatalf("applyExclusion failed: %v", err)
+	}
+	expireExclusions()
+	if owner(10) != FreeMac || owner(11) != FreeMac || len(handler.exclusions.list()) != 0 {
+		t.Errorf("Expected the expired exclusion to be removed, owners %s %s", owner(10), owner(11))
+	}
+	if exclusions, _ := ListExclusions(""); len(exclusions) != 0 {
+		t.Errorf("Expected the expired exclusion to be deleted, got %+v", exclusions)
+	}
+}
+
+func TestLoadExclusions(t *testing.T) {
+	dbPath := setupTestDB(t)
+	defer teardownTestDB(t, dbPath)
+	if err := InitDatabase(dbPath); err != nil {
+		t.Fatalf("InitDatabase failed: %v", err)
+	}
+
+	expired := time.Now().Add(-time.Minute)
+	for _, e := range []Exclusion{
+		{Network: "192.168.1.0", Start: "192.168.1.12", End: "192.168.1.13"},
+		{Network: "192.168.1.0", Start: "192.168.1.14", End: "192.168.1.14", ExpiresAt: &expired},
+		{Network: "10.0.0.0", Start: "10.0.0.12", End: "10.0.0.13"},
+	} {
+		if err := SaveExclusion(&e); err != nil {
+			t.Fatalf("SaveExclusion failed: %v", err)
+		}
+	}
+
+	_, handler := newReservationScope()
+	loadExclusions(handler, "192.168.1.0")
+	if !handler.exclusions.excluded(2) || !handler.exclusions.excluded(3) || handler.exclusions.excluded(4) {
+		t.Errorf("Unexpected exclusions %+v", handler.exclusions.list())
+	}
+	if free := handler.available.FreeIPsRemaining(); free != 18 {
+		t.Errorf("Expected 2 excluded addresses, got %d free", free)
+	}
+	if exclusions, _ := ListExclusions(""); len(exclusions) != 2 {
+		t.Errorf("Expected the expired exclusion to be deleted, got %+v", exclusions)
+	}
+}
+
+func TestExclusionAcrossRanges(t *testing.T) {
+	dbPath := setupTestDB(t)
+	defer teardownTestDB(t, dbPath)
+	if err := InitDatabase(dbPath); err != nil {
+		t.Fatalf("InitDatabase failed: %v", err)
+	}
+
+	prevConfig := DHCPConfig
+	defer func() { DHCPConfig = prevConfig }()
+	newScope := func() *DHCPHandler {
+		var handler *DHCPHandler
+		DHCPConfig, handler = newReservationScope()
+		handler.available = newRangePool([]*poolRange{
+			{start: net.ParseIP("192.168.1.10").To4(), end: net.ParseIP("192.168.1.19").To4(), size: 10},
+			{start: net.ParseIP("192.168.1.30").To4(), end: net.ParseIP("192.168.1.39").To4(), size: 10},
+		}, pool.StrategyRandom)
+		return handler
+	}
+	handler := newScope()
+
+	// The range spans the gap between the two ranges of the pool
+	_, held, err := applyExclusion(Exclusion{Start: "192.168.1.18", End: "192.168.1.31"})
+	if err != nil {
+		t.Fatalf("applyExclusion failed: %v", err)
+	}
+	if held != 0 {
+		t.Errorf("Expected no address in use, got %d", held)
+	}
+	excluded := func(handler *DHCPHandler) []int {
+		var indexes []int
+		for index := 0; index < handler.leaseRange; index++ {
+			if _, owner, _ := handler.available.GetMACIndex(safeIntToUint64(index)); owner == ExcludedMac {
+				indexes = append(indexes, index)
+			}
+		}
+		return indexes
+	}
+	// .18, .19, .30 and .31
+	if got := excluded(handler); fmt.Sprint(got) != "[8 9 10 11]" {
+		t.Errorf("Expected indexes 8 to 11 to be excluded, got %v", got)
+	}
+
+	// The stored exclusion covers the same addresses after a restart
+	handler = newScope()
+	loadExclusions(handler, "192.168.1.0")
+	if got := excluded(handler); fmt.Sprint(got) != "[8 9 10 11]" {
+		t.Errorf("Expected the restored exclusion to cover indexes 8 to 11, got %v", got)
+	}
+}
@@ -0,0 +1,708 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"fdurand/standalone_dhcp/pool"
+	cache "github.com/fdurand/go-cache"
+	"github.com/go-ini/ini"
+	"github.com/inverse-inc/packetfence/go/log"
+)
+
+// PeerMac holds, in the pool of a failover peer, the addresses owned by its
+// partner
+const PeerMac = "ff:ff:ff:ff:ff:fe"
+
+func init() {
+	pool.RegisterSentinelMAC(PeerMac)
+}
+
+// Failover states
+const (
+	failoverNormal      = "normal"
+	failoverInterrupted = "communications-interrupted"
+	failoverPartnerDown = "partner-down"
+)
+
+// failoverNonceSize is the number of random bytes of a handshake challenge
+const failoverNonceSize = 32
+
+// failoverQueueSize bounds the number of messages waiting to be written to the
+// partner
+const failoverQueueSize = 1024
+
+// failoverMessage is a line of the peer protocol
+type failoverMessage struct {
+	Type      string    `json:"type"` // hello, auth, ping, bind or release
+	Role      string    `json:"role,omitempty"`
+	Nonce     string    `json:"nonce,omitempty"`
+	Auth      string    `json:"auth,omitempty"`
+	Network   string    `json:"network,omitempty"`
+	MAC       string    `json:"mac,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+// Failover pairs two servers. Every pool is split between them: the primary
+// owns the first share percent of the indexes and the secondary the rest, and
+// each server keeps its partner's indexes reserved with PeerMac. The servers
+// exchange their bindings over a TCP connection, TLS when configured, opened
+// by the secondary. The peers prove to each other they know the shared secret
+// by answering the random challenge of the other one. When the partner has
+// been unreachable for the safety period the survivor takes over the
+// partner's free addresses until the partner comes back.
+type Failover struct {
+	role         string // primary or secondary
+	listen       string // Address the primary listens on
+	peer         string // Address of the primary the secondary connects to
+	share        int    // Percentage of every pool owned by the primary
+	safetyPeriod time.Duration
+	heartbeat    time.Duration
+	secret       string
+	tls          *tls.Config // TLS of the peer connection, nil for plain TCP
+	config       *Interfaces
+
+	lock     sync.Mutex
+	conn     net.Conn
+	outbox   chan failoverMessage // Messages to write to the partner, nil when not connected
+	resync   bool                 // A message was dropped, every binding has to be sent again
+	state    string
+	lostAt   time.Time
+	listener net.Listener
+}
+
+// failover is the failover peer of the daemon, nil when it runs alone
+var failover *Failover
+
+// FailoverStatus describes the state of the failover peer
+type FailoverStatus struct {
+	Role         string     `json:"role"`
+	State        string     `json:"state"`
+	Connected    bool       `json:"connected"`
+	Share        int        `json:"share"`
+	SafetyPeriod string     `json:"safety_period"`
+	LostAt       *time.Time `json:"lost_at,omitempty"`
+}
+
+// readFailoverConfig reads the [failover] section, it returns nil when the
+// server is not part of a pair
+func readFailoverConfig(path string) (*Failover, error) {
+	cfg, err := ini.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read file: %w", err)
+	}
+	sec, err := cfg.GetSection("failover")
+	if err != nil || sec.Key("role").String() == "" {
+		return nil, nil
+	}
+
+	f := &Failover{
+		role:   sec.Key("role").String(),
+		listen: sec.Key("listen").String(),
+		peer:   sec.Key("peer").String(),
+		secret: sec.Key("secret").String(),
+		state:  failoverInterrupted,
+		lostAt: time.Now(),
+	}
+	switch f.role {
+	case "primary":
+		if f.listen == "" {
+			return nil, errors.New("failover listen address is required for the primary")
+		}
+	case "secondary":
+		if f.peer == "" {
+			return nil, errors.New("failover peer address is required for the secondary")
+		}
+	default:
+		return nil, fmt.Errorf("invalid failover role %q, must be primary or secondary", f.role)
+	}
+
+	if f.share, err = sec.Key("share").Int(); err != nil || f.share < 0 || f.share > 100 {
+		if sec.Key("share").String() != "" {
+			return nil, fmt.Errorf("invalid failover share %q, must be between 0 and 100", sec.Key("share").String())
+		}
+		f.share = 50
+	}
+	safety, err := strconv.Atoi(sec.Key("safety_period").MustString("3600"))
+	if err != nil || safety < 0 {
+		return nil, fmt.Errorf("invalid failover safety_period %q", sec.Key("safety_period").String())
+	}
+	f.safetyPeriod = time.Duration(safety) * time.Second
+	heartbeat, err := strconv.Atoi(sec.Key("heartbeat").MustString("5"))
+	if err != nil || heartbeat <= 0 {
+		return nil, fmt.Errorf("invalid failover heartbeat %q", sec.Key("heartbeat").String())
+	}
+	f.heartbeat = time.Duration(heartbeat) * time.Second
+	if f.secret == "" {
+		return nil, errors.New("failover secret is required")
+	}
+	if f.tls, err = readFailoverTLS(sec); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// readFailoverTLS reads the certificate of the peer connection, nil when TLS
+// is disabled. With a CA, each peer must present a certificate it signed.
+func readFailoverTLS(sec *ini.Section) (*tls.Config, error) {
+	certFile, keyFile, caFile := sec.Key("tls_cert").String(), sec.Key("tls_key").String(), sec.Key("tls_ca").String()
+	if certFile == "" && keyFile == "" {
+		if caFile != "" {
+			return nil, errors.New("failover tls_ca requires tls_cert and tls_key")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("failover tls_cert and tls_key must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the failover certificate: %w", err)
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the failover CA: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in the failover CA " + caFile)
+		}
+		config.ClientCAs = config.RootCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// start connects the pair and watches the partner until the context is
+// cancelled
+func (f *Failover) start(ctx context.Context) error {
+	if f.role == "primary" {
+		listener, err := net.Listen("tcp", f.listen)
+		if err != nil {
+			return fmt.Errorf("failed to listen for the failover peer: %w", err)
+		}
+		if f.tls != nil {
+			listener = tls.NewListener(listener, f.tls)
+		}
+		f.lock.Lock()
+		f.listener = listener
+		f.lock.Unlock()
+		go f.accept(ctx, listener)
+	} else {
+		go f.dial(ctx)
+	}
+	go f.watch(ctx)
+
+	go func() {
+		<-ctx.Done()
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		if f.listener != nil {
+			f.listener.Close()
+		}
+		if f.conn != nil {
+			f.conn.Close()
+		}
+	}()
+	return nil
+}
+
+func (f *Failover) accept(ctx context.Context, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.LoggerWContext(ctx).Error("Failover listener stopped: " + err.Error())
+			}
+			return
+		}
+		go f.serve(ctx, conn)
+	}
+}
+
+func (f *Failover) dial(ctx context.Context) {
+	dialer := net.Dialer{Timeout: f.heartbeat}
+	var tlsDialer *tls.Dialer
+	if f.tls != nil {
+		config := f.tls.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(f.peer)
+		tlsDialer = &tls.Dialer{NetDialer: &dialer, Config: config}
+	}
+	for ctx.Err() == nil {
+		var conn net.Conn
+		var err error
+		if tlsDialer != nil {
+			conn, err = tlsDialer.DialContext(ctx, "tcp", f.peer)
+		} else {
+			conn, err = dialer.DialContext(ctx, "tcp", f.peer)
+		}
+		if err == nil {
+			f.serve(ctx, conn)
+		} else {
+			log.LoggerWContext(ctx).Debug("Unable to connect to the failover peer " + f.peer + ": " + err.Error())
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(f.heartbeat):
+		}
+	}
+}
+
+// watch takes over the partner's addresses once it has been unreachable for
+// the safety period
+func (f *Failover) watch(ctx context.Context) {
+	ticker := time.NewTicker(f.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		f.lock.Lock()
+		expired := f.state == failoverInterrupted && time.Since(f.lostAt) >= f.safetyPeriod
+		if expired {
+			f.state = failoverPartnerDown
+		}
+		f.lock.Unlock()
+		if expired {
+			log.LoggerWContext(ctx).Warn("Failover partner unreachable for " + f.safetyPeriod.String() + ", taking over its addresses")
+			f.takeover()
+		}
+	}
+}
+
+// auth is the answer of the peer of a role to a challenge: the HMAC of the
+// secret over its role, the challenge and its own nonce, so that an answer is
+// only valid for one connection and cannot be reflected to its sender
+func (f *Failover) auth(role string, challenge string, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(f.secret))
+	mac.Write([]byte(role + "\n" + challenge + "\n" + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// serve runs the peer protocol on a connection until it breaks
+func (f *Failover) serve(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	partnerRole := "secondary"
+	if f.role == "secondary" {
+		partnerRole = "primary"
+	}
+
+	// Each peer challenges the other with a nonce and answers the challenge
+	// it got
+	b := make([]byte, failoverNonceSize)
+	if _, err := rand.Read(b); err != nil {
+		log.LoggerWContext(ctx).Error("Unable to generate the failover challenge: " + err.Error())
+		return
+	}
+	nonce := hex.EncodeToString(b)
+	encoder := json.NewEncoder(conn)
+	conn.SetWriteDeadline(time.Now().Add(f.heartbeat))
+	if err := encoder.Encode(failoverMessage{Type: "hello", Role: f.role, Nonce: nonce}); err != nil {
+		return
+	}
+
+	scanner := bufio.NewScanner(conn)
+	conn.SetReadDeadline(time.Now().Add(3 * f.heartbeat))
+	var hello failoverMessage
+	if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &hello) != nil || hello.Type != "hello" || len(hello.Nonce) != 2*failoverNonceSize || hello.Nonce == nonce {
+		log.LoggerWContext(ctx).Error("Invalid failover handshake from " + conn.RemoteAddr().String())
+		return
+	}
+	if hello.Role != partnerRole {
+		log.LoggerWContext(ctx).Error("Failover peer " + conn.RemoteAddr().String() + " rejected, wrong role " + hello.Role)
+		return
+	}
+	if err := encoder.Encode(failoverMessage{Type: "auth", Auth: f.auth(f.role, hello.Nonce, nonce)}); err != nil {
+		return
+	}
+	var answer failoverMessage
+	if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &answer) != nil || answer.Type != "auth" {
+		log.LoggerWContext(ctx).Error("Invalid failover handshake from " + conn.RemoteAddr().String())
+		return
+	}
+	if !hmac.Equal([]byte(answer.Auth), []byte(f.auth(partnerRole, nonce, hello.Nonce))) {
+		log.LoggerWContext(ctx).Error("Failover peer " + conn.RemoteAddr().String() + " rejected, wrong secret")
+		return
+	}
+
+	f.lock.Lock()
+	if f.conn != nil {
+		f.lock.Unlock()
+		log.LoggerWContext(ctx).Error("Failover peer already connected, rejecting " + conn.RemoteAddr().String())
+		return
+	}
+	recovered := f.state == failoverPartnerDown
+	outbox := make(chan failoverMessage, failoverQueueSize)
+	f.conn = conn
+	f.outbox = outbox
+	f.resync = false
+	f.state = failoverNormal
+	f.lock.Unlock()
+	log.LoggerWContext(ctx).Info("Failover partner " + conn.RemoteAddr().String() + " connected")
+
+	if recovered {
+		log.LoggerWContext(ctx).Info("Failover partner is back, handing its free addresses back")
+		f.claimAll()
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go f.write(ctx, conn, encoder, outbox, done)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(3 * f.heartbeat))
+		if !scanner.Scan() {
+			break
+		}
+		var message failoverMessage
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			log.LoggerWContext(ctx).Error("Invalid failover message: " + err.Error())
+			continue
+		}
+		switch message.Type {
+		case "bind":
+			f.applyBind(message)
+		case "release":
+			f.applyRelease(message)
+		}
+	}
+
+	f.lock.Lock()
+	if f.conn == conn {
+		f.conn = nil
+		f.outbox = nil
+		if f.state == failoverNormal {
+			f.state = failoverInterrupted
+			f.lostAt = time.Now()
+		}
+	}
+	f.lock.Unlock()
+	log.LoggerWContext(ctx).Warn("Failover partner " + conn.RemoteAddr().String() + " lost")
+}
+
+// write is the only writer of a connection to the partner: it sends every
+// binding, then the queued messages and the keepalives until done is closed.
+// Every binding is sent again once the queue is drained when a message was
+// dropped. A failed write closes the connection.
+func (f *Failover) write(ctx context.Context, conn net.Conn, encoder *json.Encoder, outbox chan failoverMessage, done chan struct{}) {
+	encode := func(messages ...failoverMessage) bool {
+		for _, message := range messages {
+			conn.SetWriteDeadline(time.Now().Add(f.heartbeat))
+			if err := encoder.Encode(message); err != nil {
+				log.LoggerWContext(ctx).Error("Unable to send to the failover partner: " + err.Error())
+				conn.Close()
+				return false
+			}
+		}
+		return true
+	}
+
+	if !encode(f.bindings()...) {
+		return
+	}
+	ticker := time.NewTicker(f.heartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if !encode(failoverMessage{Type: "ping"}) {
+				return
+			}
+		case message := <-outbox:
+			if !encode(message) {
+				return
+			}
+		}
+		if len(outbox) == 0 && f.takeResync() {
+			log.LoggerWContext(ctx).Info("Sending every binding to the failover partner again")
+			if !encode(f.bindings()...) {
+				return
+			}
+		}
+	}
+}
+
+// takeResync returns whether a message was dropped since the last call
+func (f *Failover) takeResync() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	resync := f.resync
+	f.resync = false
+	return resync
+}
+
+// send queues a message for the partner, it is dropped when the partner is
+// not connected. A message that does not fit in the queue is dropped too and
+// every binding is sent again once the queue is drained: the callers, which
+// answer the clients, never wait for the partner.
+func (f *Failover) send(message failoverMessage) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.outbox == nil {
+		return
+	}
+	select {
+	case f.outbox <- message:
+	default:
+		if !f.resync {
+			log.LoggerWContext(ctx).Warn("Failover partner too slow, dropping the updates until it catches up")
+		}
+		f.resync = true
+	}
+}
+
+// publishBind tells the partner about a binding
+func (f *Failover) publishBind(network, mac, ip string, expiresAt time.Time) {
+	if f == nil {
+		return
+	}
+	f.send(failoverMessage{Type: "bind", Network: network, MAC: mac, IP: ip, ExpiresAt: expiresAt})
+}
+
+// publishRelease tells the partner a binding is gone
+func (f *Failover) publishRelease(network, mac, ip string) {
+	if f == nil {
+		return
+	}
+	f.send(failoverMessage{Type: "release", Network: network, MAC: mac, IP: ip})
+}
+
+// bindings returns the messages of every active binding
+func (f *Failover) bindings() []failoverMessage {
+	var messages []failoverMessage
+	for _, I := range f.config.interfaces() {
+		for _, v := range I.networks() {
+			for mac, item := range v.dhcpHandler.hwcache.Items() {
+				index, ok := item.Object.(int)
+				if !ok {
+					continue
+				}
+				if _, owner, _ := v.dhcpHandler.available.GetMACIndex(safeIntToUint64(index)); owner != mac {
+					continue
+				}
+				// Offers are not bindings yet
+				expiresAt := time.Unix(0, item.Expiration).Add(-15 * time.Second)
+				if time.Until(expiresAt) <= 0 {
+					continue
+				}
+				messages = append(messages, failoverMessage{Type: "bind", Network: v.network.IP.String(), MAC: mac, IP: v.dhcpHandler.ipAt(index).String(), ExpiresAt: expiresAt})
+			}
+		}
+	}
+	return messages
+}
+
+// scope returns the live scope of a network
+func (f *Failover) scope(network string) *DHCPHandler {
+	for _, I := range f.config.interfaces() {
+		for _, v := range I.networks() {
+			if v.network.IP.String() == network {
+				return v.dhcpHandler
+			}
+		}
+	}
+	return nil
+}
+
+// applyBind records a binding made by the partner
+func (f *Failover) applyBind(message failoverMessage) {
+	handler := f.scope(message.Network)
+	if handler == nil {
+		return
+	}
+	index := handler.indexOf(net.ParseIP(message.IP))
+	remaining := time.Until(message.ExpiresAt)
+	if index < 0 || index >= handler.leaseRange || remaining <= 0 {
+		return
+	}
+
+	if _, owner, err := handler.available.GetMACIndex(safeIntToUint64(index)); err == nil && owner != message.MAC {
+		// The partner is authoritative on its own addresses
+		if owner != PeerMac && owner != FakeMac && f.owns(handler, index) {
+			log.LoggerWContext(ctx).Error("Failover conflict on " + message.IP + ": bound to " + owner + " here and to " + message.MAC + " by the partner")
+			return
+		}
+		handler.available.FreeIPIndex(safeIntToUint64(index))
+	}
+	if _, owner, _ := handler.available.GetMACIndex(safeIntToUint64(index)); owner != message.MAC {
+		if err, _ := handler.available.ReserveIPIndex(safeIntToUint64(index), message.MAC); err != nil {
+			return
+		}
+	}
+
+	// The client moved to another address
+	if x, found := handler.hwcache.Get(message.MAC); found && x.(int) != index {
+		if _, owner, _ := handler.available.GetMACIndex(safeIntToUint64(x.(int))); owner == message.MAC {
+			freeIndex(handler, x.(int))
+		}
+	}
+
+	handler.hwcache.Set(message.MAC, index, remaining+(time.Duration(15)*time.Second))
+	handler.setPeerBound(message.MAC, true)
+	GlobalIpCache.Set(message.IP, message.MAC, remaining+(time.Duration(15)*time.Second))
+	GlobalMacCache.Set(message.MAC, message.IP, remaining+(time.Duration(15)*time.Second))
+	if err := SaveLease(Lease{MAC: message.MAC, IP: message.IP, Network: message.Network, ExpiresAt: message.ExpiresAt, Partner: true}); err != nil {
+		log.LoggerWContext(ctx).Error("Unable to persist the lease of " + message.MAC + ": " + err.Error())
+	}
+}
+
+// applyRelease drops a binding released by the partner
+func (f *Failover) applyRelease(message failoverMessage) {
+	handler := f.scope(message.Network)
+	if handler == nil {
+		return
+	}
+	index := handler.indexOf(net.ParseIP(message.IP))
+	if x, found := handler.hwcache.Get(message.MAC); found && x.(int) == index {
+		// The partner published the release, the eviction must not again
+		if err := DeleteLease(message.Network, message.MAC); err != nil && err != sql.ErrNoRows {
+			log.LoggerWContext(ctx).Error("Unable to delete the lease of " + message.MAC + ": " + err.Error())
+		}
+		handler.hwcache.Delete(message.MAC)
+	}
+}
+
+// owns returns whether the index of the pool belongs to this server
+func (f *Failover) owns(handler *DHCPHandler, index int) bool {
+	boundary := handler.leaseRange * f.share / 100
+	if f.role == "primary" {
+		return index < boundary
+	}
+	return index >= boundary
+}
+
+// claim reserves the free addresses of the partner in the pool of a scope
+func (f *Failover) claim(handler *DHCPHandler) {
+	if f == nil {
+		return
+	}
+	f.lock.Lock()
+	down := f.state == failoverPartnerDown
+	f.lock.Unlock()
+	if down {
+		return
+	}
+	for index := 0; index < handler.leaseRange; index++ {
+		if !f.owns(handler, index) && handler.available.IsFreeIPAtIndex(safeIntToUint64(index)) {
+			handler.available.ReserveIPIndex(safeIntToUint64(index), PeerMac)
+		}
+	}
+}
+
+// claimAll reserves the free addresses of the partner in every scope
+func (f *Failover) claimAll() {
+	for _, I := range f.config.interfaces() {
+		for _, v := range I.networks() {
+			f.claim(v.dhcpHandler)
+		}
+	}
+}
+
+// takeover frees the addresses of the partner in every scope
+func (f *Failover) takeover() {
+	taken := 0
+	for _, I := range f.config.interfaces() {
+		for _, v := range I.networks() {
+			for index := 0; index < v.dhcpHandler.leaseRange; index++ {
+				if _, owner, _ := v.dhcpHandler.available.GetMACIndex(safeIntToUint64(index)); owner == PeerMac {
+					v.dhcpHandler.available.FreeIPIndex(safeIntToUint64(index))
+					taken++
+				}
+			}
+		}
+	}
+	log.LoggerWContext(ctx).Info("Took over " + strconv.Itoa(taken) + " addresses of the failover partner")
+}
+
+// reclaim gives an index freed in the pool back to the partner when it owns it
+func (f *Failover) reclaim(handler *DHCPHandler, index int) {
+	if f == nil || f.owns(handler, index) {
+		return
+	}
+	f.lock.Lock()
+	down := f.state == failoverPartnerDown
+	f.lock.Unlock()
+	if !down {
+		handler.available.ReserveIPIndex(safeIntToUint64(index), PeerMac)
+	}
+}
+
+// status reports the state of the pair
+func (f *Failover) status() FailoverStatus {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	status := FailoverStatus{Role: f.role, State: f.state, Connected: f.conn != nil, Share: f.share, SafetyPeriod: f.safetyPeriod.String()}
+	if f.state != failoverNormal {
+		lostAt := f.lostAt
+		status.LostAt = &lostAt
+	}
+	return status
+}
+
+// setPeerBound records whether the binding of a MAC address was copied from
+// the partner: its expiry is then neither published back nor reported here
+func (h *DHCPHandler) setPeerBound(mac string, peer bool) {
+	if h.peerBound == nil {
+		return
+	}
+	if peer {
+		h.peerBound.Set(mac, true, cache.NoExpiration)
+	} else {
+		h.peerBound.Delete(mac)
+	}
+}
+
+// isPeerBound returns whether the binding of a MAC address was copied from
+// the partner
+func (h *DHCPHandler) isPeerBound(mac string) bool {
+	if h.peerBound == nil {
+		return false
+	}
+	_, found := h.peerBound.Get(mac)
+	return found
+}
+
+// takePeerBound returns whether the binding of a MAC address was copied from
+// the partner and forgets it, the binding being gone
+func (h *DHCPHandler) takePeerBound(mac string) bool {
+	peer := h.isPeerBound(mac)
+	h.setPeerBound(mac, false)
+	return peer
+}
+
+// freeIndex puts an index back in the pool of a scope. A static assignment
+// keeps its index and a failover peer keeps the addresses of its partner aside.
+func freeIndex(handler *DHCPHandler, index int) {
+	if handler.isStatic(index) {
+		return
+	}
+	handler.available.FreeIPIndex(safeIntToUint64(index))
+	if handler.exclusions.excluded(index) {
+		// Excluded while it was bound
+		handler.available.ReserveIPIndex(safeIntToUint64(index), ExcludedMac)
+		return
+	}
+	failover.reclaim(handler, index)
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	cache "github.com/fdurand/go-cache"
+	"github.com/go-ini/ini"
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// newFailoverTestConfig builds a configuration serving 192.168.1.10-19
+func newFailoverTestConfig() (*Interfaces, *DHCPHandler) {
+	startIP := net.ParseIP("192.168.1.10").To4()
+	endIP := net.ParseIP("192.168.1.19").To4()
+	handler := &DHCPHandler{
+		leaseRange: dhcp.IPRange(startIP, endIP),
+		available:  newTestRangePool(startIP, dhcp.IPRange(startIP, endIP)),
+		hwcache:    cache.New(time.Hour, 10*time.Second),
+	}
+	_, network, _ := net.ParseCIDR("192.168.1.0/24")
+	I := &Interface{Name: "eth0", network: []Network{{network: *network, dhcpHandler: handler}}}
+	return &Interfaces{intsNet: []*Interface{I}}, handler
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReadFailoverConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "godhcp.ini")
+
+	os.WriteFile(path, []byte("[interfaces]\nlisten=eth0\n"), 0644)
+	if f, err := readFailoverConfig(path); err != nil || f != nil {
+		t.Errorf("Expected no failover, got %v (%v)", f, err)
+	}
+
+	os.WriteFile(path, []byte("[failover]\nrole=secondary\npeer=192.168.1.1:647\nshare=70\nsafety_period=60\nsecret=s3cr3t\n"), 0644)
+	f, err := readFailoverConfig(path)
+	if err != nil {
+		t.Fatalf("readFailoverConfig failed: %v", err)
+	}
+	if f.role != "secondary" || f.share != 70 || f.safetyPeriod != time.Minute || f.heartbeat != 5*time.Second {
+		t.Errorf("Unexpected failover %+v", f)
+	}
+
+	for _, config := range []string{
+		"[failover]\nrole=backup\n",
+		"[failover]\nrole=primary\n",
+		"[failover]\nrole=primary\nlisten=:647\nshare=150\n",
+		"[failover]\nrole=primary\nlisten=:647\n",
+		"[failover]\nrole=primary\nlisten=:647\nsecret=s3cr3t\ntls_cert=cert.pem\n",
+		"[failover]\nrole=primary\nlisten=:647\nsecret=s3cr3t\ntls_ca=ca.pem\n",
+	} {
+		os.WriteFile(path, []byte(config), 0644)
+		if _, err := readFailoverConfig(path); err == nil {
+			t.Errorf("Expected an error for %q", config)
+		}
+	}
+}
+
+func TestFailoverShare(t *testing.T) {
+	_, handler := newFailoverTestConfig()
+	primary := &Failover{role: "primary", share: 60, state: failoverInterrupted}
+	primary.claim(handler)
+	if free := handler.available.FreeIPsRemaining(); free != 6 {
+		t.Errorf("Expected the primary to own 6 addresses, got %d", free)
+	}
+	if _, owner, _ := handler.available.GetMACIndex(6); owner != PeerMac {
+		t.Errorf("Expected index 6 to be set aside for the partner, got %s", owner)
+	}
+
+	_, handler = newFailoverTestConfig()
+	secondary := &Failover{role: "secondary", share: 60, state: failoverInterrupted}
+	secondary.claim(handler)
+	if free := handler.available.FreeIPsRemaining(); free != 4 {
+		t.Errorf("Expected the secondary to own 4 addresses, got %d", free)
+	}
+	for i := 0; i < 10; i++ {
+		index, _, err := handler.available.GetFreeIPIndex("aa:bb:cc:dd:ee:ff")
+		if err != nil {
+			break
+		}
+		if index < 6 {
+			t.Errorf("The secondary handed out index %d of the primary", index)
+		}
+	}
+}
+
+// TestFailoverPair runs a primary and a secondary over the loopback
+func TestFailoverPair(t *testing.T) {
+	dbPath := setupTestDB(t)
+	defer teardownTestDB(t, dbPath)
+	if err := InitDatabase(dbPath); err != nil {
+		t.Fatalf("InitDatabase failed: %v", err)
+	}
+	prevIp, prevMac := GlobalIpCache, GlobalMacCache
+	defer func() { GlobalIpCache, GlobalMacCache = prevIp, prevMac }()
+	GlobalIpCache = cache.New(5*time.Minute, 10*time.Minute)
+	GlobalMacCache = cache.New(5*time.Minute, 10*time.Minute)
+
+	config1, handler1 := newFailoverTestConfig()
+	config2, handler2 := newFailoverTestConfig()
+	primary := &Failover{role: "primary", listen: "127.0.0.1:0", share: 50, safetyPeriod: 200 * time.Millisecond, heartbeat: 50 * time.Millisecond, secret: "s3cr3t", config: config1, state: failoverInterrupted, lostAt: time.Now().Add(time.Hour)}
+	primary.claim(handler1)
+
+	// The primary binds an address before its partner shows up
+	const mac = "aa:bb:cc:dd:ee:01"
+	handler1.available.ReserveIPIndex(1, mac)
+	handler1.hwcache.Set(mac, 1, time.Hour+15*time.Second)
+
+	ctx1, stopPrimary := context.WithCancel(context.Background())
+	defer stopPrimary()
+	if err := primary.start(ctx1); err != nil {
+		t.Fatalf("Unable to start the primary: %v", err)
+	}
+
+	secondary := &Failover{role: "secondary", peer: primary.listener.Addr().String(), share: 50, safetyPeriod: 200 * time.Millisecond, heartbeat: 50 * time.Millisecond, secret: "s3cr3t", config: config2, state: failoverInterrupted, lostAt: time.Now().Add(time.Hour)}
+	secondary.claim(handler2)
+	ctx2, stopSecondary := context.WithCancel(context.Background())
+	defer stopSecondary()
+	secondary.start(ctx2)
+
+	waitFor(t, "the pair to connect", func() bool {
+		return primary.status().State == failoverNormal && secondary.status().State == failoverNormal
+	})
+
+	// The existing binding is synchronized on connection
+	waitFor(t, "the initial synchronization", func() bool {
+		x, found := handler2.hwcache.Get(mac)
+		return found && x.(int) == 1
+	})
+	if _, owner, _ := handler2.available.GetMACIndex(1); owner != mac {
+		t.Errorf("Expected index 1 to be reserved for %s on the secondary, got %s", mac, owner)
+	}
+
+	// The secondary binds one of its addresses, the primary learns it
+	const mac2 = "aa:bb:cc:dd:ee:02"
+	handler2.available.ReserveIPIndex(7, mac2)
+	handler2.hwcache.Set(mac2, 7, time.Hour)
+	secondary.publishBind("192.168.1.0", mac2, "192.168.1.17", time.Now().Add(time.Hour))
+	waitFor(t, "the binding update", func() bool {
+		_, owner, _ := handler1.available.GetMACIndex(7)
+		return owner == mac2
+	})
+	if leases, _ := ListActiveLeases("192.168.1.0"); len(leases) != 2 {
+		t.Errorf("Expected the partner bindings to be persisted, got %+v", leases)
+	}
+
+	secondary.publishRelease("192.168.1.0", mac2, "192.168.1.17")
+	waitFor(t, "the release update", func() bool {
+		_, found := handler1.hwcache.Get(mac2)
+		return !found
+	})
+
+	// The primary goes away, the secondary takes over its free addresses
+	freeBefore := handler2.available.FreeIPsRemaining()
+	stopPrimary()
+	waitFor(t, "the takeover", func() bool {
+		return secondary.status().State == failoverPartnerDown
+	})
+	if free := handler2.available.FreeIPsRemaining(); free != freeBefore+4 {
+		t.Errorf("Expected the 4 free addresses of the primary to be taken over, got %d free instead of %d", free, freeBefore)
+	}
+	if _, owner, _ := handler2.available.GetMACIndex(1); owner != mac {
+		t.Error("The takeover must not free the bindings of the partner")
+	}
+}
+
+func TestFailoverRejectsWrongSecret(t *testing.T) {
+	config1, _ := newFailoverTestConfig()
+	config2, _ := newFailoverTestConfig()
+	primary := &Failover{role: "primary", listen: "127.0.0.1:0", share: 50, safetyPeriod: time.Hour, heartbeat: 50 * time.Millisecond, secret: "s3cr3t", config: config1, state: failoverInterrupted, lostAt: time.Now()}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := primary.start(ctx); err != nil {
+		t.Fatalf("Unable to start the primary: %v", err)
+	}
+	secondary := &Failover{role: "secondary", peer: primary.listener.Addr().String(), share: 50, safetyPeriod: time.Hour, heartbeat: 50 * time.Millisecond, secret: "wrong", config: config2, state: failoverInterrupted, lostAt: time.Now()}
+	secondary.start(ctx)
+
+	time.Sleep(300 * time.Millisecond)
+	if primary.status().Connected || secondary.status().Connected {
+		t.Error("Expected peers with different secrets not to pair")
+	}
+}
+
+func TestFailoverAuth(t *testing.T) {
+	f := &Failover{secret: "s3cr3t"}
+	answer := f.auth("secondary", "challenge", "nonce")
+	if answer == f.auth("secondary", "other challenge", "nonce") {
+		t.Error("Expected the answer to depend on the challenge")
+	}
+	if answer == f.auth("primary", "challenge", "nonce") {
+		t.Error("Expected the answer to depend on the role")
+	}
+	if answer == (&Failover{secret: "wrong"}).auth("secondary", "challenge", "nonce") {
+		t.Error("Expected the answer to depend on the secret")
+	}
+}
+
+func TestFailoverTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	write := func(name string, content []byte) string {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, content, 0600)
+		return path
+	}
+	caFile := write("ca.pem", ca.pem)
+	cert, key := ca.issue(t, "primary", 2)
+	primaryConfig := write("primary.ini", []byte("[failover]\nrole=primary\nlisten=127.0.0.1:0\nsecret=s3cr3t\ntls_cert="+write("primary.pem", cert)+"\ntls_key="+write("primary.key", key)+"\ntls_ca="+caFile+"\n"))
+	cert, key = ca.issue(t, "secondary", 3)
+	secondaryConfig := write("secondary.ini", []byte("[failover]\nrole=secondary\npeer=127.0.0.1:647\nsecret=s3cr3t\ntls_cert="+write("secondary.pem", cert)+"\ntls_key="+write("secondary.key", key)+"\ntls_ca="+caFile+"\n"))
+
+	primary, err := readFailoverConfig(primaryConfig)
+	if err != nil || primary.tls == nil {
+		t.Fatalf("Expected the primary to use TLS: %v", err)
+	}
+	secondary, err := readFailoverConfig(secondaryConfig)
+	if err != nil || secondary.tls == nil {
+		t.Fatalf("Expected the secondary to use TLS: %v", err)
+	}
+	primary.config, _ = newFailoverTestConfig()
+	secondary.config, _ = newFailoverTestConfig()
+	primary.heartbeat, secondary.heartbeat = 50*time.Millisecond, 50*time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := primary.start(ctx); err != nil {
+		t.Fatalf("Unable to start the primary: %v", err)
+	}
+	secondary.peer = primary.listener.Addr().String()
+	secondary.start(ctx)
+	waitFor(t, "the pair to connect over TLS", func() bool {
+		return primary.status().Connected && secondary.status().Connected
+	})
+}
+
+func TestFailoverSendNeverBlocks(t *testing.T) {
+	f := &Failover{outbox: make(chan failoverMessage, 1)}
+	f.publishBind("192.168.1.0", "aa:bb:cc:dd:ee:01", "192.168.1.10", time.Now().Add(time.Hour))
+	if f.takeResync() {
+		t.Error("Expected the first message to be queued")
+	}
+
+	// The partner does not read, the queue is full
+	f.publishBind("192.168.1.0", "aa:bb:cc:dd:ee:02", "192.168.1.11", time.Now().Add(time.Hour))
+	if len(f.outbox) != 1 || !f.takeResync() {
+		t.Error("Expected the message to be dropped and every binding to be sent again")
+	}
+	if f.takeResync() {
+		t.Error("Expected the resynchronization to be taken once")
+	}
+}
+
+func TestFailoverPartnerBindingExpiry(t *testing.T) {
+	dbPath := setupTestDB(t)
+	defer teardownTestDB(t, dbPath)
+	if err := InitDatabase(dbPath); err != nil {
+		t.Fatalf("InitDatabase failed: %v", err)
+	}
+	prevFailover, prevEvents := failover, leaseEvents
+	defer func() { failover, leaseEvents = prevFailover, prevEvents }()
+	leaseEvents = newEventBus()
+	prevIp, prevMac := GlobalIpCache, GlobalMacCache
+	defer func() { GlobalIpCache, GlobalMacCache = prevIp, prevMac }()
+	GlobalIpCache = cache.New(5*time.Minute, 10*time.Minute)
+	GlobalMacCache = cache.New(5*time.Minute, 10*time.Minute)
+
+	cfg, _ := ini.ShadowLoad([]byte(`
+[network 192.168.1.0]
+netmask=255.255.255.0
+gateway=192.168.1.1
+dhcp_start=192.168.1.10
+dhcp_end=192.168.1.19
+dhcp_default_lease_time=3600
+`))
+	sec := cfg.Section("network 192.168.1.0")
+	ranges, _ := parseRanges(sec)
+	I := &Interface{Name: "eth0", InterfaceType: "server", intNet: &net.Interface{Name: "eth0"}}
+	I.network = append(I.network, newNetwork("network 192.168.1.0", sec, "192.168.1.0", ranges, net.ParseIP("192.168.1.1"), I.Name))
+	handler := I.networks()[0].dhcpHandler
+	failover = &Failover{role: "primary", share: 50, state: failoverNormal, config: &Interfaces{intsNet: []*Interface{I}}, outbox: make(chan failoverMessage, 4)}
+
+	// A binding of the partner and one made here, both run out
+	const peerMac, localMac = "aa:bb:cc:00:00:01", "aa:bb:cc:00:00:02"
+	failover.applyBind(failoverMessage{Type: "bind", Network: "192.168.1.0", MAC: peerMac, IP: "192.168.1.18", ExpiresAt: time.Now().Add(time.Hour)})
+	if _, owner, _ := handler.available.GetMACIndex(8); owner != peerMac {
+		t.Fatalf("Expected index 8 to be bound to %s, got %s", peerMac, owner)
+	}
+	handler.available.ReserveIPIndex(1, localMac)
+	SaveLease(Lease{MAC: localMac, IP: "192.168.1.11", Network: "192.168.1.0", ExpiresAt: time.Now().Add(time.Hour)})
+	handler.hwcache.Set(peerMac, 8, time.Millisecond)
+	handler.hwcache.Set(localMac, 1, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	handler.hwcache.DeleteExpired()
+
+	// Only the expiry of the local binding is published to the partner
+	select {
+	case message := <-failover.outbox:
+		if message.Type != "release" || message.MAC != localMac {
+			t.Errorf("Expected the release of %s, got %+v", localMac, message)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the expiry of the local binding to be published")
+	}
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case message := <-failover.outbox:
+		t.Errorf("Unexpected message %+v", message)
+	default:
+	}
+
+	leaseEvents.lock.Lock()
+	defer leaseEvents.lock.Unlock()
+	for _, e := range leaseEvents.history {
+		if e.Type == EventExpiry && e.MAC == peerMac {
+			t.Errorf("Expected no expiry event for the binding of the partner, got %+v", e)
+		}
+	}
+	if leases, _ := ListActiveLeases("192.168.1.0"); len(leases) != 0 {
+		t.Errorf("Expected both leases to be deleted, got %+v", leases)
+	}
+}
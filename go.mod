@@ -7,7 +7,6 @@ require (
 	github.com/davecgh/go-spew v1.1.1
 	github.com/fdurand/arp v0.0.0-20180807174648-27b38d3af1be
 	github.com/fdurand/go-cache v2.1.0+incompatible
-	github.com/fdurand/standalone_dhcp v0.0.0-20200317013142-1c360f7ef46c
 	github.com/go-errors/errors v1.1.1
 	github.com/go-ini/ini v1.62.0
 	github.com/go-sql-driver/mysql v1.6.0
@@ -17,7 +16,8 @@ require (
 	github.com/mattn/go-sqlite3 v1.14.32
 	github.com/mdlayher/ethernet v0.0.0-20190606142754-0394541c37b7
 	github.com/mdlayher/raw v0.0.0-20191009151244-50f2db8cc065
-	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4
+	github.com/miekg/dns v1.1.73
+	golang.org/x/net v0.57.0
 )
 
 require (
@@ -29,6 +29,6 @@ require (
 	github.com/kr/text v0.1.0 // indirect
 	github.com/mattn/go-colorable v0.1.4 // indirect
 	github.com/mattn/go-isatty v0.0.12 // indirect
-	golang.org/x/sys v0.0.0-20210330210617-4fbd30eecc44 // indirect
+	golang.org/x/sys v0.47.0 // indirect
 	gopkg.in/ini.v1 v1.67.0 // indirect
 )
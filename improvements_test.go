@@ -55,7 +55,7 @@ func TestBuildReplyOptions(t *testing.T) {
 
 	// No overrides: every base option survives; subnet mask is untouched and
 	// the DNS/router payloads carry the same bytes (only possibly reordered).
-	got := buildReplyOptions(base, p, "192.168.50.0", mac)
+	got := buildReplyOptions(base, p, "192.168.50.0", mac, nil)
 	if !bytes.Equal(got[dhcp.OptionSubnetMask], base[dhcp.OptionSubnetMask]) {
 		t.Errorf("subnet mask changed: got %v", got[dhcp.OptionSubnetMask])
 	}
@@ -69,7 +69,7 @@ func TestBuildReplyOptions(t *testing.T) {
 	}); err != nil {
 		t.Fatalf("SaveOptionOverride failed: %v", err)
 	}
-	got = buildReplyOptions(base, p, "192.168.50.0", mac)
+	got = buildReplyOptions(base, p, "192.168.50.0", mac, nil)
 	if want := net.IPv4(172, 16, 0, 1).To4(); !bytes.Equal(got[dhcp.OptionRouter], want) {
 		t.Errorf("override not applied: got %v want %v", got[dhcp.OptionRouter], []byte(want))
 	}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/binary"
 	"fmt"
+	"math"
 	"net"
 	"strings"
 	"time"
@@ -14,10 +16,44 @@ import (
 	dhcp "github.com/krolaw/dhcp4"
 )
 
+// start launches the broadcast and unicast listeners of the interface. They
+// run until stop is called.
+func (I *Interface) start(ctx context.Context, jobs chan job) {
+	ctx, cancel := context.WithCancel(ctx)
+	I.lock.Lock()
+	I.cancel = cancel
+	I.lock.Unlock()
+
+	// Unicast listener
+	go I.runUnicast(ctx, jobs)
+	// Broadcast listener
+	go I.run(ctx, jobs)
+	// DHCPv6 listener
+	if len(I.networks6()) > 0 {
+		go I.runDHCPv6(ctx)
+	}
+}
+
+// stop closes the listeners launched by start
+func (I *Interface) stop() {
+	I.lock.Lock()
+	cancel := I.cancel
+	I.cancel = nil
+	I.lock.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+}
+
 // Broadcast Listener
 func (I *Interface) run(ctx context.Context, jobs chan job) {
 
 	if err := ListenAndServeIf(ctx, I, I, jobs); err != nil {
+		if ctx.Err() != nil {
+			log.LoggerWContext(ctx).Info("Broadcast listener on " + I.Name + " stopped")
+			return
+		}
 		log.LoggerWContext(ctx).Error("Broadcast listener on " + I.Name + " stopped: " + err.Error())
 	}
 }
@@ -26,6 +62,10 @@ func (I *Interface) run(ctx context.Context, jobs chan job) {
 func (I *Interface) runUnicast(ctx context.Context, jobs chan job) {
 
 	if err := ListenAndServeIfUnicast(ctx, I, I, jobs); err != nil {
+		if ctx.Err() != nil {
+			log.LoggerWContext(ctx).Info("Unicast listener on " + I.Name + " stopped")
+			return
+		}
 		log.LoggerWContext(ctx).Error("Unicast listener on " + I.Name + " stopped: " + err.Error())
 	}
 }
@@ -40,9 +80,10 @@ func (I *Interface) isRelay() bool {
 
 // buildReplyOptions builds the DHCP option set to return to a client. It
 // shuffles the DNS and router options (so clients get varied orderings) and
-// applies any configured network/MAC option overrides. Used for both OFFER and
-// ACK replies so the two stay consistent.
-func buildReplyOptions(baseOptions dhcp.Options, p dhcp.Packet, networkIP, clientMac string) dhcp.Options {
+// applies any configured network/MAC option overrides, with the options of the
+// client class in between. Used for both OFFER and ACK replies so the two stay
+// consistent.
+func buildReplyOptions(baseOptions dhcp.Options, p dhcp.Packet, networkIP, clientMac string, class *ClientClass) dhcp.Options {
 	options := make(dhcp.Options)
 	for key, value := range baseOptions {
 		if key == dhcp.OptionDomainNameServer || key == dhcp.OptionRouter {
@@ -51,7 +92,7 @@ func buildReplyOptions(baseOptions dhcp.Options, p dhcp.Packet, networkIP, clien
 			options[key] = value
 		}
 	}
-	return ApplyOptionOverrides(options, networkIP, clientMac)
+	return applyOptionOverrides(options, networkIP, clientMac, class)
 }
 
 func (I *Interface) ServeDHCP(ctx context.Context, p dhcp.Packet, msgType dhcp.MessageType, srcIP net.Addr, srvIP net.IP) (answer Answer) {
@@ -59,12 +100,13 @@ func (I *Interface) ServeDHCP(ctx context.Context, p dhcp.Packet, msgType dhcp.M
 	var handler DHCPHandler
 	var networkIP string
 
-	Local := false
 	options := p.ParseOptions()
 	answer.MAC = p.CHAddr()
 	answer.SrcIP = I.Ipv4
 
 	ctx = log.AddToLogContext(ctx, "mac", answer.MAC.String())
+	relayAgentInfo := parseRelayAgentInfo(options[OptionRelayAgentInformation])
+	ctx = withRelayAgentInfo(ctx, relayAgentInfo)
 
 	// DHCP Relay
 
@@ -82,6 +124,7 @@ func (I *Interface) ServeDHCP(ctx context.Context, p dhcp.Packet, msgType dhcp.M
 			for k, v := range p.ParseOptions() {
 				p2.AddOption(k, v)
 			}
+			I.insertRelayAgentInfo(&p2, p, relayAgentInfo)
 			answer.D = p2
 			return answer
 
@@ -103,6 +146,10 @@ func (I *Interface) ServeDHCP(ctx context.Context, p dhcp.Packet, msgType dhcp.M
 			p2.SetCHAddr(p.CHAddr())
 			p2.SetSecs(p.Secs())
 			for k, v := range p.ParseOptions() {
+				// The option 82 is for the relay agents only
+				if k == OptionRelayAgentInformation {
+					continue
+				}
 				p2.AddOption(k, v)
 			}
 			answer.IP = p.SIAddr()
@@ -122,6 +169,7 @@ func (I *Interface) ServeDHCP(ctx context.Context, p dhcp.Packet, msgType dhcp.M
 			for k, v := range p.ParseOptions() {
 				p2.AddOption(k, v)
 			}
+			I.insertRelayAgentInfo(&p2, p, relayAgentInfo)
 			answer.D = p2
 			return answer
 
@@ -143,6 +191,10 @@ func (I *Interface) ServeDHCP(ctx context.Context, p dhcp.Packet, msgType dhcp.M
 			p2.SetCHAddr(p.CHAddr())
 			p2.SetSecs(p.Secs())
 			for k, v := range p.ParseOptions() {
+				// The option 82 is for the relay agents only
+				if k == OptionRelayAgentInformation {
+					continue
+				}
 				p2.AddOption(k, v)
 			}
 			answer.D = p2
@@ -160,6 +212,10 @@ func (I *Interface) ServeDHCP(ctx context.Context, p dhcp.Packet, msgType dhcp.M
 			p2.SetCHAddr(p.CHAddr())
 			p2.SetSecs(p.Secs())
 			for k, v := range p.ParseOptions() {
+				// The option 82 is for the relay agents only
+				if k == OptionRelayAgentInformation {
+					continue
+				}
 				p2.AddOption(k, v)
 			}
 			answer.D = p2
@@ -178,17 +234,25 @@ func (I *Interface) ServeDHCP(ctx context.Context, p dhcp.Packet, msgType dhcp.M
 			for k, v := range p.ParseOptions() {
 				p2.AddOption(k, v)
 			}
+			I.insertRelayAgentInfo(&p2, p, relayAgentInfo)
 			answer.D = p2
 			return answer
 		}
 		return answer
 	}
 
-	// Detect the handler to use (config)
-	for _, v := range I.network {
+	// Detect the handler to use (config), the link selection sub-option of
+	// the option 82 designates the subnet of the client instead of the giaddr
+	giaddr := p.GIAddr()
+	if relayAgentInfo != nil && relayAgentInfo.LinkSelection != nil {
+		giaddr = relayAgentInfo.LinkSelection
+	}
+	// A client that is not relayed is on the link of the interface
+	Local := p.GIAddr().Equal(net.IPv4zero)
+	for _, v := range I.networks() {
 
 		// Case of a l2 dhcp request
-		if v.dhcpHandler.layer2 && (p.GIAddr().Equal(net.IPv4zero) || v.network.Contains(p.CIAddr())) {
+		if v.dhcpHandler.layer2 && (giaddr.Equal(net.IPv4zero) || v.network.Contains(p.CIAddr())) {
 
 			// Case we are in L3
 			if !p.CIAddr().Equal(net.IPv4zero) && !v.network.Contains(p.CIAddr()) {
@@ -200,13 +264,13 @@ func (I *Interface) ServeDHCP(ctx context.Context, p dhcp.Packet, msgType dhcp.M
 
 		}
 		// Case dhcprequest from an already assigned l3 ip address
-		if p.GIAddr().Equal(net.IPv4zero) && v.network.Contains(p.CIAddr()) {
+		if giaddr.Equal(net.IPv4zero) && v.network.Contains(p.CIAddr()) {
 			handler = *v.dhcpHandler
 			networkIP = v.network.IP.String()
 			break
 		}
 
-		if (!p.GIAddr().Equal(net.IPv4zero) && v.network.Contains(p.GIAddr())) || v.network.Contains(p.CIAddr()) {
+		if (!giaddr.Equal(net.IPv4zero) && v.network.Contains(giaddr)) || v.network.Contains(p.CIAddr()) {
 			handler = *v.dhcpHandler
 			networkIP = v.network.IP.String()
 			break
@@ -216,6 +280,11 @@ func (I *Interface) ServeDHCP(ctx context.Context, p dhcp.Packet, msgType dhcp.M
 	if len(handler.ip) == 0 {
 		return answer
 	}
+	// The subnets of a shared network share the clients of the broadcast domain
+	if member, ok := I.sharedScope(networkIP, msgType, p, options, relayAgentInfo); ok {
+		handler = *member.dhcpHandler
+		networkIP = member.network.IP.String()
+	}
 	defer recoverName(options)
 
 	log.LoggerWContext(ctx).Debug(p.CHAddr().String() + " " + msgType.String() + " xID " + sharedutils.ByteToString(p.XId()))
@@ -235,6 +304,22 @@ func (I *Interface) ServeDHCP(ctx context.Context, p dhcp.Packet, msgType dhcp.M
 	prettyType := "DHCP" + strings.ToUpper(msgType.String())
 	clientMac := p.CHAddr().String()
 	clientHostname := string(options[dhcp.OptionHostName])
+	class := matchClientClass(options, clientMac, relayAgentInfo, networkIP)
+	ctx = log.AddToLogContext(ctx, "class", class.role())
+
+	// The client policy of the network decides who gets an address
+	if (msgType == dhcp.Discover || msgType == dhcp.Request || msgType == dhcp.Inform) && !handler.admits(clientMac, relayAgentInfo, networkIP) {
+		handler.policy.denied.Add(1)
+		serverID := options[dhcp.OptionServerIdentifier]
+		if msgType == dhcp.Request && handler.policy.nak && (len(serverID) != 4 || net.IP(serverID).Equal(handler.ip.To4())) {
+			log.LoggerWContext(ctx).Info("DHCPNAK to " + clientMac + ", denied by the client policy of network " + networkIP)
+			answer.D = dhcp.ReplyPacket(p, dhcp.NAK, handler.ip.To4(), nil, 0, echoRelayAgentInfo(nil, relayAgentInfo))
+			publishLeaseEvent(EventNak, I.Name, networkIP, clientMac, net.IP(options[dhcp.OptionRequestedIPAddress]), clientHostname, 0)
+			return answer
+		}
+		log.LoggerWContext(ctx).Info(prettyType + " from " + clientMac + " ignored, denied by the client policy of network " + networkIP)
+		return answer
+	}
 
 	switch msgType {
 
@@ -244,7 +329,7 @@ func (I *Interface) ServeDHCP(ctx context.Context, p dhcp.Packet, msgType dhcp.M
 		var free int
 		free = -1
 		// Static assign IP address ?
-		if position, ok := handler.ipAssigned[answer.MAC.String()]; ok {
+		if position, ok := handler.staticIndex(answer.MAC.String(), relayAgentInfo); ok {
 			free = int(position)
 			log.LoggerWContext(ctx).Debug("Static IP found")
 			goto reply
@@ -287,13 +372,17 @@ func (I *Interface) ServeDHCP(ctx context.Context, p dhcp.Packet, msgType dhcp.M
 			// Check if the device request a specific ip
 			if p.ParseOptions()[50] != nil && firstTry {
 				log.LoggerWContext(ctx).Debug("Attempting to use the IP requested by the device")
-				element = uint32(binary.BigEndian.Uint32(p.ParseOptions()[50])) - uint32(binary.BigEndian.Uint32(handler.start.To4()))
+				// An address outside of the ranges is not part of the pool
+				element = math.MaxUint32
+				if index := handler.indexOf(net.IP(p.ParseOptions()[50])); index >= 0 {
+					element = uint32(index)
+				}
 				// Test if we find the the mac address at the index
 				_, returnedMac, err := handler.available.GetMACIndex(safeUint32ToUint64(element))
 				if returnedMac == p.CHAddr().String() {
 					log.LoggerWContext(ctx).Debug("The IP asked by the device is available in the pool")
 					free = int(element)
-				} else if returnedMac == FreeMac {
+				} else if returnedMac == FreeMac && handler.allowedIndex(int(element), class) {
 					// The ip is free use it
 					err, returnedMac = handler.available.ReserveIPIndex(safeUint32ToUint64(element), p.CHAddr().String())
 					// Reserve the ip
@@ -311,36 +400,36 @@ func (I *Interface) ServeDHCP(ctx context.Context, p dhcp.Packet, msgType dhcp.M
 			// If we still haven't found an IP address to offer, we get the next one
 			if free == -1 {
 				log.LoggerWContext(ctx).Debug("Grabbing next available IP")
-				freeu64, _, err := handler.available.GetFreeIPIndex(p.CHAddr().String())
+				index, err := handler.allocateIndex(p.CHAddr().String(), class)
 
 				if err != nil {
-					log.LoggerWContext(ctx).Error("Unable to get free IP address, DHCP pool is full")
+					log.LoggerWContext(ctx).Error("Unable to get free IP address: " + err.Error())
 					return answer
 				}
-				free = safeUint64ToInt(freeu64)
+				free = index
 			}
 
 			// Lock it
 			handler.hwcache.Set(p.CHAddr().String(), free, time.Duration(5)*time.Second)
 			handler.xid.Set(sharedutils.ByteToString(p.XId()), 0, time.Duration(5)*time.Second)
 			var inarp bool
-			// Ping the ip address
 			inarp = false
 			// Layer 2 test (arp cache)
 			if Local {
-				mac := arp.Search(dhcp.IPAdd(handler.start, free).String())
+				mac := arp.Search(handler.ipAt(free).String())
 				if mac != "" && mac != FreeMac {
 					if p.CHAddr().String() != mac {
-						log.LoggerWContext(ctx).Info(p.CHAddr().String() + " in arp table Ip " + dhcp.IPAdd(handler.start, free).String() + " is already own by " + mac)
+						log.LoggerWContext(ctx).Info(p.CHAddr().String() + " in arp table Ip " + handler.ipAt(free).String() + " is already own by " + mac)
 						inarp = true
 					}
 				}
 			}
-			// Layer 3 Test
-			pingreply := sharedutils.Ping(setOptionServerIdentifier(srvIP, handler.ip).To4(), dhcp.IPAdd(handler.start, free), I.Name, 1)
-			if pingreply || inarp {
+			// ARP probe on the link, ping otherwise
+			if inarp || probes.inUse(ctx, I, setOptionServerIdentifier(srvIP, handler.ip).To4(), handler.ipAt(free), Local, p.CHAddr()) {
 				// Found in the arp cache or able to ping it
-				ipaddr := dhcp.IPAdd(handler.start, free)
+				metrics.pingConflicts.Add(1)
+				ipaddr := handler.ipAt(free)
+				publishLeaseEvent(EventConflict, I.Name, networkIP, clientMac, ipaddr, clientHostname, 0)
 				log.LoggerWContext(ctx).Info(p.CHAddr().String() + " Ip " + ipaddr.String() + " already in use, trying next")
 				// Added back in the pool since it's not the dhcp server who gave it
 				handler.hwcache.Delete(p.CHAddr().String())
@@ -354,9 +443,9 @@ func (I *Interface) ServeDHCP(ctx context.Context, p dhcp.Packet, msgType dhcp.M
 				go func(ctx context.Context, free int, ipaddr net.IP) {
 					time.Sleep(10 * time.Minute)
 					log.LoggerWContext(ctx).Info("Releasing previously pingable IP " + ipaddr.String() + " back into the pool")
-					handler.available.FreeIPIndex(safeIntToUint64(free))
+					freeUnusable(&handler, free)
 				}(ctx, free, ipaddr)
-				free = 0
+				free = -1
 				goto retry
 			}
 			// 5 seconds to send a request
@@ -369,15 +458,19 @@ func (I *Interface) ServeDHCP(ctx context.Context, p dhcp.Packet, msgType dhcp.M
 
 	reply:
 
-		answer.IP = dhcp.IPAdd(handler.start, free)
+		answer.IP = handler.ipAt(free)
 		// Add options on the fly (with overrides applied)
-		GlobalOptions := buildReplyOptions(handler.options, p, networkIP, clientMac)
-		leaseDuration := handler.leaseDuration
+		GlobalOptions := buildReplyOptions(handler.options, p, networkIP, clientMac, class)
+		handler.boot.apply(GlobalOptions, options)
+		handler.reservations.apply(GlobalOptions, clientMac)
+		leaseDuration := handler.grantLease(GlobalOptions, options[dhcp.OptionIPAddressLeaseTime])
 
 		log.LoggerWContext(ctx).Info("DHCPOFFER on " + answer.IP.String() + " to " + clientMac + " (" + clientHostname + ")")
 
 		answer.D = dhcp.ReplyPacket(p, dhcp.Offer, handler.ip.To4(), answer.IP, leaseDuration,
-			GlobalOptions.SelectOrderOrAll(GlobalOptions[dhcp.OptionParameterRequestList]))
+			echoRelayAgentInfo(GlobalOptions.SelectOrderOrAll(GlobalOptions[dhcp.OptionParameterRequestList]), relayAgentInfo))
+		setBootFields(answer.D, handler.boot, GlobalOptions)
+		publishLeaseEvent(EventOffer, I.Name, networkIP, clientMac, answer.IP, clientHostname, leaseDuration)
 
 		return answer
 
@@ -408,9 +501,9 @@ func (I *Interface) ServeDHCP(ctx context.Context, p dhcp.Packet, msgType dhcp.M
 		// Valid IP
 		if len(reqIP) == 4 && !reqIP.Equal(net.IPv4zero) {
 			// Requested IP is in the pool ?
-			if leaseNum := dhcp.IPRange(handler.start, reqIP) - 1; leaseNum >= 0 && leaseNum < handler.leaseRange {
+			if leaseNum := handler.indexOf(reqIP); leaseNum >= 0 && leaseNum < handler.leaseRange {
 				// Static assigned ip ?
-				if position, ok := handler.ipAssigned[answer.MAC.String()]; ok {
+				if position, ok := handler.staticIndex(answer.MAC.String(), relayAgentInfo); ok {
 					Static = true
 					if int(position) == leaseNum {
 						Index = int(position)
@@ -423,7 +516,7 @@ func (I *Interface) ServeDHCP(ctx context.Context, p dhcp.Packet, msgType dhcp.M
 					// Requested IP is in the cache ?
 					if index, found := handler.hwcache.Get(p.CHAddr().String()); found {
 						// Requested IP is equal to what we have in the cache ?
-						if dhcp.IPAdd(handler.start, index.(int)).Equal(reqIP) {
+						if handler.ipAt(index.(int)).Equal(reqIP) {
 							id, _ := GlobalTransactionLock.Lock()
 							if _, found = RequestGlobalTransactionCache.Get(cacheKey); found {
 								log.LoggerWContext(ctx).Debug("Not answering to REQUEST. Already processed")
@@ -444,7 +537,7 @@ func (I *Interface) ServeDHCP(ctx context.Context, p dhcp.Packet, msgType dhcp.M
 							// So remove the ip from the cache
 						} else {
 							Reply = false
-							log.LoggerWContext(ctx).Info(p.CHAddr().String() + " Asked for an IP " + reqIP.String() + " that hasnt been assigned by Offer " + dhcp.IPAdd(handler.start, index.(int)).String() + " xID " + sharedutils.ByteToString(p.XId()))
+							log.LoggerWContext(ctx).Info(p.CHAddr().String() + " Asked for an IP " + reqIP.String() + " that hasnt been assigned by Offer " + handler.ipAt(index.(int)).String() + " xID " + sharedutils.ByteToString(p.XId()))
 							if index, found = handler.xid.Get(fmt.Sprintf("%d", binary.BigEndian.Uint32(p.XId()))); found {
 								if index.(int) == 1 {
 									handler.hwcache.Delete(p.CHAddr().String())
@@ -462,20 +555,42 @@ func (I *Interface) ServeDHCP(ctx context.Context, p dhcp.Packet, msgType dhcp.M
 			if Reply {
 				// Build the same option set as the OFFER, including overrides,
 				// so the client receives consistent options across the exchange.
-				GlobalOptions := buildReplyOptions(handler.options, p, networkIP, clientMac)
-				leaseDuration := handler.leaseDuration
-				answer.D = dhcp.ReplyPacket(p, dhcp.ACK, handler.ip.To4(), reqIP, leaseDuration,
-					GlobalOptions.SelectOrderOrAll(GlobalOptions[dhcp.OptionParameterRequestList]))
+				GlobalOptions := buildReplyOptions(handler.options, p, networkIP, clientMac, class)
+				handler.boot.apply(GlobalOptions, options)
+				handler.reservations.apply(GlobalOptions, clientMac)
+				leaseDuration := handler.grantLease(GlobalOptions, options[dhcp.OptionIPAddressLeaseTime])
+				replyOptions := GlobalOptions.SelectOrderOrAll(GlobalOptions[dhcp.OptionParameterRequestList])
+				if msgType == dhcp.Request {
+					if fqdn := handler.ddns.register(ctx, clientMac, reqIP, options, leaseDuration); fqdn != nil {
+						replyOptions = append(replyOptions, dhcp.Option{Code: OptionClientFQDN, Value: fqdn})
+					}
+				}
+				answer.D = dhcp.ReplyPacket(p, dhcp.ACK, handler.ip.To4(), reqIP, leaseDuration, echoRelayAgentInfo(replyOptions, relayAgentInfo))
+				bootFile := setBootFields(answer.D, handler.boot, GlobalOptions)
 				// Update Global Caches
 				GlobalIpCache.Set(reqIP.String(), p.CHAddr().String(), leaseDuration+(time.Duration(15)*time.Second))
 				GlobalMacCache.Set(p.CHAddr().String(), reqIP.String(), leaseDuration+(time.Duration(15)*time.Second))
 				// Update the cache
 				log.LoggerWContext(ctx).Info("DHCPACK on " + reqIP.String() + " to " + clientMac + " (" + clientHostname + ")")
 				handler.hwcache.Set(p.CHAddr().String(), Index, leaseDuration+(time.Duration(15)*time.Second))
+				handler.setPeerBound(clientMac, false)
+				handler.setBoundClient(clientMac, boundClient{role: class.role(), bootFile: bootFile}, leaseDuration+(time.Duration(15)*time.Second))
 				handler.available.ReserveIPIndex(safeIntToUint64(Index), p.CHAddr().String())
+				// Persist the binding so it survives a restart
+				lease := Lease{MAC: clientMac, IP: reqIP.String(), Network: networkIP, Hostname: clientHostname, ExpiresAt: time.Now().Add(leaseDuration)}
+				lease.DNSName, lease.DNSForward = handler.ddns.registered(clientMac)
+				if err := SaveLease(lease); err != nil {
+					log.LoggerWContext(ctx).Error("Unable to persist the lease of " + clientMac + ": " + err.Error())
+				}
+				if err := RecordLeaseHistory(LeaseHistory{MAC: clientMac, IP: reqIP.String(), Network: networkIP, Interface: I.Name, Hostname: clientHostname}); err != nil {
+					log.LoggerWContext(ctx).Error("Unable to log the lease of " + clientMac + ": " + err.Error())
+				}
+				failover.publishBind(networkIP, clientMac, reqIP.String(), time.Now().Add(leaseDuration))
+				publishLeaseEvent(EventAck, I.Name, networkIP, clientMac, reqIP, clientHostname, leaseDuration)
 			} else {
 				log.LoggerWContext(ctx).Info("DHCPNAK on " + reqIP.String() + " to " + clientMac)
-				answer.D = dhcp.ReplyPacket(p, dhcp.NAK, handler.ip.To4(), nil, 0, nil)
+				answer.D = dhcp.ReplyPacket(p, dhcp.NAK, handler.ip.To4(), nil, 0, echoRelayAgentInfo(nil, relayAgentInfo))
+				publishLeaseEvent(EventNak, I.Name, networkIP, clientMac, reqIP, clientHostname, 0)
 			}
 			return answer
 		}
@@ -485,7 +600,7 @@ func (I *Interface) ServeDHCP(ctx context.Context, p dhcp.Packet, msgType dhcp.M
 		if reqIP == nil {
 			reqIP = net.IP(p.CIAddr())
 		}
-		if leaseNum := dhcp.IPRange(handler.start, reqIP) - 1; leaseNum >= 0 && leaseNum < handler.leaseRange {
+		if leaseNum := handler.indexOf(reqIP); leaseNum >= 0 && leaseNum < handler.leaseRange {
 			if x, found := handler.hwcache.Get(p.CHAddr().String()); found {
 				if leaseNum == x.(int) {
 					log.LoggerWContext(ctx).Debug(prettyType + " Found the ip " + reqIP.String() + " in the cache")
@@ -493,13 +608,21 @@ func (I *Interface) ServeDHCP(ctx context.Context, p dhcp.Packet, msgType dhcp.M
 					if returnedMac == p.CHAddr().String() {
 						log.LoggerWContext(ctx).Info("Temporarily declaring " + reqIP.String() + " as unusable")
 						handler.available.ReserveIPIndex(safeIntToUint64(leaseNum), FakeMac)
+						// The probe missed the host holding it
+						probes.forget(reqIP)
 						// Put it back into the available IPs in 10 minutes
 						go func(ctx context.Context, leaseNum int, reqIP net.IP) {
 							time.Sleep(10 * time.Minute)
 							log.LoggerWContext(ctx).Info("Releasing previously declined IP " + reqIP.String() + " back into the pool")
-							handler.available.FreeIPIndex(safeIntToUint64(leaseNum))
+							freeUnusable(&handler, leaseNum)
 						}(ctx, leaseNum, reqIP)
 						go func(ctx context.Context, x int, reqIP net.IP) {
+							// Unbound here so the eviction is not taken for an expiry
+							if err := DeleteLease(networkIP, clientMac); err != nil && err != sql.ErrNoRows {
+								log.LoggerWContext(ctx).Error("Unable to delete the lease of " + clientMac + ": " + err.Error())
+							}
+							handler.unbind(networkIP, clientMac, reqIP, leaseEndReleased)
+							publishLeaseEvent(EventRelease, I.Name, networkIP, clientMac, reqIP, clientHostname, 0)
 							handler.hwcache.Delete(p.CHAddr().String())
 						}(ctx, x.(int), reqIP)
 					}
@@ -516,7 +639,7 @@ func (I *Interface) ServeDHCP(ctx context.Context, p dhcp.Packet, msgType dhcp.M
 			reqIP = net.IP(p.CIAddr())
 		}
 
-		if leaseNum := dhcp.IPRange(handler.start, reqIP) - 1; leaseNum >= 0 && leaseNum < handler.leaseRange {
+		if leaseNum := handler.indexOf(reqIP); leaseNum >= 0 && leaseNum < handler.leaseRange {
 			// Remove the mac from the cache
 			if x, found := handler.hwcache.Get(p.CHAddr().String()); found {
 				if leaseNum == x.(int) {
@@ -529,9 +652,15 @@ func (I *Interface) ServeDHCP(ctx context.Context, p dhcp.Packet, msgType dhcp.M
 						go func(ctx context.Context, leaseNum int, reqIP net.IP) {
 							time.Sleep(10 * time.Minute)
 							log.LoggerWContext(ctx).Info("Releasing previously declined IP " + reqIP.String() + " back into the pool")
-							handler.available.FreeIPIndex(safeIntToUint64(leaseNum))
+							freeUnusable(&handler, leaseNum)
 						}(ctx, leaseNum, reqIP)
 						go func(ctx context.Context, x int, reqIP net.IP) {
+							// Unbound here so the eviction is not taken for an expiry
+							if err := DeleteLease(networkIP, clientMac); err != nil && err != sql.ErrNoRows {
+								log.LoggerWContext(ctx).Error("Unable to delete the lease of " + clientMac + ": " + err.Error())
+							}
+							handler.unbind(networkIP, clientMac, reqIP, leaseEndDeclined)
+							publishLeaseEvent(EventDecline, I.Name, networkIP, clientMac, reqIP, clientHostname, 0)
 							handler.hwcache.Delete(p.CHAddr().String())
 						}(ctx, x.(int), reqIP)
 					}
@@ -544,7 +673,8 @@ func (I *Interface) ServeDHCP(ctx context.Context, p dhcp.Packet, msgType dhcp.M
 		return answer
 	}
 	log.LoggerWContext(ctx).Info(p.CHAddr().String() + " Nak " + sharedutils.ByteToString(p.XId()))
-	answer.D = dhcp.ReplyPacket(p, dhcp.NAK, handler.ip.To4(), nil, 0, nil)
+	answer.D = dhcp.ReplyPacket(p, dhcp.NAK, handler.ip.To4(), nil, 0, echoRelayAgentInfo(nil, relayAgentInfo))
+	publishLeaseEvent(EventNak, I.Name, networkIP, clientMac, p.CIAddr(), clientHostname, 0)
 	return answer
 
 }
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// States of the bindings reported by the lease query API
+const (
+	leaseStateOffered = "offered" // Offered, the client did not request it yet
+	leaseStateBound   = "bound"   // Acknowledged and persisted
+	leaseStateStatic  = "static"  // Statically assigned to the client
+)
+
+// Limits of a page of the lease query API
+const (
+	defaultLeasePageSize = 100
+	maxLeasePageSize     = 1000
+)
+
+// LeaseInfo is a binding of a scope, as reported by the lease query API
+type LeaseInfo struct {
+	MAC       string    `json:"mac"`
+	IP        string    `json:"ip"`
+	Interface string    `json:"interface"`
+	Network   string    `json:"network"`
+	Hostname  string    `json:"hostname,omitempty"`
+	State     string    `json:"state"`
+	Class     string    `json:"class,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// LeaseFilter selects the bindings of a lease query, the empty fields match
+// every binding
+type LeaseFilter struct {
+	Network       string // Network address, with or without its prefix length
+	Interface     string
+	MACPrefix     string
+	Hostname      string // Case insensitive substring
+	State         string
+	ExpiresBefore time.Time
+}
+
+// validLeaseState tells if a state exists
+func validLeaseState(state string) bool {
+	return state == leaseStateOffered || state == leaseStateBound || state == leaseStateStatic
+}
+
+// match tells if a binding is selected by the filter
+func (f LeaseFilter) match(l LeaseInfo) bool {
+	if networkIP, _, _ := strings.Cut(l.Network, "/"); f.Network != "" && f.Network != l.Network && f.Network != networkIP {
+		return false
+	}
+	if f.Interface != "" && f.Interface != l.Interface {
+		return false
+	}
+	if f.MACPrefix != "" && !strings.HasPrefix(l.MAC, strings.ToLower(f.MACPrefix)) {
+		return false
+	}
+	if f.Hostname != "" && !strings.Contains(strings.ToLower(l.Hostname), strings.ToLower(f.Hostname)) {
+		return false
+	}
+	if f.State != "" && f.State != l.State {
+		return false
+	}
+	if !f.ExpiresBefore.IsZero() && !l.ExpiresAt.Before(f.ExpiresBefore) {
+		return false
+	}
+	return true
+}
+
+// collectLeases returns the bindings of the IPv4 scopes of the interfaces
+// selected by the filter. The persisted leases tell the bound clients from
+// the ones that were only offered an address, and give their hostname.
+func collectLeases(interfaces []*Interface, filter LeaseFilter) ([]LeaseInfo, error) {
+	persisted, err := ListActiveLeases("")
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[string]Lease, len(persisted))
+	for _, lease := range persisted {
+		stored[lease.Network+" "+lease.MAC] = lease
+	}
+
+	leases := []LeaseInfo{}
+	for _, I := range interfaces {
+		for _, v := range I.networks() {
+			networkIP := v.network.IP.String()
+			for mac, item := range v.dhcpHandler.hwcache.Items() {
+				index := item.Object.(int)
+				l := LeaseInfo{
+					MAC:       mac,
+					IP:        v.dhcpHandler.ipAt(index).String(),
+					Interface: I.Name,
+					Network:   v.network.String(),
+					State:     leaseStateOffered,
+					Class:     v.dhcpHandler.boundClient(mac).role,
+					ExpiresAt: time.Unix(0, item.Expiration),
+				}
+				if lease, found := stored[networkIP+" "+mac]; found && lease.IP == l.IP {
+					l.State = leaseStateBound
+					l.Hostname = lease.Hostname
+					l.ExpiresAt = lease.ExpiresAt
+				}
+				if v.dhcpHandler.isStatic(index) {
+					l.State = leaseStateStatic
+				}
+				if filter.match(l) {
+					leases = append(leases, l)
+				}
+			}
+		}
+	}
+	return leases, nil
+}
+
+// leaseSortFields are the fields the leases can be sorted on
+var leaseSortFields = map[string]bool{"ip": true, "mac": true, "hostname": true, "network": true, "interface": true, "expires_at": true}
+
+// leaseSortKey returns the value of the field a lease is sorted on, in a form
+// ordered like the field: addresses and dates are made fixed width
+func leaseSortKey(l LeaseInfo, field string) string {
+	var key string
+	switch field {
+	case "ip":
+		if ip := net.ParseIP(l.IP).To4(); ip != nil {
+			key = fmt.Sprintf("%08x", binary.BigEndian.Uint32(ip))
+		} else {
+			key = l.IP
+		}
+	case "mac":
+		key = l.MAC
+	case "hostname":
+		key = strings.ToLower(l.Hostname)
+	case "network":
+		_, network, _ := net.ParseCIDR(l.Network)
+		key = leaseSortKey(LeaseInfo{IP: network.IP.String()}, "ip") + l.Network
+	case "interface":
+		key = l.Interface
+	case "expires_at":
+		key = fmt.Sprintf("%020d", l.ExpiresAt.UnixNano())
+	}
+	// The MAC address and the network make the key unique
+	return key + "\x00" + l.Network + "\x00" + l.MAC
+}
+
+// leaseCursor is the position after the last lease of a page
+type leaseCursor struct {
+	sort string
+	key  string
+}
+
+func (c leaseCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.sort + "\x01" + c.key))
+}
+
+// errInvalidLeaseCursor is returned for a cursor that was not built by the
+// same query
+var errInvalidLeaseCursor = errors.New("invalid cursor")
+
+func parseLeaseCursor(cursor string) (leaseCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return leaseCursor{}, errInvalidLeaseCursor
+	}
+	sortSpec, key, found := strings.Cut(string(b), "\x01")
+	if !found {
+		return leaseCursor{}, errInvalidLeaseCursor
+	}
+	return leaseCursor{sort: sortSpec, key: key}, nil
+}
+
+// pageLeases sorts the leases on a field, descending when it is prefixed
+// with a dash, and returns the page following the cursor with the cursor of
+// the next page, empty on the last page.
+func pageLeases(leases []LeaseInfo, sortSpec, cursor string, limit int) ([]LeaseInfo, string, error) {
+	field, desc := strings.CutPrefix(sortSpec, "-")
+	if !leaseSortFields[field] {
+		return nil, "", fmt.Errorf("invalid sort field %q", field)
+	}
+	keys := make(map[string]string, len(leases))
+	for _, l := range leases {
+		keys[l.Network+" "+l.MAC] = leaseSortKey(l, field)
+	}
+	key := func(l LeaseInfo) string { return keys[l.Network+" "+l.MAC] }
+	after := func(a, b string) bool {
+		if desc {
+			return a < b
+		}
+		return a > b
+	}
+	sort.Slice(leases, func(i, j int) bool { return after(key(leases[j]), key(leases[i])) })
+
+	start := 0
+	if cursor != "" {
+		c, err := parseLeaseCursor(cursor)
+		if err != nil || c.sort != sortSpec {
+			return nil, "", errInvalidLeaseCursor
+		}
+		start = sort.Search(len(leases), func(i int) bool { return after(key(leases[i]), c.key) })
+	}
+	end := min(start+limit, len(leases))
+	page := leases[start:end]
+	if end < len(leases) && len(page) > 0 {
+		return page, leaseCursor{sort: sortSpec, key: key(page[len(page)-1])}.String(), nil
+	}
+	return page, "", nil
+}
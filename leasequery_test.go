@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	cache "github.com/fdurand/go-cache"
+)
+
+// newLeaseQueryConfig builds an interface with a scope holding the bindings
+// of the lease query tests
+func newLeaseQueryConfig(t *testing.T) *Interfaces {
+	startIP := net.ParseIP("192.168.1.10").To4()
+	handler := &DHCPHandler{
+		leaseRange: 20,
+		available:  newTestRangePool(startIP, 20),
+		hwcache:    cache.New(time.Hour, 10*time.Second),
+		ipAssigned: map[string]uint32{"aa:bb:cc:dd:ee:05": 5},
+	}
+	_, network, _ := net.ParseCIDR("192.168.1.0/24")
+	for i, mac := range []string{"aa:bb:cc:dd:ee:01", "aa:bb:cc:dd:ee:02", "aa:bb:cc:00:00:03", "aa:bb:cc:dd:ee:05"} {
+		index := []int{2, 0, 1, 5}[i]
+		handler.hwcache.Set(mac, index, time.Duration(i+1)*time.Hour)
+	}
+	for _, lease := range []Lease{
+		{MAC: "aa:bb:cc:dd:ee:01", IP: "192.168.1.12", Network: "192.168.1.0", Hostname: "Laptop", ExpiresAt: time.Now().Add(time.Hour)},
+		{MAC: "aa:bb:cc:dd:ee:02", IP: "192.168.1.10", Network: "192.168.1.0", Hostname: "printer", ExpiresAt: time.Now().Add(2 * time.Hour)},
+	} {
+		if err := SaveLease(lease); err != nil {
+			t.Fatalf("SaveLease failed: %v", err)
+		}
+	}
+	return &Interfaces{intsNet: []*Interface{{Name: "eth0", network: []Network{{network: *network, dhcpHandler: handler}}}}}
+}
+
+func TestCollectLeases(t *testing.T) {
+	dbPath := setupTestDB(t)
+	defer teardownTestDB(t, dbPath)
+	if err := InitDatabase(dbPath); err != nil {
+		t.Fatalf("InitDatabase failed: %v", err)
+	}
+	config := newLeaseQueryConfig(t)
+
+	leases, err := collectLeases(config.interfaces(), LeaseFilter{})
+	if err != nil {
+		t.Fatalf("collectLeases failed: %v", err)
+	}
+	states := make(map[string]string)
+	for _, l := range leases {
+		states[l.MAC] = l.State
+	}
+	expected := map[string]string{"aa:bb:cc:dd:ee:01": leaseStateBound, "aa:bb:cc:dd:ee:02": leaseStateBound, "aa:bb:cc:00:00:03": leaseStateOffered, "aa:bb:cc:dd:ee:05": leaseStateStatic}
+	for mac, state := range expected {
+		if states[mac] != state {
+			t.Errorf("Expected %s to be %s, got %s", mac, state, states[mac])
+		}
+	}
+
+	for _, test := range []struct {
+		filter LeaseFilter
+		count  int
+	}{
+		{LeaseFilter{Network: "192.168.1.0"}, 4},
+		{LeaseFilter{Network: "192.168.1.0/24", Interface: "eth0"}, 4},
+		{LeaseFilter{Network: "10.0.0.0"}, 0},
+		{LeaseFilter{Interface: "eth1"}, 0},
+		{LeaseFilter{MACPrefix: "AA:BB:CC:DD"}, 3},
+		{LeaseFilter{Hostname: "lap"}, 1},
+		{LeaseFilter{State: leaseStateOffered}, 1},
+		{LeaseFilter{ExpiresBefore: time.Now().Add(150 * time.Minute)}, 2},
+	} {
+		leases, _ := collectLeases(config.interfaces(), test.filter)
+		if len(leases) != test.count {
+			t.Errorf("Expected %d leases for %+v, got %d", test.count, test.filter, len(leases))
+		}
+	}
+}
+
+func TestPageLeases(t *testing.T) {
+	var leases []LeaseInfo
+	for i, ip := range []string{"192.168.1.100", "192.168.1.9", "192.168.1.20", "192.168.1.3", "192.168.1.50"} {
+		leases = append(leases, LeaseInfo{MAC: "aa:bb:cc:dd:ee:0" + string(rune('0'+i)), IP: ip, Network: "192.168.1.0/24"})
+	}
+
+	var ips []string
+	cursor := ""
+	for {
+		page, next, err := pageLeases(leases, "ip", cursor, 2)
+		if err != nil {
+			t.Fatalf("pageLeases failed: %v", err)
+		}
+		for _, l := range page {
+			ips = append(ips, l.IP)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	expected := []string{"192.168.1.3", "192.168.1.9", "192.168.1.20", "192.168.1.50", "192.168.1.100"}
+	if len(ips) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, ips)
+	}
+	for i := range expected {
+		if ips[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, ips)
+			break
+		}
+	}
+
+	page, next, _ := pageLeases(leases, "-ip", "", 1)
+	if page[0].IP != "192.168.1.100" {
+		t.Errorf("Expected the highest address first, got %s", page[0].IP)
+	}
+	if page, _, _ = pageLeases(leases, "-ip", next, 1); page[0].IP != "192.168.1.50" {
+		t.Errorf("Expected the second page to follow the first, got %s", page[0].IP)
+	}
+
+	if _, _, err := pageLeases(leases, "ip", next, 1); err == nil {
+		t.Error("Expected a cursor of another sort to be refused")
+	}
+	if _, _, err := pageLeases(leases, "vendor", "", 1); err == nil {
+		t.Error("Expected an unknown sort field to be refused")
+	}
+}
+
+func TestHandleListLeases(t *testing.T) {
+	router, dbPath := setupTestAPI(t)
+	defer teardownTestDB(t, dbPath)
+
+	prevConfig := DHCPConfig
+	defer func() { DHCPConfig = prevConfig }()
+	DHCPConfig = newLeaseQueryConfig(t)
+	RecordLeaseHistory(LeaseHistory{MAC: "aa:bb:cc:dd:ee:01", IP: "192.168.1.12", Network: "192.168.1.0", Interface: "eth0"})
+
+	get := func(url string) (int, map[string]interface{}) {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", url, nil))
+		var body map[string]interface{}
+		json.Unmarshal(rr.Body.Bytes(), &body)
+		return rr.Code, body
+	}
+
+	code, body := get("/api/v1/dhcp/leases?state=bound&sort=-expires_at&limit=1")
+	if code != http.StatusOK || body["total"].(float64) != 2 || body["count"].(float64) != 1 || body["next_cursor"] == nil {
+		t.Fatalf("Unexpected answer %d %v", code, body)
+	}
+	if lease := body["leases"].([]interface{})[0].(map[string]interface{}); lease["hostname"] != "printer" {
+		t.Errorf("Expected the lease expiring last first, got %v", lease)
+	}
+	code, body = get("/api/v1/dhcp/leases?state=bound&sort=-expires_at&limit=1&cursor=" + body["next_cursor"].(string))
+	if code != http.StatusOK || body["leases"].([]interface{})[0].(map[string]interface{})["hostname"] != "Laptop" || body["next_cursor"] != nil {
+		t.Errorf("Unexpected last page %d %v", code, body)
+	}
+
+	for _, url := range []string{
+		"/api/v1/dhcp/leases?state=expired",
+		"/api/v1/dhcp/leases?expires_before=tomorrow",
+		"/api/v1/dhcp/leases?limit=0",
+		"/api/v1/dhcp/leases?cursor=garbage",
+	} {
+		if code, _ := get(url); code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be refused, got %d", url, code)
+		}
+	}
+
+	code, body = get("/api/v1/dhcp/mac/AA:BB:CC:DD:EE:01/history")
+	if code != http.StatusOK || body["count"].(float64) != 1 {
+		t.Errorf("Unexpected history %d %v", code, body)
+	}
+}
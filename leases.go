@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/inverse-inc/packetfence/go/log"
+)
+
+// Lease represents a persisted DHCP binding
+type Lease struct {
+	MAC       string    `json:"mac"`
+	IP        string    `json:"ip"`
+	Network   string    `json:"network"`
+	Hostname  string    `json:"hostname"`
+	ExpiresAt time.Time `json:"expires_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// Name registered in DNS for the client, restored with the lease so
+	// its records are removed when it ends
+	DNSName    string `json:"dns_name,omitempty"`
+	DNSForward bool   `json:"-"` // The A record was added, not only the PTR record
+
+	Partner bool `json:"partner,omitempty"` // Copied from the failover partner, which made the binding
+}
+
+// leaseTime normalizes a timestamp before it is written to or compared in the
+// database. Leases are stored in UTC with second precision so that the textual
+// DATETIME representation sorts chronologically.
+func leaseTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Second)
+}
+
+// SaveLease records (or refreshes) the binding of a MAC address to an IP
+// address in a network. Any stale binding of the same IP to another MAC in the
+// network is dropped so an address is never restored twice.
+func SaveLease(lease Lease) error {
+	return store.SaveLease(lease)
+}
+
+// DeleteLease removes the binding of a MAC address in a network
+func DeleteLease(network, mac string) error {
+	return store.DeleteLease(network, mac)
+}
+
+// ListActiveLeases lists the unexpired leases, optionally limited to a network
+func ListActiveLeases(network string) ([]Lease, error) {
+	return store.ListActiveLeases(network)
+}
+
+// PurgeExpiredLeases deletes every lease whose expiry is in the past and
+// returns the number of leases removed
+func PurgeExpiredLeases() (int64, error) {
+	return store.PurgeExpiredLeases()
+}
+
+// Reasons a lease history entry ended for
+const (
+	leaseEndExpired    = "expired"
+	leaseEndReleased   = "released"
+	leaseEndDeclined   = "declined"
+	leaseEndMoved      = "moved"      // The client got another address of the network
+	leaseEndReassigned = "reassigned" // The address was given to another client
+)
+
+// leaseHistoryRetention is how long the ended history entries are kept
+const leaseHistoryRetention = 90 * 24 * time.Hour
+
+// LeaseHistory is a period during which a MAC address held an IP address
+type LeaseHistory struct {
+	MAC       string     `json:"mac"`
+	IP        string     `json:"ip"`
+	Network   string     `json:"network"`
+	Interface string     `json:"interface"`
+	Hostname  string     `json:"hostname"`
+	StartedAt time.Time  `json:"started_at"`
+	RenewedAt time.Time  `json:"renewed_at"`
+	EndedAt   *time.Time `json:"ended_at,omitempty"`
+	EndReason string     `json:"end_reason,omitempty"`
+}
+
+// RecordLeaseHistory logs the binding of a MAC address to an IP address: a
+// renewal extends the open entry, a new address starts another one. The open
+// entries of the client on other addresses of the network and of other
+// clients on this address are ended.
+func RecordLeaseHistory(entry LeaseHistory) error {
+	return store.RecordLeaseHistory(entry)
+}
+
+// EndLeaseHistory ends the open history entry of a MAC address in a network,
+// if any
+func EndLeaseHistory(network, mac, reason string) error {
+	return store.EndLeaseHistory(network, mac, reason)
+}
+
+// EndStaleLeaseHistory ends the open history entries whose lease is gone,
+// the ones that expired while the daemon was stopped
+func EndStaleLeaseHistory() (int64, error) {
+	leases, err := store.ListActiveLeases("")
+	if err != nil {
+		return 0, fmt.Errorf("failed to end stale lease history: %w", err)
+	}
+	active := make(map[string]bool, len(leases))
+	for _, lease := range leases {
+		active[lease.Network+" "+lease.MAC] = true
+	}
+
+	open, err := store.ListOpenLeaseHistory()
+	if err != nil {
+		return 0, fmt.Errorf("failed to end stale lease history: %w", err)
+	}
+	var ended int64
+	for _, entry := range open {
+		key := entry.Network + " " + entry.MAC
+		if active[key] {
+			continue
+		}
+		if err := store.EndLeaseHistory(entry.Network, entry.MAC, leaseEndExpired); err != nil {
+			return ended, err
+		}
+		// A client has a single open entry per network
+		active[key] = true
+		ended++
+	}
+
+	return ended, nil
+}
+
+// ListLeaseHistory lists the history of a MAC address, most recent first
+func ListLeaseHistory(mac string, limit int) ([]LeaseHistory, error) {
+	return store.ListLeaseHistory(mac, limit)
+}
+
+// PurgeLeaseHistory deletes the history entries that ended before a date
+// and returns the number of rows removed
+func PurgeLeaseHistory(before time.Time) (int64, error) {
+	return store.PurgeLeaseHistory(before)
+}
+
+// unbind ends the binding of a MAC address whose persisted lease was
+// deleted: its history, the copy of the failover partner and its DNS records
+func (h *DHCPHandler) unbind(network, mac string, ip net.IP, reason string) {
+	if err := EndLeaseHistory(network, mac, reason); err != nil {
+		log.LoggerWContext(ctx).Error("Unable to log the end of the lease of " + mac + ": " + err.Error())
+	}
+	failover.publishRelease(network, mac, ip.String())
+	h.ddns.unregister(ctx, mac)
+}
+
+// restoreLeases reloads the unexpired leases of a network into the scope
+// caches and reserves their indexes in the pool so a restarted daemon does not
+// hand out addresses that are still bound. It returns the number of leases
+// restored.
+func restoreLeases(handler *DHCPHandler, network string) int {
+	leases, err := ListActiveLeases(network)
+	if err != nil {
+		log.LoggerWContext(ctx).Error("Unable to restore leases of network " + network + ": " + err.Error())
+		return 0
+	}
+
+	restored := 0
+	for _, lease := range leases {
+		ip := net.ParseIP(lease.IP)
+		if ip.To4() == nil {
+			continue
+		}
+		index := handler.indexOf(ip)
+		if index < 0 || index >= handler.leaseRange {
+			log.LoggerWContext(ctx).Info("Lease " + lease.IP + " of " + lease.MAC + " is outside of the pool of network " + network + ", skipping")
+			continue
+		}
+		remaining := time.Until(lease.ExpiresAt)
+		if remaining <= 0 {
+			continue
+		}
+
+		// A static assignment already holds its index for the MAC
+		if position, ok := handler.staticIndex(lease.MAC, nil); !ok || int(position) != index {
+			if err, _ := handler.available.ReserveIPIndex(safeIntToUint64(index), lease.MAC); err != nil {
+				log.LoggerWContext(ctx).Info("Unable to restore lease " + lease.IP + " of " + lease.MAC + ": " + err.Error())
+				continue
+			}
+		}
+
+		handler.hwcache.Set(lease.MAC, index, remaining+(time.Duration(15)*time.Second))
+		handler.ddns.restore(lease.MAC, ip, lease.DNSName, lease.DNSForward)
+		handler.setPeerBound(lease.MAC, lease.Partner)
+		GlobalIpCache.Set(lease.IP, lease.MAC, remaining+(time.Duration(15)*time.Second))
+		GlobalMacCache.Set(lease.MAC, lease.IP, remaining+(time.Duration(15)*time.Second))
+		restored++
+	}
+
+	if restored > 0 {
+		log.LoggerWContext(ctx).Info("Restored " + strconv.Itoa(restored) + " leases in network " + network)
+	}
+
+	return restored
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"database/sql"
+	"net"
+	"testing"
+	"time"
+
+	cache "github.com/fdurand/go-cache"
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+func TestSaveAndListLeases(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+
+		leases := []Lease{
+			{MAC: "aa:bb:cc:dd:ee:01", IP: "192.168.1.10", Network: "192.168.1.0", Hostname: "laptop", ExpiresAt: time.Now().Add(time.Hour), DNSName: "laptop.example.org.", DNSForward: true},
+			{MAC: "aa:bb:cc:dd:ee:02", IP: "192.168.1.11", Network: "192.168.1.0", ExpiresAt: time.Now().Add(-time.Hour)},
+			{MAC: "aa:bb:cc:dd:ee:03", IP: "10.0.0.10", Network: "10.0.0.0", ExpiresAt: time.Now().Add(time.Hour)},
+		}
+		for _, lease := range leases {
+			if err := SaveLease(lease); err != nil {
+				t.Fatalf("SaveLease failed: %v", err)
+			}
+		}
+
+		all, err := ListActiveLeases("")
+		if err != nil {
+			t.Fatalf("ListActiveLeases failed: %v", err)
+		}
+		if len(all) != 2 {
+			t.Errorf("Expected 2 active leases, got %d", len(all))
+		}
+
+		network, err := ListActiveLeases("192.168.1.0")
+		if err != nil {
+			t.Fatalf("ListActiveLeases failed: %v", err)
+		}
+		if len(network) != 1 || network[0].Hostname != "laptop" {
+			t.Fatalf("Expected the laptop lease only, got %+v", network)
+		}
+		if network[0].DNSName != "laptop.example.org." || !network[0].DNSForward {
+			t.Errorf("Expected the DNS name to be stored with the lease, got %+v", network[0])
+		}
+
+		// Renewing the lease must update it in place
+		renewed := leases[0]
+		renewed.ExpiresAt = time.Now().Add(2 * time.Hour)
+		if err := SaveLease(renewed); err != nil {
+			t.Fatalf("SaveLease renew failed: %v", err)
+		}
+		network, _ = ListActiveLeases("192.168.1.0")
+		if len(network) != 1 || network[0].ExpiresAt.Before(time.Now().Add(90*time.Minute)) {
+			t.Errorf("Expected the renewed lease to be extended, got %+v", network)
+		}
+
+		// Binding the same IP to another MAC replaces the stale binding
+		if err := SaveLease(Lease{MAC: "aa:bb:cc:dd:ee:09", IP: "192.168.1.10", Network: "192.168.1.0", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+			t.Fatalf("SaveLease failed: %v", err)
+		}
+		network, _ = ListActiveLeases("192.168.1.0")
+		if len(network) != 1 || network[0].MAC != "aa:bb:cc:dd:ee:09" {
+			t.Errorf("Expected the IP to belong to the new MAC only, got %+v", network)
+		}
+
+		purged, err := PurgeExpiredLeases()
+		if err != nil {
+			t.Fatalf("PurgeExpiredLeases failed: %v", err)
+		}
+		if purged != 1 {
+			t.Errorf("Expected 1 expired lease purged, got %d", purged)
+		}
+
+		if err := DeleteLease("10.0.0.0", "aa:bb:cc:dd:ee:03"); err != nil {
+			t.Fatalf("DeleteLease failed: %v", err)
+		}
+		if err := DeleteLease("10.0.0.0", "aa:bb:cc:dd:ee:03"); err != sql.ErrNoRows {
+			t.Errorf("Expected ErrNoRows, got %v", err)
+		}
+	})
+}
+
+func TestRestoreLeases(t *testing.T) {
+	dbPath := setupTestDB(t)
+	defer teardownTestDB(t, dbPath)
+
+	if err := InitDatabase(dbPath); err != nil {
+		t.Fatalf("InitDatabase failed: %v", err)
+	}
+
+	prevIp, prevMac := GlobalIpCache, GlobalMacCache
+	defer func() { GlobalIpCache, GlobalMacCache = prevIp, prevMac }()
+	GlobalIpCache = cache.New(5*time.Minute, 10*time.Minute)
+	GlobalMacCache = cache.New(5*time.Minute, 10*time.Minute)
+
+	startIP := net.ParseIP("192.168.1.10").To4()
+	endIP := net.ParseIP("192.168.1.20").To4()
+	handler := &DHCPHandler{
+		leaseRange: dhcp.IPRange(startIP, endIP),
+		available:  newTestRangePool(startIP, dhcp.IPRange(startIP, endIP)),
+		hwcache:    cache.New(time.Hour, 10*time.Second),
+		peerBound:  cache.New(cache.NoExpiration, 0),
+		ddns:       &ddnsConfig{zone: "example.org.", records: make(map[string]ddnsRecord)},
+	}
+
+	for _, lease := range []Lease{
+		{MAC: "aa:bb:cc:dd:ee:01", IP: "192.168.1.12", Network: "192.168.1.0", ExpiresAt: time.Now().Add(time.Hour), DNSName: "laptop.example.org.", DNSForward: true, Partner: true},
+		{MAC: "aa:bb:cc:dd:ee:02", IP: "192.168.1.200", Network: "192.168.1.0", ExpiresAt: time.Now().Add(time.Hour)},
+		{MAC: "aa:bb:cc:dd:ee:03", IP: "192.168.1.13", Network: "192.168.1.0", ExpiresAt: time.Now().Add(-time.Hour)},
+	} {
+		if err := SaveLease(lease); err != nil {
+			t.Fatalf("SaveLease failed: %v", err)
+		}
+	}
+
+	if restored := restoreLeases(handler, "192.168.1.0"); restored != 1 {
+		t.Fatalf("Expected 1 restored lease, got %d", restored)
+	}
+
+	if x, found := handler.hwcache.Get("aa:bb:cc:dd:ee:01"); !found || x.(int) != 2 {
+		t.Errorf("Expected index 2 in the hardware cache, got %v (found %v)", x, found)
+	}
+	if _, mac, err := handler.available.GetMACIndex(2); err != nil || mac != "aa:bb:cc:dd:ee:01" {
+		t.Errorf("Expected index 2 reserved for the restored MAC, got %s (%v)", mac, err)
+	}
+	if ip, found := GlobalMacCache.Get("aa:bb:cc:dd:ee:01"); !found || ip.(string) != "192.168.1.12" {
+		t.Errorf("Expected the MAC cache to be restored, got %v", ip)
+	}
+	if mac, found := GlobalIpCache.Get("192.168.1.12"); !found || mac.(string) != "aa:bb:cc:dd:ee:01" {
+		t.Errorf("Expected the IP cache to be restored, got %v", mac)
+	}
+	if free := handler.available.FreeIPsRemaining(); free != uint64(handler.leaseRange-1) {
+		t.Errorf("Expected a single reserved index, got %d free", free)
+	}
+	// The DNS name is restored so it is removed when the lease ends
+	if name, forward := handler.ddns.registered("aa:bb:cc:dd:ee:01"); name != "laptop.example.org." || !forward {
+		t.Errorf("Expected the DNS name to be restored, got %q (forward %v)", name, forward)
+	}
+	if !handler.isPeerBound("aa:bb:cc:dd:ee:01") {
+		t.Error("Expected the binding to be restored as one of the failover partner")
+	}
+}
+
+func TestUpgradeLeaseTable(t *testing.T) {
+	dbPath := setupTestDB(t)
+	defer teardownTestDB(t, dbPath)
+
+	// The lease table of a version without the DNS names
+	old, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	_, err = old.Exec(`CREATE TABLE dhcp_leases (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		mac TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		network TEXT NOT NULL,
+		hostname TEXT NOT NULL DEFAULT '',
+		expires_at DATETIME NOT NULL,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(network, mac)
+	)`)
+	old.Close()
+	if err != nil {
+		t.Fatalf("Failed to create the old table: %v", err)
+	}
+
+	if err := InitDatabase(dbPath); err != nil {
+		t.Fatalf("InitDatabase failed: %v", err)
+	}
+	if err := SaveLease(Lease{MAC: "aa:bb:cc:dd:ee:01", IP: "192.168.1.10", Network: "192.168.1.0", ExpiresAt: time.Now().Add(time.Hour), DNSName: "laptop.example.org."}); err != nil {
+		t.Fatalf("SaveLease failed: %v", err)
+	}
+	if leases, _ := ListActiveLeases(""); len(leases) != 1 || leases[0].DNSName != "laptop.example.org." {
+		t.Errorf("Expected the DNS name to be stored, got %+v", leases)
+	}
+
+	// Opening the upgraded database again leaves it as is
+	CloseDatabase()
+	if err := InitDatabase(dbPath); err != nil {
+		t.Errorf("InitDatabase of the upgraded database failed: %v", err)
+	}
+}
+
+func TestLeaseHistory(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		mac := "aa:bb:cc:dd:ee:01"
+		record := func(ip string) {
+			if err := RecordLeaseHistory(LeaseHistory{MAC: mac, IP: ip, Network: "192.168.1.0", Interface: "eth0", Hostname: "laptop"}); err != nil {
+				t.Fatalf("RecordLeaseHistory failed: %v", err)
+			}
+		}
+
+		// A renewal extends the open entry
+		record("192.168.1.10")
+		record("192.168.1.10")
+		history, err := ListLeaseHistory(mac, 10)
+		if err != nil {
+			t.Fatalf("ListLeaseHistory failed: %v", err)
+		}
+		if len(history) != 1 || history[0].EndedAt != nil || history[0].Interface != "eth0" {
+			t.Fatalf("Expected a single open entry, got %+v", history)
+		}
+
+		// Another address ends it
+		record("192.168.1.11")
+		history, _ = ListLeaseHistory(mac, 10)
+		if len(history) != 2 || history[0].IP != "192.168.1.11" || history[0].EndedAt != nil {
+			t.Fatalf("Expected the new address first, got %+v", history)
+		}
+		if history[1].EndedAt == nil || history[1].EndReason != leaseEndMoved {
+			t.Errorf("Expected the first address to be ended as moved, got %+v", history[1])
+		}
+
+		// The address given to another client ends the entry of the previous one
+		if err := RecordLeaseHistory(LeaseHistory{MAC: "aa:bb:cc:dd:ee:02", IP: "192.168.1.11", Network: "192.168.1.0"}); err != nil {
+			t.Fatalf("RecordLeaseHistory failed: %v", err)
+		}
+		history, _ = ListLeaseHistory(mac, 1)
+		if len(history) != 1 || history[0].EndReason != leaseEndReassigned {
+			t.Errorf("Expected the entry to be ended as reassigned, got %+v", history)
+		}
+
+		if err := EndLeaseHistory("192.168.1.0", "aa:bb:cc:dd:ee:02", leaseEndReleased); err != nil {
+			t.Fatalf("EndLeaseHistory failed: %v", err)
+		}
+		history, _ = ListLeaseHistory("aa:bb:cc:dd:ee:02", 10)
+		if len(history) != 1 || history[0].EndReason != leaseEndReleased {
+			t.Errorf("Expected the entry to be ended as released, got %+v", history)
+		}
+
+		// Open entries without a lease expired while the daemon was stopped
+		SaveLease(Lease{MAC: "aa:bb:cc:dd:ee:03", IP: "192.168.1.12", Network: "192.168.1.0", ExpiresAt: time.Now().Add(time.Hour)})
+		RecordLeaseHistory(LeaseHistory{MAC: "aa:bb:cc:dd:ee:03", IP: "192.168.1.12", Network: "192.168.1.0"})
+		RecordLeaseHistory(LeaseHistory{MAC: "aa:bb:cc:dd:ee:04", IP: "192.168.1.13", Network: "192.168.1.0"})
+		if ended, err := EndStaleLeaseHistory(); err != nil || ended != 1 {
+			t.Errorf("Expected a single stale entry, got %d (%v)", ended, err)
+		}
+
+		if purged, err := PurgeLeaseHistory(time.Now().Add(time.Minute)); err != nil || purged != 4 {
+			t.Errorf("Expected the 4 ended entries purged, got %d (%v)", purged, err)
+		}
+	})
+}
+
+func TestLeaseHistoryRestart(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		// A lease still bound when the daemon stops
+		SaveLease(Lease{MAC: "aa:bb:cc:dd:ee:01", IP: "192.168.1.10", Network: "192.168.1.0", ExpiresAt: time.Now().Add(time.Hour)})
+		RecordLeaseHistory(LeaseHistory{MAC: "aa:bb:cc:dd:ee:01", IP: "192.168.1.10", Network: "192.168.1.0"})
+		// And one that expires while it is stopped
+		SaveLease(Lease{MAC: "aa:bb:cc:dd:ee:02", IP: "192.168.1.11", Network: "192.168.1.0", ExpiresAt: time.Now().Add(-time.Minute)})
+		RecordLeaseHistory(LeaseHistory{MAC: "aa:bb:cc:dd:ee:02", IP: "192.168.1.11", Network: "192.168.1.0"})
+
+		// The startup of main
+		if _, err := PurgeExpiredLeases(); err != nil {
+			t.Fatalf("PurgeExpiredLeases failed: %v", err)
+		}
+		if ended, err := EndStaleLeaseHistory(); err != nil || ended != 1 {
+			t.Fatalf("Expected the expired lease only to be ended, got %d (%v)", ended, err)
+		}
+
+		history, err := ListLeaseHistory("aa:bb:cc:dd:ee:01", 10)
+		if err != nil {
+			t.Fatalf("ListLeaseHistory failed: %v", err)
+		}
+		if len(history) != 1 || history[0].EndedAt != nil {
+			t.Errorf("Expected the history of the live lease to stay open, got %+v", history)
+		}
+		history, _ = ListLeaseHistory("aa:bb:cc:dd:ee:02", 10)
+		if len(history) != 1 || history[0].EndReason != leaseEndExpired {
+			t.Errorf("Expected the history of the expired lease to be ended, got %+v", history)
+		}
+	})
+}
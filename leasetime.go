@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/binary"
+	"strconv"
+	"time"
+
+	"github.com/go-ini/ini"
+	"github.com/inverse-inc/packetfence/go/log"
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// leaseBounds reads dhcp_min_lease_time and dhcp_max_lease_time of a network.
+// A missing maximum does not let clients extend the default lease time and a
+// missing minimum lets them shorten it down to one second.
+func leaseBounds(sec *ini.Section, leaseDuration time.Duration) (time.Duration, time.Duration) {
+	minLease := time.Second
+	maxLease := leaseDuration
+
+	if value := sec.Key("dhcp_min_lease_time").String(); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+			minLease = time.Duration(seconds) * time.Second
+		} else {
+			log.LoggerWContext(ctx).Error("Invalid dhcp_min_lease_time " + value + " in " + sec.Name())
+		}
+	}
+	if value := sec.Key("dhcp_max_lease_time").String(); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+			maxLease = time.Duration(seconds) * time.Second
+		} else {
+			log.LoggerWContext(ctx).Error("Invalid dhcp_max_lease_time " + value + " in " + sec.Name())
+		}
+	}
+
+	if maxLease < leaseDuration {
+		log.LoggerWContext(ctx).Error("dhcp_max_lease_time is lower than dhcp_default_lease_time in " + sec.Name() + ", using the default lease time as maximum")
+		maxLease = leaseDuration
+	}
+	if minLease > leaseDuration {
+		log.LoggerWContext(ctx).Error("dhcp_min_lease_time is greater than dhcp_default_lease_time in " + sec.Name() + ", using the default lease time as minimum")
+		minLease = leaseDuration
+	}
+	return minLease, maxLease
+}
+
+// grantLease resolves the lease time granted to a client from the reply
+// options, once the overrides have been applied, and the lease time the
+// client requested (option 51).
+//
+// A network or MAC override of option 51 is authoritative. Otherwise the
+// client gets what it asked for, clamped between the minimum and maximum lease
+// time of the scope, or the default lease time when it did not ask.
+//
+// Option 51 is removed from the options since dhcp.ReplyPacket adds it, and
+// the renewal (58) and rebinding (59) times are set to match the granted
+// lease: overridden values are kept when they are consistent with it,
+// otherwise the RFC 2131 defaults of 50% and 87.5% are used.
+func (h *DHCPHandler) grantLease(options dhcp.Options, requested []byte) time.Duration {
+	leaseDuration := h.leaseDuration
+
+	if override, ok := options[dhcp.OptionIPAddressLeaseTime]; ok && len(override) == 4 {
+		leaseDuration = time.Duration(binary.BigEndian.Uint32(override)) * time.Second
+	} else if len(requested) == 4 {
+		leaseDuration = time.Duration(binary.BigEndian.Uint32(requested)) * time.Second
+		if leaseDuration < h.minLeaseDuration {
+			leaseDuration = h.minLeaseDuration
+		}
+		if h.maxLeaseDuration > 0 && leaseDuration > h.maxLeaseDuration {
+			leaseDuration = h.maxLeaseDuration
+		}
+	}
+	delete(options, dhcp.OptionIPAddressLeaseTime)
+	if leaseDuration <= 0 {
+		return leaseDuration
+	}
+
+	t1 := leaseDuration / 2
+	t2 := leaseDuration * 7 / 8
+	if value, ok := options[dhcp.OptionRenewalTimeValue]; ok && len(value) == 4 {
+		if overridden := time.Duration(binary.BigEndian.Uint32(value)) * time.Second; overridden < leaseDuration {
+			t1 = overridden
+		}
+	}
+	if value, ok := options[dhcp.OptionRebindingTimeValue]; ok && len(value) == 4 {
+		if overridden := time.Duration(binary.BigEndian.Uint32(value)) * time.Second; overridden > t1 && overridden < leaseDuration {
+			t2 = overridden
+		}
+	}
+	if t2 <= t1 {
+		t1, t2 = leaseDuration/2, leaseDuration*7/8
+	}
+
+	options[dhcp.OptionRenewalTimeValue] = dhcp.OptionsLeaseTime(t1)
+	options[dhcp.OptionRebindingTimeValue] = dhcp.OptionsLeaseTime(t2)
+	return leaseDuration
+}
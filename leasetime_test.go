@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+func leaseOption(seconds uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, seconds)
+	return b
+}
+
+func TestLeaseBounds(t *testing.T) {
+	cfg := ini.Empty()
+	sec, _ := cfg.NewSection("network 192.168.1.0")
+
+	if minLease, maxLease := leaseBounds(sec, time.Hour); minLease != time.Second || maxLease != time.Hour {
+		t.Errorf("Expected the default lease time as maximum, got %v-%v", minLease, maxLease)
+	}
+
+	sec.Key("dhcp_min_lease_time").SetValue("600")
+	sec.Key("dhcp_max_lease_time").SetValue("86400")
+	if minLease, maxLease := leaseBounds(sec, time.Hour); minLease != 10*time.Minute || maxLease != 24*time.Hour {
+		t.Errorf("Expected 10m-24h, got %v-%v", minLease, maxLease)
+	}
+
+	// Bounds that exclude the default lease time are widened to include it
+	sec.Key("dhcp_min_lease_time").SetValue("7200")
+	sec.Key("dhcp_max_lease_time").SetValue("1800")
+	if minLease, maxLease := leaseBounds(sec, time.Hour); minLease != time.Hour || maxLease != time.Hour {
+		t.Errorf("Expected 1h-1h, got %v-%v", minLease, maxLease)
+	}
+}
+
+func TestGrantLease(t *testing.T) {
+	handler := &DHCPHandler{leaseDuration: time.Hour, minLeaseDuration: 10 * time.Minute, maxLeaseDuration: 24 * time.Hour}
+
+	tests := []struct {
+		name      string
+		options   dhcp.Options
+		requested []byte
+		lease     time.Duration
+		t1        uint32
+		t2        uint32
+	}{
+		{"default", dhcp.Options{}, nil, time.Hour, 1800, 3150},
+		{"requested", dhcp.Options{}, leaseOption(7200), 2 * time.Hour, 3600, 6300},
+		{"below minimum", dhcp.Options{}, leaseOption(60), 10 * time.Minute, 300, 525},
+		{"above maximum", dhcp.Options{}, leaseOption(7 * 86400), 24 * time.Hour, 43200, 75600},
+		{"override", dhcp.Options{dhcp.OptionIPAddressLeaseTime: leaseOption(300)}, leaseOption(7200), 5 * time.Minute, 150, 262},
+		{"renewal overrides", dhcp.Options{dhcp.OptionRenewalTimeValue: leaseOption(600), dhcp.OptionRebindingTimeValue: leaseOption(3000)}, nil, time.Hour, 600, 3000},
+		{"rebinding override below renewal", dhcp.Options{dhcp.OptionRenewalTimeValue: leaseOption(3000), dhcp.OptionRebindingTimeValue: leaseOption(600)}, nil, time.Hour, 3000, 3150},
+		{"renewal override above lease", dhcp.Options{dhcp.OptionRenewalTimeValue: leaseOption(7200)}, nil, time.Hour, 1800, 3150},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lease := handler.grantLease(tt.options, tt.requested)
+			if lease != tt.lease {
+				t.Errorf("Expected a lease of %v, got %v", tt.lease, lease)
+			}
+			if _, found := tt.options[dhcp.OptionIPAddressLeaseTime]; found {
+				t.Error("Option 51 must be left to dhcp.ReplyPacket")
+			}
+			if t1 := binary.BigEndian.Uint32(tt.options[dhcp.OptionRenewalTimeValue]); t1 != tt.t1 {
+				t.Errorf("Expected T1 %d, got %d", tt.t1, t1)
+			}
+			if t2 := binary.BigEndian.Uint32(tt.options[dhcp.OptionRebindingTimeValue]); t2 != tt.t2 {
+				t.Errorf("Expected T2 %d, got %d", tt.t2, t2)
+			}
+		})
+	}
+}
+
+func TestGrantLeaseOverrides(t *testing.T) {
+	dbPath := setupTestDB(t)
+	defer teardownTestDB(t, dbPath)
+
+	if err := InitDatabase(dbPath); err != nil {
+		t.Fatalf("InitDatabase failed: %v", err)
+	}
+
+	handler := &DHCPHandler{leaseDuration: time.Hour, minLeaseDuration: time.Minute, maxLeaseDuration: 2 * time.Hour}
+	const mac = "aa:bb:cc:dd:ee:ff"
+
+	if err := SaveOptionOverride("network", "192.168.1.0", []DHCPOption{{OptionCode: 51, OptionValue: "600", OptionType: "uint32"}}); err != nil {
+		t.Fatalf("SaveOptionOverride failed: %v", err)
+	}
+	options := ApplyOptionOverrides(dhcp.Options{}, "192.168.1.0", mac)
+	if lease := handler.grantLease(options, leaseOption(7200)); lease != 10*time.Minute {
+		t.Errorf("Expected the network override, got %v", lease)
+	}
+
+	if err := SaveOptionOverride("mac", mac, []DHCPOption{{OptionCode: 51, OptionValue: "86400", OptionType: "uint32"}}); err != nil {
+		t.Fatalf("SaveOptionOverride failed: %v", err)
+	}
+	options = ApplyOptionOverrides(dhcp.Options{}, "192.168.1.0", mac)
+	if lease := handler.grantLease(options, nil); lease != 24*time.Hour {
+		t.Errorf("Expected the MAC override to win over the network one and the maximum, got %v", lease)
+	}
+}
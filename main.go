@@ -8,6 +8,8 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/coreos/go-systemd/daemon"
@@ -15,7 +17,6 @@ import (
 	"github.com/fdurand/arp"
 	cache "github.com/fdurand/go-cache"
 	"github.com/go-errors/errors"
-	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
 	"github.com/inverse-inc/packetfence/go/log"
 	"github.com/inverse-inc/packetfence/go/timedlock"
@@ -43,7 +44,7 @@ const FreeMac = "00:00:00:00:00:00"
 const FakeMac = "ff:ff:ff:ff:ff:ff"
 
 // Filesystem paths used by the daemon.
-const (
+var (
 	configFilePath   = "/usr/local/etc/godhcp.ini"
 	databaseFilePath = "/usr/local/etc/godhcp.db"
 	webUIDir         = "/usr/local/share/godhcp/webui"
@@ -56,13 +57,46 @@ func main() {
 	// Default http timeout
 	http.DefaultClient.Timeout = 10 * time.Second
 
-	// Initialize SQLite database for option overrides
+	// Initialize SQLite database for option overrides and leases
 	if err := InitDatabase(databaseFilePath); err != nil {
 		log.LoggerWContext(ctx).Error("Failed to initialize database: " + err.Error())
 		os.Exit(1)
 	}
 	defer CloseDatabase()
 
+	// The leases and option overrides can be stored elsewhere
+	databaseConf, err := readDatabaseConfig(configFilePath)
+	if err != nil {
+		fmt.Printf("Fail to read database configuration: %v", err)
+		os.Exit(1)
+	}
+	if err := openLeaseStore(databaseConf); err != nil {
+		log.LoggerWContext(ctx).Error("Failed to open the " + databaseConf.backend + " database: " + err.Error())
+		os.Exit(1)
+	}
+
+	// Drop the leases that expired while the daemon was stopped
+	if _, err := PurgeExpiredLeases(); err != nil {
+		log.LoggerWContext(ctx).Error("Failed to purge expired leases: " + err.Error())
+	}
+	if _, err := EndStaleLeaseHistory(); err != nil {
+		log.LoggerWContext(ctx).Error("Failed to end the history of the expired leases: " + err.Error())
+	}
+
+	// Forget the old lease history every day
+	go func() {
+		for {
+			if _, err := PurgeLeaseHistory(time.Now().Add(-leaseHistoryRetention)); err != nil {
+				log.LoggerWContext(ctx).Error("Failed to purge the lease history: " + err.Error())
+			}
+			time.Sleep(24 * time.Hour)
+		}
+	}()
+
+	if total, _, err := CountAPICredentials(); err == nil && total == 0 {
+		log.LoggerWContext(ctx).Warn("No API credential configured, the API is open to the unix socket and loopback connections until an admin user or token is created")
+	}
+
 	// Initialize IP cache
 	GlobalIpCache = cache.New(5*time.Minute, 10*time.Minute)
 	// Initialize Mac cache
@@ -76,9 +110,51 @@ func main() {
 	VIP = make(map[string]bool)
 	VIPIp = make(map[string]net.IP)
 
+	// Failover pairing, the pools are split before the scopes are built
+	failover, err = readFailoverConfig(configFilePath)
+	if err != nil {
+		fmt.Printf("Fail to read failover configuration: %v", err)
+		os.Exit(1)
+	}
+
+	// Per client, per relay and global rate limits
+	rateLimitConf, err := readRateLimitConfig(configFilePath)
+	if err != nil {
+		fmt.Printf("Fail to read ratelimit configuration: %v", err)
+		os.Exit(1)
+	}
+	rateLimits.configure(rateLimitConf)
+
+	// Conflict detection before the addresses are offered
+	probeConf, err := readProbeConfig(configFilePath)
+	if err != nil {
+		fmt.Printf("Fail to read probe configuration: %v", err)
+		os.Exit(1)
+	}
+	probes.configure(probeConf)
+
 	// Read pfconfig
 	DHCPConfig = newDHCPConfig()
-	DHCPConfig.readConfig()
+	if err := DHCPConfig.readConfig(); err != nil {
+		fmt.Printf("Fail to read configuration: %v", err)
+		os.Exit(1)
+	}
+
+	// Lease event webhooks
+	hooks, err := readWebhooks(configFilePath)
+	if err != nil {
+		fmt.Printf("Fail to read webhook configuration: %v", err)
+		os.Exit(1)
+	}
+	startWebhooks(hooks)
+
+	if failover != nil {
+		failover.config = DHCPConfig
+		if err := failover.start(ctx); err != nil {
+			fmt.Printf("Fail to start failover: %v", err)
+			os.Exit(1)
+		}
+	}
 
 	// Queue value
 	var (
@@ -98,32 +174,58 @@ func main() {
 		}(i)
 	}
 
+	DHCPConfig.jobs = jobs
+
+	// Give the addresses of the expired exclusions back to the pools and
+	// forget the idle rate limited clients
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			expireExclusions()
+			rateLimits.expire(time.Now())
+		}
+	}()
+
 	intNametoInterface = make(map[string]*Interface)
 
-	// Reference the interfaces by their address in the backing slice so the
-	// API map, the unicast listener and the broadcast listener all share the
-	// same Interface value rather than independent copies.
-	for i := range DHCPConfig.intsNet {
-		iface := &DHCPConfig.intsNet[i]
+	// The API map, the unicast listener and the broadcast listener all share
+	// the same Interface value so a reload can update it in place.
+	for _, iface := range DHCPConfig.intsNet {
 		intNametoInterface[iface.Name] = iface
-
-		// Unicast listener
-		go iface.runUnicast(ctx, jobs)
-		// Broadcast listener
-		go iface.run(ctx, jobs)
+		iface.start(ctx, jobs)
 	}
 
+	// Reload the configuration on SIGHUP
+	go func() {
+		sighup := make(chan os.Signal, 1)
+		signal.Notify(sighup, syscall.SIGHUP)
+		for range sighup {
+			log.LoggerWContext(ctx).Info("SIGHUP received, reloading the configuration")
+			if _, err := DHCPConfig.reload(); err != nil {
+				log.LoggerWContext(ctx).Error("Failed to reload the configuration: " + err.Error())
+			}
+		}
+	}()
+
 	// Api
 	router := mux.NewRouter()
 	router.HandleFunc("/api/v1/dhcp/mac/{mac:(?:[0-9A-Fa-f]{2}:){5}[0-9A-Fa-f]{2}}", handleMac2Ip).Methods("GET")
 	router.HandleFunc("/api/v1/dhcp/mac/{mac:(?:[0-9A-Fa-f]{2}:){5}[0-9A-Fa-f]{2}}", handleReleaseIP).Methods("DELETE")
+	router.HandleFunc("/api/v1/dhcp/mac/{mac:(?:[0-9A-Fa-f]{2}:){5}[0-9A-Fa-f]{2}}/history", handleLeaseHistory).Methods("GET")
 	router.HandleFunc("/api/v1/dhcp/ip/{ip:(?:[0-9]{1,3}.){3}(?:[0-9]{1,3})}", handleIP2Mac).Methods("GET")
+	router.HandleFunc("/api/v1/dhcp/leases", handleListLeases).Methods("GET")
+	router.HandleFunc("/api/v1/dhcp6/ip/{ip:[0-9A-Fa-f:.]+}", handleIP6ToClient).Methods("GET")
+	router.HandleFunc("/api/v1/dhcp6/client/{client:[^/]+}", handleClient6).Methods("GET")
+	router.HandleFunc("/api/v1/dhcp6/client/{client:[^/]+}", handleReleaseClient6).Methods("DELETE")
 	router.HandleFunc("/api/v1/dhcp/stats", handleAllStats).Methods("GET")
 	router.HandleFunc("/api/v1/dhcp/stats/{int:.*}/{network:(?:[0-9]{1,3}.){3}(?:[0-9]{1,3})}", handleStats).Methods("GET")
 	router.HandleFunc("/api/v1/dhcp/stats/{int:.*}", handleStats).Methods("GET")
 	router.HandleFunc("/api/v1/dhcp/debug/{int:.*}/{role:(?:[^/]*)}", handleDebug).Methods("GET")
+	router.HandleFunc("/api/v1/failover", handleFailoverStatus).Methods("GET")
 	router.HandleFunc("/api/v1/config", handleGetConfig).Methods("GET")
 	router.HandleFunc("/api/v1/config", handleUpdateConfig).Methods("POST")
+	router.HandleFunc("/api/v1/config/reload", handleReloadConfig).Methods("POST")
+	router.HandleFunc("/api/v1/events", handleEvents).Methods("GET")
 
 	// DHCP option override endpoints
 	router.HandleFunc("/api/v1/dhcp/options/network/{network:(?:[0-9]{1,3}.){3}(?:[0-9]{1,3})}", handleOverrideNetworkOptions).Methods("POST")
@@ -133,13 +235,59 @@ func main() {
 	router.HandleFunc("/api/v1/dhcp/options", handleListOptionOverrides).Methods("GET")
 	router.HandleFunc("/api/v1/dhcp/options/{type}/{target}", handleGetOptionOverride).Methods("GET")
 
+	// Client classes
+	router.HandleFunc("/api/v1/dhcp/classes", handleListClientClasses).Methods("GET")
+	router.HandleFunc("/api/v1/dhcp/classes/{name:[A-Za-z0-9_.-]+}", handleGetClientClass).Methods("GET")
+	router.HandleFunc("/api/v1/dhcp/classes/{name:[A-Za-z0-9_.-]+}", handleSaveClientClass).Methods("POST")
+	router.HandleFunc("/api/v1/dhcp/classes/{name:[A-Za-z0-9_.-]+}", handleDeleteClientClass).Methods("DELETE")
+
+	// Static reservations
+	router.HandleFunc("/api/v1/dhcp/reservations", handleListReservations).Methods("GET")
+	router.HandleFunc("/api/v1/dhcp/reservations/{mac:(?:[0-9A-Fa-f]{2}:){5}[0-9A-Fa-f]{2}}", handleGetReservation).Methods("GET")
+	router.HandleFunc("/api/v1/dhcp/reservations/{mac:(?:[0-9A-Fa-f]{2}:){5}[0-9A-Fa-f]{2}}", handleSaveReservation).Methods("POST")
+	router.HandleFunc("/api/v1/dhcp/reservations/{mac:(?:[0-9A-Fa-f]{2}:){5}[0-9A-Fa-f]{2}}", handleDeleteReservation).Methods("DELETE")
+
+	// Exclusion ranges
+	router.HandleFunc("/api/v1/dhcp/exclusions", handleListExclusions).Methods("GET")
+	router.HandleFunc("/api/v1/dhcp/exclusions", handleSaveExclusion).Methods("POST")
+	router.HandleFunc("/api/v1/dhcp/exclusions/{id:[0-9]+}", handleGetExclusion).Methods("GET")
+	router.HandleFunc("/api/v1/dhcp/exclusions/{id:[0-9]+}", handleSaveExclusion).Methods("POST")
+	router.HandleFunc("/api/v1/dhcp/exclusions/{id:[0-9]+}", handleDeleteExclusion).Methods("DELETE")
+
+	// Allow-list and deny-list
+	router.HandleFunc("/api/v1/dhcp/maclists/{list:allow|deny}", handleListMACList).Methods("GET")
+	router.HandleFunc("/api/v1/dhcp/maclists/{list:allow|deny}", handleAddMACListEntry).Methods("POST")
+	router.HandleFunc("/api/v1/dhcp/maclists/{list:allow|deny}/{id:[0-9]+}", handleDeleteMACListEntry).Methods("DELETE")
+
+	// Rate limits
+	router.HandleFunc("/api/v1/dhcp/throttled", handleListThrottled).Methods("GET")
+	router.HandleFunc("/api/v1/dhcp/throttled", handleClearAllThrottled).Methods("DELETE")
+	router.HandleFunc("/api/v1/dhcp/throttled/{client:[0-9A-Fa-f:.]+}", handleClearThrottled).Methods("DELETE")
+
+	// API credentials
+	router.HandleFunc("/api/v1/auth/login", handleLogin).Methods("POST")
+	router.HandleFunc("/api/v1/auth/logout", handleLogout).Methods("POST")
+	router.HandleFunc("/api/v1/auth/whoami", handleWhoami).Methods("GET")
+	router.HandleFunc("/api/v1/auth/users", handleListAPIUsers).Methods("GET")
+	router.HandleFunc("/api/v1/auth/users/{username:[A-Za-z0-9_.@-]+}", handleSaveAPIUser).Methods("POST")
+	router.HandleFunc("/api/v1/auth/users/{username:[A-Za-z0-9_.@-]+}", handleDeleteAPIUser).Methods("DELETE")
+	router.HandleFunc("/api/v1/auth/tokens", handleListAPITokens).Methods("GET")
+	router.HandleFunc("/api/v1/auth/tokens/{name:[A-Za-z0-9_.-]+}", handleCreateAPIToken).Methods("POST")
+	router.HandleFunc("/api/v1/auth/tokens/{name:[A-Za-z0-9_.-]+}", handleDeleteAPIToken).Methods("DELETE")
+
+	// Prometheus metrics
+	router.HandleFunc("/metrics", handleMetrics).Methods("GET")
+
 	// Serve static web UI
 	router.PathPrefix("/").Handler(http.FileServer(http.Dir(webUIDir)))
 
-	srv := &http.Server{
-		Addr:        "127.0.0.1:22227",
-		IdleTimeout: 5 * time.Second,
-		Handler:     router,
+	// Every route requires credentials once some exist
+	router.Use(authMiddleware)
+
+	apiConf, err := readAPIConfig(configFilePath)
+	if err != nil {
+		fmt.Printf("Fail to read api configuration: %v", err)
+		os.Exit(1)
 	}
 
 	// Systemd
@@ -150,26 +298,18 @@ func main() {
 		if err != nil || interval == 0 {
 			return
 		}
-		cli := &http.Client{}
 		for {
-			req, err := http.NewRequest("GET", "http://127.0.0.1:22227", nil)
-			if err != nil {
-				log.LoggerWContext(ctx).Error(err.Error())
-				continue
-			}
-			req.Close = true
-			resp, err := cli.Do(req)
+			err := apiConf.probe()
 			time.Sleep(100 * time.Millisecond)
 			if err != nil {
 				log.LoggerWContext(ctx).Error(err.Error())
 				continue
 			}
-			resp.Body.Close()
 			daemon.SdNotify(false, "WATCHDOG=1")
 			time.Sleep(interval / 3)
 		}
 	}()
-	if err := srv.ListenAndServe(); err != nil {
+	if err := serveAPI(apiConf, router); err != nil {
 		log.LoggerWContext(ctx).Error("HTTP server error: " + err.Error())
 	}
 }
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// TestMain sends the daemon logs to stdout so code paths that log can be
+// exercised without a syslog socket.
+func TestMain(m *testing.M) {
+	if os.Getenv("LOG_OUTPUT") == "" {
+		os.Setenv("LOG_OUTPUT", "stdout")
+	}
+	os.Exit(m.Run())
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// latencyBuckets are the upper bounds of the ServeDHCP latency histogram, in
+// seconds
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// serverMetrics holds the counters exposed on /metrics
+type serverMetrics struct {
+	received        [dhcp.Inform + 1]atomic.Uint64 // Packets received by message type
+	sent            [dhcp.Inform + 1]atomic.Uint64 // Packets sent by message type
+	jobsDropped     atomic.Uint64                  // Packets dropped because the job queue was full
+	throttled       [throttleReasons]atomic.Uint64 // Packets dropped by the rate limits by reason
+	pingConflicts   atomic.Uint64                  // Addresses found in use before being offered
+	probes          [probeMethods]atomic.Uint64    // Addresses checked before being offered by method
+	eventsDropped   atomic.Uint64                  // Lease events lost by a subscriber not keeping up
+	webhookFailures atomic.Uint64                  // Lease events a webhook failed to deliver
+	latency         []atomic.Uint64                // Packets by latency bucket, the last one is +Inf
+	latencySum      atomic.Uint64                  // Nanoseconds
+}
+
+var metrics = &serverMetrics{latency: make([]atomic.Uint64, len(latencyBuckets)+1)}
+
+// countReceived counts a packet read from an interface
+func (m *serverMetrics) countReceived(msgType dhcp.MessageType) {
+	if msgType >= dhcp.Discover && msgType <= dhcp.Inform {
+		m.received[msgType].Add(1)
+	}
+}
+
+// countSent counts a packet handed to the network
+func (m *serverMetrics) countSent(p dhcp.Packet) {
+	if t := p.ParseOptions()[dhcp.OptionDHCPMessageType]; len(t) == 1 {
+		if msgType := dhcp.MessageType(t[0]); msgType >= dhcp.Discover && msgType <= dhcp.Inform {
+			m.sent[msgType].Add(1)
+		}
+	}
+}
+
+// observeLatency records the time ServeDHCP took to handle a packet
+func (m *serverMetrics) observeLatency(d time.Duration) {
+	bucket := len(latencyBuckets)
+	for i, bound := range latencyBuckets {
+		if d.Seconds() <= bound {
+			bucket = i
+			break
+		}
+	}
+	m.latency[bucket].Add(1)
+	m.latencySum.Add(uint64(d))
+}
+
+// writeTo renders the metrics in the Prometheus text format
+func (m *serverMetrics) writeTo(b *bytes.Buffer, interfaces []*Interface) {
+	// Every sample of a family follows its own HELP and TYPE lines
+	for _, family := range []struct {
+		name, help string
+		value      func(size, free uint64) uint64
+	}{
+		{"godhcp_pool_size", "Number of addresses of the pool.", func(size, free uint64) uint64 { return size }},
+		{"godhcp_pool_free", "Number of free addresses of the pool.", func(size, free uint64) uint64 { return free }},
+		{"godhcp_pool_used", "Number of addresses of the pool in use.", func(size, free uint64) uint64 { return size - free }},
+	} {
+		fmt.Fprintf(b, "# HELP %s %s\n", family.name, family.help)
+		fmt.Fprintf(b, "# TYPE %s gauge\n", family.name)
+		for _, I := range interfaces {
+			for _, network := range I.networks() {
+				size := network.dhcpHandler.available.Capacity()
+				free := network.dhcpHandler.available.FreeIPsRemaining()
+				labels := `{interface="` + I.Name + `",network="` + network.network.String() + `"}`
+				fmt.Fprintf(b, "%s%s %d\n", family.name, labels, family.value(size, free))
+			}
+		}
+	}
+	fmt.Fprintln(b, "# HELP godhcp_packets_denied_total Packets refused by the client policy of the network.")
+	fmt.Fprintln(b, "# TYPE godhcp_packets_denied_total counter")
+	for _, I := range interfaces {
+		for _, network := range I.networks() {
+			labels := `{interface="` + I.Name + `",network="` + network.network.String() + `"}`
+			fmt.Fprintf(b, "godhcp_packets_denied_total%s %d\n", labels, network.dhcpHandler.policy.deniedCount())
+		}
+	}
+
+	fmt.Fprintln(b, "# HELP godhcp_packets_received_total DHCP packets received by message type.")
+	fmt.Fprintln(b, "# TYPE godhcp_packets_received_total counter")
+	for msgType := dhcp.Discover; msgType <= dhcp.Inform; msgType++ {
+		fmt.Fprintf(b, "godhcp_packets_received_total{type=%q} %d\n", strings.ToUpper(msgType.String()), m.received[msgType].Load())
+	}
+	fmt.Fprintln(b, "# HELP godhcp_packets_sent_total DHCP packets sent by message type.")
+	fmt.Fprintln(b, "# TYPE godhcp_packets_sent_total counter")
+	for msgType := dhcp.Discover; msgType <= dhcp.Inform; msgType++ {
+		fmt.Fprintf(b, "godhcp_packets_sent_total{type=%q} %d\n", strings.ToUpper(msgType.String()), m.sent[msgType].Load())
+	}
+
+	fmt.Fprintln(b, "# HELP godhcp_jobs_dropped_total Packets dropped because the job queue was full.")
+	fmt.Fprintln(b, "# TYPE godhcp_jobs_dropped_total counter")
+	fmt.Fprintf(b, "godhcp_jobs_dropped_total %d\n", m.jobsDropped.Load())
+	fmt.Fprintln(b, "# HELP godhcp_packets_throttled_total Packets dropped by the rate limits by reason.")
+	fmt.Fprintln(b, "# TYPE godhcp_packets_throttled_total counter")
+	for reason, name := range throttleReasonNames {
+		fmt.Fprintf(b, "godhcp_packets_throttled_total{reason=%q} %d\n", name, m.throttled[reason].Load())
+	}
+	fmt.Fprintln(b, "# HELP godhcp_ping_conflicts_total Addresses found in use by the ping or ARP probe before being offered.")
+	fmt.Fprintln(b, "# TYPE godhcp_ping_conflicts_total counter")
+	fmt.Fprintf(b, "godhcp_ping_conflicts_total %d\n", m.pingConflicts.Load())
+	fmt.Fprintln(b, "# HELP godhcp_probes_total Addresses checked before being offered, by ARP, by ICMP, from the cache or skipped for want of a free probe slot.")
+	fmt.Fprintln(b, "# TYPE godhcp_probes_total counter")
+	for method, name := range probeMethodNames {
+		fmt.Fprintf(b, "godhcp_probes_total{method=%q} %d\n", name, m.probes[method].Load())
+	}
+	fmt.Fprintln(b, "# HELP godhcp_events_dropped_total Lease events lost by a webhook or stream not keeping up.")
+	fmt.Fprintln(b, "# TYPE godhcp_events_dropped_total counter")
+	fmt.Fprintf(b, "godhcp_events_dropped_total %d\n", m.eventsDropped.Load())
+	fmt.Fprintln(b, "# HELP godhcp_webhook_failures_total Lease events a webhook failed to deliver after its retries.")
+	fmt.Fprintln(b, "# TYPE godhcp_webhook_failures_total counter")
+	fmt.Fprintf(b, "godhcp_webhook_failures_total %d\n", m.webhookFailures.Load())
+
+	fmt.Fprintln(b, "# HELP godhcp_serve_duration_seconds Time spent handling a DHCP packet.")
+	fmt.Fprintln(b, "# TYPE godhcp_serve_duration_seconds histogram")
+	var count uint64
+	for i, bound := range latencyBuckets {
+		count += m.latency[i].Load()
+		fmt.Fprintf(b, "godhcp_serve_duration_seconds_bucket{le=%q} %d\n", strconv.FormatFloat(bound, 'g', -1, 64), count)
+	}
+	count += m.latency[len(latencyBuckets)].Load()
+	fmt.Fprintf(b, "godhcp_serve_duration_seconds_bucket{le=\"+Inf\"} %d\n", count)
+	fmt.Fprintf(b, "godhcp_serve_duration_seconds_sum %s\n", strconv.FormatFloat(time.Duration(m.latencySum.Load()).Seconds(), 'g', -1, 64))
+	fmt.Fprintf(b, "godhcp_serve_duration_seconds_count %d\n", count)
+}
+
+func handleMetrics(res http.ResponseWriter, req *http.Request) {
+	var b bytes.Buffer
+	metrics.writeTo(&b, DHCPConfig.interfaces())
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	res.WriteHeader(http.StatusOK)
+	b.WriteTo(res)
+}
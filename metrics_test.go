@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+func TestMetrics(t *testing.T) {
+	prevMetrics, prevConfig := metrics, DHCPConfig
+	defer func() { metrics, DHCPConfig = prevMetrics, prevConfig }()
+	metrics = &serverMetrics{latency: make([]atomic.Uint64, len(latencyBuckets)+1)}
+
+	handler := &DHCPHandler{available: newTestRangePool(net.ParseIP("192.168.1.10"), 10)}
+	handler.available.ReserveIPIndex(0, "00:11:22:33:44:55")
+	_, network, _ := net.ParseCIDR("192.168.1.0/24")
+	DHCPConfig = &Interfaces{intsNet: []*Interface{{Name: "eth0", network: []Network{{network: *network, dhcpHandler: handler}}}}}
+
+	metrics.countReceived(dhcp.Discover)
+	metrics.countReceived(dhcp.Discover)
+	metrics.countReceived(dhcp.Request)
+	offer := dhcp.ReplyPacket(newTestPacket(t, "00:11:22:33:44:55"), dhcp.Offer, net.ParseIP("192.168.1.1"), net.ParseIP("192.168.1.10"), time.Hour, nil)
+	metrics.countSent(offer)
+	metrics.jobsDropped.Add(1)
+	metrics.pingConflicts.Add(2)
+	metrics.observeLatency(200 * time.Microsecond)
+	metrics.observeLatency(3 * time.Millisecond)
+	metrics.observeLatency(10 * time.Second)
+
+	rr := httptest.NewRecorder()
+	handleMetrics(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if rr.Code != http.StatusOK || !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("Unexpected response %d %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	body := rr.Body.String()
+	for _, line := range []string{
+		`godhcp_pool_size{interface="eth0",network="192.168.1.0/24"} 10`,
+		`godhcp_pool_free{interface="eth0",network="192.168.1.0/24"} 9`,
+		`godhcp_pool_used{interface="eth0",network="192.168.1.0/24"} 1`,
+		`godhcp_packets_received_total{type="DISCOVER"} 2`,
+		`godhcp_packets_received_total{type="REQUEST"} 1`,
+		`godhcp_packets_received_total{type="INFORM"} 0`,
+		`godhcp_packets_sent_total{type="OFFER"} 1`,
+		`godhcp_jobs_dropped_total 1`,
+		`godhcp_ping_conflicts_total 2`,
+		`godhcp_serve_duration_seconds_bucket{le="0.0005"} 1`,
+		`godhcp_serve_duration_seconds_bucket{le="0.005"} 2`,
+		`godhcp_serve_duration_seconds_bucket{le="2.5"} 2`,
+		`godhcp_serve_duration_seconds_bucket{le="+Inf"} 3`,
+		`godhcp_serve_duration_seconds_sum 10.0032`,
+		`godhcp_serve_duration_seconds_count 3`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Missing %s in\n%s", line, body)
+		}
+	}
+}
+
+func TestMetricsFormat(t *testing.T) {
+	var interfaces []*Interface
+	for _, cidr := range []string{"192.168.1.0/24", "10.0.0.0/24"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		handler := &DHCPHandler{available: newTestRangePool(network.IP, 10)}
+		interfaces = append(interfaces, &Interface{Name: "eth0", network: []Network{{network: *network, dhcpHandler: handler}}})
+	}
+	var b bytes.Buffer
+	(&serverMetrics{latency: make([]atomic.Uint64, len(latencyBuckets)+1)}).writeTo(&b, interfaces)
+
+	// The samples of a family follow its HELP and TYPE lines without
+	// interruption
+	family, help := "", ""
+	seen := make(map[string]bool)
+	samples := make(map[string]int)
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		switch {
+		case strings.HasPrefix(line, "# HELP "):
+			help = strings.Fields(line)[2]
+			continue
+		case strings.HasPrefix(line, "# TYPE "):
+			family = strings.Fields(line)[2]
+			if help != family {
+				t.Errorf("The TYPE line of %s does not follow its HELP line", family)
+			}
+			if seen[family] {
+				t.Errorf("Family %s is described twice", family)
+			}
+			seen[family] = true
+			continue
+		case strings.HasPrefix(line, "#"):
+			continue
+		}
+		name := strings.FieldsFunc(line, func(r rune) bool { return r == '{' || r == ' ' })[0]
+		if name != family && strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(name, "_bucket"), "_sum"), "_count") != family {
+			t.Errorf("Sample %s is not under the TYPE line of its family, but under %s", name, family)
+		}
+		samples[name]++
+	}
+	if samples["godhcp_pool_free"] != 2 {
+		t.Errorf("Expected the free addresses of the 2 networks, got %d samples\n%s", samples["godhcp_pool_free"], b.String())
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"regexp"
+	"strings"
+
+	"fdurand/standalone_dhcp/pool"
+	"github.com/inverse-inc/packetfence/go/log"
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// OptionRelayAgentInformation is the Relay Agent Information option (RFC 3046)
+const OptionRelayAgentInformation dhcp.OptionCode = 82
+
+// RelayAgentMac holds in the pool the addresses assigned by circuit-id or
+// remote-id, they are never handed out to another client
+const RelayAgentMac = "ff:ff:ff:ff:ff:fc"
+
+func init() {
+	pool.RegisterSentinelMAC(RelayAgentMac)
+}
+
+// Relay Agent Information sub-options
+const (
+	relayAgentCircuitID     = 1 // RFC 3046
+	relayAgentRemoteID      = 2 // RFC 3046
+	relayAgentLinkSelection = 5 // RFC 3527
+	relayAgentSubscriberID  = 6 // RFC 3993
+)
+
+// RelayAgentInfo holds the decoded option 82 of a relayed request
+type RelayAgentInfo struct {
+	CircuitID     []byte
+	RemoteID      []byte
+	LinkSelection net.IP
+	SubscriberID  string
+	raw           []byte
+}
+
+type relayAgentInfoKey struct{}
+
+// parseRelayAgentInfo decodes option 82, it returns nil when the option is
+// absent or malformed
+func parseRelayAgentInfo(b []byte) *RelayAgentInfo {
+	if len(b) == 0 {
+		return nil
+	}
+	info := &RelayAgentInfo{raw: b}
+	for i := 0; i < len(b); {
+		if i+2 > len(b) || i+2+int(b[i+1]) > len(b) {
+			return nil
+		}
+		code, value := b[i], b[i+2:i+2+int(b[i+1])]
+		switch code {
+		case relayAgentCircuitID:
+			info.CircuitID = value
+		case relayAgentRemoteID:
+			info.RemoteID = value
+		case relayAgentLinkSelection:
+			if len(value) == 4 {
+				info.LinkSelection = net.IP(value)
+			}
+		case relayAgentSubscriberID:
+			info.SubscriberID = string(value)
+		}
+		i += 2 + len(value)
+	}
+	return info
+}
+
+// marshal encodes the sub-options of the option 82. A decoded option is
+// returned as received.
+func (r *RelayAgentInfo) marshal() []byte {
+	if r.raw != nil {
+		return r.raw
+	}
+	var b []byte
+	add := func(code byte, value []byte) {
+		if len(value) > 0 && len(value) <= 255 {
+			b = append(b, code, byte(len(value)))
+			b = append(b, value...)
+		}
+	}
+	add(relayAgentCircuitID, r.CircuitID)
+	add(relayAgentRemoteID, r.RemoteID)
+	add(relayAgentLinkSelection, r.LinkSelection.To4())
+	add(relayAgentSubscriberID, []byte(r.SubscriberID))
+	return b
+}
+
+// relayAgentID returns a circuit-id or remote-id as configured: as is when it
+// is printable, otherwise in hexadecimal prefixed with 0x
+func relayAgentID(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return "0x" + hex.EncodeToString(b)
+		}
+	}
+	return string(b)
+}
+
+// withRelayAgentInfo stores the option 82 of a request in its context
+func withRelayAgentInfo(ctx context.Context, info *RelayAgentInfo) context.Context {
+	if info == nil {
+		return ctx
+	}
+	if circuitID := relayAgentID(info.CircuitID); circuitID != "" {
+		ctx = log.AddToLogContext(ctx, "circuit_id", circuitID)
+	}
+	if remoteID := relayAgentID(info.RemoteID); remoteID != "" {
+		ctx = log.AddToLogContext(ctx, "remote_id", remoteID)
+	}
+	return context.WithValue(ctx, relayAgentInfoKey{}, info)
+}
+
+// relayAgentInfoFromContext returns the option 82 of the request, nil when the
+// request was not relayed by an agent adding it
+func relayAgentInfoFromContext(ctx context.Context) *RelayAgentInfo {
+	info, _ := ctx.Value(relayAgentInfoKey{}).(*RelayAgentInfo)
+	return info
+}
+
+// echoRelayAgentInfo appends the option 82 of the request to the options of
+// the reply, as RFC 3046 requires
+func echoRelayAgentInfo(options []dhcp.Option, info *RelayAgentInfo) []dhcp.Option {
+	if info == nil {
+		return options
+	}
+	return append(options, dhcp.Option{Code: OptionRelayAgentInformation, Value: info.marshal()})
+}
+
+// staticIndex returns the index statically assigned to a client, by MAC
+// address first in the configuration then in the reservations, then by
+// circuit-id and remote-id
+func (h *DHCPHandler) staticIndex(mac string, info *RelayAgentInfo) (uint32, bool) {
+	if position, ok := h.ipAssigned[mac]; ok {
+		return position, true
+	}
+	if position, ok := h.reservations.index(mac); ok {
+		return position, true
+	}
+	if info == nil {
+		return 0, false
+	}
+	if position, ok := h.circuitAssigned[relayAgentID(info.CircuitID)]; ok && len(info.CircuitID) > 0 {
+		return position, true
+	}
+	if position, ok := h.remoteAssigned[relayAgentID(info.RemoteID)]; ok && len(info.RemoteID) > 0 {
+		return position, true
+	}
+	return 0, false
+}
+
+// isStatic tells if an index is statically assigned
+func (h *DHCPHandler) isStatic(index int) bool {
+	for _, assigned := range []map[string]uint32{h.ipAssigned, h.circuitAssigned, h.remoteAssigned} {
+		for _, position := range assigned {
+			if int(position) == index {
+				return true
+			}
+		}
+	}
+	_, reserved := h.reservations.owner(index)
+	return reserved
+}
+
+// AssignRelayAgentIP statically assigns IP addresses to circuit-ids or
+// remote-ids (format: id:ip,id:ip) and removes them from the pool
+func AssignRelayAgentIP(dhcpHandler *DHCPHandler, ipRange string) map[string]uint32 {
+	couple := make(map[string]uint32)
+	if ipRange == "" {
+		return couple
+	}
+	rgx := regexp.MustCompile(`^(.+):((?:[0-9]{1,3}\.){3}[0-9]{1,3})$`)
+	for _, assignment := range strings.Split(ipRange, ",") {
+		result := rgx.FindStringSubmatch(strings.TrimSpace(assignment))
+		if len(result) < 3 {
+			log.LoggerWContext(ctx).Error("Invalid IP assignment format: " + assignment)
+			continue
+		}
+		index := dhcpHandler.indexOf(net.ParseIP(result[2]))
+		if index < 0 || index >= dhcpHandler.leaseRange {
+			log.LoggerWContext(ctx).Error("IP assignment " + assignment + " is outside of the pool")
+			continue
+		}
+		// The client is not known yet, keep the address aside
+		dhcpHandler.available.ReserveIPIndex(safeIntToUint64(index), RelayAgentMac)
+		couple[result[1]] = uint32(index)
+	}
+	return couple
+}
+
+// circuitID expands the circuit-id template of a relay interface
+func (I *Interface) circuitID(p dhcp.Packet) []byte {
+	return []byte(strings.NewReplacer(
+		"{interface}", I.Name,
+		"{ip}", I.Ipv4.String(),
+		"{mac}", p.CHAddr().String(),
+	).Replace(I.circuitIDTemplate))
+}
+
+// insertRelayAgentInfo adds the option 82 to a request a relay interface
+// forwards, unless no circuit-id template is configured or a downstream agent
+// already added one
+func (I *Interface) insertRelayAgentInfo(p2 *dhcp.Packet, p dhcp.Packet, info *RelayAgentInfo) {
+	if I.circuitIDTemplate == "" || info != nil {
+		return
+	}
+	info = &RelayAgentInfo{CircuitID: I.circuitID(p)}
+	p2.AddOption(OptionRelayAgentInformation, info.marshal())
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	cache "github.com/fdurand/go-cache"
+	"github.com/inverse-inc/packetfence/go/timedlock"
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+func TestParseRelayAgentInfo(t *testing.T) {
+	b := []byte{
+		1, 4, 'G', 'i', '0', '1',
+		2, 6, 0x00, 0x11, 0x22, 0x33, 0x44, 0x55,
+		5, 4, 10, 0, 2, 0,
+		6, 3, 'b', 'o', 'b',
+		9, 1, 0, // Unknown sub-option
+	}
+	info := parseRelayAgentInfo(b)
+	if info == nil {
+		t.Fatal("Expected the option 82 to be decoded")
+	}
+	if relayAgentID(info.CircuitID) != "Gi01" || relayAgentID(info.RemoteID) != "0x001122334455" {
+		t.Errorf("Unexpected circuit-id %q or remote-id %q", relayAgentID(info.CircuitID), relayAgentID(info.RemoteID))
+	}
+	if !info.LinkSelection.Equal(net.ParseIP("10.0.2.0")) || info.SubscriberID != "bob" {
+		t.Errorf("Unexpected link selection %v or subscriber-id %q", info.LinkSelection, info.SubscriberID)
+	}
+	if !bytes.Equal(info.marshal(), b) {
+		t.Error("The option 82 must be echoed as received")
+	}
+
+	if parseRelayAgentInfo([]byte{1, 10, 'x'}) != nil {
+		t.Error("Expected a truncated option 82 to be ignored")
+	}
+
+	built := &RelayAgentInfo{CircuitID: []byte("eth1"), LinkSelection: net.ParseIP("10.0.2.0")}
+	if decoded := parseRelayAgentInfo(built.marshal()); decoded == nil || string(decoded.CircuitID) != "eth1" || !decoded.LinkSelection.Equal(built.LinkSelection) {
+		t.Errorf("Round trip failed: %+v", decoded)
+	}
+}
+
+// newOption82TestInterface serves 10.0.1.0/24 and 10.0.2.0/24, the second one
+// through relays, with static assignments by circuit-id and remote-id
+func newOption82TestInterface() *Interface {
+	I := &Interface{Name: "eth0", InterfaceType: "server"}
+	for _, subnet := range []string{"10.0.1", "10.0.2"} {
+		start := net.ParseIP(subnet + ".10").To4()
+		end := net.ParseIP(subnet + ".50").To4()
+		handler := &DHCPHandler{
+			ip:            net.ParseIP(subnet + ".1").To4(),
+			leaseRange:    dhcp.IPRange(start, end),
+			leaseDuration: time.Hour,
+			available:     newTestRangePool(start, dhcp.IPRange(start, end)),
+			hwcache:       cache.New(time.Hour, 10*time.Second),
+			xid:           cache.New(4*time.Second, 2*time.Second),
+			layer2:        true,
+			options:       dhcp.Options{dhcp.OptionSubnetMask: []byte{255, 255, 255, 0}},
+		}
+		handler.circuitAssigned = AssignRelayAgentIP(handler, "Gi0/1:"+subnet+".20")
+		handler.remoteAssigned = AssignRelayAgentIP(handler, "0x001122334455:"+subnet+".30")
+		_, network, _ := net.ParseCIDR(subnet + ".0/24")
+		I.network = append(I.network, Network{network: *network, dhcpHandler: handler})
+	}
+	return I
+}
+
+func relayedDiscover(t *testing.T, mac string, giaddr net.IP, info *RelayAgentInfo) dhcp.Packet {
+	p := newTestPacket(t, mac)
+	p.SetXId([]byte{1, 2, 3, byte(len(mac))})
+	p.SetGIAddr(giaddr)
+	p.AddOption(dhcp.OptionDHCPMessageType, []byte{byte(dhcp.Discover)})
+	p.AddOption(OptionRelayAgentInformation, info.marshal())
+	return p
+}
+
+func TestServeDHCPRelayAgentInfo(t *testing.T) {
+	dbPath := setupTestDB(t)
+	defer teardownTestDB(t, dbPath)
+	if err := InitDatabase(dbPath); err != nil {
+		t.Fatalf("InitDatabase failed: %v", err)
+	}
+	prevCache, prevLock := GlobalTransactionCache, GlobalTransactionLock
+	defer func() { GlobalTransactionCache, GlobalTransactionLock = prevCache, prevLock }()
+	GlobalTransactionCache = cache.New(5*time.Minute, 10*time.Minute)
+	GlobalTransactionLock = timedlock.NewRWLock()
+
+	I := newOption82TestInterface()
+	relay := net.ParseIP("10.0.1.254").To4()
+
+	tests := []struct {
+		name string
+		mac  string
+		info *RelayAgentInfo
+		ip   string
+	}{
+		{"circuit-id", "aa:bb:cc:00:00:01", &RelayAgentInfo{CircuitID: []byte("Gi0/1")}, "10.0.1.20"},
+		{"remote-id", "aa:bb:cc:00:00:02", &RelayAgentInfo{RemoteID: []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}}, "10.0.1.30"},
+		{"link selection", "aa:bb:cc:00:00:03", &RelayAgentInfo{CircuitID: []byte("Gi0/1"), LinkSelection: net.ParseIP("10.0.2.0").To4()}, "10.0.2.20"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := relayedDiscover(t, tt.mac, relay, tt.info)
+			answer := I.ServeDHCP(context.Background(), p, dhcp.Discover, nil, nil)
+			if answer.D == nil {
+				t.Fatal("Expected an offer")
+			}
+			if !answer.D.YIAddr().Equal(net.ParseIP(tt.ip)) {
+				t.Errorf("Expected %s to be offered, got %s", tt.ip, answer.D.YIAddr())
+			}
+			if echoed := answer.D.ParseOptions()[OptionRelayAgentInformation]; !bytes.Equal(echoed, tt.info.marshal()) {
+				t.Errorf("Expected the option 82 to be echoed, got %v", echoed)
+			}
+		})
+	}
+}
+
+func TestRelayAgentAssignmentKept(t *testing.T) {
+	I := newOption82TestInterface()
+	handler := I.networks()[0].dhcpHandler
+	owner := func(index int) string {
+		_, mac, _ := handler.available.GetMACIndex(safeIntToUint64(index))
+		return mac
+	}
+	if owner(10) != RelayAgentMac || owner(20) != RelayAgentMac {
+		t.Fatalf("Expected the assigned addresses to be held for the relay agents, owners %s %s", owner(10), owner(20))
+	}
+
+	// Neither a binding of the failover partner, nor the end of a
+	// declined address, nor an exclusion takes them over
+	f := &Failover{role: "primary", share: 100, config: &Interfaces{intsNet: []*Interface{I}}}
+	f.applyBind(failoverMessage{Type: "bind", Network: "10.0.1.0", MAC: "aa:bb:cc:00:00:09", IP: "10.0.1.20", ExpiresAt: time.Now().Add(time.Hour)})
+	freeUnusable(handler, 20)
+	handler.exclusions = newExclusionSet()
+	excludeIndexes(handler, 10, 10)
+	if owner(10) != RelayAgentMac || owner(20) != RelayAgentMac {
+		t.Errorf("Expected the assigned addresses to be kept, owners %s %s", owner(10), owner(20))
+	}
+}
+
+func TestRelayInsertsRelayAgentInfo(t *testing.T) {
+	I := &Interface{Name: "eth1", InterfaceType: "relay", Ipv4: net.ParseIP("10.0.3.1").To4(), circuitIDTemplate: "{interface}:{mac}"}
+
+	p := newTestPacket(t, "aa:bb:cc:00:00:04")
+	p.AddOption(dhcp.OptionDHCPMessageType, []byte{byte(dhcp.Discover)})
+	answer := I.ServeDHCP(context.Background(), p, dhcp.Discover, nil, nil)
+	info := parseRelayAgentInfo(answer.D.ParseOptions()[OptionRelayAgentInformation])
+	if info == nil || string(info.CircuitID) != "eth1:aa:bb:cc:00:00:04" {
+		t.Fatalf("Expected the circuit-id to be inserted, got %+v", info)
+	}
+
+	// The option is removed from the replies sent to the client
+	offer := dhcp.ReplyPacket(answer.D, dhcp.Offer, net.ParseIP("10.0.0.1").To4(), net.ParseIP("10.0.3.10").To4(), time.Hour,
+		[]dhcp.Option{{Code: OptionRelayAgentInformation, Value: info.marshal()}})
+	answer = I.ServeDHCP(context.Background(), offer, dhcp.Offer, nil, nil)
+	if _, found := answer.D.ParseOptions()[OptionRelayAgentInformation]; found {
+		t.Error("Expected the option 82 to be stripped from the offer")
+	}
+}
@@ -2,7 +2,8 @@ package pool
 
 import (
 	"errors"
-	"math/rand"
+	"math"
+	"math/bits"
 	"sort"
 	"sync"
 	"time"
@@ -11,31 +12,265 @@ import (
 const FreeMac = "00:00:00:00:00:00"
 const FakeMac = "ff:ff:ff:ff:ff:ff"
 
+// sentinels are the MAC addresses holding indexes on behalf of no client,
+// their frees are not remembered for the stickiness
+var sentinels = map[string]bool{FakeMac: true}
+
+// RegisterSentinelMAC declares a MAC address the callers reserve indexes with
+// on behalf of no client, like FakeMac. It must be called before the pools
+// are used, from an init function.
+func RegisterSentinelMAC(mac string) {
+	sentinels[mac] = true
+}
+
+// MaxCapacity is the largest number of indexes of a pool
+const MaxCapacity = math.MaxUint32 - 1
+
+// none marks the end of the free list of the least-recently-released strategy
+const none = math.MaxUint32
+
+// DHCPPool keeps track of the indexes of a range of addresses. The reserved
+// indexes are flagged in a bitset, a summary bitset flagging its words with
+// no free index left, and the strategy of the pool picks the index to hand
+// out.
 type DHCPPool struct {
-	lock      *sync.Mutex
-	free      map[uint64]bool
-	mac       map[uint64]string
-	capacity  uint64
-	released  map[uint64]int64
-	algorithm int
+	lock     *sync.Mutex
+	reserved []uint64          // Bitset of the reserved indexes, the bits past the capacity are set
+	full     []uint64          // Bitset of the words of reserved with every bit set
+	mac      map[uint64]string // Owner of the reserved indexes
+	capacity uint64
+	free     uint64
+	strategy Strategy
+
+	stickiness time.Duration
+	released   map[uint64]release // Last owner of the free indexes, with stickiness
+	former     map[string]uint64  // Index last released by a MAC address, with stickiness
+	now        func() time.Time
 }
 
+// Span is a run of indexes of a pool, both bounds included
+type Span struct {
+	First uint64
+	Last  uint64
+}
+
+// contains tells if an index is part of one of the spans, sorted and disjoint
+func contains(spans []Span, index uint64) bool {
+	i := sort.Search(len(spans), func(i int) bool { return spans[i].Last >= index })
+	return i < len(spans) && spans[i].First <= index
+}
+
+// release is the last owner of a free index
+type release struct {
+	mac string
+	at  time.Time
+}
+
+// NewDHCPPool creates a pool of capacity indexes, all free. Algorithm 2
+// hands out the index released the longest ago, any other value a random one.
 func NewDHCPPool(capacity uint64, algorithm int) *DHCPPool {
+	name := StrategyRandom
+	if algorithm == 2 {
+		name = StrategyLeastRecentlyReleased
+	}
+	strategy, _ := NewStrategy(name)
+	return NewDHCPPoolWithStrategy(capacity, strategy)
+}
+
+// NewDHCPPoolWithStrategy creates a pool of capacity indexes, all free,
+// handed out by a strategy
+func NewDHCPPoolWithStrategy(capacity uint64, strategy Strategy) *DHCPPool {
+	if capacity > MaxCapacity {
+		capacity = MaxCapacity
+	}
+	words := (capacity + 63) / 64
 	d := &DHCPPool{
-		lock:      &sync.Mutex{},
-		free:      make(map[uint64]bool),
-		mac:       make(map[uint64]string),
-		capacity:  capacity,
-		released:  make(map[uint64]int64),
-		algorithm: algorithm,
+		lock:     &sync.Mutex{},
+		reserved: make([]uint64, words),
+		full:     make([]uint64, (words+63)/64),
+		mac:      make(map[uint64]string),
+		capacity: capacity,
+		free:     capacity,
+		strategy: strategy,
+		released: make(map[uint64]release),
+		former:   make(map[string]uint64),
+		now:      time.Now,
 	}
-	for i := uint64(0); i < d.capacity; i++ {
-		d.free[i] = true
-		d.released[i] = time.Now().UnixNano()
+	if capacity%64 != 0 {
+		d.reserved[words-1] = ^uint64(0) << (capacity % 64)
 	}
+	if words%64 != 0 {
+		d.full[len(d.full)-1] = ^uint64(0) << (words % 64)
+	}
+	strategy.Reset(capacity)
 	return d
 }
 
+func (dp *DHCPPool) isReserved(index uint64) bool {
+	return dp.reserved[index/64]&(1<<(index%64)) != 0
+}
+
+// reserve flags a free index as reserved by a MAC address
+func (dp *DHCPPool) reserve(index uint64, mac string) {
+	w := index / 64
+	dp.reserved[w] |= 1 << (index % 64)
+	if dp.reserved[w] == math.MaxUint64 {
+		dp.full[w/64] |= 1 << (w % 64)
+	}
+	dp.free--
+	dp.strategy.Reserved(index)
+	dp.mac[index] = mac
+	dp.forget(index)
+}
+
+// forget drops the last owner of an index
+func (dp *DHCPPool) forget(index uint64) {
+	if r, found := dp.released[index]; found {
+		delete(dp.released, index)
+		if dp.former[r.mac] == index {
+			delete(dp.former, r.mac)
+		}
+	}
+}
+
+// SetStickiness makes the pool hand out to a MAC address the index it
+// released within a window, as long as it is still free. A zero window
+// disables it.
+func (dp *DHCPPool) SetStickiness(window time.Duration) {
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+
+	dp.stickiness = window
+	if window <= 0 {
+		dp.released = make(map[uint64]release)
+		dp.former = make(map[string]uint64)
+	}
+}
+
+// ReserveFormerIPIndex reserves for a MAC address the index it released
+// within the stickiness window, when it is still free
+func (dp *DHCPPool) ReserveFormerIPIndex(mac string) (uint64, bool) {
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+
+	return dp.reserveFormer(mac, nil)
+}
+
+// ReserveFormerIPIndexIn is ReserveFormerIPIndex for an index of spans,
+// sorted and disjoint
+func (dp *DHCPPool) ReserveFormerIPIndexIn(mac string, spans []Span) (uint64, bool) {
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
+
+	return dp.reserveFormer(mac, dp.clip(spans))
+}
+
+// reserveFormer reserves the index a MAC address released, when it is part of
+// spans or anywhere in the pool when they are nil
+func (dp *DHCPPool) reserveFormer(mac string, spans []Span) (uint64, bool) {
+	index, found := dp.former[mac]
+	if !found {
+		return 0, false
+	}
+	if dp.now().Sub(dp.released[index].at) > dp.stickiness {
+		dp.forget(index)
+		return 0, false
+	}
+	if spans != nil && !contains(spans, index) {
+		return 0, false
+	}
+	dp.reserve(index, mac)
+	return index, true
+}
+
+// clip drops the part of spans past the capacity of the pool
+func (dp *DHCPPool) clip(spans []Span) []Span {
+	clipped := make([]Span, 0, len(spans))
+	for _, span := range spans {
+		if span.First > span.Last || span.First >= dp.capacity {
+			continue
+		}
+		clipped = append(clipped, Span{First: span.First, Last: min(span.Last, dp.capacity-1)})
+	}
+	return clipped
+}
+
+// NextFree returns the first free index from an index, wrapping around to
+// the start of the pool. The pool must have a free index, it is meant to be
+// called by the strategy of the pool.
+func (dp *DHCPPool) NextFree(from uint64) uint64 {
+	if index, found := dp.firstFree(from); found {
+		return index
+	}
+	index, _ := dp.firstFree(0)
+	return index
+}
+
+// firstFree returns the first free index from an index, up to the end of the
+// pool
+func (dp *DHCPPool) firstFree(from uint64) (uint64, bool) {
+	if from >= dp.capacity {
+		return 0, false
+	}
+	w := from / 64
+	if open := ^dp.reserved[w] &^ (1<<(from%64) - 1); open != 0 {
+		return w*64 + uint64(bits.TrailingZeros64(open)), true
+	}
+	// Skip the words with no free index
+	w++
+	for s := w / 64; s < uint64(len(dp.full)); s++ {
+		open := ^dp.full[s]
+		if s == w/64 {
+			open &^= 1<<(w%64) - 1
+		}
+		if open != 0 {
+			w = s*64 + uint64(bits.TrailingZeros64(open))
+			return w*64 + uint64(bits.TrailingZeros64(^dp.reserved[w])), true
+		}
+	}
+	return 0, false
+}
+
+// bits returns the bits of a word of the bitset that are part of the span
+func (span Span) bits(w uint64) uint64 {
+	mask := ^uint64(0)
+	if w == span.First/64 {
+		mask &^= 1<<(span.First%64) - 1
+	}
+	if w == span.Last/64 && span.Last%64 != 63 {
+		mask &= 1<<(span.Last%64+1) - 1
+	}
+	return mask
+}
+
+// FreeIn returns the number of free indexes of a span, which must be part of
+// the pool. It is meant to be called by the strategy of the pool.
+func (dp *DHCPPool) FreeIn(span Span) uint64 {
+	var free uint64
+	for w := span.First / 64; w <= span.Last/64; w++ {
+		free += uint64(bits.OnesCount64(^dp.reserved[w] & span.bits(w)))
+	}
+	return free
+}
+
+// NthFree returns the free index of a span coming after n other free ones,
+// the span must have more than n. It is meant to be called by the strategy of
+// the pool.
+func (dp *DHCPPool) NthFree(span Span, n uint64) uint64 {
+	for w := span.First / 64; w <= span.Last/64; w++ {
+		open := ^dp.reserved[w] & span.bits(w)
+		if count := uint64(bits.OnesCount64(open)); n >= count {
+			n -= count
+			continue
+		}
+		for ; n > 0; n-- {
+			open &= open - 1
+		}
+		return w*64 + uint64(bits.TrailingZeros64(open))
+	}
+	return span.Last
+}
+
 // Reserves an IP in the pool, returns an error if the IP has already been reserved
 func (dp *DHCPPool) ReserveIPIndex(index uint64, mac string) (error, string) {
 	dp.lock.Lock()
@@ -45,13 +280,11 @@ func (dp *DHCPPool) ReserveIPIndex(index uint64, mac string) (error, string) {
 		return errors.New("Trying to reserve an IP that is outside the capacity of this pool"), FreeMac
 	}
 
-	if _, free := dp.free[index]; free {
-		delete(dp.free, index)
-		dp.mac[index] = mac
-		return nil, mac
-	} else {
+	if dp.isReserved(index) {
 		return errors.New("IP is already reserved"), FreeMac
 	}
+	dp.reserve(index, mac)
+	return nil, mac
 }
 
 // Frees an IP in the pool, returns an error if the IP is already free
@@ -63,14 +296,23 @@ func (dp *DHCPPool) FreeIPIndex(index uint64) error {
 		return errors.New("Trying to free an IP that is outside the capacity of this pool")
 	}
 
-	if _, free := dp.free[index]; free {
+	if !dp.isReserved(index) {
 		return errors.New("IP is already free")
-	} else {
-		dp.free[index] = true
-		dp.released[index] = time.Now().UnixNano()
-		delete(dp.mac, index)
-		return nil
 	}
+	w := index / 64
+	dp.reserved[w] &^= 1 << (index % 64)
+	dp.full[w/64] &^= 1 << (w % 64)
+	dp.free++
+	dp.strategy.Freed(index)
+	if mac := dp.mac[index]; dp.stickiness > 0 && !sentinels[mac] {
+		if previous, found := dp.former[mac]; found {
+			dp.forget(previous)
+		}
+		dp.released[index] = release{mac: mac, at: dp.now()}
+		dp.former[mac] = index
+	}
+	delete(dp.mac, index)
+	return nil
 }
 
 // Check if the IP is free at the index
@@ -78,18 +320,10 @@ func (dp *DHCPPool) IsFreeIPAtIndex(index uint64) bool {
 	dp.lock.Lock()
 	defer dp.lock.Unlock()
 
-	if !dp.IndexInPool(index) {
-		return false
-	}
-
-	if _, free := dp.free[index]; free {
-		return true
-	} else {
-		return false
-	}
+	return dp.IndexInPool(index) && !dp.isReserved(index)
 }
 
-// Check if the IP is free at the index
+// Returns the MAC address the index is reserved for, an error if it is free
 func (dp *DHCPPool) GetMACIndex(index uint64) (uint64, string, error) {
 	dp.lock.Lock()
 	defer dp.lock.Unlock()
@@ -98,59 +332,63 @@ func (dp *DHCPPool) GetMACIndex(index uint64) (uint64, string, error) {
 		return index, FreeMac, errors.New("The index is not part of the pool")
 	}
 
-	if _, free := dp.free[index]; free {
+	if !dp.isReserved(index) {
 		return index, FreeMac, errors.New("Index is free")
-	} else {
-		return index, dp.mac[index], nil
 	}
+	return index, dp.mac[index], nil
 }
 
-// Returns a random free IP address, an error if the pool is full
+// Reserves a free IP address chosen by the strategy of the pool, an error if
+// the pool is full. The index the MAC address released within the stickiness
+// window comes first.
 func (dp *DHCPPool) GetFreeIPIndex(mac string) (uint64, string, error) {
 	dp.lock.Lock()
 	defer dp.lock.Unlock()
 
-	if len(dp.free) == 0 {
+	if dp.free == 0 {
 		return 0, FreeMac, errors.New("DHCP pool is full")
 	}
 
-	var available uint64
-
-	if dp.algorithm == 2 {
+	if index, found := dp.reserveFormer(mac, nil); found {
+		return index, mac, nil
+	}
 
-		type kv struct {
-			Key   uint64
-			Value int64
-		}
+	available := dp.strategy.Pick(mac, dp)
+	dp.reserve(available, mac)
 
-		var ss []kv
-		for k, v := range dp.released {
-			if _, free := dp.free[k]; free {
-				ss = append(ss, kv{k, v})
-			}
-		}
+	return available, mac, nil
+}
 
-		sort.Slice(ss, func(i, j int) bool {
-			return ss[i].Value < ss[j].Value
-		})
+// GetFreeIPIndexIn is GetFreeIPIndex for the indexes of spans, sorted and
+// disjoint. Strategies that are not a BoundedStrategy hand out the lowest
+// free index of the spans.
+func (dp *DHCPPool) GetFreeIPIndexIn(mac string, spans []Span) (uint64, string, error) {
+	dp.lock.Lock()
+	defer dp.lock.Unlock()
 
-		for _, kv := range ss {
-			available = kv.Key
+	spans = dp.clip(spans)
+	free := false
+	for _, span := range spans {
+		if dp.FreeIn(span) > 0 {
+			free = true
 			break
 		}
+	}
+	if !free {
+		return 0, FreeMac, errors.New("No free IP left in the spans of the pool")
+	}
 
-	} else {
-		index := rand.Intn(len(dp.free))
-		for available = range dp.free {
-			if index == 0 {
-				break
-			}
-			index--
-		}
+	if index, found := dp.reserveFormer(mac, spans); found {
+		return index, mac, nil
 	}
 
-	delete(dp.free, available)
-	dp.mac[available] = mac
+	var available uint64
+	if strategy, ok := dp.strategy.(BoundedStrategy); ok {
+		available = strategy.PickIn(mac, dp, spans)
+	} else {
+		available = firstFreeIn(dp, spans)
+	}
+	dp.reserve(available, mac)
 
 	return available, mac, nil
 }
@@ -164,7 +402,7 @@ func (dp *DHCPPool) IndexInPool(index uint64) bool {
 func (dp *DHCPPool) FreeIPsRemaining() uint64 {
 	dp.lock.Lock()
 	defer dp.lock.Unlock()
-	return uint64(len(dp.free))
+	return dp.free
 }
 
 // Returns the capacity of the pool
@@ -2,6 +2,7 @@ package pool
 
 import (
 	"testing"
+	"time"
 )
 
 func TestReserveIPIndex(t *testing.T) {
@@ -27,7 +28,7 @@ func TestReserveIPIndex(t *testing.T) {
 			t.Error("Returned mac is not the same")
 		}
 
-		if free := dp.free[i]; free {
+		if dp.IsFreeIPAtIndex(i) {
 			t.Error("IP is still free although its been reserved")
 		}
 	}
@@ -62,7 +63,7 @@ func TestFreeIPIndex(t *testing.T) {
 	// Try to reserve all the IP, then free all of them
 	// Not validating ReserveIPIndex works, this is why TestReserveIPIndex is there
 	for i := uint64(0); i < dp.capacity; i++ {
-		if _, found := dp.free[i]; !found {
+		if !dp.IsFreeIPAtIndex(i) {
 			t.Errorf("IP address %d isn't free at the beginning of the process", i)
 		}
 
@@ -73,7 +74,7 @@ func TestFreeIPIndex(t *testing.T) {
 			t.Error("Got an error while freeing IP address", err)
 		}
 
-		if _, found := dp.free[i]; !found {
+		if !dp.IsFreeIPAtIndex(i) {
 			t.Errorf("IP address %d isn't free at the end of the process", i)
 		}
 	}
@@ -119,7 +120,7 @@ func TestGetFreeIPIndex(t *testing.T) {
 			t.Error("Got previously provided IP index", index)
 		}
 
-		if free := dp.free[index]; free {
+		if dp.IsFreeIPAtIndex(index) {
 			t.Error("IP is still free although its been assigned")
 		}
 
@@ -217,3 +218,368 @@ func TestCapacity(t *testing.T) {
 		t.Error("Pool capacity not equal the one provided at instantiation")
 	}
 }
+
+func TestLeastRecentlyReleased(t *testing.T) {
+	dp := NewDHCPPool(5, 2)
+	mac := "00:11:22:33:44:55"
+
+	// A new pool hands out its indexes in order
+	for i := uint64(0); i < 3; i++ {
+		if index, _, _ := dp.GetFreeIPIndex(mac); index != i {
+			t.Errorf("Expected index %d, got %d", i, index)
+		}
+	}
+
+	// Reserving an index takes it out of the order
+	dp.ReserveIPIndex(4, mac)
+	dp.FreeIPIndex(1)
+	dp.FreeIPIndex(0)
+
+	for _, expected := range []uint64{3, 1, 0} {
+		if index, _, _ := dp.GetFreeIPIndex(mac); index != expected {
+			t.Errorf("Expected index %d, got %d", expected, index)
+		}
+	}
+
+	if _, _, err := dp.GetFreeIPIndex(mac); err == nil {
+		t.Error("Didn't get an error when attempting to get a free index in a pool that has reached capacity")
+	}
+
+	dp.FreeIPIndex(4)
+	if index, _, _ := dp.GetFreeIPIndex(mac); index != 4 {
+		t.Errorf("Expected the only free index, got %d", index)
+	}
+}
+
+func TestGetMACIndex(t *testing.T) {
+	dp := NewDHCPPool(100, 1)
+	mac := "00:11:22:33:44:55"
+
+	index, _, _ := dp.GetFreeIPIndex(mac)
+	if _, got, err := dp.GetMACIndex(index); err != nil || got != mac {
+		t.Errorf("Expected index %d to be reserved by %s, got %s (%v)", index, mac, got, err)
+	}
+
+	dp.FreeIPIndex(index)
+	if _, got, err := dp.GetMACIndex(index); err == nil || got != FreeMac {
+		t.Errorf("Expected index %d to be free, got %s", index, got)
+	}
+
+	if _, _, err := dp.GetMACIndex(100); err == nil {
+		t.Error("Didn't get an error for an index outside the capacity")
+	}
+}
+
+func TestStrategyName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"":                        StrategyRandom,
+		"1":                       StrategyRandom,
+		"2":                       StrategyLeastRecentlyReleased,
+		"Sequential":              StrategySequential,
+		"mac-hash":                StrategyMACHash,
+		"least-recently-released": StrategyLeastRecentlyReleased,
+	} {
+		if got, err := StrategyName(name); err != nil || got != expected {
+			t.Errorf("Expected %q to be %s, got %s (%v)", name, expected, got, err)
+		}
+	}
+	for _, name := range []string{"3", "fifo"} {
+		if _, err := NewStrategy(name); err == nil {
+			t.Errorf("Expected %q to be refused", name)
+		}
+	}
+}
+
+func newStrategyPool(t *testing.T, capacity uint64, name string) *DHCPPool {
+	strategy, err := NewStrategy(name)
+	if err != nil {
+		t.Fatalf("NewStrategy failed: %v", err)
+	}
+	return NewDHCPPoolWithStrategy(capacity, strategy)
+}
+
+func TestSequential(t *testing.T) {
+	dp := newStrategyPool(t, 200, StrategySequential)
+	mac := "00:11:22:33:44:55"
+
+	for i := uint64(0); i < 150; i++ {
+		if index, _, _ := dp.GetFreeIPIndex(mac); index != i {
+			t.Fatalf("Expected index %d, got %d", i, index)
+		}
+	}
+
+	// The lowest free index is handed out first
+	dp.FreeIPIndex(130)
+	dp.FreeIPIndex(70)
+	for _, expected := range []uint64{70, 130, 150} {
+		if index, _, _ := dp.GetFreeIPIndex(mac); index != expected {
+			t.Errorf("Expected index %d, got %d", expected, index)
+		}
+	}
+
+	for dp.FreeIPsRemaining() > 0 {
+		dp.GetFreeIPIndex(mac)
+	}
+	if _, _, err := dp.GetFreeIPIndex(mac); err == nil {
+		t.Error("Didn't get an error when attempting to get a free index in a pool that has reached capacity")
+	}
+	dp.FreeIPIndex(199)
+	if index, _, _ := dp.GetFreeIPIndex(mac); index != 199 {
+		t.Errorf("Expected the last index, got %d", index)
+	}
+}
+
+func TestMACHash(t *testing.T) {
+	mac := "00:11:22:33:44:55"
+
+	// A client gets the same index from every empty pool
+	first, _, _ := newStrategyPool(t, 1000, StrategyMACHash).GetFreeIPIndex(mac)
+	dp := newStrategyPool(t, 1000, StrategyMACHash)
+	if index, _, _ := dp.GetFreeIPIndex("00:11:22:33:44:55"); index != first {
+		t.Errorf("Expected index %d, got %d", first, index)
+	}
+
+	// The next free index is handed out when it is taken, wrapping around
+	dp.FreeIPIndex(first)
+	dp.ReserveIPIndex(first, "00:11:22:33:44:66")
+	if index, _, _ := dp.GetFreeIPIndex(mac); index != (first+1)%1000 {
+		t.Errorf("Expected index %d, got %d", (first+1)%1000, index)
+	}
+
+	dp = newStrategyPool(t, 64, StrategyMACHash)
+	for i := uint64(0); i < 64; i++ {
+		dp.GetFreeIPIndex(mac)
+	}
+	dp.FreeIPIndex(0)
+	if index, _, _ := dp.GetFreeIPIndex(mac); index != 0 {
+		t.Errorf("Expected the only free index, got %d", index)
+	}
+}
+
+// lastStrategy hands out the highest free index
+type lastStrategy struct {
+	capacity uint64
+	reserved map[uint64]bool
+}
+
+func (s *lastStrategy) Reset(capacity uint64) {
+	s.capacity, s.reserved = capacity, map[uint64]bool{}
+}
+func (s *lastStrategy) Reserved(index uint64) { s.reserved[index] = true }
+func (s *lastStrategy) Freed(index uint64)    { delete(s.reserved, index) }
+func (s *lastStrategy) Pick(mac string, free FreeSet) uint64 {
+	index := s.capacity - 1
+	for s.reserved[index] {
+		index--
+	}
+	return index
+}
+
+func TestRegisterStrategy(t *testing.T) {
+	RegisterStrategy("last", func() Strategy { return &lastStrategy{} })
+	defer func() {
+		strategyLock.Lock()
+		delete(strategies, "last")
+		strategyLock.Unlock()
+	}()
+
+	dp := newStrategyPool(t, 10, "last")
+	dp.ReserveIPIndex(9, FakeMac)
+	if index, _, _ := dp.GetFreeIPIndex("00:11:22:33:44:55"); index != 8 {
+		t.Errorf("Expected the registered strategy to hand out index 8, got %d", index)
+	}
+}
+
+func TestStickiness(t *testing.T) {
+	dp := newStrategyPool(t, 100, StrategySequential)
+	dp.SetStickiness(time.Hour)
+	now := time.Now()
+	dp.now = func() time.Time { return now }
+	mac := "00:11:22:33:44:55"
+
+	for i := 0; i < 10; i++ {
+		dp.GetFreeIPIndex("00:11:22:33:44:00")
+	}
+	index, _, _ := dp.GetFreeIPIndex(mac)
+	dp.FreeIPIndex(index)
+	dp.FreeIPIndex(3)
+
+	// The former index comes back although a lower one is free
+	now = now.Add(30 * time.Minute)
+	if got, _, _ := dp.GetFreeIPIndex(mac); got != index {
+		t.Errorf("Expected the former index %d, got %d", index, got)
+	}
+
+	// Not once another client got it
+	dp.FreeIPIndex(index)
+	dp.ReserveIPIndex(index, "00:11:22:33:44:66")
+	if got, _, _ := dp.GetFreeIPIndex(mac); got != 3 {
+		t.Errorf("Expected the lowest free index, got %d", got)
+	}
+
+	// Nor after the window
+	dp.FreeIPIndex(3)
+	now = now.Add(time.Hour + time.Second)
+	if got, found := dp.ReserveFormerIPIndex(mac); found {
+		t.Errorf("Expected the former index to be forgotten, got %d", got)
+	}
+
+	// Only the index released last is remembered
+	dp.GetFreeIPIndex("00:11:22:33:44:77")
+	first, _, _ := dp.GetFreeIPIndex(mac)
+	second, _, _ := dp.GetFreeIPIndex(mac)
+	dp.FreeIPIndex(first)
+	dp.FreeIPIndex(second)
+	if got, _, _ := dp.GetFreeIPIndex(mac); got != second {
+		t.Errorf("Expected the index released last %d, got %d", second, got)
+	}
+
+	// The frees of the sentinel MAC addresses are not remembered
+	RegisterSentinelMAC("ff:ff:ff:ff:ff:fe")
+	for _, sentinel := range []string{FakeMac, "ff:ff:ff:ff:ff:fe"} {
+		dp.ReserveIPIndex(50, sentinel)
+		dp.FreeIPIndex(50)
+		if got, found := dp.ReserveFormerIPIndex(sentinel); found {
+			t.Errorf("Expected no former index for %s, got %d", sentinel, got)
+		}
+	}
+
+	dp.FreeIPIndex(second)
+	dp.SetStickiness(0)
+	if _, found := dp.ReserveFormerIPIndex(mac); found || len(dp.released) != 0 {
+		t.Error("Expected no former index without stickiness")
+	}
+}
+
+func TestGetFreeIPIndexIn(t *testing.T) {
+	spans := []Span{{First: 10, Last: 19}, {First: 70, Last: 139}}
+	mac := "00:11:22:33:44:55"
+	for _, name := range []string{StrategyRandom, StrategySequential, StrategyMACHash, StrategyLeastRecentlyReleased, "last"} {
+		t.Run(name, func(t *testing.T) {
+			RegisterStrategy("last", func() Strategy { return &lastStrategy{} })
+			defer func() {
+				strategyLock.Lock()
+				delete(strategies, "last")
+				strategyLock.Unlock()
+			}()
+
+			dp := newStrategyPool(t, 200, name)
+			dp.ReserveIPIndex(15, FakeMac)
+			handed := map[uint64]bool{}
+			for i := 0; i < 79; i++ {
+				index, _, err := dp.GetFreeIPIndexIn(mac, spans)
+				if err != nil {
+					t.Fatalf("Allocation %d failed: %v", i, err)
+				}
+				if !contains(spans, index) || handed[index] {
+					t.Fatalf("Unexpected index %d", index)
+				}
+				handed[index] = true
+			}
+			if _, _, err := dp.GetFreeIPIndexIn(mac, spans); err == nil {
+				t.Error("Expected the spans to be exhausted")
+			}
+			if free := dp.FreeIPsRemaining(); free != 200-80 {
+				t.Errorf("Expected the indexes outside of the spans to be left free, got %d free", free)
+			}
+		})
+	}
+
+	// The order of the strategy is kept within the spans
+	dp := newStrategyPool(t, 200, StrategyLeastRecentlyReleased)
+	for i := 0; i < 200; i++ {
+		dp.GetFreeIPIndex(mac)
+	}
+	for _, index := range []uint64{5, 120, 12, 71} {
+		dp.FreeIPIndex(index)
+	}
+	for _, expected := range []uint64{120, 12, 71} {
+		if index, _, _ := dp.GetFreeIPIndexIn(mac, spans); index != expected {
+			t.Errorf("Expected the index released the longest ago %d, got %d", expected, index)
+		}
+	}
+
+	// A client gets the same index of the spans from every empty pool
+	first, _, _ := newStrategyPool(t, 200, StrategyMACHash).GetFreeIPIndexIn(mac, spans)
+	if index, _, _ := newStrategyPool(t, 200, StrategyMACHash).GetFreeIPIndexIn(mac, spans); index != first {
+		t.Errorf("Expected index %d, got %d", first, index)
+	}
+
+	// The former index only comes back when it is part of the spans
+	dp = newStrategyPool(t, 200, StrategySequential)
+	dp.SetStickiness(time.Hour)
+	dp.ReserveIPIndex(50, mac)
+	dp.FreeIPIndex(50)
+	if index, _, _ := dp.GetFreeIPIndexIn(mac, spans); index != 10 {
+		t.Errorf("Expected the lowest index of the spans, got %d", index)
+	}
+	if index, found := dp.ReserveFormerIPIndexIn(mac, []Span{{First: 40, Last: 60}}); !found || index != 50 {
+		t.Errorf("Expected the former index, got %d", index)
+	}
+}
+
+func TestFreeIn(t *testing.T) {
+	dp := newStrategyPool(t, 300, StrategySequential)
+	for _, index := range []uint64{3, 63, 64, 200, 299} {
+		dp.ReserveIPIndex(index, FakeMac)
+	}
+	if free := dp.FreeIn(Span{First: 3, Last: 200}); free != 194 {
+		t.Errorf("Expected 194 free indexes, got %d", free)
+	}
+	if index := dp.NthFree(Span{First: 60, Last: 299}, 3); index != 65 {
+		t.Errorf("Expected index 65, got %d", index)
+	}
+}
+
+// The allocation strategies benchmarked, on a /16
+var benchmarkStrategies = []string{StrategyRandom, StrategySequential, StrategyMACHash, StrategyLeastRecentlyReleased}
+
+func newBenchmarkPool(b *testing.B, name string) *DHCPPool {
+	strategy, err := NewStrategy(name)
+	if err != nil {
+		b.Fatalf("NewStrategy failed: %v", err)
+	}
+	return NewDHCPPoolWithStrategy(1<<16, strategy)
+}
+
+func BenchmarkNewDHCPPool(b *testing.B) {
+	for _, name := range benchmarkStrategies {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				newBenchmarkPool(b, name)
+			}
+		})
+	}
+}
+
+func BenchmarkGetFreeIPIndex(b *testing.B) {
+	mac := "00:11:22:33:44:55"
+	for _, name := range benchmarkStrategies {
+		b.Run(name, func(b *testing.B) {
+			dp := newBenchmarkPool(b, name)
+			// Keep the pool nearly full, where a scan for a free index would be slowest
+			for i := 0; i < 1<<16-16; i++ {
+				dp.GetFreeIPIndex(mac)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				index, _, _ := dp.GetFreeIPIndex(mac)
+				dp.FreeIPIndex(index)
+			}
+		})
+	}
+}
+
+func BenchmarkReserveIPIndex(b *testing.B) {
+	mac := "00:11:22:33:44:55"
+	for _, name := range benchmarkStrategies {
+		b.Run(name, func(b *testing.B) {
+			dp := newBenchmarkPool(b, name)
+			for i := 0; i < b.N; i++ {
+				index := uint64(i*7919) % dp.Capacity()
+				dp.ReserveIPIndex(index, mac)
+				dp.FreeIPIndex(index)
+			}
+		})
+	}
+}
@@ -0,0 +1,300 @@
+package pool
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The allocation strategies of the package
+const (
+	StrategyRandom                = "random"
+	StrategySequential            = "sequential"
+	StrategyMACHash               = "mac-hash"
+	StrategyLeastRecentlyReleased = "least-recently-released"
+)
+
+// Strategy chooses the free index a pool hands out. The pool tells it about
+// every index reserved and freed, under the lock of the pool.
+type Strategy interface {
+	// Reset starts tracking a pool of capacity indexes, all free
+	Reset(capacity uint64)
+	// Reserved is called when a free index is reserved
+	Reserved(index uint64)
+	// Freed is called when a reserved index is freed
+	Freed(index uint64)
+	// Pick returns the free index to hand out to a MAC address, the pool
+	// has at least one
+	Pick(mac string, free FreeSet) uint64
+}
+
+// BoundedStrategy is a Strategy able to choose among the free indexes of some
+// spans of the pool only, see DHCPPool.GetFreeIPIndexIn
+type BoundedStrategy interface {
+	Strategy
+	// PickIn returns the free index to hand out to a MAC address among the
+	// spans, sorted and disjoint, which have at least one
+	PickIn(mac string, free FreeSet, spans []Span) uint64
+}
+
+// FreeSet tells which indexes of a pool are free
+type FreeSet interface {
+	// NextFree returns the first free index from an index, wrapping around
+	// to the start of the pool
+	NextFree(from uint64) uint64
+	// FreeIn returns the number of free indexes of a span
+	FreeIn(span Span) uint64
+	// NthFree returns the free index of a span coming after n other free
+	// ones
+	NthFree(span Span, n uint64) uint64
+}
+
+// firstFreeIn returns the lowest free index of spans that have one
+func firstFreeIn(free FreeSet, spans []Span) uint64 {
+	return nextFreeIn(free, spans, 0, spans[0].First)
+}
+
+// nextFreeIn returns the first free index of the spans from an index of the
+// span i, wrapping around to the first span
+func nextFreeIn(free FreeSet, spans []Span, i int, from uint64) uint64 {
+	for k := 0; k <= len(spans); k++ {
+		span := spans[(i+k)%len(spans)]
+		if k > 0 {
+			from = span.First
+		}
+		if index := free.NextFree(from); index >= from && index <= span.Last {
+			return index
+		}
+	}
+	return spans[0].First
+}
+
+var (
+	strategyLock sync.RWMutex
+	strategies   = map[string]func() Strategy{
+		StrategyRandom:                func() Strategy { return &randomStrategy{} },
+		StrategySequential:            func() Strategy { return sequentialStrategy{} },
+		StrategyMACHash:               func() Strategy { return &macHashStrategy{} },
+		StrategyLeastRecentlyReleased: func() Strategy { return &lrrStrategy{} },
+	}
+	// The values of the algorithm key before the strategies had names
+	strategyAliases = map[string]string{
+		"":  StrategyRandom,
+		"1": StrategyRandom,
+		"2": StrategyLeastRecentlyReleased,
+	}
+)
+
+// RegisterStrategy makes a strategy available under a name, replacing the
+// one registered under the same name
+func RegisterStrategy(name string, factory func() Strategy) {
+	strategyLock.Lock()
+	defer strategyLock.Unlock()
+	strategies[name] = factory
+}
+
+// Strategies returns the names of the registered strategies, sorted
+func Strategies() []string {
+	strategyLock.RLock()
+	defer strategyLock.RUnlock()
+	names := make([]string, 0, len(strategies))
+	for name := range strategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// StrategyName returns the name of the strategy a name or a legacy algorithm
+// number stands for, an error if there is none
+func StrategyName(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if alias, found := strategyAliases[name]; found {
+		name = alias
+	}
+	strategyLock.RLock()
+	_, found := strategies[name]
+	strategyLock.RUnlock()
+	if !found {
+		return "", fmt.Errorf("unknown allocation algorithm %q, must be one of %s", name, strings.Join(Strategies(), ", "))
+	}
+	return name, nil
+}
+
+// NewStrategy returns a new instance of a strategy, see StrategyName for
+// the names accepted
+func NewStrategy(name string) (Strategy, error) {
+	name, err := StrategyName(name)
+	if err != nil {
+		return nil, err
+	}
+	strategyLock.RLock()
+	defer strategyLock.RUnlock()
+	return strategies[name](), nil
+}
+
+// randomStrategy hands out a random free index. The free indexes are kept
+// in no particular order in an array, along with their position in it.
+type randomStrategy struct {
+	indexes  []uint32
+	position []uint32
+}
+
+func (s *randomStrategy) Reset(capacity uint64) {
+	s.indexes = make([]uint32, capacity)
+	s.position = make([]uint32, capacity)
+	for i := range s.indexes {
+		s.indexes[i] = uint32(i)
+		s.position[i] = uint32(i)
+	}
+}
+
+// Reserved moves the last free index in the place of the reserved one
+func (s *randomStrategy) Reserved(index uint64) {
+	last := s.indexes[len(s.indexes)-1]
+	s.indexes[s.position[index]] = last
+	s.position[last] = s.position[index]
+	s.indexes = s.indexes[:len(s.indexes)-1]
+}
+
+func (s *randomStrategy) Freed(index uint64) {
+	s.position[index] = uint32(len(s.indexes))
+	s.indexes = append(s.indexes, uint32(index))
+}
+
+func (s *randomStrategy) Pick(mac string, free FreeSet) uint64 {
+	return uint64(s.indexes[rand.Intn(len(s.indexes))])
+}
+
+func (s *randomStrategy) PickIn(mac string, free FreeSet, spans []Span) uint64 {
+	counts := make([]uint64, len(spans))
+	var total uint64
+	for i, span := range spans {
+		counts[i] = free.FreeIn(span)
+		total += counts[i]
+	}
+	n := rand.Uint64() % total
+	for i, span := range spans {
+		if n < counts[i] {
+			return free.NthFree(span, n)
+		}
+		n -= counts[i]
+	}
+	return firstFreeIn(free, spans)
+}
+
+// sequentialStrategy hands out the lowest free index
+type sequentialStrategy struct{}
+
+func (sequentialStrategy) Reset(capacity uint64) {}
+func (sequentialStrategy) Reserved(index uint64) {}
+func (sequentialStrategy) Freed(index uint64)    {}
+
+func (sequentialStrategy) Pick(mac string, free FreeSet) uint64 {
+	return free.NextFree(0)
+}
+
+func (sequentialStrategy) PickIn(mac string, free FreeSet, spans []Span) uint64 {
+	return firstFreeIn(free, spans)
+}
+
+// macHashStrategy hands out the index the MAC address hashes to, or the
+// next free one, so that a client gets the same address from an empty pool
+// every time
+type macHashStrategy struct {
+	capacity uint64
+}
+
+func (s *macHashStrategy) Reset(capacity uint64) {
+	s.capacity = capacity
+}
+
+func (s *macHashStrategy) Reserved(index uint64) {}
+func (s *macHashStrategy) Freed(index uint64)    {}
+
+func (s *macHashStrategy) Pick(mac string, free FreeSet) uint64 {
+	return free.NextFree(hashMAC(mac) % s.capacity)
+}
+
+// PickIn hashes the MAC address over the indexes of the spans
+func (s *macHashStrategy) PickIn(mac string, free FreeSet, spans []Span) uint64 {
+	var size uint64
+	for _, span := range spans {
+		size += span.Last - span.First + 1
+	}
+	offset := hashMAC(mac) % size
+	for i, span := range spans {
+		if offset <= span.Last-span.First {
+			return nextFreeIn(free, spans, i, span.First+offset)
+		}
+		offset -= span.Last - span.First + 1
+	}
+	return firstFreeIn(free, spans)
+}
+
+func hashMAC(mac string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(strings.ToLower(mac)))
+	return h.Sum64()
+}
+
+// lrrStrategy hands out the index released the longest ago, the indexes of
+// a new pool being released in ascending order. The free indexes are linked
+// in release order.
+type lrrStrategy struct {
+	prev []uint32
+	next []uint32
+	head uint32 // Released the longest ago
+	tail uint32 // Released last
+}
+
+func (s *lrrStrategy) Reset(capacity uint64) {
+	s.prev = make([]uint32, capacity)
+	s.next = make([]uint32, capacity)
+	s.head, s.tail = none, none
+	for i := uint64(0); i < capacity; i++ {
+		s.Freed(i)
+	}
+}
+
+func (s *lrrStrategy) Reserved(index uint64) {
+	prev, next := s.prev[index], s.next[index]
+	if prev == none {
+		s.head = next
+	} else {
+		s.next[prev] = next
+	}
+	if next == none {
+		s.tail = prev
+	} else {
+		s.prev[next] = prev
+	}
+}
+
+func (s *lrrStrategy) Freed(index uint64) {
+	s.prev[index], s.next[index] = s.tail, none
+	if s.tail == none {
+		s.head = uint32(index)
+	} else {
+		s.next[s.tail] = uint32(index)
+	}
+	s.tail = uint32(index)
+}
+
+func (s *lrrStrategy) Pick(mac string, free FreeSet) uint64 {
+	return uint64(s.head)
+}
+
+// PickIn walks the free indexes in release order up to the first one of the
+// spans
+func (s *lrrStrategy) PickIn(mac string, free FreeSet, spans []Span) uint64 {
+	for index := s.head; index != none; index = s.next[index] {
+		if contains(spans, uint64(index)) {
+			return uint64(index)
+		}
+	}
+	return firstFreeIn(free, spans)
+}
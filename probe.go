@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	cache "github.com/fdurand/go-cache"
+	"github.com/go-ini/ini"
+	"github.com/inverse-inc/packetfence/go/log"
+	"github.com/inverse-inc/packetfence/go/sharedutils"
+)
+
+// The ways an address is found free or in use, they label the probe counters
+const (
+	probedARP = iota
+	probedICMP
+	probedCache
+	probedSkipped // No slot was free within the timeout
+	probeMethods
+)
+
+var probeMethodNames = [probeMethods]string{"arp", "icmp", "cache", "skipped"}
+
+// probeConfig is the [probe] section of the configuration file: how an
+// address is checked before it is offered
+type probeConfig struct {
+	arp         bool          // ARP probe of the addresses of the clients on the link
+	icmp        bool          // Ping of the addresses of the relayed clients, or when ARP fails
+	timeout     time.Duration // Longest wait for an answer, or for a probe slot
+	parallelism int           // Probes running at once
+	cacheTTL    time.Duration // How long a result is reused, 0 disables the cache
+}
+
+// readProbeConfig reads the [probe] section of the configuration file
+func readProbeConfig(path string) (probeConfig, error) {
+	cfg, err := ini.Load(path)
+	if err != nil {
+		return probeConfig{}, fmt.Errorf("fail to read file: %w", err)
+	}
+	sec := cfg.Section("probe")
+
+	c := probeConfig{
+		arp:  sec.Key("arp").MustString("enabled") == "enabled",
+		icmp: sec.Key("icmp").MustString("enabled") == "enabled",
+	}
+	timeout, err := strconv.Atoi(sec.Key("timeout").MustString("500"))
+	if err != nil || timeout <= 0 {
+		return probeConfig{}, fmt.Errorf("invalid probe timeout %q, must be a number of milliseconds", sec.Key("timeout").String())
+	}
+	c.timeout = time.Duration(timeout) * time.Millisecond
+	if c.parallelism, err = strconv.Atoi(sec.Key("parallelism").MustString("32")); err != nil || c.parallelism <= 0 {
+		return probeConfig{}, fmt.Errorf("invalid probe parallelism %q", sec.Key("parallelism").String())
+	}
+	ttl, err := strconv.Atoi(sec.Key("cache").MustString("60"))
+	if err != nil || ttl < 0 {
+		return probeConfig{}, fmt.Errorf("invalid probe cache %q, must be a number of seconds", sec.Key("cache").String())
+	}
+	c.cacheTTL = time.Duration(ttl) * time.Second
+	return c, nil
+}
+
+// probeResult is what a probe found at an address
+type probeResult struct {
+	inUse bool
+	owner string // MAC address answering the ARP probe, empty for a ping
+}
+
+// prober checks that the addresses are free before they are offered
+type prober struct {
+	lock   sync.RWMutex
+	config probeConfig
+	slots  chan struct{} // One per probe running
+	cache  *cache.Cache  // Address -> probeResult
+
+	// The probes, replaced in the tests
+	arp  func(ifi *net.Interface, ip net.IP, timeout time.Duration) (net.HardwareAddr, error)
+	ping func(srcIP net.IP, ip net.IP, ifname string, timeout time.Duration) bool
+}
+
+// probes is the prober of the server, it does not probe until configured
+var probes = newProber(probeConfig{parallelism: 1})
+
+func newProber(c probeConfig) *prober {
+	p := &prober{arp: probeARP, ping: probeICMP}
+	p.configure(c)
+	return p
+}
+
+// configure applies a configuration, the cached results are dropped
+func (p *prober) configure(c probeConfig) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.config = c
+	p.slots = make(chan struct{}, c.parallelism)
+	p.cache = nil
+	if c.cacheTTL > 0 {
+		p.cache = cache.New(c.cacheTTL, c.cacheTTL)
+	}
+}
+
+// inUse tells if another host than the client holds an address. The clients
+// on the link are probed with ARP, with ICMP as the fallback, and the relayed
+// ones with ICMP. The wait for a probe slot and for each answer is bounded by
+// the timeout: an address that could not be probed in time is deemed free.
+func (p *prober) inUse(ctx context.Context, I *Interface, srcIP net.IP, ip net.IP, local bool, client net.HardwareAddr) bool {
+	p.lock.RLock()
+	c, slots, results := p.config, p.slots, p.cache
+	p.lock.RUnlock()
+
+	useARP := c.arp && local && I.intNet != nil
+	if !useARP && !c.icmp {
+		return false
+	}
+
+	if results != nil {
+		if x, found := results.Get(ip.String()); found {
+			metrics.probes[probedCache].Add(1)
+			return x.(probeResult).conflicts(client)
+		}
+	}
+
+	deadline := time.NewTimer(c.timeout)
+	defer deadline.Stop()
+	select {
+	case slots <- struct{}{}:
+	case <-deadline.C:
+		metrics.probes[probedSkipped].Add(1)
+		log.LoggerWContext(ctx).Warn("No probe slot free, offering " + ip.String() + " unprobed")
+		return false
+	}
+
+	var result probeResult
+	answered := false
+	if useARP {
+		owner, err := p.arp(I.intNet, ip, c.timeout)
+		if err == nil {
+			metrics.probes[probedARP].Add(1)
+			result, answered = probeResult{inUse: owner != nil, owner: owner.String()}, true
+		} else {
+			log.LoggerWContext(ctx).Warn("Unable to ARP probe " + ip.String() + " on " + I.Name + ", falling back to ICMP: " + err.Error())
+		}
+	}
+	if !answered && c.icmp {
+		metrics.probes[probedICMP].Add(1)
+		// The ping frees its slot when it is over, its answer is only
+		// waited for until the timeout
+		answer := make(chan bool, 1)
+		go func() {
+			answer <- p.ping(srcIP, ip, I.Name, c.timeout)
+			<-slots
+		}()
+		select {
+		case inUse := <-answer:
+			result, answered = probeResult{inUse: inUse}, true
+		case <-deadline.C:
+		}
+	} else {
+		<-slots
+	}
+
+	if answered && results != nil {
+		results.Set(ip.String(), result, cache.DefaultExpiration)
+	}
+	return result.conflicts(client)
+}
+
+// conflicts tells if the address is held by another host than the client
+func (r probeResult) conflicts(client net.HardwareAddr) bool {
+	return r.inUse && r.owner != client.String()
+}
+
+// forget drops the cached result of an address
+func (p *prober) forget(ip net.IP) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if p.cache != nil {
+		p.cache.Delete(ip.String())
+	}
+}
+
+// probeARP sends an RFC 5227 ARP probe for an address on an interface, it
+// returns the MAC address answering it, nil when none does before the
+// timeout
+func probeARP(ifi *net.Interface, ip net.IP, timeout time.Duration) (net.HardwareAddr, error) {
+	client, err := NewRawClient(ifi)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	return client.probeARP(ip, timeout)
+}
+
+// probeICMP pings an address, the ping waits for whole seconds
+func probeICMP(srcIP net.IP, ip net.IP, ifname string, timeout time.Duration) bool {
+	return sharedutils.Ping(srcIP, ip, ifname, int(math.Ceil(timeout.Seconds())))
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cache "github.com/fdurand/go-cache"
+	"github.com/go-ini/ini"
+	"github.com/inverse-inc/packetfence/go/timedlock"
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+func TestReadProbeConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "godhcp.ini")
+		os.WriteFile(path, []byte(content), 0644)
+		return path
+	}
+
+	conf, err := readProbeConfig(write("[interfaces]\nlisten=eth0\n"))
+	if err != nil {
+		t.Fatalf("readProbeConfig failed: %v", err)
+	}
+	if !conf.arp || !conf.icmp || conf.timeout != 500*time.Millisecond || conf.parallelism != 32 || conf.cacheTTL != time.Minute {
+		t.Errorf("Unexpected defaults %+v", conf)
+	}
+
+	conf, err = readProbeConfig(write("[probe]\narp=disabled\ntimeout=200\nparallelism=4\ncache=0\n"))
+	if err != nil {
+		t.Fatalf("readProbeConfig failed: %v", err)
+	}
+	if conf.arp || !conf.icmp || conf.timeout != 200*time.Millisecond || conf.parallelism != 4 || conf.cacheTTL != 0 {
+		t.Errorf("Unexpected configuration %+v", conf)
+	}
+
+	for _, content := range []string{
+		"[probe]\ntimeout=0\n",
+		"[probe]\ntimeout=1s\n",
+		"[probe]\nparallelism=0\n",
+		"[probe]\ncache=-1\n",
+	} {
+		if _, err := readProbeConfig(write(content)); err == nil {
+			t.Errorf("Expected %q to be refused", content)
+		}
+	}
+}
+
+func TestARPProbePacket(t *testing.T) {
+	sender, _ := net.ParseMAC("00:11:22:33:44:55")
+	b := marshalARPProbe(sender, net.ParseIP("192.168.1.10"))
+
+	op, hw, ip, err := parseARPSender(b)
+	if err != nil || op != arpRequest || hw.String() != sender.String() || !ip.Equal(net.IPv4zero) {
+		t.Errorf("Unexpected probe sender %d %s %s (%v)", op, hw, ip, err)
+	}
+	if !net.IP(b[24:28]).Equal(net.ParseIP("192.168.1.10")) || net.HardwareAddr(b[18:24]).String() != "00:00:00:00:00:00" {
+		t.Errorf("Unexpected probe target % x", b[18:28])
+	}
+	if _, _, _, err := parseARPSender(b[:20]); err == nil {
+		t.Error("Expected a truncated packet to be refused")
+	}
+}
+
+func TestProber(t *testing.T) {
+	var arps, pings atomic.Int32
+	owner, _ := net.ParseMAC("aa:bb:cc:00:00:99")
+	client, _ := net.ParseMAC("aa:bb:cc:00:00:01")
+	var arpErr error
+	var pingDelay time.Duration
+	p := newProber(probeConfig{arp: true, icmp: true, timeout: 50 * time.Millisecond, parallelism: 1, cacheTTL: time.Minute})
+	p.arp = func(ifi *net.Interface, ip net.IP, timeout time.Duration) (net.HardwareAddr, error) {
+		arps.Add(1)
+		if arpErr != nil {
+			return nil, arpErr
+		}
+		if ip.Equal(net.ParseIP("192.168.1.10")) {
+			return owner, nil
+		}
+		if ip.Equal(net.ParseIP("192.168.1.11")) {
+			return client, nil
+		}
+		return nil, nil
+	}
+	p.ping = func(srcIP net.IP, ip net.IP, ifname string, timeout time.Duration) bool {
+		pings.Add(1)
+		time.Sleep(pingDelay)
+		return ip.Equal(net.ParseIP("10.0.0.10"))
+	}
+	I := &Interface{Name: "eth0", intNet: &net.Interface{Name: "eth0"}}
+	inUse := func(ip string, local bool) bool {
+		return p.inUse(context.Background(), I, net.ParseIP("192.168.1.1"), net.ParseIP(ip), local, client)
+	}
+
+	// The clients on the link are probed with ARP, the answer is cached
+	if !inUse("192.168.1.10", true) || !inUse("192.168.1.10", true) || arps.Load() != 1 || pings.Load() != 0 {
+		t.Errorf("Expected a single ARP probe to find the address in use, got %d ARP probes and %d pings", arps.Load(), pings.Load())
+	}
+	if inUse("192.168.1.11", true) || inUse("192.168.1.12", true) {
+		t.Error("Expected the address of the client and a free one not to conflict")
+	}
+
+	// The relayed clients are pinged
+	if !inUse("10.0.0.10", false) || inUse("10.0.0.11", false) || pings.Load() != 2 {
+		t.Errorf("Expected the relayed addresses to be pinged, got %d pings", pings.Load())
+	}
+
+	// ICMP is the fallback of ARP
+	arpErr = errors.New("no raw socket")
+	p.configure(probeConfig{arp: true, icmp: true, timeout: 50 * time.Millisecond, parallelism: 1})
+	if inUse("192.168.1.10", true) || pings.Load() != 3 {
+		t.Errorf("Expected a ping when the ARP probe fails, got %d pings", pings.Load())
+	}
+
+	// A ping answering late is not waited for, and holds its slot meanwhile
+	pingDelay = 200 * time.Millisecond
+	start := time.Now()
+	if inUse("10.0.0.10", false) || inUse("10.0.0.10", false) {
+		t.Error("Expected the addresses not probed in time to be deemed free")
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("Expected the probes to be bounded by the timeout, took %s", elapsed)
+	}
+	if pings.Load() != 4 {
+		t.Errorf("Expected the second probe to be skipped for want of a slot, got %d pings", pings.Load())
+	}
+
+	p.configure(probeConfig{parallelism: 1})
+	if inUse("10.0.0.10", false) || pings.Load() != 4 {
+		t.Error("Expected no probe when disabled")
+	}
+}
+
+func TestServeDHCPProbe(t *testing.T) {
+	dbPath := setupTestDB(t)
+	defer teardownTestDB(t, dbPath)
+	if err := InitDatabase(dbPath); err != nil {
+		t.Fatalf("InitDatabase failed: %v", err)
+	}
+	prevCache, prevLock, prevProbes := GlobalTransactionCache, GlobalTransactionLock, probes
+	defer func() { GlobalTransactionCache, GlobalTransactionLock, probes = prevCache, prevLock, prevProbes }()
+	GlobalTransactionCache = cache.New(5*time.Minute, 10*time.Minute)
+	GlobalTransactionLock = timedlock.NewRWLock()
+
+	// The first address of the range is held by another host
+	probes = newProber(probeConfig{arp: true, icmp: true, timeout: 50 * time.Millisecond, parallelism: 4, cacheTTL: time.Minute})
+	probes.arp = func(ifi *net.Interface, ip net.IP, timeout time.Duration) (net.HardwareAddr, error) {
+		if ip.Equal(net.ParseIP("192.168.1.10")) {
+			return net.ParseMAC("aa:bb:cc:00:00:99")
+		}
+		return nil, nil
+	}
+	probes.ping = func(srcIP net.IP, ip net.IP, ifname string, timeout time.Duration) bool {
+		t.Error("Expected no ping for a client on the link")
+		return false
+	}
+
+	cfg, _ := ini.ShadowLoad([]byte(`
+[network 192.168.1.0]
+netmask=255.255.255.0
+gateway=192.168.1.1
+dhcp_start=192.168.1.10
+dhcp_end=192.168.1.19
+dhcp_default_lease_time=3600
+algorithm=sequential
+`))
+	sec := cfg.Section("network 192.168.1.0")
+	ranges, _ := parseRanges(sec)
+	I := &Interface{Name: "eth0", InterfaceType: "server", intNet: &net.Interface{Name: "eth0"}}
+	I.network = append(I.network, newNetwork("network 192.168.1.0", sec, "192.168.1.0", ranges, net.ParseIP("192.168.1.1"), I.Name))
+	// The conflict drops the binding, which must not outlive the database
+	I.networks()[0].dhcpHandler.hwcache.OnEvicted(nil)
+
+	conflicts := metrics.pingConflicts.Load()
+	p := newTestPacket(t, "aa:bb:cc:00:00:01")
+	p.AddOption(dhcp.OptionDHCPMessageType, []byte{byte(dhcp.Discover)})
+	answer := I.ServeDHCP(context.Background(), p, dhcp.Discover, nil, nil)
+	if answer.D == nil || !answer.D.YIAddr().Equal(net.ParseIP("192.168.1.11")) {
+		t.Fatalf("Expected the address after the one in use to be offered, got %v", answer.IP)
+	}
+	if metrics.pingConflicts.Load() != conflicts+1 {
+		t.Error("Expected the conflict to be counted")
+	}
+}
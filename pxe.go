@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/go-ini/ini"
+	"github.com/inverse-inc/packetfence/go/log"
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// Client system architectures of option 93 (RFC 4578)
+const (
+	archBIOS     = 0
+	archEFIIA32  = 6
+	archEFIx64   = 7
+	archEFIBC    = 9 // Sent by most x64 UEFI firmwares
+	archEFIARM64 = 11
+)
+
+// bootConfig holds the network boot settings of a scope
+type bootConfig struct {
+	nextServer net.IP            // TFTP server of the boot files
+	files      map[string]string // Boot file by kind of client
+}
+
+// bootFileKeys maps the kinds of clients to the keys of their boot file, the
+// default boot file is sent to the clients without a specific one
+var bootFileKeys = map[string]string{
+	"default": "boot_filename",
+	"bios":    "boot_filename_bios",
+	"uefi32":  "boot_filename_uefi32",
+	"uefi":    "boot_filename_uefi",
+	"arm64":   "boot_filename_arm64",
+	"ipxe":    "boot_filename_ipxe",
+}
+
+// readBootConfig reads next_server and the boot_filename keys of a network,
+// it returns nil when network boot is not configured
+func readBootConfig(sec *ini.Section) *bootConfig {
+	boot := &bootConfig{files: make(map[string]string)}
+	if value := sec.Key("next_server").String(); value != "" {
+		if boot.nextServer = net.ParseIP(value).To4(); boot.nextServer == nil {
+			log.LoggerWContext(ctx).Error("Invalid next_server " + value + " in " + sec.Name())
+		}
+	}
+	for kind, key := range bootFileKeys {
+		if value := sec.Key(key).String(); value != "" {
+			boot.files[kind] = value
+		}
+	}
+	if boot.nextServer == nil && len(boot.files) == 0 {
+		return nil
+	}
+	return boot
+}
+
+// bootClientKind tells what kind of network boot client sent a request: iPXE
+// identifies itself with its user class, the firmwares with option 93
+func bootClientKind(options dhcp.Options) string {
+	for _, class := range userClasses(options[dhcp.OptionUserClass]) {
+		if class == "iPXE" {
+			return "ipxe"
+		}
+	}
+	if arch := options[dhcp.OptionClientArchitecture]; len(arch) >= 2 {
+		switch binary.BigEndian.Uint16(arch) {
+		case archBIOS:
+			return "bios"
+		case archEFIIA32:
+			return "uefi32"
+		case archEFIx64, archEFIBC:
+			return "uefi"
+		case archEFIARM64:
+			return "arm64"
+		}
+	}
+	return "default"
+}
+
+// apply fills options 66 and 67 of a reply, unless an override or a client
+// class already set them
+func (b *bootConfig) apply(reply dhcp.Options, request dhcp.Options) {
+	if b == nil {
+		return
+	}
+	if _, found := reply[dhcp.OptionTFTPServerName]; !found && b.nextServer != nil {
+		reply[dhcp.OptionTFTPServerName] = []byte(b.nextServer.String())
+	}
+	if _, found := reply[dhcp.OptionBootFileName]; !found {
+		file, found := b.files[bootClientKind(request)]
+		if !found {
+			file = b.files["default"]
+		}
+		if file != "" {
+			reply[dhcp.OptionBootFileName] = []byte(file)
+		}
+	}
+}
+
+// setBootFields copies the boot server and file of the options of a reply in
+// its siaddr and file fields, which is where PXE firmwares look for them. It
+// returns the boot file.
+func setBootFields(p dhcp.Packet, boot *bootConfig, options dhcp.Options) string {
+	if boot != nil && boot.nextServer != nil {
+		p.SetSIAddr(boot.nextServer)
+	} else if server := net.ParseIP(string(options[dhcp.OptionTFTPServerName])).To4(); server != nil {
+		p.SetSIAddr(server)
+	}
+	file := options[dhcp.OptionBootFileName]
+	if len(file) > 0 && len(file) < 128 {
+		p.SetFile(file)
+	}
+	return string(file)
+}
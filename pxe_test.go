@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	cache "github.com/fdurand/go-cache"
+	"github.com/go-ini/ini"
+	"github.com/inverse-inc/packetfence/go/timedlock"
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+const bootTestConfig = `
+[network 10.0.1.0]
+next_server=10.0.1.5
+boot_filename=pxelinux.0
+boot_filename_uefi=grubx64.efi
+boot_filename_ipxe=http://10.0.1.5/boot.ipxe
+
+[network 10.0.2.0]
+dns=10.0.2.1
+`
+
+func TestBootClientKind(t *testing.T) {
+	tests := []struct {
+		name    string
+		options dhcp.Options
+		kind    string
+	}{
+		{"BIOS", dhcp.Options{dhcp.OptionClientArchitecture: []byte{0, 0}}, "bios"},
+		{"x64 UEFI", dhcp.Options{dhcp.OptionClientArchitecture: []byte{0, 7}}, "uefi"},
+		{"EFI BC", dhcp.Options{dhcp.OptionClientArchitecture: []byte{0, 9}}, "uefi"},
+		{"IA32 UEFI", dhcp.Options{dhcp.OptionClientArchitecture: []byte{0, 6}}, "uefi32"},
+		{"ARM64 UEFI", dhcp.Options{dhcp.OptionClientArchitecture: []byte{0, 11}}, "arm64"},
+		{"raw iPXE user class", dhcp.Options{dhcp.OptionUserClass: []byte("iPXE"), dhcp.OptionClientArchitecture: []byte{0, 7}}, "ipxe"},
+		{"RFC 3004 iPXE user class", dhcp.Options{dhcp.OptionUserClass: []byte("\x04iPXE")}, "ipxe"},
+		{"unknown architecture", dhcp.Options{dhcp.OptionClientArchitecture: []byte{0, 2}}, "default"},
+		{"no option", dhcp.Options{}, "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if kind := bootClientKind(tt.options); kind != tt.kind {
+				t.Errorf("Expected %s, got %s", tt.kind, kind)
+			}
+		})
+	}
+}
+
+func TestBootConfigApply(t *testing.T) {
+	cfg, err := ini.Load([]byte(bootTestConfig))
+	if err != nil {
+		t.Fatalf("Failed to load configuration: %v", err)
+	}
+	if boot := readBootConfig(cfg.Section("network 10.0.2.0")); boot != nil {
+		t.Errorf("Expected no boot configuration, got %+v", boot)
+	}
+	boot := readBootConfig(cfg.Section("network 10.0.1.0"))
+	if boot == nil || !boot.nextServer.Equal(net.ParseIP("10.0.1.5")) {
+		t.Fatalf("Unexpected boot configuration %+v", boot)
+	}
+
+	tests := []struct {
+		name    string
+		reply   dhcp.Options
+		request dhcp.Options
+		file    string
+	}{
+		{"default", dhcp.Options{}, dhcp.Options{dhcp.OptionClientArchitecture: []byte{0, 0}}, "pxelinux.0"},
+		{"UEFI", dhcp.Options{}, dhcp.Options{dhcp.OptionClientArchitecture: []byte{0, 7}}, "grubx64.efi"},
+		{"iPXE chaining", dhcp.Options{}, dhcp.Options{dhcp.OptionUserClass: []byte("iPXE")}, "http://10.0.1.5/boot.ipxe"},
+		{"override kept", dhcp.Options{dhcp.OptionBootFileName: []byte("class.efi")}, dhcp.Options{dhcp.OptionClientArchitecture: []byte{0, 7}}, "class.efi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			boot.apply(tt.reply, tt.request)
+			if string(tt.reply[dhcp.OptionBootFileName]) != tt.file {
+				t.Errorf("Expected boot file %s, got %s", tt.file, tt.reply[dhcp.OptionBootFileName])
+			}
+			if string(tt.reply[dhcp.OptionTFTPServerName]) != "10.0.1.5" {
+				t.Errorf("Expected the next server in option 66, got %s", tt.reply[dhcp.OptionTFTPServerName])
+			}
+		})
+	}
+
+	p := dhcp.NewPacket(dhcp.BootReply)
+	if file := setBootFields(p, boot, dhcp.Options{dhcp.OptionBootFileName: []byte("grubx64.efi")}); file != "grubx64.efi" {
+		t.Errorf("Unexpected boot file %s", file)
+	}
+	if !p.SIAddr().Equal(boot.nextServer) || strings.TrimRight(string(p.File()), "\x00") != "grubx64.efi" {
+		t.Errorf("Unexpected siaddr %s or file %q", p.SIAddr(), p.File())
+	}
+}
+
+// TestServeDHCPBootFile checks an offer carries the boot settings and an
+// acknowledgement records the boot file given to the client
+func TestServeDHCPBootFile(t *testing.T) {
+	dbPath := setupTestDB(t)
+	defer teardownTestDB(t, dbPath)
+	if err := InitDatabase(dbPath); err != nil {
+		t.Fatalf("InitDatabase failed: %v", err)
+	}
+	prevCache, prevLock := GlobalTransactionCache, GlobalTransactionLock
+	prevIPCache, prevMacCache := GlobalIpCache, GlobalMacCache
+	defer func() {
+		GlobalTransactionCache, GlobalTransactionLock = prevCache, prevLock
+		GlobalIpCache, GlobalMacCache = prevIPCache, prevMacCache
+	}()
+	GlobalTransactionCache = cache.New(5*time.Minute, 10*time.Minute)
+	GlobalTransactionLock = timedlock.NewRWLock()
+	GlobalIpCache = cache.New(5*time.Minute, 10*time.Minute)
+	GlobalMacCache = cache.New(5*time.Minute, 10*time.Minute)
+
+	I := newOption82TestInterface()
+	handler := I.network[0].dhcpHandler
+	handler.clients = cache.New(time.Hour, 10*time.Minute)
+	handler.boot = &bootConfig{nextServer: net.ParseIP("10.0.1.5").To4(), files: map[string]string{"default": "pxelinux.0", "uefi": "grubx64.efi"}}
+
+	const mac = "aa:bb:cc:00:00:10"
+	p := relayedDiscover(t, mac, net.ParseIP("10.0.1.254").To4(), &RelayAgentInfo{CircuitID: []byte("Gi0/1")})
+	p.AddOption(dhcp.OptionClientArchitecture, []byte{0, 7})
+	answer := I.ServeDHCP(context.Background(), p, dhcp.Discover, nil, nil)
+	if answer.D == nil {
+		t.Fatal("Expected an offer")
+	}
+	if !answer.D.SIAddr().Equal(handler.boot.nextServer) || strings.TrimRight(string(answer.D.File()), "\x00") != "grubx64.efi" {
+		t.Errorf("Unexpected siaddr %s or file %q", answer.D.SIAddr(), answer.D.File())
+	}
+
+	request := newTestPacket(t, mac)
+	request.SetXId([]byte{4, 5, 6, 7})
+	request.SetGIAddr(net.ParseIP("10.0.1.254").To4())
+	request.AddOption(dhcp.OptionDHCPMessageType, []byte{byte(dhcp.Request)})
+	request.AddOption(dhcp.OptionClientArchitecture, []byte{0, 7})
+	request.AddOption(dhcp.OptionRequestedIPAddress, answer.D.YIAddr().To4())
+	request.AddOption(OptionRelayAgentInformation, (&RelayAgentInfo{CircuitID: []byte("Gi0/1")}).marshal())
+	answer = I.ServeDHCP(context.Background(), request, dhcp.Request, nil, nil)
+	if answer.D == nil || dhcp.MessageType(answer.D.ParseOptions()[dhcp.OptionDHCPMessageType][0]) != dhcp.ACK {
+		t.Fatal("Expected an acknowledgement")
+	}
+	if client := handler.boundClient(mac); client.bootFile != "grubx64.efi" {
+		t.Errorf("Expected the boot file to be recorded, got %q", client.bootFile)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"fdurand/standalone_dhcp/pool"
+	"github.com/go-ini/ini"
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// poolRange is one of the address ranges of a scope, with a pool of its own
+type poolRange struct {
+	start     net.IP
+	end       net.IP
+	first     int // Index of start in the scope
+	size      int
+	available *pool.DHCPPool
+}
+
+// contains tells if an address is part of the range
+func (r *poolRange) contains(ip net.IP) bool {
+	ip = ip.To4()
+	return ip != nil && dhcp.IPRange(r.start, ip) >= 1 && dhcp.IPRange(ip, r.end) >= 1
+}
+
+// local returns the part of spans of indexes of the scope within the range,
+// in indexes of its pool
+func (r *poolRange) local(spans []pool.Span) []pool.Span {
+	first, last := safeIntToUint64(r.first), safeIntToUint64(r.first+r.size-1)
+	var local []pool.Span
+	for _, span := range spans {
+		if span.Last < first || span.First > last {
+			continue
+		}
+		local = append(local, pool.Span{First: max(span.First, first) - first, Last: min(span.Last, last) - first})
+	}
+	return local
+}
+
+// rangePool hands out the addresses of the ranges of a scope. It offers the
+// methods of pool.DHCPPool over the indexes of the scope, which number the
+// addresses of the ranges in address order, and allocates from the ranges in
+// the order they are configured.
+type rangePool struct {
+	ranges    []*poolRange // In address order
+	order     []*poolRange // In configuration order
+	capacity  int
+	algorithm string // Allocation strategy of the pools of the ranges
+}
+
+// parseRanges reads the address ranges of a network section: the "range"
+// entries, start-end separated by commas or on several lines, or else
+// dhcp_start and dhcp_end
+func parseRanges(sec *ini.Section) ([]*poolRange, error) {
+	var entries []string
+	if sec.HasKey("range") {
+		for _, value := range sec.Key("range").ValueWithShadows() {
+			for _, entry := range strings.Split(value, ",") {
+				if entry = strings.TrimSpace(entry); entry != "" {
+					entries = append(entries, entry)
+				}
+			}
+		}
+	} else {
+		entries = append(entries, sec.Key("dhcp_start").String()+"-"+sec.Key("dhcp_end").String())
+	}
+
+	var ranges []*poolRange
+	for _, entry := range entries {
+		bounds := strings.SplitN(entry, "-", 2)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("invalid range %q, must be start-end", entry)
+		}
+		start := net.ParseIP(strings.TrimSpace(bounds[0])).To4()
+		end := net.ParseIP(strings.TrimSpace(bounds[1])).To4()
+		if start == nil || end == nil {
+			return nil, fmt.Errorf("invalid range %q, the bounds must be IPv4 addresses", entry)
+		}
+		if dhcp.IPRange(start, end) < 1 {
+			return nil, fmt.Errorf("invalid range %q, the start is after the end", entry)
+		}
+		for _, other := range ranges {
+			if dhcp.IPRange(other.start, end) >= 1 && dhcp.IPRange(start, other.end) >= 1 {
+				return nil, fmt.Errorf("range %q overlaps %s-%s", entry, other.start, other.end)
+			}
+		}
+		ranges = append(ranges, &poolRange{start: start, end: end, size: dhcp.IPRange(start, end)})
+	}
+	if len(ranges) == 0 {
+		return nil, errors.New("no address range")
+	}
+	return ranges, nil
+}
+
+// rangesWithin tells if every range is part of a network
+func rangesWithin(ranges []*poolRange, network *net.IPNet) bool {
+	for _, r := range ranges {
+		if !network.Contains(r.start) || !network.Contains(r.end) {
+			return false
+		}
+	}
+	return len(ranges) > 0
+}
+
+// readAlgorithm reads the allocation strategy of a section, random when
+// missing or invalid
+func readAlgorithm(sec *ini.Section) (string, error) {
+	algorithm, err := pool.StrategyName(sec.Key("algorithm").String())
+	if err != nil {
+		return pool.StrategyRandom, err
+	}
+	return algorithm, nil
+}
+
+// readStickiness reads how long a client gets back the address it released,
+// disabled when missing or invalid
+func readStickiness(sec *ini.Section) (time.Duration, error) {
+	value := sec.Key("stickiness").String()
+	if value == "" {
+		return 0, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, fmt.Errorf("invalid stickiness %q, must be a number of seconds", value)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// newRangePool creates the pools of the ranges, given in configuration order,
+// handed out with an allocation strategy
+func newRangePool(ranges []*poolRange, algorithm string) *rangePool {
+	p := &rangePool{order: ranges, ranges: append([]*poolRange(nil), ranges...), algorithm: algorithm}
+	sort.Slice(p.ranges, func(i, j int) bool {
+		return dhcp.IPRange(p.ranges[i].start, p.ranges[j].start) > 1
+	})
+	for _, r := range p.ranges {
+		r.first = p.capacity
+		strategy, err := pool.NewStrategy(algorithm)
+		if err != nil {
+			strategy, _ = pool.NewStrategy(pool.StrategyRandom)
+		}
+		r.available = pool.NewDHCPPoolWithStrategy(safeIntToUint64(r.size), strategy)
+		p.capacity += r.size
+	}
+	return p
+}
+
+// rangeOf returns the range of an index of the scope, nil when it is outside
+// of the pool
+func (p *rangePool) rangeOf(index uint64) *poolRange {
+	i := sort.Search(len(p.ranges), func(i int) bool {
+		return safeIntToUint64(p.ranges[i].first+p.ranges[i].size) > index
+	})
+	if i == len(p.ranges) {
+		return nil
+	}
+	return p.ranges[i]
+}
+
+// ip returns the address of an index of the scope
+func (p *rangePool) ip(index int) net.IP {
+	if r := p.rangeOf(safeIntToUint64(index)); r != nil && index >= 0 {
+		return dhcp.IPAdd(r.start, index-r.first)
+	}
+	return nil
+}
+
+// index returns the index of an address in the scope, -1 when it is outside
+// of the ranges
+func (p *rangePool) index(ip net.IP) int {
+	for _, r := range p.ranges {
+		if r.contains(ip) {
+			return r.first + dhcp.IPRange(r.start, ip) - 1
+		}
+	}
+	return -1
+}
+
+// span returns the first and last indexes of the addresses of the scope
+// between start and end, ok is false when there is none
+func (p *rangePool) span(start, end net.IP) (first int, last int, ok bool) {
+	first, last = -1, -1
+	for _, r := range p.ranges {
+		if first < 0 && dhcp.IPRange(start, r.end) >= 1 {
+			first = r.first + max(dhcp.IPRange(r.start, start)-1, 0)
+		}
+		if dhcp.IPRange(r.start, end) >= 1 {
+			last = r.first + min(dhcp.IPRange(r.start, end), r.size) - 1
+		}
+	}
+	return first, last, first >= 0 && last >= first
+}
+
+// ReserveIPIndex reserves an index for a MAC address, it fails when the
+// index is not free
+func (p *rangePool) ReserveIPIndex(index uint64, mac string) (error, string) {
+	r := p.rangeOf(index)
+	if r == nil {
+		return errors.New("Trying to reserve an IP that is outside the capacity of this pool"), FreeMac
+	}
+	return r.available.ReserveIPIndex(index-safeIntToUint64(r.first), mac)
+}
+
+// FreeIPIndex frees an index, it fails when the index is already free
+func (p *rangePool) FreeIPIndex(index uint64) error {
+	r := p.rangeOf(index)
+	if r == nil {
+		return errors.New("Trying to free an IP that is outside the capacity of this pool")
+	}
+	return r.available.FreeIPIndex(index - safeIntToUint64(r.first))
+}
+
+// IsFreeIPAtIndex tells if an index is free
+func (p *rangePool) IsFreeIPAtIndex(index uint64) bool {
+	r := p.rangeOf(index)
+	return r != nil && r.available.IsFreeIPAtIndex(index-safeIntToUint64(r.first))
+}
+
+// GetMACIndex returns the owner of an index, an error when it is free
+func (p *rangePool) GetMACIndex(index uint64) (uint64, string, error) {
+	r := p.rangeOf(index)
+	if r == nil {
+		return index, FreeMac, errors.New("The index is not part of the pool")
+	}
+	_, mac, err := r.available.GetMACIndex(index - safeIntToUint64(r.first))
+	return index, mac, err
+}
+
+// setStickiness sets the stickiness window of the pools of the ranges
+func (p *rangePool) setStickiness(window time.Duration) {
+	for _, r := range p.ranges {
+		r.available.SetStickiness(window)
+	}
+}
+
+// GetFreeIPIndex reserves a free index of the first range that has one,
+// unless the MAC address released an index of another range within the
+// stickiness window
+func (p *rangePool) GetFreeIPIndex(mac string) (uint64, string, error) {
+	for _, r := range p.order {
+		if index, found := r.available.ReserveFormerIPIndex(mac); found {
+			return index + safeIntToUint64(r.first), mac, nil
+		}
+	}
+	for _, r := range p.order {
+		if index, owner, err := r.available.GetFreeIPIndex(mac); err == nil {
+			return index + safeIntToUint64(r.first), owner, nil
+		}
+	}
+	return 0, FreeMac, errors.New("DHCP pool is full")
+}
+
+// GetFreeIPIndexIn is GetFreeIPIndex for the indexes of spans of the scope,
+// sorted and disjoint
+func (p *rangePool) GetFreeIPIndexIn(mac string, spans []pool.Span) (uint64, string, error) {
+	for _, r := range p.order {
+		if local := r.local(spans); len(local) > 0 {
+			if index, found := r.available.ReserveFormerIPIndexIn(mac, local); found {
+				return index + safeIntToUint64(r.first), mac, nil
+			}
+		}
+	}
+	for _, r := range p.order {
+		if local := r.local(spans); len(local) > 0 {
+			if index, owner, err := r.available.GetFreeIPIndexIn(mac, local); err == nil {
+				return index + safeIntToUint64(r.first), owner, nil
+			}
+		}
+	}
+	return 0, FreeMac, errors.New("DHCP pool is full")
+}
+
+// FreeIPsRemaining returns the number of free indexes of the ranges
+func (p *rangePool) FreeIPsRemaining() uint64 {
+	var free uint64
+	for _, r := range p.ranges {
+		free += r.available.FreeIPsRemaining()
+	}
+	return free
+}
+
+// Capacity returns the number of addresses of the ranges
+func (p *rangePool) Capacity() uint64 {
+	return safeIntToUint64(p.capacity)
+}
+
+// usage returns the usage of the ranges, in the order they are allocated from
+func (p *rangePool) usage() []RangeStats {
+	var stats []RangeStats
+	for _, r := range p.order {
+		free := safeUint64ToInt(r.available.FreeIPsRemaining())
+		stats = append(stats, RangeStats{Start: r.start.String(), End: r.end.String(), Size: r.size, Free: free, Used: r.size - free})
+	}
+	return stats
+}
+
+// ipAt returns the address of an index of the scope
+func (h *DHCPHandler) ipAt(index int) net.IP {
+	return h.available.ip(index)
+}
+
+// indexOf returns the index of an address of the scope, -1 when it is not
+// part of its ranges
+func (h *DHCPHandler) indexOf(ip net.IP) int {
+	return h.available.index(ip)
+}
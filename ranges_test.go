@@ -0,0 +1,199 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"fdurand/standalone_dhcp/pool"
+	"github.com/go-ini/ini"
+)
+
+// newTestRangePool returns the pool of a single range of size addresses
+func newTestRangePool(start net.IP, size int) *rangePool {
+	start = start.To4()
+	return newRangePool([]*poolRange{{start: start, end: net.IPv4(start[0], start[1], start[2], start[3]+byte(size-1)).To4(), size: size}}, pool.StrategyRandom)
+}
+
+func TestParseRanges(t *testing.T) {
+	cfg, err := ini.ShadowLoad([]byte(`
+[network 192.168.1.0]
+range=192.168.1.100-192.168.1.109,192.168.1.200-192.168.1.200
+range=192.168.1.10-192.168.1.14
+dhcp_start=192.168.1.1
+dhcp_end=192.168.1.254
+
+[network 192.168.2.0]
+dhcp_start=192.168.2.10
+dhcp_end=192.168.2.20
+`))
+	if err != nil {
+		t.Fatalf("Failed to load the configuration: %v", err)
+	}
+
+	ranges, err := parseRanges(cfg.Section("network 192.168.1.0"))
+	if err != nil {
+		t.Fatalf("parseRanges failed: %v", err)
+	}
+	expected := []string{"192.168.1.100-192.168.1.109", "192.168.1.200-192.168.1.200", "192.168.1.10-192.168.1.14"}
+	if len(ranges) != len(expected) {
+		t.Fatalf("Expected %d ranges, got %d", len(expected), len(ranges))
+	}
+	for i, r := range ranges {
+		if got := r.start.String() + "-" + r.end.String(); got != expected[i] {
+			t.Errorf("Range %d: expected %s, got %s", i, expected[i], got)
+		}
+	}
+	_, network, _ := net.ParseCIDR("192.168.1.0/24")
+	if !rangesWithin(ranges, network) {
+		t.Error("Expected the ranges to be part of 192.168.1.0/24")
+	}
+
+	// dhcp_start and dhcp_end are the range when there is no range entry
+	ranges, err = parseRanges(cfg.Section("network 192.168.2.0"))
+	if err != nil || len(ranges) != 1 || ranges[0].size != 11 {
+		t.Errorf("Expected the range of dhcp_start and dhcp_end, got %v (%v)", ranges, err)
+	}
+	if rangesWithin(ranges, network) {
+		t.Error("Expected 192.168.2.10-192.168.2.20 to be outside of 192.168.1.0/24")
+	}
+
+	for _, content := range []string{
+		"range=192.168.1.10\n",
+		"range=192.168.1.20-192.168.1.10\n",
+		"range=192.168.1.10-2001:db8::1\n",
+		"range=192.168.1.10-192.168.1.20,192.168.1.20-192.168.1.30\n",
+		"range=192.168.1.10-192.168.1.20\nrange=192.168.1.5-192.168.1.40\n",
+		"dhcp_start=192.168.1.10\n",
+	} {
+		cfg, _ := ini.ShadowLoad([]byte("[network 192.168.1.0]\n" + content))
+		if _, err := parseRanges(cfg.Section("network 192.168.1.0")); err == nil {
+			t.Errorf("Expected %q to be refused", content)
+		}
+	}
+}
+
+func TestRangePool(t *testing.T) {
+	// Configured out of address order, the allocation follows the configuration
+	ranges := []*poolRange{
+		{start: net.ParseIP("192.168.1.100").To4(), end: net.ParseIP("192.168.1.109").To4(), size: 10},
+		{start: net.ParseIP("192.168.1.10").To4(), end: net.ParseIP("192.168.1.14").To4(), size: 5},
+	}
+	available := newRangePool(ranges, pool.StrategyRandom)
+	handler := &DHCPHandler{available: available, leaseRange: available.capacity}
+	if handler.leaseRange != 15 {
+		t.Fatalf("Expected 15 addresses, got %d", handler.leaseRange)
+	}
+
+	// The indexes number the addresses in address order
+	for ip, index := range map[string]int{"192.168.1.10": 0, "192.168.1.14": 4, "192.168.1.100": 5, "192.168.1.109": 14, "192.168.1.50": -1, "192.168.1.9": -1, "192.168.1.110": -1} {
+		if got := handler.indexOf(net.ParseIP(ip)); got != index {
+			t.Errorf("Expected %s at index %d, got %d", ip, index, got)
+		}
+		if index >= 0 && handler.ipAt(index).String() != ip {
+			t.Errorf("Expected index %d to be %s, got %s", index, ip, handler.ipAt(index))
+		}
+	}
+	if handler.ipAt(15) != nil || handler.ipAt(-1) != nil {
+		t.Error("Expected no address outside of the pool")
+	}
+
+	// Spans skip the gap between the ranges
+	if first, last, ok := available.span(net.ParseIP("192.168.1.12"), net.ParseIP("192.168.1.105")); !ok || first != 2 || last != 10 {
+		t.Errorf("Expected the span 2-10, got %d-%d %v", first, last, ok)
+	}
+	if first, last, ok := available.span(net.ParseIP("192.168.1.1"), net.ParseIP("192.168.1.254")); !ok || first != 0 || last != 14 {
+		t.Errorf("Expected the span 0-14, got %d-%d %v", first, last, ok)
+	}
+	if _, _, ok := available.span(net.ParseIP("192.168.1.20"), net.ParseIP("192.168.1.90")); ok {
+		t.Error("Expected no index between the ranges")
+	}
+
+	// The first range is used up before the second one
+	for i := 0; i < 15; i++ {
+		index, _, err := available.GetFreeIPIndex("00:11:22:33:44:55")
+		if err != nil {
+			t.Fatalf("Allocation %d failed: %v", i, err)
+		}
+		ip := handler.ipAt(int(index))
+		if i < 10 && !ranges[0].contains(ip) || i >= 10 && !ranges[1].contains(ip) {
+			t.Errorf("Allocation %d got %s out of order", i, ip)
+		}
+		if _, owner, _ := available.GetMACIndex(index); owner != "00:11:22:33:44:55" {
+			t.Errorf("Expected index %d to be reserved, got %s", index, owner)
+		}
+	}
+	if _, _, err := available.GetFreeIPIndex("00:11:22:33:44:55"); err == nil {
+		t.Error("Expected the pool to be full")
+	}
+
+	if err := available.FreeIPIndex(12); err != nil || !available.IsFreeIPAtIndex(12) || available.FreeIPsRemaining() != 1 {
+		t.Errorf("Expected index 12 to be freed: %v", err)
+	}
+	if err, _ := available.ReserveIPIndex(15, "00:11:22:33:44:55"); err == nil {
+		t.Error("Expected an index outside of the pool to be refused")
+	}
+	usage := available.usage()
+	if len(usage) != 2 || usage[0].Start != "192.168.1.100" || usage[0].Used != 9 || usage[0].Free != 1 || usage[1].Used != 5 || usage[1].Size != 5 {
+		t.Errorf("Unexpected range usage %+v", usage)
+	}
+}
+
+func TestReadAlgorithm(t *testing.T) {
+	cfg, _ := ini.Load([]byte("[default]\n[legacy]\nalgorithm=2\n[sequential]\nalgorithm=sequential\n[bad]\nalgorithm=fifo\n"))
+
+	for name, expected := range map[string]string{
+		"default":    pool.StrategyRandom,
+		"legacy":     pool.StrategyLeastRecentlyReleased,
+		"sequential": pool.StrategySequential,
+	} {
+		if algorithm, err := readAlgorithm(cfg.Section(name)); err != nil || algorithm != expected {
+			t.Errorf("Expected section %s to use %s, got %s (%v)", name, expected, algorithm, err)
+		}
+	}
+	if algorithm, err := readAlgorithm(cfg.Section("bad")); err == nil || algorithm != pool.StrategyRandom {
+		t.Errorf("Expected an unknown algorithm to be refused and fall back to random, got %s", algorithm)
+	}
+
+	// Every range hands out its addresses with the strategy
+	start, middle := net.ParseIP("192.168.1.10").To4(), net.ParseIP("192.168.1.100").To4()
+	available := newRangePool([]*poolRange{{start: middle, end: net.ParseIP("192.168.1.109").To4(), size: 10}, {start: start, end: net.ParseIP("192.168.1.19").To4(), size: 10}}, pool.StrategySequential)
+	for _, expected := range []string{"192.168.1.100", "192.168.1.101"} {
+		if index, _, _ := available.GetFreeIPIndex("aa:bb:cc:00:00:01"); !available.ip(int(index)).Equal(net.ParseIP(expected)) {
+			t.Errorf("Expected %s, got %s", expected, available.ip(int(index)))
+		}
+	}
+}
+
+func TestStickiness(t *testing.T) {
+	cfg, _ := ini.Load([]byte("[default]\n[day]\nstickiness=86400\n[bad]\nstickiness=-1\n"))
+	if window, err := readStickiness(cfg.Section("default")); err != nil || window != 0 {
+		t.Errorf("Expected no stickiness by default, got %s (%v)", window, err)
+	}
+	if window, err := readStickiness(cfg.Section("day")); err != nil || window != 24*time.Hour {
+		t.Errorf("Expected a day, got %s (%v)", window, err)
+	}
+	if _, err := readStickiness(cfg.Section("bad")); err == nil {
+		t.Error("Expected a negative stickiness to be refused")
+	}
+
+	// The former address of a client comes back, even from a range used up later
+	ranges := []*poolRange{
+		{start: net.ParseIP("192.168.1.10").To4(), end: net.ParseIP("192.168.1.11").To4(), size: 2},
+		{start: net.ParseIP("192.168.1.100").To4(), end: net.ParseIP("192.168.1.109").To4(), size: 10},
+	}
+	available := newRangePool(ranges, pool.StrategySequential)
+	available.setStickiness(time.Hour)
+	available.GetFreeIPIndex("aa:bb:cc:00:00:01")
+	available.GetFreeIPIndex("aa:bb:cc:00:00:02")
+	index, _, _ := available.GetFreeIPIndex("aa:bb:cc:00:00:03")
+	available.FreeIPIndex(0)
+	available.FreeIPIndex(index)
+
+	if got, _, _ := available.GetFreeIPIndex("aa:bb:cc:00:00:03"); !available.ip(int(got)).Equal(net.ParseIP("192.168.1.100")) {
+		t.Errorf("Expected the former address 192.168.1.100, got %s", available.ip(int(got)))
+	}
+	if got, _, _ := available.GetFreeIPIndex("aa:bb:cc:00:00:04"); !available.ip(int(got)).Equal(net.ParseIP("192.168.1.10")) {
+		t.Errorf("Expected the first free address 192.168.1.10, got %s", available.ip(int(got)))
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-ini/ini"
+	"github.com/gorilla/mux"
+	"github.com/inverse-inc/packetfence/go/api-frontend/unifiedapierrors"
+	"github.com/inverse-inc/packetfence/go/log"
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// The reasons a packet is throttled, they label the drop counters
+const (
+	throttledMAC = iota
+	throttledSource
+	throttledGlobal
+	throttledBlacklist
+	throttleReasons
+)
+
+var throttleReasonNames = [throttleReasons]string{"mac", "source", "global", "blacklist"}
+
+// blacklistWindow is the period the drops of a MAC address are counted over
+// to decide whether it is blacklisted
+const blacklistWindow = time.Minute
+
+// rateLimitIdle is the time after which a client that sent nothing is
+// forgotten
+const rateLimitIdle = 10 * time.Minute
+
+// rateLimitClients bounds the MAC addresses and the sources tracked, a new
+// one replaces a random one beyond it so a flood of forged addresses cannot
+// grow them
+const rateLimitClients = 65536
+
+// rateLimitConfig is the [ratelimit] section of the configuration file. The
+// rates are in packets per second, a rate of 0 disables its limit.
+type rateLimitConfig struct {
+	macRate            float64
+	macBurst           float64
+	sourceRate         float64
+	sourceBurst        float64
+	globalRate         float64
+	globalBurst        float64
+	blacklistThreshold int // Drops within blacklistWindow, 0 never blacklists
+	blacklistDuration  time.Duration
+}
+
+// readRateLimitConfig reads the [ratelimit] section of the configuration file
+func readRateLimitConfig(path string) (rateLimitConfig, error) {
+	cfg, err := ini.Load(path)
+	if err != nil {
+		return rateLimitConfig{}, fmt.Errorf("fail to read file: %w", err)
+	}
+	sec := cfg.Section("ratelimit")
+
+	var c rateLimitConfig
+	for _, limit := range []struct {
+		name        string
+		rate, burst *float64
+		defaultRate string
+	}{
+		{"mac", &c.macRate, &c.macBurst, "10"},
+		{"source", &c.sourceRate, &c.sourceBurst, "100"},
+		{"global", &c.globalRate, &c.globalBurst, "1000"},
+	} {
+		rate, err := strconv.ParseFloat(sec.Key(limit.name+"_rate").MustString(limit.defaultRate), 64)
+		if err != nil || rate < 0 {
+			return rateLimitConfig{}, fmt.Errorf("invalid ratelimit %s_rate %q", limit.name, sec.Key(limit.name+"_rate").String())
+		}
+		// The burst defaults to two seconds worth of packets
+		burst, err := strconv.ParseFloat(sec.Key(limit.name+"_burst").MustString(strconv.FormatFloat(rate*2, 'f', -1, 64)), 64)
+		if err != nil || (rate > 0 && burst < 1) {
+			return rateLimitConfig{}, fmt.Errorf("invalid ratelimit %s_burst %q, must be at least 1", limit.name, sec.Key(limit.name+"_burst").String())
+		}
+		*limit.rate, *limit.burst = rate, burst
+	}
+	if c.blacklistThreshold, err = strconv.Atoi(sec.Key("blacklist_threshold").MustString("100")); err != nil || c.blacklistThreshold < 0 {
+		return rateLimitConfig{}, fmt.Errorf("invalid ratelimit blacklist_threshold %q", sec.Key("blacklist_threshold").String())
+	}
+	duration, err := strconv.Atoi(sec.Key("blacklist_duration").MustString("300"))
+	if err != nil || duration <= 0 {
+		return rateLimitConfig{}, fmt.Errorf("invalid ratelimit blacklist_duration %q", sec.Key("blacklist_duration").String())
+	}
+	c.blacklistDuration = time.Duration(duration) * time.Second
+	return c, nil
+}
+
+// tokenBucket lets rate packets per second through, with bursts of up to
+// burst packets
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the last update
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+}
+
+// take consumes a token, it returns false when there is none left
+func (b *tokenBucket) take(now time.Time, rate, burst float64) bool {
+	b.refill(now, rate, burst)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// wait returns how long until a token is available, without consuming it
+func (b *tokenBucket) wait(now time.Time, rate, burst float64) time.Duration {
+	b.refill(now, rate, burst)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// throttle is the bucket of a client and the packets it got dropped
+type throttle struct {
+	bucket      tokenBucket
+	dropped     uint64
+	recent      int // Drops since windowStart
+	windowStart time.Time
+	lastDrop    time.Time
+}
+
+// drop counts a dropped packet
+func (t *throttle) drop(now time.Time) {
+	if now.Sub(t.windowStart) > blacklistWindow {
+		t.windowStart = now
+		t.recent = 0
+	}
+	t.recent++
+	t.dropped++
+	t.lastDrop = now
+}
+
+// ThrottledClient is a client whose packets have been dropped by the rate
+// limits
+type ThrottledClient struct {
+	Client           string     `json:"client"`
+	Type             string     `json:"type"` // mac or source
+	Dropped          uint64     `json:"dropped"`
+	LastDrop         *time.Time `json:"last_drop,omitempty"`
+	BlacklistedUntil *time.Time `json:"blacklisted_until,omitempty"`
+}
+
+// rateLimiter applies the rate limits to the packets read from the
+// interfaces, before they are queued for the workers
+type rateLimiter struct {
+	lock      sync.Mutex
+	conf      rateLimitConfig
+	global    tokenBucket
+	macs      map[string]*throttle
+	sources   map[string]*throttle
+	blacklist map[string]time.Time // Blacklisted MAC addresses and the end of their blacklisting
+}
+
+// rateLimits is disabled until main configures it from the [ratelimit] section
+var rateLimits = newRateLimiter(rateLimitConfig{})
+
+func newRateLimiter(conf rateLimitConfig) *rateLimiter {
+	return &rateLimiter{
+		conf:      conf,
+		macs:      make(map[string]*throttle),
+		sources:   make(map[string]*throttle),
+		blacklist: make(map[string]time.Time),
+	}
+}
+
+// configure applies new limits, the buckets start over while the blacklisted
+// clients stay blacklisted
+func (l *rateLimiter) configure(conf rateLimitConfig) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.conf = conf
+	l.global = tokenBucket{}
+	l.macs = make(map[string]*throttle)
+	l.sources = make(map[string]*throttle)
+}
+
+// allow tells if a packet of a MAC address, received from source (the relay
+// or the address of the client, empty when unknown), can be handled. The
+// reason is one of the throttled constants when it cannot.
+func (l *rateLimiter) allow(mac string, source string, now time.Time) (bool, int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if until, found := l.blacklist[mac]; found {
+		if now.Before(until) {
+			if t := l.macs[mac]; t != nil {
+				t.dropped++
+				t.lastDrop = now
+			}
+			return false, throttledBlacklist
+		}
+		delete(l.blacklist, mac)
+	}
+
+	// The global limit first, a flood is dropped before a client is tracked
+	if l.conf.globalRate > 0 && !l.global.take(now, l.conf.globalRate, l.conf.globalBurst) {
+		return false, throttledGlobal
+	}
+
+	if l.conf.macRate > 0 {
+		t := throttleOf(l.macs, mac)
+		if !t.bucket.take(now, l.conf.macRate, l.conf.macBurst) {
+			t.drop(now)
+			if l.conf.blacklistThreshold > 0 && t.recent >= l.conf.blacklistThreshold {
+				l.blacklist[mac] = now.Add(l.conf.blacklistDuration)
+				t.recent = 0
+				log.LoggerWContext(ctx).Warn(mac + " exceeded its rate limit " + strconv.Itoa(l.conf.blacklistThreshold) + " times, blacklisted for " + l.conf.blacklistDuration.String())
+			}
+			return false, throttledMAC
+		}
+	}
+
+	if l.conf.sourceRate > 0 && source != "" {
+		t := throttleOf(l.sources, source)
+		if !t.bucket.take(now, l.conf.sourceRate, l.conf.sourceBurst) {
+			t.drop(now)
+			return false, throttledSource
+		}
+	}
+	return true, 0
+}
+
+// throttleOf returns the throttle of a client, tracking it when it is new
+func throttleOf(clients map[string]*throttle, key string) *throttle {
+	t := clients[key]
+	if t == nil {
+		if len(clients) >= rateLimitClients {
+			// The iteration order of a map is random
+			for evicted := range clients {
+				delete(clients, evicted)
+				break
+			}
+		}
+		t = &throttle{}
+		clients[key] = t
+	}
+	return t
+}
+
+// expire forgets the clients idle for rateLimitIdle and the blacklistings
+// that are over
+func (l *rateLimiter) expire(now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for mac, until := range l.blacklist {
+		if !now.Before(until) {
+			delete(l.blacklist, mac)
+		}
+	}
+	for _, clients := range []map[string]*throttle{l.macs, l.sources} {
+		for key, t := range clients {
+			if _, blacklisted := l.blacklist[key]; !blacklisted && now.Sub(t.bucket.last) > rateLimitIdle {
+				delete(clients, key)
+			}
+		}
+	}
+}
+
+// throttled lists the clients that got packets dropped and the blacklisted
+// ones
+func (l *rateLimiter) throttled(now time.Time) []ThrottledClient {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var clients []ThrottledClient
+	for _, source := range []struct {
+		clientType string
+		clients    map[string]*throttle
+	}{{"mac", l.macs}, {"source", l.sources}} {
+		for key, t := range source.clients {
+			if t.dropped == 0 {
+				continue
+			}
+			lastDrop := t.lastDrop
+			clients = append(clients, ThrottledClient{Client: key, Type: source.clientType, Dropped: t.dropped, LastDrop: &lastDrop})
+		}
+	}
+	for mac, until := range l.blacklist {
+		if !now.Before(until) {
+			continue
+		}
+		until := until
+		found := false
+		for i := range clients {
+			if clients[i].Type == "mac" && clients[i].Client == mac {
+				clients[i].BlacklistedUntil = &until
+				found = true
+			}
+		}
+		if !found {
+			clients = append(clients, ThrottledClient{Client: mac, Type: "mac", BlacklistedUntil: &until})
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		if clients[i].Type != clients[j].Type {
+			return clients[i].Type < clients[j].Type
+		}
+		return clients[i].Client < clients[j].Client
+	})
+	return clients
+}
+
+// clear forgets the drops and the blacklisting of a client, a MAC address or
+// a source address. It returns false when the client is unknown.
+func (l *rateLimiter) clear(client string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	_, mac := l.macs[client]
+	_, source := l.sources[client]
+	_, blacklisted := l.blacklist[client]
+	delete(l.macs, client)
+	delete(l.sources, client)
+	delete(l.blacklist, client)
+	return mac || source || blacklisted
+}
+
+// clearAll forgets every client, it returns the number of throttled clients
+// that were cleared
+func (l *rateLimiter) clearAll(now time.Time) int {
+	count := len(l.throttled(now))
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.macs = make(map[string]*throttle)
+	l.sources = make(map[string]*throttle)
+	l.blacklist = make(map[string]time.Time)
+	return count
+}
+
+// packetSource returns the key of the source rate limit of a packet: the
+// relay when it was relayed, else the address of the client when it has one
+func packetSource(p dhcp.Packet, addr net.Addr) string {
+	if giaddr := p.GIAddr(); giaddr != nil && !giaddr.Equal(net.IPv4zero) {
+		return giaddr.String()
+	}
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+		return ip.String()
+	}
+	return ""
+}
+
+// throttledClientKey normalizes the MAC address or IP address of a client
+func throttledClientKey(client string) (string, bool) {
+	if mac, err := net.ParseMAC(client); err == nil {
+		return mac.String(), true
+	}
+	if ip := net.ParseIP(client); ip != nil {
+		return ip.String(), true
+	}
+	return "", false
+}
+
+// handleListThrottled handles GET /api/v1/dhcp/throttled
+func handleListThrottled(res http.ResponseWriter, req *http.Request) {
+	clients := rateLimits.throttled(time.Now())
+
+	dropped := make(map[string]uint64)
+	for reason, name := range throttleReasonNames {
+		dropped[name] = metrics.throttled[reason].Load()
+	}
+	response := map[string]interface{}{
+		"status":  "success",
+		"count":   len(clients),
+		"clients": clients,
+		"dropped": dropped,
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, response)
+}
+
+// handleClearThrottled handles DELETE /api/v1/dhcp/throttled/{client}, the
+// client is a MAC address or the address of a relay or a client
+func handleClearThrottled(res http.ResponseWriter, req *http.Request) {
+	client, ok := throttledClientKey(mux.Vars(req)["client"])
+	if !ok {
+		unifiedapierrors.Error(res, "Invalid client "+mux.Vars(req)["client"]+", must be a MAC or IP address", http.StatusBadRequest)
+		return
+	}
+	if !rateLimits.clear(client) {
+		unifiedapierrors.Error(res, "No throttled client "+client, http.StatusNotFound)
+		return
+	}
+
+	response := map[string]interface{}{
+		"status":  "success",
+		"message": "Throttling of " + client + " cleared",
+		"client":  client,
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, response)
+}
+
+// handleClearAllThrottled handles DELETE /api/v1/dhcp/throttled
+func handleClearAllThrottled(res http.ResponseWriter, req *http.Request) {
+	count := rateLimits.clearAll(time.Now())
+
+	response := map[string]interface{}{
+		"status":  "success",
+		"message": strconv.Itoa(count) + " throttled clients cleared",
+		"count":   count,
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusOK)
+	encodeJSON(res, response)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadRateLimitConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "godhcp.ini")
+		os.WriteFile(path, []byte(content), 0644)
+		return path
+	}
+
+	conf, err := readRateLimitConfig(write("[interfaces]\nlisten=eth0\n"))
+	if err != nil {
+		t.Fatalf("readRateLimitConfig failed: %v", err)
+	}
+	if conf.macRate != 10 || conf.macBurst != 20 || conf.sourceRate != 100 || conf.globalBurst != 2000 || conf.blacklistThreshold != 100 || conf.blacklistDuration != 5*time.Minute {
+		t.Errorf("Unexpected defaults %+v", conf)
+	}
+
+	conf, err = readRateLimitConfig(write("[ratelimit]\nmac_rate=0.5\nmac_burst=3\nsource_rate=0\nglobal_rate=0\nblacklist_threshold=0\nblacklist_duration=60\n"))
+	if err != nil {
+		t.Fatalf("readRateLimitConfig failed: %v", err)
+	}
+	if conf.macRate != 0.5 || conf.macBurst != 3 || conf.sourceRate != 0 || conf.globalRate != 0 || conf.blacklistThreshold != 0 || conf.blacklistDuration != time.Minute {
+		t.Errorf("Unexpected configuration %+v", conf)
+	}
+
+	for _, content := range []string{
+		"[ratelimit]\nmac_rate=-1\n",
+		"[ratelimit]\nsource_rate=fast\n",
+		"[ratelimit]\nglobal_rate=10\nglobal_burst=0.5\n",
+		"[ratelimit]\nblacklist_threshold=-5\n",
+		"[ratelimit]\nblacklist_duration=0\n",
+	} {
+		if _, err := readRateLimitConfig(write(content)); err == nil {
+			t.Errorf("Expected %q to be refused", content)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	var b tokenBucket
+	for i := 0; i < 3; i++ {
+		if !b.take(now, 2, 3) {
+			t.Fatalf("Expected packet %d of the burst to pass", i)
+		}
+	}
+	if b.take(now, 2, 3) {
+		t.Error("Expected the bucket to be empty")
+	}
+	if !b.take(now.Add(500*time.Millisecond), 2, 3) {
+		t.Error("Expected a token after half a second at 2 packets per second")
+	}
+	if b.take(now.Add(500*time.Millisecond), 2, 3) {
+		t.Error("Expected a single token")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(rateLimitConfig{macRate: 1, macBurst: 2, sourceRate: 1, sourceBurst: 2, blacklistThreshold: 3, blacklistDuration: time.Minute})
+	now := time.Now()
+	allow := func(mac, source string) int {
+		if ok, reason := l.allow(mac, source, now); !ok {
+			return reason
+		}
+		return -1
+	}
+
+	// A MAC address is limited on its own
+	for i, expected := range []int{-1, -1, throttledMAC} {
+		if got := allow("aa:bb:cc:00:00:01", ""); got != expected {
+			t.Errorf("Packet %d: expected %d, got %d", i, expected, got)
+		}
+	}
+	if got := allow("aa:bb:cc:00:00:02", ""); got != -1 {
+		t.Errorf("Expected another MAC address to pass, got %d", got)
+	}
+
+	// The clients behind a relay share its limit
+	for i, mac := range []string{"aa:bb:cc:00:01:01", "aa:bb:cc:00:01:02", "aa:bb:cc:00:01:03"} {
+		expected := -1
+		if i == 2 {
+			expected = throttledSource
+		}
+		if got := allow(mac, "10.0.0.1"); got != expected {
+			t.Errorf("Relayed packet %d: expected %d, got %d", i, expected, got)
+		}
+	}
+
+	// Too many drops blacklist the MAC address until it expires
+	allow("aa:bb:cc:00:00:01", "")
+	if got := allow("aa:bb:cc:00:00:01", ""); got != throttledMAC {
+		t.Fatalf("Expected the third drop to be a rate limit, got %d", got)
+	}
+	now = now.Add(10 * time.Second)
+	if got := allow("aa:bb:cc:00:00:01", ""); got != throttledBlacklist {
+		t.Errorf("Expected the MAC address to be blacklisted, got %d", got)
+	}
+
+	clients := l.throttled(now)
+	if len(clients) != 2 || clients[0].Client != "aa:bb:cc:00:00:01" || clients[0].BlacklistedUntil == nil || clients[0].Dropped != 4 || clients[1].Client != "10.0.0.1" || clients[1].Type != "source" {
+		t.Errorf("Unexpected throttled clients %+v", clients)
+	}
+
+	now = now.Add(time.Minute)
+	if got := allow("aa:bb:cc:00:00:01", ""); got != -1 {
+		t.Errorf("Expected the blacklisting to be over, got %d", got)
+	}
+
+	if !l.clear("10.0.0.1") || l.clear("10.0.0.1") {
+		t.Error("Expected the relay to be cleared once")
+	}
+	now = now.Add(rateLimitIdle + time.Second)
+	l.expire(now)
+	if len(l.macs) != 0 || len(l.sources) != 0 {
+		t.Errorf("Expected the idle clients to be forgotten, got %d and %d", len(l.macs), len(l.sources))
+	}
+}
+
+func TestRateLimiterFlood(t *testing.T) {
+	l := newRateLimiter(rateLimitConfig{macRate: 1, macBurst: 2, sourceRate: 1, sourceBurst: 2})
+	now := time.Now()
+	mac := make(net.HardwareAddr, 6)
+	for i := 0; i < 2*rateLimitClients; i++ {
+		rand.Read(mac)
+		l.allow(mac.String(), net.IP(mac[2:]).String(), now)
+	}
+	if len(l.macs) > rateLimitClients || len(l.sources) > rateLimitClients {
+		t.Errorf("Expected at most %d clients tracked, got %d MAC addresses and %d sources", rateLimitClients, len(l.macs), len(l.sources))
+	}
+
+	// The packets over the global limit are dropped before their client is
+	// tracked
+	l = newRateLimiter(rateLimitConfig{macRate: 1, macBurst: 2, globalRate: 1, globalBurst: 10})
+	for i := 0; i < 1000; i++ {
+		rand.Read(mac)
+		l.allow(mac.String(), "", now)
+	}
+	if len(l.macs) != 10 {
+		t.Errorf("Expected the 10 MAC addresses of the global burst only, got %d", len(l.macs))
+	}
+}
+
+func TestPacketSource(t *testing.T) {
+	p := newTestPacket(t, "aa:bb:cc:00:00:01")
+	if source := packetSource(p, &net.UDPAddr{IP: net.IPv4zero, Port: 68}); source != "" {
+		t.Errorf("Expected no source for an unconfigured client, got %q", source)
+	}
+	if source := packetSource(p, &net.UDPAddr{IP: net.ParseIP("192.168.1.20"), Port: 68}); source != "192.168.1.20" {
+		t.Errorf("Expected the address of the client, got %q", source)
+	}
+	p.SetGIAddr(net.ParseIP("10.0.0.1").To4())
+	if source := packetSource(p, &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 67}); source != "10.0.0.1" {
+		t.Errorf("Expected the relay, got %q", source)
+	}
+}
+
+func TestThrottledAPI(t *testing.T) {
+	router, dbPath := setupTestAPI(t)
+	defer teardownTestDB(t, dbPath)
+
+	prev := rateLimits
+	defer func() { rateLimits = prev }()
+	rateLimits = newRateLimiter(rateLimitConfig{macRate: 1, macBurst: 1, blacklistThreshold: 1, blacklistDuration: time.Minute})
+	now := time.Now()
+	rateLimits.allow("aa:bb:cc:00:00:01", "", now)
+	rateLimits.allow("aa:bb:cc:00:00:01", "", now)
+	rateLimits.allow("aa:bb:cc:00:00:02", "", now)
+
+	do := func(method, url string) (int, map[string]interface{}) {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(method, url, nil))
+		var answer map[string]interface{}
+		json.Unmarshal(rr.Body.Bytes(), &answer)
+		return rr.Code, answer
+	}
+
+	code, answer := do("GET", "/api/v1/dhcp/throttled")
+	if code != http.StatusOK || answer["count"].(float64) != 1 {
+		t.Fatalf("Expected one throttled client, got %d %v", code, answer)
+	}
+	client := answer["clients"].([]interface{})[0].(map[string]interface{})
+	if client["client"] != "aa:bb:cc:00:00:01" || client["blacklisted_until"] == nil {
+		t.Errorf("Unexpected throttled client %v", client)
+	}
+
+	if code, _ := do("DELETE", "/api/v1/dhcp/throttled/AA:BB:CC:00:00:01"); code != http.StatusOK {
+		t.Errorf("Expected the client to be cleared, got %d", code)
+	}
+	if ok, _ := rateLimits.allow("aa:bb:cc:00:00:01", "", now); !ok {
+		t.Error("Expected the cleared client to pass")
+	}
+	if code, _ := do("DELETE", "/api/v1/dhcp/throttled/10.0.0.9"); code != http.StatusNotFound {
+		t.Errorf("Expected an unknown client to be refused, got %d", code)
+	}
+	if code, _ := do("DELETE", "/api/v1/dhcp/throttled/1:2"); code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid client to be refused, got %d", code)
+	}
+
+	rateLimits.allow("aa:bb:cc:00:00:01", "", now)
+	code, answer = do("DELETE", "/api/v1/dhcp/throttled")
+	if code != http.StatusOK || answer["count"].(float64) != 1 || len(rateLimits.throttled(now)) != 0 {
+		t.Errorf("Expected every client to be cleared, got %d %v", code, answer)
+	}
+}
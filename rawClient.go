@@ -3,8 +3,10 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"net"
 	"syscall"
+	"time"
 
 	"github.com/mdlayher/ethernet"
 	"github.com/mdlayher/raw"
@@ -12,9 +14,10 @@ import (
 
 const UDP_HEADER_LEN = 8
 
-// A RawClient is a Wake-on-LAN client which operates directly on top of
-// Ethernet frames using raw sockets.  It can be used to send WoL magic packets
-// to other machines on a local network, using their hardware addresses.
+// A RawClient operates directly on top of Ethernet frames using raw sockets.
+// It sends the DHCP replies to the clients that have no address yet, using
+// their hardware addresses, and the ARP probes checking that an address is
+// free before it is offered.
 type RawClient struct {
 	ifi *net.Interface
 	p   net.PacketConn
@@ -51,12 +54,10 @@ type iphdr struct {
 // NewRawClient creates a new RawClient using the specified network interface.
 //
 // Note that raw sockets typically require elevated user privileges, such as
-// the 'root' user on Linux, or the 'SET_CAP_RAW' capability.
-//
-// For this reason, it is typically recommended to use the regular Client type
-// instead, which operates over UDP.
+// the 'root' user on Linux, or the 'CAP_NET_RAW' capability.
 func NewRawClient(ifi *net.Interface) (*RawClient, error) {
-	// Open raw socket to send Wake-on-LAN magic packets
+	// Open a raw socket of the ARP EtherType, it reads the replies to the
+	// probes, the DHCP replies are written as whole IPv4 frames
 	var cfg raw.Config
 
 	p, err := raw.ListenPacket(ifi, 0x0806, &cfg)
@@ -148,6 +149,79 @@ func (c *RawClient) sendDHCP(target net.HardwareAddr, dhcp []byte, dstIP net.IP,
 	return err
 }
 
+// The ARP operations
+const (
+	arpRequest = 1
+	arpReply   = 2
+)
+
+// arpLen is the length of an ARP packet for IPv4 over Ethernet
+const arpLen = 28
+
+// marshalARPProbe builds an RFC 5227 ARP probe for an address: a request
+// with an unspecified sender address, so the caches of the other hosts are
+// left alone
+func marshalARPProbe(sender net.HardwareAddr, target net.IP) []byte {
+	b := make([]byte, arpLen)
+	binary.BigEndian.PutUint16(b[0:], 1)      // Ethernet
+	binary.BigEndian.PutUint16(b[2:], 0x0800) // IPv4
+	b[4], b[5] = 6, 4
+	binary.BigEndian.PutUint16(b[6:], arpRequest)
+	copy(b[8:14], sender)
+	copy(b[24:28], target.To4())
+	return b
+}
+
+// parseARPSender returns the sender of an ARP packet for IPv4 over Ethernet
+func parseARPSender(b []byte) (op uint16, hw net.HardwareAddr, ip net.IP, err error) {
+	if len(b) < arpLen || binary.BigEndian.Uint16(b[0:]) != 1 || binary.BigEndian.Uint16(b[2:]) != 0x0800 || b[4] != 6 || b[5] != 4 {
+		return 0, nil, nil, errors.New("not an ARP packet for IPv4 over Ethernet")
+	}
+	return binary.BigEndian.Uint16(b[6:]), net.HardwareAddr(b[8:14]), net.IP(b[14:18]), nil
+}
+
+// probeARP broadcasts an ARP probe for an address and returns the MAC
+// address of the host claiming it, nil when none does before the timeout
+func (c *RawClient) probeARP(ip net.IP, timeout time.Duration) (net.HardwareAddr, error) {
+	f := &ethernet.Frame{
+		Destination: ethernet.Broadcast,
+		Source:      c.ifi.HardwareAddr,
+		EtherType:   ethernet.EtherTypeARP,
+		Payload:     marshalARPProbe(c.ifi.HardwareAddr, ip),
+	}
+	fb, err := f.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = c.p.WriteTo(fb, &raw.Addr{HardwareAddr: ethernet.Broadcast}); err != nil {
+		return nil, err
+	}
+
+	if err = c.p.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, max(c.ifi.MTU, 1500)+14)
+	for {
+		n, _, err := c.p.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil, nil
+			}
+			return nil, err
+		}
+		var reply ethernet.Frame
+		if reply.UnmarshalBinary(buf[:n]) != nil || reply.EtherType != ethernet.EtherTypeARP {
+			continue
+		}
+		// A reply, or the probe of a host about to take the address
+		op, hw, sender, err := parseARPSender(reply.Payload)
+		if err != nil || (op != arpReply && op != arpRequest) || !sender.Equal(ip) || bytes.Equal(hw, c.ifi.HardwareAddr) {
+			continue
+		}
+		return append(net.HardwareAddr(nil), hw...), nil
+	}
+}
+
 func (u *udphdr) checksum(ip *iphdr, payload []byte) {
 	u.csum = 0
 
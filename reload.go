@@ -0,0 +1,318 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/inverse-inc/packetfence/go/log"
+)
+
+// ReloadSummary describes what a configuration reload changed
+type ReloadSummary struct {
+	InterfacesAdded     []string `json:"interfaces_added"`
+	InterfacesRemoved   []string `json:"interfaces_removed"`
+	InterfacesRestarted []string `json:"interfaces_restarted"`
+	ScopesAdded         []string `json:"scopes_added"`
+	ScopesRemoved       []string `json:"scopes_removed"`
+	ScopesChanged       []string `json:"scopes_changed"`
+	ScopesKept          []string `json:"scopes_kept"`
+}
+
+// reloadLock serializes configuration reloads
+var reloadLock sync.Mutex
+
+// reload re-reads the configuration file and applies it to the live
+// configuration: listeners are started and stopped for the interfaces that
+// appeared, disappeared or changed, and only the scopes whose configuration
+// changed are rebuilt.
+func (d *Interfaces) reload() (ReloadSummary, error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	next := newDHCPConfig()
+	next.keepScopes(d)
+	if err := next.readConfig(); err != nil {
+		return ReloadSummary{}, err
+	}
+	hooks, err := readWebhooks(configFilePath)
+	if err != nil {
+		return ReloadSummary{}, err
+	}
+	startWebhooks(hooks)
+	rateLimitConf, err := readRateLimitConfig(configFilePath)
+	if err != nil {
+		return ReloadSummary{}, err
+	}
+	rateLimits.configure(rateLimitConf)
+	probeConf, err := readProbeConfig(configFilePath)
+	if err != nil {
+		return ReloadSummary{}, err
+	}
+	probes.configure(probeConf)
+
+	summary, started, stopped := d.applyConfig(next)
+
+	for _, I := range stopped {
+		I.stop()
+	}
+	for _, I := range started {
+		I.start(ctx, d.jobs)
+	}
+
+	log.LoggerWContext(ctx).Info("Configuration reloaded: " +
+		strconv.Itoa(len(summary.InterfacesAdded)) + " interfaces added, " +
+		strconv.Itoa(len(summary.InterfacesRemoved)) + " removed, " +
+		strconv.Itoa(len(summary.InterfacesRestarted)) + " restarted, " +
+		strconv.Itoa(len(summary.ScopesAdded)) + " scopes added, " +
+		strconv.Itoa(len(summary.ScopesRemoved)) + " removed, " +
+		strconv.Itoa(len(summary.ScopesChanged)) + " changed, " +
+		strconv.Itoa(len(summary.ScopesKept)) + " kept")
+
+	return summary, nil
+}
+
+// applyConfig merges a freshly read configuration into the live one. It
+// returns the interfaces whose listeners have to be started and stopped; the
+// caller is responsible for doing so.
+func (d *Interfaces) applyConfig(next *Interfaces) (summary ReloadSummary, started []*Interface, stopped []*Interface) {
+	interfacesLock.Lock()
+	defer interfacesLock.Unlock()
+
+	live := make(map[string]*Interface)
+	for _, I := range d.intsNet {
+		live[I.Name] = I
+	}
+
+	var merged []*Interface
+	for _, I := range next.intsNet {
+		old, found := live[I.Name]
+		if !found {
+			summary.InterfacesAdded = append(summary.InterfacesAdded, I.Name)
+			for _, v := range I.networks() {
+				summary.ScopesAdded = append(summary.ScopesAdded, scopeName(I, v))
+			}
+			for _, v := range I.networks6() {
+				summary.ScopesAdded = append(summary.ScopesAdded, scopeName6(I, v))
+			}
+			merged = append(merged, I)
+			started = append(started, I)
+			continue
+		}
+		delete(live, I.Name)
+
+		networks := mergeNetworks(I, old.networks(), I.networks(), &summary)
+		networks6 := mergeNetworks6(I, old.networks6(), I.networks6(), &summary)
+		if old.sameListener(I) {
+			old.setNetworks(networks)
+			old.setNetworks6(networks6)
+			merged = append(merged, old)
+			continue
+		}
+		I.setNetworks(networks)
+		I.setNetworks6(networks6)
+		summary.InterfacesRestarted = append(summary.InterfacesRestarted, I.Name)
+		merged = append(merged, I)
+		stopped = append(stopped, old)
+		started = append(started, I)
+	}
+
+	var removed []string
+	for name := range live {
+		removed = append(removed, name)
+	}
+	sort.Strings(removed)
+	for _, name := range removed {
+		old := live[name]
+		for _, v := range old.networks() {
+			v.dhcpHandler.retire()
+			summary.ScopesRemoved = append(summary.ScopesRemoved, scopeName(old, v))
+		}
+		for _, v := range old.networks6() {
+			v.dhcpHandler.retire()
+			summary.ScopesRemoved = append(summary.ScopesRemoved, scopeName6(old, v))
+		}
+		summary.InterfacesRemoved = append(summary.InterfacesRemoved, name)
+		stopped = append(stopped, old)
+	}
+
+	d.intsNet = merged
+	intNametoInterface = make(map[string]*Interface)
+	for _, I := range merged {
+		intNametoInterface[I.Name] = I
+	}
+
+	return summary, started, stopped
+}
+
+// mergeNetworks keeps the live scopes whose configuration did not change, be
+// they reused by readConfig or built again, and moves the bindings of the
+// changed ones into their rebuilt replacement.
+func mergeNetworks(I *Interface, old []Network, next []Network, summary *ReloadSummary) []Network {
+	previous := make(map[string]Network)
+	for _, v := range old {
+		previous[v.network.String()] = v
+	}
+
+	var merged []Network
+	for _, v := range next {
+		key := v.network.String()
+		o, found := previous[key]
+		if !found {
+			summary.ScopesAdded = append(summary.ScopesAdded, scopeName(I, v))
+			merged = append(merged, v)
+			continue
+		}
+		delete(previous, key)
+
+		if o.dhcpHandler.signature == v.dhcpHandler.signature {
+			if v.dhcpHandler != o.dhcpHandler {
+				// Discard the duplicate built by readConfig
+				v.dhcpHandler.retire()
+			}
+			summary.ScopesKept = append(summary.ScopesKept, scopeName(I, o))
+			merged = append(merged, o)
+			continue
+		}
+
+		migrated := migrateBindings(o.dhcpHandler, v.dhcpHandler)
+		o.dhcpHandler.retire()
+		log.LoggerWContext(ctx).Info("Scope " + scopeName(I, v) + " rebuilt, " + strconv.Itoa(migrated) + " bindings kept")
+		summary.ScopesChanged = append(summary.ScopesChanged, scopeName(I, v))
+		merged = append(merged, v)
+	}
+
+	for _, v := range old {
+		if _, found := previous[v.network.String()]; found {
+			v.dhcpHandler.retire()
+			summary.ScopesRemoved = append(summary.ScopesRemoved, scopeName(I, v))
+		}
+	}
+
+	return merged
+}
+
+// mergeNetworks6 is mergeNetworks for the IPv6 scopes
+func mergeNetworks6(I *Interface, old []Network6, next []Network6, summary *ReloadSummary) []Network6 {
+	previous := make(map[string]Network6)
+	for _, v := range old {
+		previous[v.network.String()] = v
+	}
+
+	var merged []Network6
+	for _, v := range next {
+		key := v.network.String()
+		o, found := previous[key]
+		if !found {
+			summary.ScopesAdded = append(summary.ScopesAdded, scopeName6(I, v))
+			merged = append(merged, v)
+			continue
+		}
+		delete(previous, key)
+
+		if o.dhcpHandler.signature == v.dhcpHandler.signature {
+			if v.dhcpHandler != o.dhcpHandler {
+				v.dhcpHandler.retire()
+			}
+			summary.ScopesKept = append(summary.ScopesKept, scopeName6(I, o))
+			merged = append(merged, o)
+			continue
+		}
+
+		migrated := 0
+		if o.dhcpHandler.na != nil {
+			migrated += o.dhcpHandler.na.migrate(v.dhcpHandler.na)
+		}
+		if o.dhcpHandler.pd != nil {
+			migrated += o.dhcpHandler.pd.migrate(v.dhcpHandler.pd)
+		}
+		o.dhcpHandler.retire()
+		log.LoggerWContext(ctx).Info("Scope " + scopeName6(I, v) + " rebuilt, " + strconv.Itoa(migrated) + " bindings kept")
+		summary.ScopesChanged = append(summary.ScopesChanged, scopeName6(I, v))
+		merged = append(merged, v)
+	}
+
+	for _, v := range old {
+		if _, found := previous[v.network.String()]; found {
+			v.dhcpHandler.retire()
+			summary.ScopesRemoved = append(summary.ScopesRemoved, scopeName6(I, v))
+		}
+	}
+
+	return merged
+}
+
+// migrateBindings copies the bindings of a scope into the scope rebuilt to
+// replace it. Bindings whose address is not part of the new pool are dropped.
+// It returns the number of bindings kept.
+func migrateBindings(old *DHCPHandler, next *DHCPHandler) int {
+	migrated := 0
+	for mac, item := range old.hwcache.Items() {
+		index, ok := item.Object.(int)
+		if !ok {
+			continue
+		}
+		remaining := time.Until(time.Unix(0, item.Expiration))
+		if remaining <= 0 {
+			continue
+		}
+
+		ip := old.ipAt(index)
+		newIndex := next.indexOf(ip)
+		if newIndex < 0 || newIndex >= next.leaseRange {
+			log.LoggerWContext(ctx).Info(mac + " " + ip.String() + " is no longer part of the pool, dropping the binding")
+			continue
+		}
+		if position, ok := next.staticIndex(mac, nil); ok && int(position) != newIndex {
+			// The client now has a static assignment, it will get it on renewal
+			continue
+		}
+
+		_, owner, _ := next.available.GetMACIndex(safeIntToUint64(newIndex))
+		if owner == PeerMac || owner == ExcludedMac {
+			// A binding of the failover partner, or an address excluded
+			// while it is bound
+			next.available.FreeIPIndex(safeIntToUint64(newIndex))
+		}
+		if owner != mac {
+			if err, _ := next.available.ReserveIPIndex(safeIntToUint64(newIndex), mac); err != nil {
+				log.LoggerWContext(ctx).Info(mac + " " + ip.String() + " cannot be kept: " + err.Error())
+				continue
+			}
+		}
+
+		next.hwcache.Set(mac, newIndex, remaining)
+		next.setPeerBound(mac, old.isPeerBound(mac))
+		if name, forward := old.ddns.registered(mac); name != "" {
+			next.ddns.restore(mac, ip, name, forward)
+		}
+		migrated++
+	}
+	return migrated
+}
+
+// retire detaches a scope that is no longer served: its bindings are dropped
+// without releasing them so the persisted leases are left untouched.
+func (h *DHCPHandler) retire() {
+	h.hwcache.OnEvicted(nil)
+	h.hwcache.Flush()
+}
+
+// sameListener returns whether the listeners of the interface can be kept
+// when it is replaced by other
+func (I *Interface) sameListener(other *Interface) bool {
+	return I.InterfaceType == other.InterfaceType &&
+		I.listenPort == other.listenPort &&
+		I.Ipv4.Equal(other.Ipv4) &&
+		I.relayIP.Equal(other.relayIP) &&
+		(len(I.networks6()) > 0) == (len(other.networks6()) > 0)
+}
+
+func scopeName(I *Interface, v Network) string {
+	return I.Name + " " + v.network.String()
+}
+
+func scopeName6(I *Interface, v Network6) string {
+	return I.Name + " " + v.network.String()
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	cache "github.com/fdurand/go-cache"
+)
+
+const reloadTestConfig = `[interfaces]
+listen=lo
+
+[network 127.0.0.0]
+dns=127.0.0.53
+gateway=127.0.0.1
+netmask=255.0.0.0
+dhcp_start=127.0.0.10
+dhcp_end=%END%
+dhcp_default_lease_time=3600
+dhcpd=enabled
+ddns_server=127.0.0.1
+ddns_zone=example.org
+`
+
+// setupReloadTest points the daemon at a temporary configuration file served
+// on the loopback interface and returns a function writing a new version of it.
+func setupReloadTest(t *testing.T) func(end string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	prevConfig, prevIntNames := configFilePath, intNametoInterface
+	prevIp, prevMac := GlobalIpCache, GlobalMacCache
+	t.Cleanup(func() {
+		configFilePath, intNametoInterface = prevConfig, prevIntNames
+		GlobalIpCache, GlobalMacCache = prevIp, prevMac
+	})
+
+	configFilePath = filepath.Join(dir, "godhcp.ini")
+	intNametoInterface = make(map[string]*Interface)
+	GlobalIpCache = cache.New(5*time.Minute, 10*time.Minute)
+	GlobalMacCache = cache.New(5*time.Minute, 10*time.Minute)
+
+	dbPath := setupTestDB(t)
+	t.Cleanup(func() { teardownTestDB(t, dbPath) })
+	if err := InitDatabase(dbPath); err != nil {
+		t.Fatalf("InitDatabase failed: %v", err)
+	}
+
+	return func(end string) {
+		config := reloadTestConfig
+		if end == "" {
+			config = "[interfaces]\nlisten=lo\n"
+		}
+		config = strings.ReplaceAll(config, "%END%", end)
+		if err := os.WriteFile(configFilePath, []byte(config), 0644); err != nil {
+			t.Fatalf("Failed to write configuration: %v", err)
+		}
+	}
+}
+
+func readTestConfig(t *testing.T) *Interfaces {
+	t.Helper()
+	config := newDHCPConfig()
+	if err := config.readConfig(); err != nil {
+		t.Fatalf("readConfig failed: %v", err)
+	}
+	return config
+}
+
+func TestReloadKeepsUnchangedScopes(t *testing.T) {
+	writeConfig := setupReloadTest(t)
+	writeConfig("127.0.0.50")
+
+	live := newDHCPConfig()
+	summary, started, _ := live.applyConfig(readTestConfig(t))
+	if len(live.intsNet) != 1 || len(started) != 1 || len(summary.ScopesAdded) != 1 {
+		t.Fatalf("Expected the loopback scope to be added, got %+v", summary)
+	}
+	handler := live.intsNet[0].networks()[0].dhcpHandler
+
+	const mac = "aa:bb:cc:dd:ee:ff"
+	handler.available.ReserveIPIndex(5, mac)
+	handler.hwcache.Set(mac, 5, time.Hour)
+
+	summary, started, stopped := live.applyConfig(readTestConfig(t))
+	if len(summary.ScopesKept) != 1 || len(started) != 0 || len(stopped) != 0 {
+		t.Fatalf("Expected the scope to be kept without restarting listeners, got %+v", summary)
+	}
+	if live.intsNet[0].networks()[0].dhcpHandler != handler {
+		t.Error("Unchanged scope has been rebuilt")
+	}
+	if I, ok := lookupInterface("lo"); !ok || I != live.intsNet[0] {
+		t.Error("Interface map not updated")
+	}
+}
+
+func TestReloadReusesUnchangedScopes(t *testing.T) {
+	writeConfig := setupReloadTest(t)
+	writeConfig("127.0.0.50")
+
+	live := newDHCPConfig()
+	live.applyConfig(readTestConfig(t))
+	handler := live.intsNet[0].networks()[0].dhcpHandler
+
+	// The unchanged scope is not built again
+	next := newDHCPConfig()
+	next.keepScopes(live)
+	if err := next.readConfig(); err != nil {
+		t.Fatalf("readConfig failed: %v", err)
+	}
+	if next.intsNet[0].networks()[0].dhcpHandler != handler {
+		t.Fatal("Expected readConfig to reuse the unchanged scope")
+	}
+	const mac = "aa:bb:cc:dd:ee:ff"
+	handler.hwcache.Set(mac, 5, time.Hour)
+	summary, _, _ := live.applyConfig(next)
+	if len(summary.ScopesKept) != 1 || handler.hwcache.ItemCount() != 1 {
+		t.Errorf("Expected the reused scope to be kept with its bindings, got %+v", summary)
+	}
+
+	// The changed one is
+	writeConfig("127.0.0.100")
+	next = newDHCPConfig()
+	next.keepScopes(live)
+	if err := next.readConfig(); err != nil {
+		t.Fatalf("readConfig failed: %v", err)
+	}
+	if next.intsNet[0].networks()[0].dhcpHandler == handler {
+		t.Error("Expected readConfig to build the changed scope")
+	}
+}
+
+func TestReloadMigratesBindings(t *testing.T) {
+	writeConfig := setupReloadTest(t)
+	writeConfig("127.0.0.50")
+
+	live := newDHCPConfig()
+	live.applyConfig(readTestConfig(t))
+	old := live.intsNet[0].networks()[0].dhcpHandler
+
+	const mac = "aa:bb:cc:dd:ee:ff"
+	old.available.ReserveIPIndex(5, mac)
+	old.hwcache.Set(mac, 5, time.Hour)
+	old.ddns.restore(mac, old.ipAt(5), "laptop.example.org.", true)
+
+	// Grow the pool, the binding must follow
+	writeConfig("127.0.0.100")
+	summary, _, _ := live.applyConfig(readTestConfig(t))
+	if len(summary.ScopesChanged) != 1 {
+		t.Fatalf("Expected the scope to be rebuilt, got %+v", summary)
+	}
+	handler := live.intsNet[0].networks()[0].dhcpHandler
+	if handler == old {
+		t.Fatal("Changed scope has not been rebuilt")
+	}
+	if handler.leaseRange != 91 {
+		t.Errorf("Expected the new pool size, got %d", handler.leaseRange)
+	}
+	if x, found := handler.hwcache.Get(mac); !found || x.(int) != 5 {
+		t.Errorf("Expected the binding to be kept at index 5, got %v", x)
+	}
+	if _, owner, _ := handler.available.GetMACIndex(5); owner != mac {
+		t.Errorf("Expected index 5 to be reserved for %s, got %s", mac, owner)
+	}
+	if name, forward := handler.ddns.registered(mac); name != "laptop.example.org." || !forward {
+		t.Errorf("Expected the DNS name of the binding to be kept, got %q (forward %v)", name, forward)
+	}
+	if old.hwcache.ItemCount() != 0 {
+		t.Error("Expected the replaced scope to be retired")
+	}
+
+	// Shrink the pool below the binding, it must be dropped
+	writeConfig("127.0.0.12")
+	live.applyConfig(readTestConfig(t))
+	handler = live.intsNet[0].networks()[0].dhcpHandler
+	if _, found := handler.hwcache.Get(mac); found {
+		t.Error("Expected the binding outside the pool to be dropped")
+	}
+
+	// Remove the network, the interface has nothing left to serve
+	writeConfig("")
+	summary, _, stopped := live.applyConfig(readTestConfig(t))
+	if len(summary.InterfacesRemoved) != 1 || len(summary.ScopesRemoved) != 1 || len(stopped) != 1 {
+		t.Errorf("Expected the interface to be removed, got %+v", summary)
+	}
+	if _, ok := lookupInterface("lo"); ok {
+		t.Error("Removed interface still referenced")
+	}
+}
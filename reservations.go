@@ -0,0 +1,404 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/inverse-inc/packetfence/go/log"
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// Reservation statically assigns an address to a MAC address, it is made
+// through the API and stored in the database
+type Reservation struct {
+	MAC       string       `json:"mac"`
+	IP        string       `json:"ip"`
+	Network   string       `json:"network"`
+	Hostname  string       `json:"hostname,omitempty"` // Sent as the host name option
+	Options   []DHCPOption `json:"options,omitempty"`  // Sent to the client over the other options
+	CreatedAt time.Time    `json:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at"`
+}
+
+// reservationSet holds the reservations of a scope, they change at runtime
+// so they are kept apart from the assignments of the configuration file
+type reservationSet struct {
+	lock    sync.RWMutex
+	byMAC   map[string]Reservation
+	indexes map[string]uint32 // Pool index by MAC address
+}
+
+func newReservationSet() *reservationSet {
+	return &reservationSet{byMAC: make(map[string]Reservation), indexes: make(map[string]uint32)}
+}
+
+// index returns the pool index reserved for a MAC address
+func (s *reservationSet) index(mac string) (uint32, bool) {
+	if s == nil {
+		return 0, false
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	position, ok := s.indexes[mac]
+	return position, ok
+}
+
+// owner returns the MAC address a pool index is reserved for
+func (s *reservationSet) owner(index int) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for mac, position := range s.indexes {
+		if int(position) == index {
+			return mac, true
+		}
+	}
+	return "", false
+}
+
+func (s *reservationSet) set(r Reservation, index uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.byMAC[r.MAC] = r
+	s.indexes[r.MAC] = index
+}
+
+func (s *reservationSet) remove(mac string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.byMAC, mac)
+	delete(s.indexes, mac)
+}
+
+// apply adds the host name and the options of the reservation of a client to
+// the options of its reply
+func (s *reservationSet) apply(options dhcp.Options, mac string) {
+	if s == nil {
+		return
+	}
+	s.lock.RLock()
+	r, found := s.byMAC[mac]
+	s.lock.RUnlock()
+	if !found {
+		return
+	}
+	if r.Hostname != "" {
+		options[dhcp.OptionHostName] = []byte(r.Hostname)
+	}
+	for _, opt := range r.Options {
+		code, value, err := ConvertOptionToDHCP(opt)
+		if err != nil {
+			log.LoggerWContext(ctx).Error(fmt.Sprintf("Failed to convert option %d of the reservation of %s: %s", opt.OptionCode, mac, err))
+			continue
+		}
+		options[code] = value
+	}
+}
+
+// loadReservations applies the stored reservations of a network to its scope,
+// before the leases are restored so a reserved address is not given back to
+// another client
+func loadReservations(handler *DHCPHandler, network string) {
+	handler.reservations = newReservationSet()
+	reservations, err := ListReservations(network)
+	if err != nil {
+		log.LoggerWContext(ctx).Error("Unable to load the reservations of network " + network + ": " + err.Error())
+		return
+	}
+	for _, r := range reservations {
+		index := handler.indexOf(net.ParseIP(r.IP))
+		if index < 0 || index >= handler.leaseRange {
+			log.LoggerWContext(ctx).Error("Reservation " + r.IP + " of " + r.MAC + " is outside of the pool of network " + network + ", skipping")
+			continue
+		}
+		if _, static := handler.ipAssigned[r.MAC]; static {
+			log.LoggerWContext(ctx).Error("Reservation of " + r.MAC + " is overridden by the ip_assigned of network " + network)
+			continue
+		}
+		if err, _ := handler.available.ReserveIPIndex(safeIntToUint64(index), r.MAC); err != nil {
+			log.LoggerWContext(ctx).Error("Unable to apply the reservation " + r.IP + " of " + r.MAC + ": " + err.Error())
+			continue
+		}
+		handler.reservations.set(r, uint32(index))
+	}
+	if len(reservations) > 0 {
+		log.LoggerWContext(ctx).Info("Applied " + strconv.Itoa(len(reservations)) + " reservations in network " + network)
+	}
+}
+
+// Reasons an address cannot be reserved
+const (
+	conflictLease       = "lease"       // Leased to another client
+	conflictStatic      = "static"      // Assigned in the configuration file
+	conflictReservation = "reservation" // Reserved for another client
+	conflictExcluded    = "excluded"    // Part of an exclusion range
+	conflictUnusable    = "unusable"    // Declined or found in use
+	conflictPartner     = "partner"     // Owned by the failover partner
+)
+
+// ReservationConflict is returned when the address of a reservation is held
+type ReservationConflict struct {
+	IP        string     `json:"ip"`
+	MAC       string     `json:"mac,omitempty"`
+	Reason    string     `json:"reason"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func (c *ReservationConflict) Error() string {
+	switch c.Reason {
+	case conflictLease:
+		return fmt.Sprintf("%s is leased to %s", c.IP, c.MAC)
+	case conflictStatic:
+		return fmt.Sprintf("%s is assigned to %s in the configuration file", c.IP, c.MAC)
+	case conflictReservation:
+		return fmt.Sprintf("%s is reserved for %s", c.IP, c.MAC)
+	case conflictPartner:
+		return fmt.Sprintf("%s belongs to the failover partner", c.IP)
+	case conflictExcluded:
+		return fmt.Sprintf("%s is excluded", c.IP)
+	}
+	return fmt.Sprintf("%s is currently unusable", c.IP)
+}
+
+// errNoReservationScope is returned for an address no scope hands out
+var errNoReservationScope = errors.New("no network of this server hands out this address")
+
+// reservationsLock serializes the changes of the reservations
+var reservationsLock sync.Mutex
+
+// scopeOf returns the scope whose pool contains an address, with the index
+// of the address in the pool
+func scopeOf(ip net.IP) (*DHCPHandler, string, int, bool) {
+	for _, I := range DHCPConfig.interfaces() {
+		for _, v := range I.networks() {
+			if !v.network.Contains(ip) {
+				continue
+			}
+			if index := v.dhcpHandler.indexOf(ip); index >= 0 && index < v.dhcpHandler.leaseRange {
+				return v.dhcpHandler, v.network.IP.String(), index, true
+			}
+		}
+	}
+	return nil, "", 0, false
+}
+
+// conflictAt describes who holds an index of a scope
+func conflictAt(handler *DHCPHandler, index int, ip string) *ReservationConflict {
+	_, owner, _ := handler.available.GetMACIndex(safeIntToUint64(index))
+	conflict := &ReservationConflict{IP: ip, MAC: owner, Reason: conflictLease}
+	switch {
+	case owner == FakeMac:
+		conflict.MAC, conflict.Reason = "", conflictUnusable
+	case owner == PeerMac:
+		conflict.MAC, conflict.Reason = "", conflictPartner
+	case owner == ExcludedMac:
+		conflict.MAC, conflict.Reason = "", conflictExcluded
+	case owner == RelayAgentMac:
+		conflict.MAC, conflict.Reason = "", conflictStatic
+	default:
+		if position, static := handler.ipAssigned[owner]; static && int(position) == index {
+			conflict.Reason = conflictStatic
+		} else if _, reserved := handler.reservations.index(owner); reserved {
+			conflict.Reason = conflictReservation
+		} else if _, expiration, found := handler.hwcache.GetWithExpiration(owner); found {
+			conflict.ExpiresAt = &expiration
+		}
+	}
+	return conflict
+}
+
+// applyReservation stores a reservation and reserves its address in the pool
+// of its scope. An address held by another client is reported as a
+// ReservationConflict and nothing is changed. Moving a reservation releases
+// its previous address, unless the client is still bound to it.
+func applyReservation(r Reservation) (*Reservation, error) {
+	reservationsLock.Lock()
+	defer reservationsLock.Unlock()
+
+	ip := net.ParseIP(r.IP).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip %q", r.IP)
+	}
+	handler, network, index, found := scopeOf(ip)
+	if !found {
+		return nil, errNoReservationScope
+	}
+	if _, static := handler.ipAssigned[r.MAC]; static {
+		return nil, &ReservationConflict{IP: r.IP, MAC: r.MAC, Reason: conflictStatic}
+	}
+	r.IP, r.Network = ip.String(), network
+
+	previous, err := GetReservation(r.MAC)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	reserved := false
+	if err, _ := handler.available.ReserveIPIndex(safeIntToUint64(index), r.MAC); err == nil {
+		reserved = true
+	} else if _, owner, _ := handler.available.GetMACIndex(safeIntToUint64(index)); owner != r.MAC {
+		return nil, conflictAt(handler, index, r.IP)
+	}
+
+	if err := SaveReservation(r); err != nil {
+		if reserved {
+			handler.available.FreeIPIndex(safeIntToUint64(index))
+		}
+		return nil, err
+	}
+	if previous != nil && previous.IP != r.IP {
+		releaseReservation(previous)
+	}
+	saved, err := GetReservation(r.MAC)
+	if err != nil {
+		return nil, err
+	}
+	handler.reservations.set(*saved, uint32(index))
+	log.LoggerWContext(ctx).Info("Reserved " + saved.IP + " for " + saved.MAC + " in network " + network)
+	return saved, nil
+}
+
+// removeReservation deletes the reservation of a MAC address
+func removeReservation(mac string) error {
+	reservationsLock.Lock()
+	defer reservationsLock.Unlock()
+
+	r, err := GetReservation(mac)
+	if err != nil {
+		return err
+	}
+	if err := DeleteReservation(mac); err != nil {
+		return err
+	}
+	releaseReservation(r)
+	log.LoggerWContext(ctx).Info("Removed the reservation " + r.IP + " of " + r.MAC)
+	return nil
+}
+
+// releaseReservation gives the address of a removed reservation back to the
+// pool. A client bound to it keeps it as a dynamic lease until it expires.
+func releaseReservation(r *Reservation) {
+	handler, _, index, found := scopeOf(net.ParseIP(r.IP))
+	if !found {
+		return
+	}
+	if position, ok := handler.reservations.index(r.MAC); !ok || int(position) != index {
+		return
+	}
+	handler.reservations.remove(r.MAC)
+	if bound, found := handler.hwcache.Get(r.MAC); found && bound.(int) == index {
+		return
+	}
+	if _, owner, _ := handler.available.GetMACIndex(safeIntToUint64(index)); owner == r.MAC {
+		freeIndex(handler, index)
+	}
+}
+
+// SaveReservation creates or updates a reservation
+func SaveReservation(r Reservation) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	optionsJSON, err := json.Marshal(r.Options)
+	if err != nil {
+		return fmt.Errorf("failed to marshal options: %w", err)
+	}
+
+	query := `
+		INSERT INTO dhcp_reservations (mac, ip, network, hostname, options, updated_at)
+		VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(mac) DO UPDATE SET
+			ip = excluded.ip,
+			network = excluded.network,
+			hostname = excluded.hostname,
+			options = excluded.options,
+			updated_at = CURRENT_TIMESTAMP
+	`
+
+	if _, err := db.Exec(query, r.MAC, r.IP, r.Network, r.Hostname, string(optionsJSON)); err != nil {
+		return fmt.Errorf("failed to save reservation: %w", err)
+	}
+
+	return nil
+}
+
+// scanReservation reads a reservation from a row
+func scanReservation(row interface{ Scan(...interface{}) error }) (*Reservation, error) {
+	var r Reservation
+	var optionsJSON string
+	if err := row.Scan(&r.MAC, &r.IP, &r.Network, &r.Hostname, &optionsJSON, &r.CreatedAt, &r.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(optionsJSON), &r.Options); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal options: %w", err)
+	}
+	return &r, nil
+}
+
+// GetReservation returns the reservation of a MAC address
+func GetReservation(mac string) (*Reservation, error) {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	return scanReservation(db.QueryRow(`SELECT mac, ip, network, hostname, options, created_at, updated_at FROM dhcp_reservations WHERE mac = ?`, mac))
+}
+
+// DeleteReservation deletes the reservation of a MAC address
+func DeleteReservation(mac string) error {
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+
+	result, err := db.Exec(`DELETE FROM dhcp_reservations WHERE mac = ?`, mac)
+	if err != nil {
+		return fmt.Errorf("failed to delete reservation: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// ListReservations lists the reservations, optionally limited to a network
+func ListReservations(network string) ([]Reservation, error) {
+	dbMutex.RLock()
+	defer dbMutex.RUnlock()
+
+	query := `SELECT mac, ip, network, hostname, options, created_at, updated_at FROM dhcp_reservations`
+	var args []interface{}
+	if network != "" {
+		query += ` WHERE network = ?`
+		args = append(args, network)
+	}
+	query += ` ORDER BY network, mac`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list reservations: %w", err)
+	}
+	defer rows.Close()
+
+	reservations := []Reservation{}
+	for rows.Next() {
+		r, err := scanReservation(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		reservations = append(reservations, *r)
+	}
+
+	return reservations, rows.Err()
+}
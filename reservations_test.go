@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	cache "github.com/fdurand/go-cache"
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// newReservationScope builds a configuration with a scope handing out
+// 192.168.1.10 to 192.168.1.29
+func newReservationScope() (*Interfaces, *DHCPHandler) {
+	handler := &DHCPHandler{
+		leaseRange:   20,
+		available:    newTestRangePool(net.ParseIP("192.168.1.10"), 20),
+		hwcache:      cache.New(time.Hour, 10*time.Second),
+		ipAssigned:   map[string]uint32{},
+		reservations: newReservationSet(),
+		exclusions:   newExclusionSet(),
+	}
+	_, network, _ := net.ParseCIDR("192.168.1.0/24")
+	return &Interfaces{intsNet: []*Interface{{Name: "eth0", network: []Network{{network: *network, dhcpHandler: handler}}}}}, handler
+}
+
+func TestReservationsAPI(t *testing.T) {
+	router, dbPath := setupTestAPI(t)
+	defer teardownTestDB(t, dbPath)
+
+	prevConfig := DHCPConfig
+	defer func() { DHCPConfig = prevConfig }()
+	var handler *DHCPHandler
+	DHCPConfig, handler = newReservationScope()
+
+	owner := func(index uint64) string {
+		_, mac, _ := handler.available.GetMACIndex(index)
+		return mac
+	}
+
+	code, answer := apiRequest(router, "POST", "/api/v1/dhcp/reservations/AA:BB:CC:DD:EE:01", map[string]interface{}{
+		"ip":       "192.168.1.15",
+		"hostname": "printer",
+		"options":  []DHCPOption{{OptionCode: 42, OptionValue: "192.168.1.1", OptionType: "ip"}},
+	})
+	if code != http.StatusOK {
+		t.Fatalf("Expected the reservation to be saved, got %d %v", code, answer)
+	}
+	if owner(5) != "aa:bb:cc:dd:ee:01" {
+		t.Errorf("Expected the index to be reserved right away, owned by %s", owner(5))
+	}
+	if position, ok := handler.staticIndex("aa:bb:cc:dd:ee:01", nil); !ok || position != 5 || !handler.isStatic(5) {
+		t.Errorf("Expected the reservation to be a static assignment, got %d %v", position, ok)
+	}
+	options := make(dhcp.Options)
+	handler.reservations.apply(options, "aa:bb:cc:dd:ee:01")
+	if string(options[dhcp.OptionHostName]) != "printer" || !net.IP(options[dhcp.OptionNetworkTimeProtocolServers]).Equal(net.ParseIP("192.168.1.1")) {
+		t.Errorf("Expected the hostname and options of the reservation, got %v", options)
+	}
+
+	// An address leased to another client is reported
+	handler.available.ReserveIPIndex(6, "aa:bb:cc:dd:ee:02")
+	handler.hwcache.Set("aa:bb:cc:dd:ee:02", 6, time.Hour)
+	code, answer = apiRequest(router, "POST", "/api/v1/dhcp/reservations/aa:bb:cc:dd:ee:03", map[string]interface{}{"ip": "192.168.1.16"})
+	if code != http.StatusConflict {
+		t.Fatalf("Expected a conflict, got %d %v", code, answer)
+	}
+	conflict := answer["conflict"].(map[string]interface{})
+	if conflict["mac"] != "aa:bb:cc:dd:ee:02" || conflict["reason"] != conflictLease || conflict["expires_at"] == nil {
+		t.Errorf("Unexpected conflict %v", conflict)
+	}
+	if code, _ = apiRequest(router, "POST", "/api/v1/dhcp/reservations/aa:bb:cc:dd:ee:03", map[string]interface{}{"ip": "192.168.1.15"}); code != http.StatusConflict {
+		t.Errorf("Expected a reserved address to be refused, got %d", code)
+	}
+
+	// Moving a reservation frees its previous address
+	if code, answer = apiRequest(router, "POST", "/api/v1/dhcp/reservations/aa:bb:cc:dd:ee:01", map[string]interface{}{"ip": "192.168.1.17"}); code != http.StatusOK {
+		t.Fatalf("Expected the reservation to move, got %d %v", code, answer)
+	}
+	if owner(5) != FreeMac || owner(7) != "aa:bb:cc:dd:ee:01" {
+		t.Errorf("Expected the reservation to move from index 5 to 7, owners %s %s", owner(5), owner(7))
+	}
+
+	if code, answer = apiRequest(router, "GET", "/api/v1/dhcp/reservations", nil); code != http.StatusOK || answer["count"].(float64) != 1 {
+		t.Errorf("Unexpected list %d %v", code, answer)
+	}
+	if code, answer = apiRequest(router, "GET", "/api/v1/dhcp/reservations/aa:bb:cc:dd:ee:01", nil); code != http.StatusOK || answer["ip"] != "192.168.1.17" || answer["network"] != "192.168.1.0" {
+		t.Errorf("Unexpected reservation %d %v", code, answer)
+	}
+
+	for _, ip := range []string{"10.0.0.10", "192.168.1.200", "garbage"} {
+		if code, _ := apiRequest(router, "POST", "/api/v1/dhcp/reservations/aa:bb:cc:dd:ee:04", map[string]interface{}{"ip": ip}); code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be refused, got %d", ip, code)
+		}
+	}
+
+	// A removed reservation stays with its client while it is bound
+	handler.hwcache.Set("aa:bb:cc:dd:ee:01", 7, time.Hour)
+	if code, _ = apiRequest(router, "DELETE", "/api/v1/dhcp/reservations/aa:bb:cc:dd:ee:01", nil); code != http.StatusOK {
+		t.Fatalf("Expected the reservation to be removed, got %d", code)
+	}
+	if _, ok := handler.staticIndex("aa:bb:cc:dd:ee:01", nil); ok || owner(7) != "aa:bb:cc:dd:ee:01" {
+		t.Errorf("Expected a dynamic lease to remain on index 7, owned by %s", owner(7))
+	}
+	if code, _ = apiRequest(router, "DELETE", "/api/v1/dhcp/reservations/aa:bb:cc:dd:ee:01", nil); code != http.StatusNotFound {
+		t.Errorf("Expected a missing reservation, got %d", code)
+	}
+}
+
+func TestLoadReservations(t *testing.T) {
+	dbPath := setupTestDB(t)
+	defer teardownTestDB(t, dbPath)
+	if err := InitDatabase(dbPath); err != nil {
+		t.Fatalf("InitDatabase failed: %v", err)
+	}
+
+	for _, r := range []Reservation{
+		{MAC: "aa:bb:cc:dd:ee:01", IP: "192.168.1.12", Network: "192.168.1.0"},
+		{MAC: "aa:bb:cc:dd:ee:02", IP: "192.168.1.200", Network: "192.168.1.0"},
+		{MAC: "aa:bb:cc:dd:ee:03", IP: "10.0.0.12", Network: "10.0.0.0"},
+	} {
+		if err := SaveReservation(r); err != nil {
+			t.Fatalf("SaveReservation failed: %v", err)
+		}
+	}
+
+	_, handler := newReservationScope()
+	loadReservations(handler, "192.168.1.0")
+	if position, ok := handler.staticIndex("aa:bb:cc:dd:ee:01", nil); !ok || position != 2 {
+		t.Errorf("Expected the reservation to be applied, got %d %v", position, ok)
+	}
+	if _, ok := handler.staticIndex("aa:bb:cc:dd:ee:02", nil); ok {
+		t.Error("Expected a reservation outside of the pool to be skipped")
+	}
+	if free := handler.available.FreeIPsRemaining(); free != 19 {
+		t.Errorf("Expected a single reserved index, got %d free", free)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"net"
+	"time"
 
 	"github.com/inverse-inc/packetfence/go/log"
 	dhcp "github.com/krolaw/dhcp4"
@@ -73,6 +74,13 @@ func Serve(conn *serveIfConn, handler Handler, jobs chan job, interfaceNet *Inte
 				continue
 			}
 		}
+		metrics.countReceived(reqType)
+		// Drop the floods before they reach the queue and starve the other
+		// clients
+		if ok, reason := rateLimits.allow(req.CHAddr().String(), packetSource(req, addr), time.Now()); !ok {
+			metrics.throttled[reason].Add(1)
+			continue
+		}
 		var dhcprequest dhcp.Packet
 		dhcprequest = append([]byte(nil), req...)
 		// addr is source ip address cm.Dst is the target
@@ -83,6 +91,7 @@ func Serve(conn *serveIfConn, handler Handler, jobs chan job, interfaceNet *Inte
 		select {
 		case jobs <- jobe:
 		default:
+			metrics.jobsDropped.Add(1)
 			log.LoggerWContext(ctx).Warn("DHCP job queue full, dropping packet")
 		}
 
@@ -46,6 +46,17 @@ func ServeIf(ifIndex int, p *ipv4.PacketConn, handler Handler, jobs chan job, in
 	if err := p.SetControlMessage(ipv4.FlagInterface, true); err != nil {
 		return err
 	}
+	// Closing the connection is what unblocks Serve when the listener is
+	// stopped
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.Close()
+		case <-done:
+		}
+	}()
 	return Serve(&serveIfConn{ifIndex: ifIndex, conn: p}, handler, jobs, interfaceNet, ctx)
 }
 
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net"
+	"regexp"
+
+	"github.com/go-ini/ini"
+	"github.com/inverse-inc/packetfence/go/log"
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+// hasNetwork tells if a network is served on the interface
+func (I *Interface) hasNetwork(ip net.IP) bool {
+	for _, v := range I.network {
+		if v.network.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addSharedMembers adds the subnets of the shared networks served on the
+// interface it has no address in. They are served from the address of the
+// first member of their shared network, and built by the configuration d.
+func (I *Interface) addSharedMembers(cfg *ini.File, networkKey *regexp.Regexp, d *Interfaces) {
+	for _, key := range cfg.SectionStrings() {
+		if !networkKey.MatchString(key) {
+			continue
+		}
+		sec := cfg.Section(key)
+		shared := sec.Key("shared_network").String()
+		if shared == "" || sec.Key("dhcpd").String() == "disabled" {
+			continue
+		}
+		networkIP := networkKey.FindStringSubmatch(key)[1]
+		if I.hasNetwork(net.ParseIP(networkIP)) {
+			continue
+		}
+		var serverIP net.IP
+		for _, v := range I.network {
+			if v.shared == shared {
+				serverIP = v.dhcpHandler.ip
+				break
+			}
+		}
+		if serverIP == nil {
+			continue
+		}
+
+		network := net.IPNet{IP: net.ParseIP(networkIP), Mask: net.IPMask(net.ParseIP(sec.Key("netmask").String()))}
+		ranges, err := parseRanges(sec)
+		if err != nil {
+			log.LoggerWContext(ctx).Error("Missing or invalid address range (" + err.Error() + "), check your network " + key)
+			continue
+		}
+		if !rangesWithin(ranges, &network) {
+			log.LoggerWContext(ctx).Error("The address ranges are outside of the network, check your network " + key)
+			continue
+		}
+		I.network = append(I.network, d.network(key, sec, networkIP, ranges, serverIP, I.Name))
+	}
+}
+
+// sharedMembers returns the subnets of a shared network served on the
+// interface, in configuration order
+func (I *Interface) sharedMembers(shared string) []Network {
+	var members []Network
+	for _, v := range I.networks() {
+		if v.shared == shared {
+			members = append(members, v)
+		}
+	}
+	return members
+}
+
+// sharedScope chooses the subnet of a shared network a request is served
+// from, ok is false when the network selected is not part of a shared
+// network. A request for an address is served by the subnet of the address.
+// A discover is served by the subnet the client is bound to, then by the one
+// of its class, then by the first one with a free address.
+func (I *Interface) sharedScope(selected string, msgType dhcp.MessageType, p dhcp.Packet, options dhcp.Options, info *RelayAgentInfo) (Network, bool) {
+	var members []Network
+	for _, v := range I.networks() {
+		if v.network.IP.String() == selected && v.shared != "" {
+			members = I.sharedMembers(v.shared)
+			break
+		}
+	}
+	if len(members) < 2 {
+		return Network{}, false
+	}
+
+	reqIP := net.IP(options[dhcp.OptionRequestedIPAddress])
+	if msgType != dhcp.Discover {
+		if reqIP == nil {
+			reqIP = p.CIAddr()
+		}
+		for _, v := range members {
+			if v.network.Contains(reqIP) {
+				return v, true
+			}
+		}
+		return Network{}, false
+	}
+
+	mac := p.CHAddr().String()
+	for _, v := range members {
+		if _, static := v.dhcpHandler.staticIndex(mac, info); static {
+			return v, true
+		}
+		if _, bound := v.dhcpHandler.hwcache.Get(mac); bound {
+			return v, true
+		}
+	}
+	for _, v := range members {
+		networkIP := v.network.IP.String()
+		class := matchClientClass(options, mac, info, networkIP)
+		if class == nil {
+			continue
+		}
+		if _, _, ok := class.indexRange(v.dhcpHandler); ok || class.Network == networkIP {
+			return v, true
+		}
+	}
+	for _, v := range members {
+		if v.dhcpHandler.available.FreeIPsRemaining() > 0 {
+			return v, true
+		}
+	}
+	return Network{}, false
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	cache "github.com/fdurand/go-cache"
+	"github.com/go-ini/ini"
+	"github.com/inverse-inc/packetfence/go/timedlock"
+	dhcp "github.com/krolaw/dhcp4"
+)
+
+const sharedNetworkTestConfig = `
+[network 192.168.1.0]
+netmask=255.255.255.0
+gateway=192.168.1.1
+dhcp_start=192.168.1.10
+dhcp_end=192.168.1.11
+dhcp_default_lease_time=3600
+shared_network=lan
+
+[network 192.168.2.0]
+netmask=255.255.255.0
+gateway=192.168.2.1
+dhcp_start=192.168.2.10
+dhcp_end=192.168.2.19
+dhcp_default_lease_time=3600
+ip_assigned=aa:bb:cc:00:00:02:192.168.2.15
+shared_network=lan
+
+[network 192.168.3.0]
+netmask=255.255.255.0
+gateway=192.168.3.1
+dhcp_start=192.168.3.10
+dhcp_end=192.168.3.19
+shared_network=other
+
+[network 192.168.4.0]
+netmask=255.255.255.0
+gateway=192.168.4.1
+dhcp_start=192.168.4.10
+dhcp_end=192.168.4.19
+
+[class phones]
+mac_prefix=00:04:f2
+dhcp_start=192.168.2.18
+dhcp_end=192.168.2.19
+`
+
+// newSharedNetworkTestInterface serves 192.168.1.0/24 from 192.168.1.1 and
+// the other subnets of its shared network
+func newSharedNetworkTestInterface(t *testing.T) (*Interface, *ini.File) {
+	cfg, err := ini.ShadowLoad([]byte(sharedNetworkTestConfig))
+	if err != nil {
+		t.Fatalf("Failed to load the configuration: %v", err)
+	}
+	networkKey := regexp.MustCompile("^network (?P<Net>.*)$")
+
+	I := &Interface{Name: "eth0", InterfaceType: "server"}
+	sec := cfg.Section("network 192.168.1.0")
+	ranges, err := parseRanges(sec)
+	if err != nil {
+		t.Fatalf("parseRanges failed: %v", err)
+	}
+	I.network = append(I.network, newNetwork("network 192.168.1.0", sec, "192.168.1.0", ranges, net.ParseIP("192.168.1.1"), I.Name))
+	I.addSharedMembers(cfg, networkKey, newDHCPConfig())
+	return I, cfg
+}
+
+func sharedNetworkPacket(t *testing.T, mac string, msgType dhcp.MessageType) dhcp.Packet {
+	p := newTestPacket(t, mac)
+	p.SetXId([]byte{4, 3, 2, byte(msgType)})
+	p.AddOption(dhcp.OptionDHCPMessageType, []byte{byte(msgType)})
+	return p
+}
+
+func TestAddSharedMembers(t *testing.T) {
+	dbPath := setupTestDB(t)
+	defer teardownTestDB(t, dbPath)
+	if err := InitDatabase(dbPath); err != nil {
+		t.Fatalf("InitDatabase failed: %v", err)
+	}
+
+	I, _ := newSharedNetworkTestInterface(t)
+	networks := I.networks()
+	if len(networks) != 2 || networks[1].network.IP.String() != "192.168.2.0" {
+		t.Fatalf("Expected the other subnet of the shared network to be added, got %v", networks)
+	}
+	if networks[1].shared != "lan" || !networks[1].dhcpHandler.ip.Equal(net.ParseIP("192.168.1.1")) {
+		t.Errorf("Expected 192.168.2.0 to be served from 192.168.1.1, got %s", networks[1].dhcpHandler.ip)
+	}
+	if router := net.IP(networks[1].dhcpHandler.options[dhcp.OptionRouter]); !router.Equal(net.ParseIP("192.168.2.1")) {
+		t.Errorf("Expected the gateway of 192.168.2.0, got %s", router)
+	}
+	if members := I.sharedMembers("lan"); len(members) != 2 {
+		t.Errorf("Expected 2 members, got %d", len(members))
+	}
+}
+
+func TestSharedScope(t *testing.T) {
+	dbPath := setupTestDB(t)
+	defer teardownTestDB(t, dbPath)
+	if err := InitDatabase(dbPath); err != nil {
+		t.Fatalf("InitDatabase failed: %v", err)
+	}
+	I, cfg := newSharedNetworkTestInterface(t)
+	prev := iniClientClasses
+	defer setIniClientClasses(prev)
+	setIniClientClasses(readClientClasses(cfg))
+	primary, secondary := I.networks()[0], I.networks()[1]
+
+	selected := func(p dhcp.Packet, msgType dhcp.MessageType) string {
+		member, ok := I.sharedScope("192.168.1.0", msgType, p, p.ParseOptions(), nil)
+		if !ok {
+			return ""
+		}
+		return member.network.IP.String()
+	}
+
+	// New clients go to the first subnet with a free address
+	if got := selected(sharedNetworkPacket(t, "aa:bb:cc:00:00:01", dhcp.Discover), dhcp.Discover); got != "192.168.1.0" {
+		t.Errorf("Expected the first subnet, got %q", got)
+	}
+	primary.dhcpHandler.available.ReserveIPIndex(0, "aa:bb:cc:00:00:10")
+	primary.dhcpHandler.available.ReserveIPIndex(1, "aa:bb:cc:00:00:11")
+	if got := selected(sharedNetworkPacket(t, "aa:bb:cc:00:00:01", dhcp.Discover), dhcp.Discover); got != "192.168.2.0" {
+		t.Errorf("Expected the overflow into the second subnet, got %q", got)
+	}
+
+	// Bound and static clients stay in their subnet, the members of a class
+	// with a range go to its subnet
+	primary.dhcpHandler.available.FreeIPIndex(1)
+	secondary.dhcpHandler.hwcache.Set("aa:bb:cc:00:00:03", 2, time.Hour)
+	for _, mac := range []string{"aa:bb:cc:00:00:02", "aa:bb:cc:00:00:03", "00:04:f2:00:00:01"} {
+		if got := selected(sharedNetworkPacket(t, mac, dhcp.Discover), dhcp.Discover); got != "192.168.2.0" {
+			t.Errorf("Expected %s to be served by the second subnet, got %q", mac, got)
+		}
+	}
+	primary.dhcpHandler.hwcache.Set("aa:bb:cc:00:00:11", 0, time.Hour)
+	if got := selected(sharedNetworkPacket(t, "aa:bb:cc:00:00:11", dhcp.Discover), dhcp.Discover); got != "192.168.1.0" {
+		t.Errorf("Expected the bound client to stay in the first subnet, got %q", got)
+	}
+
+	// Requests are served by the subnet of the address
+	request := sharedNetworkPacket(t, "aa:bb:cc:00:00:01", dhcp.Request)
+	request.AddOption(dhcp.OptionRequestedIPAddress, net.ParseIP("192.168.2.12").To4())
+	if got := selected(request, dhcp.Request); got != "192.168.2.0" {
+		t.Errorf("Expected the request to be served by the second subnet, got %q", got)
+	}
+	renew := sharedNetworkPacket(t, "aa:bb:cc:00:00:01", dhcp.Request)
+	renew.SetCIAddr(net.ParseIP("192.168.1.10").To4())
+	if got := selected(renew, dhcp.Request); got != "192.168.1.0" {
+		t.Errorf("Expected the renewal to be served by the first subnet, got %q", got)
+	}
+	foreign := sharedNetworkPacket(t, "aa:bb:cc:00:00:01", dhcp.Request)
+	foreign.AddOption(dhcp.OptionRequestedIPAddress, net.ParseIP("10.0.0.5").To4())
+	if got := selected(foreign, dhcp.Request); got != "" {
+		t.Errorf("Expected no member for an address outside of the shared network, got %q", got)
+	}
+}
+
+func TestServeDHCPSharedNetwork(t *testing.T) {
+	dbPath := setupTestDB(t)
+	defer teardownTestDB(t, dbPath)
+	if err := InitDatabase(dbPath); err != nil {
+		t.Fatalf("InitDatabase failed: %v", err)
+	}
+	prevCache, prevLock := GlobalTransactionCache, GlobalTransactionLock
+	defer func() { GlobalTransactionCache, GlobalTransactionLock = prevCache, prevLock }()
+	GlobalTransactionCache = cache.New(5*time.Minute, 10*time.Minute)
+	GlobalTransactionLock = timedlock.NewRWLock()
+
+	I, _ := newSharedNetworkTestInterface(t)
+
+	// The broadcast reaches the first subnet, the client is static in the second
+	p := sharedNetworkPacket(t, "aa:bb:cc:00:00:02", dhcp.Discover)
+	answer := I.ServeDHCP(context.Background(), p, dhcp.Discover, nil, nil)
+	if answer.D == nil {
+		t.Fatal("Expected an offer")
+	}
+	if !answer.D.YIAddr().Equal(net.ParseIP("192.168.2.15")) {
+		t.Errorf("Expected 192.168.2.15 to be offered, got %s", answer.D.YIAddr())
+	}
+	options := answer.D.ParseOptions()
+	if router := net.IP(options[dhcp.OptionRouter]); !router.Equal(net.ParseIP("192.168.2.1")) {
+		t.Errorf("Expected the gateway of the second subnet, got %s", router)
+	}
+	if mask := net.IPMask(options[dhcp.OptionSubnetMask]); mask.String() != "ffffff00" {
+		t.Errorf("Expected the netmask of the second subnet, got %s", mask)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/go-ini/ini"
+	"github.com/go-sql-driver/mysql"
+	"github.com/inverse-inc/packetfence/go/log"
+)
+
+// Backends of the lease store
+const (
+	storeSQLite = "sqlite" // The local database file
+	storeMySQL  = "mysql"  // A MySQL server, shared by several servers
+	storeMemory = "memory" // Lost when the daemon stops
+)
+
+// leaseStore persists the leases, their history and the option overrides.
+// The rest, reservations, exclusions, client classes and API credentials,
+// stays in the local SQLite database.
+type leaseStore interface {
+	SaveOptionOverride(overrideType, target string, options []DHCPOption) error
+	// GetOptionOverride returns nil without error when there is no override
+	GetOptionOverride(overrideType, target string) (*OptionOverride, error)
+	// DeleteOptionOverride returns sql.ErrNoRows when there is no override
+	DeleteOptionOverride(overrideType, target string) error
+	ListOptionOverrides(overrideType string) ([]OptionOverride, error)
+
+	SaveLease(lease Lease) error
+	// DeleteLease returns sql.ErrNoRows when there is no lease
+	DeleteLease(network, mac string) error
+	ListActiveLeases(network string) ([]Lease, error)
+	PurgeExpiredLeases() (int64, error)
+
+	RecordLeaseHistory(entry LeaseHistory) error
+	EndLeaseHistory(network, mac, reason string) error
+	ListLeaseHistory(mac string, limit int) ([]LeaseHistory, error)
+	// ListOpenLeaseHistory lists the entries that have not ended yet
+	ListOpenLeaseHistory() ([]LeaseHistory, error)
+	PurgeLeaseHistory(before time.Time) (int64, error)
+
+	Close() error
+}
+
+// store is the lease store in use, the SQLite one until the [database]
+// section selects another backend
+var store leaseStore
+
+// sharedOverrideCacheTTL bounds the age of the cached option overrides when
+// the store is shared, so the changes made through another server apply
+const sharedOverrideCacheTTL = 30 * time.Second
+
+// mysqlDriver is the database/sql driver of the MySQL backend
+var mysqlDriver = "mysql"
+
+// databaseConfig is the [database] section of the configuration file
+type databaseConfig struct {
+	backend  string
+	host     string
+	port     int
+	user     string
+	password string
+	name     string
+	timeout  time.Duration
+}
+
+// readDatabaseConfig reads the [database] section of the configuration file
+func readDatabaseConfig(path string) (*databaseConfig, error) {
+	cfg, err := ini.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read file: %w", err)
+	}
+	sec := cfg.Section("database")
+
+	c := &databaseConfig{
+		backend:  sec.Key("backend").MustString(storeSQLite),
+		host:     sec.Key("host").MustString("127.0.0.1"),
+		user:     sec.Key("user").String(),
+		password: sec.Key("password").String(),
+		name:     sec.Key("name").MustString("godhcp"),
+	}
+	switch c.backend {
+	case storeSQLite, storeMemory:
+		return c, nil
+	case storeMySQL:
+	default:
+		return nil, fmt.Errorf("unknown database backend %q, must be sqlite, mysql or memory", c.backend)
+	}
+	if c.port, err = strconv.Atoi(sec.Key("port").MustString("3306")); err != nil || c.port <= 0 || c.port > 65535 {
+		return nil, fmt.Errorf("invalid database port %q", sec.Key("port").String())
+	}
+	timeout, err := strconv.Atoi(sec.Key("timeout").MustString("5"))
+	if err != nil || timeout <= 0 {
+		return nil, fmt.Errorf("invalid database timeout %q", sec.Key("timeout").String())
+	}
+	c.timeout = time.Duration(timeout) * time.Second
+	if c.user == "" {
+		return nil, errors.New("the mysql backend requires a user")
+	}
+	return c, nil
+}
+
+// dsn returns the data source name of the MySQL backend
+func (c *databaseConfig) dsn() string {
+	conf := mysql.NewConfig()
+	conf.User = c.user
+	conf.Passwd = c.password
+	conf.Net = "tcp"
+	conf.Addr = net.JoinHostPort(c.host, strconv.Itoa(c.port))
+	conf.DBName = c.name
+	conf.Timeout = c.timeout
+	conf.ParseTime = true
+	conf.Loc = time.UTC
+	return conf.FormatDSN()
+}
+
+// openLeaseStore replaces the lease store by the backend of the
+// configuration. The SQLite backend uses the database opened by InitDatabase.
+func openLeaseStore(c *databaseConfig) error {
+	var next leaseStore
+	var err error
+	ttl := time.Duration(0)
+	switch c.backend {
+	case storeSQLite:
+		next = newSQLiteStore(db)
+	case storeMySQL:
+		if next, err = openMySQLStore(mysqlDriver, c.dsn()); err != nil {
+			return err
+		}
+		ttl = sharedOverrideCacheTTL
+	case storeMemory:
+		next = newMemoryStore()
+	default:
+		return fmt.Errorf("unknown database backend %q", c.backend)
+	}
+
+	previous := store
+	store = next
+	if previous != nil {
+		previous.Close()
+	}
+	resetOverrideCache(ttl)
+	log.LoggerWContext(ctx).Info("Storing the leases, their history and the option overrides in the " + c.backend + " backend")
+	return nil
+}
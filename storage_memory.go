@@ -0,0 +1,288 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps the leases and the option overrides in memory, for the
+// servers that do not need them to survive a restart
+type memoryStore struct {
+	lock      sync.RWMutex
+	lastID    int64
+	overrides map[string]OptionOverride // By type and target
+	leases    map[string]Lease          // By network and MAC address
+	history   []LeaseHistory            // In the order the entries started
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{overrides: make(map[string]OptionOverride), leases: make(map[string]Lease)}
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// copyOverride returns an override that does not share its options
+func copyOverride(o OptionOverride) *OptionOverride {
+	o.Options = append([]DHCPOption(nil), o.Options...)
+	return &o
+}
+
+// SaveOptionOverride saves or updates an option override
+func (s *memoryStore) SaveOptionOverride(overrideType, target string, options []DHCPOption) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := overrideCacheKey(overrideType, target)
+	now := time.Now().UTC()
+	override, found := s.overrides[key]
+	if !found {
+		s.lastID++
+		override = OptionOverride{ID: s.lastID, Type: overrideType, Target: target, CreatedAt: now}
+	}
+	override.Options = append([]DHCPOption(nil), options...)
+	override.UpdatedAt = now
+	s.overrides[key] = override
+	return nil
+}
+
+// GetOptionOverride retrieves an option override
+func (s *memoryStore) GetOptionOverride(overrideType, target string) (*OptionOverride, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	override, found := s.overrides[overrideCacheKey(overrideType, target)]
+	if !found {
+		return nil, nil
+	}
+	return copyOverride(override), nil
+}
+
+// DeleteOptionOverride deletes an option override
+func (s *memoryStore) DeleteOptionOverride(overrideType, target string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := overrideCacheKey(overrideType, target)
+	if _, found := s.overrides[key]; !found {
+		return sql.ErrNoRows
+	}
+	delete(s.overrides, key)
+	return nil
+}
+
+// ListOptionOverrides lists the option overrides like the SQL backends, by
+// type then most recent first
+func (s *memoryStore) ListOptionOverrides(overrideType string) ([]OptionOverride, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var overrides []OptionOverride
+	for _, override := range s.overrides {
+		if overrideType == "" || override.Type == overrideType {
+			overrides = append(overrides, *copyOverride(override))
+		}
+	}
+	sort.Slice(overrides, func(i, j int) bool {
+		a, b := overrides[i], overrides[j]
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.After(b.CreatedAt)
+		}
+		return a.ID > b.ID
+	})
+	return overrides, nil
+}
+
+// SaveLease records (or refreshes) the binding of a MAC address to an IP
+// address in a network, dropping the stale binding of the IP to another MAC
+func (s *memoryStore) SaveLease(lease Lease) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for key, stale := range s.leases {
+		if stale.Network == lease.Network && stale.IP == lease.IP && stale.MAC != lease.MAC {
+			delete(s.leases, key)
+		}
+	}
+	lease.ExpiresAt = leaseTime(lease.ExpiresAt)
+	lease.UpdatedAt = leaseTime(time.Now())
+	s.leases[lease.Network+" "+lease.MAC] = lease
+	return nil
+}
+
+// DeleteLease removes the binding of a MAC address in a network
+func (s *memoryStore) DeleteLease(network, mac string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := network + " " + mac
+	if _, found := s.leases[key]; !found {
+		return sql.ErrNoRows
+	}
+	delete(s.leases, key)
+	return nil
+}
+
+// ListActiveLeases lists the unexpired leases, optionally limited to a network
+func (s *memoryStore) ListActiveLeases(network string) ([]Lease, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	now := leaseTime(time.Now())
+	var leases []Lease
+	for _, lease := range s.leases {
+		if lease.ExpiresAt.After(now) && (network == "" || lease.Network == network) {
+			leases = append(leases, lease)
+		}
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		if leases[i].Network != leases[j].Network {
+			return leases[i].Network < leases[j].Network
+		}
+		return leases[i].IP < leases[j].IP
+	})
+	return leases, nil
+}
+
+// PurgeExpiredLeases deletes every lease whose expiry is in the past and
+// returns the number of leases removed
+func (s *memoryStore) PurgeExpiredLeases() (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := leaseTime(time.Now())
+	var purged int64
+	for key, lease := range s.leases {
+		if !lease.ExpiresAt.After(now) {
+			delete(s.leases, key)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// RecordLeaseHistory extends the open entry of the client on the address or
+// starts another one, ending the entries it replaces
+func (s *memoryStore) RecordLeaseHistory(entry LeaseHistory) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := leaseTime(time.Now())
+	for i := range s.history {
+		open := &s.history[i]
+		if open.EndedAt == nil && open.Network == entry.Network && open.MAC == entry.MAC && open.IP == entry.IP {
+			open.RenewedAt = now
+			open.Hostname = entry.Hostname
+			open.Interface = entry.Interface
+			return nil
+		}
+	}
+
+	for i := range s.history {
+		open := &s.history[i]
+		if open.EndedAt != nil || open.Network != entry.Network {
+			continue
+		}
+		if open.MAC == entry.MAC {
+			endHistory(open, now, leaseEndMoved)
+		} else if open.IP == entry.IP {
+			endHistory(open, now, leaseEndReassigned)
+		}
+	}
+	s.history = append(s.history, LeaseHistory{
+		MAC:       entry.MAC,
+		IP:        entry.IP,
+		Network:   entry.Network,
+		Interface: entry.Interface,
+		Hostname:  entry.Hostname,
+		StartedAt: now,
+		RenewedAt: now,
+	})
+	return nil
+}
+
+// endHistory ends an entry of the history
+func endHistory(entry *LeaseHistory, at time.Time, reason string) {
+	ended := at
+	entry.EndedAt = &ended
+	entry.EndReason = reason
+}
+
+// EndLeaseHistory ends the open history entry of a MAC address in a network,
+// if any
+func (s *memoryStore) EndLeaseHistory(network, mac, reason string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := leaseTime(time.Now())
+	for i := range s.history {
+		open := &s.history[i]
+		if open.EndedAt == nil && open.Network == network && open.MAC == mac {
+			endHistory(open, now, reason)
+		}
+	}
+	return nil
+}
+
+// copyHistory returns an entry that does not share its end date
+func copyHistory(entry LeaseHistory) LeaseHistory {
+	if entry.EndedAt != nil {
+		ended := *entry.EndedAt
+		entry.EndedAt = &ended
+	}
+	return entry
+}
+
+// ListLeaseHistory lists the history of a MAC address, most recent first
+func (s *memoryStore) ListLeaseHistory(mac string, limit int) ([]LeaseHistory, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	history := []LeaseHistory{}
+	for i := len(s.history) - 1; i >= 0 && len(history) < limit; i-- {
+		if s.history[i].MAC == mac {
+			history = append(history, copyHistory(s.history[i]))
+		}
+	}
+	return history, nil
+}
+
+// ListOpenLeaseHistory lists the entries that have not ended yet
+func (s *memoryStore) ListOpenLeaseHistory() ([]LeaseHistory, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	history := []LeaseHistory{}
+	for _, entry := range s.history {
+		if entry.EndedAt == nil {
+			history = append(history, copyHistory(entry))
+		}
+	}
+	return history, nil
+}
+
+// PurgeLeaseHistory deletes the history entries that ended before a date
+// and returns the number of entries removed
+func (s *memoryStore) PurgeLeaseHistory(before time.Time) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	before = leaseTime(before)
+	kept := s.history[:0]
+	var purged int64
+	for _, entry := range s.history {
+		if entry.EndedAt != nil && entry.EndedAt.Before(before) {
+			purged++
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	s.history = kept
+	return purged, nil
+}
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sqlDialect holds the statements that differ between the SQL backends
+type sqlDialect struct {
+	schema         []string // Run one by one when the store is opened
+	upsertOverride string
+	upsertLease    string
+}
+
+// sqliteDialect is created by InitDatabase with the rest of the local schema
+var sqliteDialect = sqlDialect{
+	upsertOverride: `
+		INSERT INTO dhcp_option_overrides (type, target, options, updated_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(type, target) DO UPDATE SET
+			options = excluded.options,
+			updated_at = CURRENT_TIMESTAMP
+	`,
+	upsertLease: `
+		INSERT INTO dhcp_leases (mac, ip, network, hostname, expires_at, dns_name, dns_forward, partner, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(network, mac) DO UPDATE SET
+			ip = excluded.ip,
+			hostname = excluded.hostname,
+			expires_at = excluded.expires_at,
+			dns_name = excluded.dns_name,
+			dns_forward = excluded.dns_forward,
+			partner = excluded.partner,
+			updated_at = CURRENT_TIMESTAMP
+	`,
+}
+
+// mysqlDialect stores the timestamps in UTC like SQLite
+var mysqlDialect = sqlDialect{
+	schema: []string{`
+	CREATE TABLE IF NOT EXISTS dhcp_option_overrides (
+		id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		type VARCHAR(16) NOT NULL,
+		target VARCHAR(64) NOT NULL,
+		options TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL,
+		UNIQUE (type, target),
+		CHECK (type IN ('network', 'mac'))
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`, `
+	CREATE TABLE IF NOT EXISTS dhcp_leases (
+		id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		mac VARCHAR(255) NOT NULL,
+		ip VARCHAR(64) NOT NULL,
+		network VARCHAR(64) NOT NULL,
+		hostname VARCHAR(255) NOT NULL DEFAULT '',
+		expires_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL,
+		dns_name VARCHAR(255) NOT NULL DEFAULT '',
+		dns_forward BOOLEAN NOT NULL DEFAULT 0,
+		partner BOOLEAN NOT NULL DEFAULT 0,
+		UNIQUE (network, mac),
+		KEY idx_leases_network_ip (network, ip),
+		KEY idx_leases_expires_at (expires_at)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`, `
+	CREATE TABLE IF NOT EXISTS dhcp_lease_history (
+		id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		mac VARCHAR(255) NOT NULL,
+		ip VARCHAR(64) NOT NULL,
+		network VARCHAR(64) NOT NULL,
+		interface VARCHAR(64) NOT NULL DEFAULT '',
+		hostname VARCHAR(255) NOT NULL DEFAULT '',
+		started_at DATETIME NOT NULL,
+		renewed_at DATETIME NOT NULL,
+		ended_at DATETIME NULL,
+		end_reason VARCHAR(16) NOT NULL DEFAULT '',
+		KEY idx_lease_history_mac (mac, started_at),
+		KEY idx_lease_history_open (network, mac, ended_at)
+	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+	},
+	upsertOverride: `
+		INSERT INTO dhcp_option_overrides (type, target, options, created_at, updated_at)
+		VALUES (?, ?, ?, UTC_TIMESTAMP(), UTC_TIMESTAMP())
+		ON DUPLICATE KEY UPDATE
+			options = VALUES(options),
+			updated_at = UTC_TIMESTAMP()
+	`,
+	upsertLease: `
+		INSERT INTO dhcp_leases (mac, ip, network, hostname, expires_at, dns_name, dns_forward, partner, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, UTC_TIMESTAMP())
+		ON DUPLICATE KEY UPDATE
+			ip = VALUES(ip),
+			hostname = VALUES(hostname),
+			expires_at = VALUES(expires_at),
+			dns_name = VALUES(dns_name),
+			dns_forward = VALUES(dns_forward),
+			partner = VALUES(partner),
+			updated_at = UTC_TIMESTAMP()
+	`,
+}
+
+// leaseColumns add the columns missing from a lease table created by an
+// older version, in both dialects
+var leaseColumns = []string{
+	`ALTER TABLE dhcp_leases ADD COLUMN dns_name VARCHAR(255) NOT NULL DEFAULT ''`,
+	`ALTER TABLE dhcp_leases ADD COLUMN dns_forward BOOLEAN NOT NULL DEFAULT 0`,
+	`ALTER TABLE dhcp_leases ADD COLUMN partner BOOLEAN NOT NULL DEFAULT 0`,
+}
+
+// upgradeLeaseTable adds the leaseColumns, the ones already there are left
+// untouched
+func upgradeLeaseTable(db *sql.DB) error {
+	for _, statement := range leaseColumns {
+		_, err := db.Exec(statement)
+		if err != nil && !strings.Contains(strings.ToLower(err.Error()), "duplicate column") {
+			return fmt.Errorf("failed to upgrade the lease table: %w", err)
+		}
+	}
+	return nil
+}
+
+// sqlStore is the lease store of the SQL backends
+type sqlStore struct {
+	db      *sql.DB
+	lock    *sync.RWMutex
+	dialect sqlDialect
+	local   bool // The database is the local one, closed by CloseDatabase
+}
+
+// newSQLiteStore stores the leases in the local database, its lock is shared
+// with the other tables since SQLite has a single writer
+func newSQLiteStore(localDB *sql.DB) *sqlStore {
+	return &sqlStore{db: localDB, lock: &dbMutex, dialect: sqliteDialect, local: true}
+}
+
+// openMySQLStore connects to a MySQL server and creates the tables missing
+func openMySQLStore(driverName, dsn string) (*sqlStore, error) {
+	mysqlDB, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	mysqlDB.SetMaxOpenConns(25)
+	mysqlDB.SetMaxIdleConns(5)
+	mysqlDB.SetConnMaxLifetime(5 * time.Minute)
+
+	for _, statement := range mysqlDialect.schema {
+		if _, err := mysqlDB.Exec(statement); err != nil {
+			mysqlDB.Close()
+			return nil, fmt.Errorf("failed to create schema: %w", err)
+		}
+	}
+	if err := upgradeLeaseTable(mysqlDB); err != nil {
+		mysqlDB.Close()
+		return nil, err
+	}
+
+	return &sqlStore{db: mysqlDB, lock: &sync.RWMutex{}, dialect: mysqlDialect}, nil
+}
+
+func (s *sqlStore) Close() error {
+	if s.local {
+		return nil
+	}
+	return s.db.Close()
+}
+
+// SaveOptionOverride saves or updates an option override
+func (s *sqlStore) SaveOptionOverride(overrideType, target string, options []DHCPOption) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	optionsJSON, err := json.Marshal(options)
+	if err != nil {
+		return fmt.Errorf("failed to marshal options: %w", err)
+	}
+
+	_, err = s.db.Exec(s.dialect.upsertOverride, overrideType, target, string(optionsJSON))
+	if err != nil {
+		return fmt.Errorf("failed to save option override: %w", err)
+	}
+
+	return nil
+}
+
+// GetOptionOverride retrieves an option override
+func (s *sqlStore) GetOptionOverride(overrideType, target string) (*OptionOverride, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	query := `
+		SELECT id, type, target, options, created_at, updated_at
+		FROM dhcp_option_overrides
+		WHERE type = ? AND target = ?
+	`
+
+	var override OptionOverride
+	var optionsJSON string
+
+	err := s.db.QueryRow(query, overrideType, target).Scan(
+		&override.ID,
+		&override.Type,
+		&override.Target,
+		&optionsJSON,
+		&override.CreatedAt,
+		&override.UpdatedAt,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get option override: %w", err)
+	}
+
+	err = json.Unmarshal([]byte(optionsJSON), &override.Options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal options: %w", err)
+	}
+
+	return &override, nil
+}
+
+// DeleteOptionOverride deletes an option override
+func (s *sqlStore) DeleteOptionOverride(overrideType, target string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	query := `DELETE FROM dhcp_option_overrides WHERE type = ? AND target = ?`
+
+	result, err := s.db.Exec(query, overrideType, target)
+	if err != nil {
+		return fmt.Errorf("failed to delete option override: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// ListOptionOverrides lists all option overrides
+func (s *sqlStore) ListOptionOverrides(overrideType string) ([]OptionOverride, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var query string
+	var args []interface{}
+
+	if overrideType != "" {
+		query = `
+			SELECT id, type, target, options, created_at, updated_at
+			FROM dhcp_option_overrides
+			WHERE type = ?
+			ORDER BY created_at DESC
+		`
+		args = append(args, overrideType)
+	} else {
+		query = `
+			SELECT id, type, target, options, created_at, updated_at
+			FROM dhcp_option_overrides
+			ORDER BY type, created_at DESC
+		`
+	}
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list option overrides: %w", err)
+	}
+	defer rows.Close()
+
+	var overrides []OptionOverride
+
+	for rows.Next() {
+		var override OptionOverride
+		var optionsJSON string
+
+		err := rows.Scan(
+			&override.ID,
+			&override.Type,
+			&override.Target,
+			&optionsJSON,
+			&override.CreatedAt,
+			&override.UpdatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		err = json.Unmarshal([]byte(optionsJSON), &override.Options)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal options: %w", err)
+		}
+
+		overrides = append(overrides, override)
+	}
+
+	return overrides, nil
+}
+
+// SaveLease records (or refreshes) the binding of a MAC address to an IP
+// address in a network. Any stale binding of the same IP to another MAC in the
+// network is dropped so an address is never restored twice.
+func (s *sqlStore) SaveLease(lease Lease) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	_, err = tx.Exec(`DELETE FROM dhcp_leases WHERE network = ? AND ip = ? AND mac != ?`, lease.Network, lease.IP, lease.MAC)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to drop stale lease: %w", err)
+	}
+
+	_, err = tx.Exec(s.dialect.upsertLease, lease.MAC, lease.IP, lease.Network, lease.Hostname, leaseTime(lease.ExpiresAt), lease.DNSName, lease.DNSForward, lease.Partner)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to save lease: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit lease: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteLease removes the binding of a MAC address in a network
+func (s *sqlStore) DeleteLease(network, mac string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	result, err := s.db.Exec(`DELETE FROM dhcp_leases WHERE network = ? AND mac = ?`, network, mac)
+	if err != nil {
+		return fmt.Errorf("failed to delete lease: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// ListActiveLeases lists the unexpired leases, optionally limited to a network
+func (s *sqlStore) ListActiveLeases(network string) ([]Lease, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	query := `
+		SELECT mac, ip, network, hostname, expires_at, updated_at, dns_name, dns_forward, partner
+		FROM dhcp_leases
+		WHERE expires_at > ?
+	`
+	args := []interface{}{leaseTime(time.Now())}
+
+	if network != "" {
+		query += ` AND network = ?`
+		args = append(args, network)
+	}
+	query += ` ORDER BY network, ip`
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list leases: %w", err)
+	}
+	defer rows.Close()
+
+	var leases []Lease
+
+	for rows.Next() {
+		var lease Lease
+
+		err := rows.Scan(
+			&lease.MAC,
+			&lease.IP,
+			&lease.Network,
+			&lease.Hostname,
+			&lease.ExpiresAt,
+			&lease.UpdatedAt,
+			&lease.DNSName,
+			&lease.DNSForward,
+			&lease.Partner,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		leases = append(leases, lease)
+	}
+
+	return leases, rows.Err()
+}
+
+// PurgeExpiredLeases deletes every lease whose expiry is in the past and
+// returns the number of rows removed
+func (s *sqlStore) PurgeExpiredLeases() (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	result, err := s.db.Exec(`DELETE FROM dhcp_leases WHERE expires_at <= ?`, leaseTime(time.Now()))
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge leases: %w", err)
+	}
+
+	return result.RowsAffected()
+}
+
+// RecordLeaseHistory logs the binding of a MAC address to an IP address: a
+// renewal extends the open entry, a new address starts another one. The open
+// entries of the client on other addresses of the network and of other
+// clients on this address are ended.
+func (s *sqlStore) RecordLeaseHistory(entry LeaseHistory) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := leaseTime(time.Now())
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	result, err := tx.Exec(`
+		UPDATE dhcp_lease_history SET renewed_at = ?, hostname = ?, interface = ?
+		WHERE network = ? AND mac = ? AND ip = ? AND ended_at IS NULL
+	`, now, entry.Hostname, entry.Interface, entry.Network, entry.MAC, entry.IP)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to renew lease history: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		_, err = tx.Exec(`UPDATE dhcp_lease_history SET ended_at = ?, end_reason = ? WHERE network = ? AND mac = ? AND ended_at IS NULL`,
+			now, leaseEndMoved, entry.Network, entry.MAC)
+		if err == nil {
+			_, err = tx.Exec(`UPDATE dhcp_lease_history SET ended_at = ?, end_reason = ? WHERE network = ? AND ip = ? AND mac != ? AND ended_at IS NULL`,
+				now, leaseEndReassigned, entry.Network, entry.IP, entry.MAC)
+		}
+		if err == nil {
+			_, err = tx.Exec(`
+				INSERT INTO dhcp_lease_history (mac, ip, network, interface, hostname, started_at, renewed_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?)
+			`, entry.MAC, entry.IP, entry.Network, entry.Interface, entry.Hostname, now, now)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to record lease history: %w", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit lease history: %w", err)
+	}
+
+	return nil
+}
+
+// EndLeaseHistory ends the open history entry of a MAC address in a network,
+// if any
+func (s *sqlStore) EndLeaseHistory(network, mac, reason string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, err := s.db.Exec(`UPDATE dhcp_lease_history SET ended_at = ?, end_reason = ? WHERE network = ? AND mac = ? AND ended_at IS NULL`,
+		leaseTime(time.Now()), reason, network, mac)
+	if err != nil {
+		return fmt.Errorf("failed to end lease history: %w", err)
+	}
+
+	return nil
+}
+
+// ListLeaseHistory lists the history of a MAC address, most recent first
+func (s *sqlStore) ListLeaseHistory(mac string, limit int) ([]LeaseHistory, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	rows, err := s.db.Query(`
+		SELECT mac, ip, network, interface, hostname, started_at, renewed_at, ended_at, end_reason
+		FROM dhcp_lease_history
+		WHERE mac = ?
+		ORDER BY started_at DESC, id DESC
+		LIMIT ?
+	`, mac, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list lease history: %w", err)
+	}
+	defer rows.Close()
+
+	return scanLeaseHistory(rows)
+}
+
+// ListOpenLeaseHistory lists the entries that have not ended yet
+func (s *sqlStore) ListOpenLeaseHistory() ([]LeaseHistory, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	rows, err := s.db.Query(`
+		SELECT mac, ip, network, interface, hostname, started_at, renewed_at, ended_at, end_reason
+		FROM dhcp_lease_history
+		WHERE ended_at IS NULL
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list lease history: %w", err)
+	}
+	defer rows.Close()
+
+	return scanLeaseHistory(rows)
+}
+
+// scanLeaseHistory reads the history entries of a query
+func scanLeaseHistory(rows *sql.Rows) ([]LeaseHistory, error) {
+	history := []LeaseHistory{}
+	for rows.Next() {
+		var entry LeaseHistory
+		var endedAt sql.NullTime
+		err := rows.Scan(
+			&entry.MAC,
+			&entry.IP,
+			&entry.Network,
+			&entry.Interface,
+			&entry.Hostname,
+			&entry.StartedAt,
+			&entry.RenewedAt,
+			&endedAt,
+			&entry.EndReason,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		if endedAt.Valid {
+			entry.EndedAt = &endedAt.Time
+		}
+		history = append(history, entry)
+	}
+
+	return history, rows.Err()
+}
+
+// PurgeLeaseHistory deletes the history entries that ended before a date
+// and returns the number of rows removed
+func (s *sqlStore) PurgeLeaseHistory(before time.Time) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	result, err := s.db.Exec(`DELETE FROM dhcp_lease_history WHERE ended_at IS NOT NULL AND ended_at < ?`, leaseTime(before))
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge lease history: %w", err)
+	}
+
+	return result.RowsAffected()
+}
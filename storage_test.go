@@ -0,0 +1,160 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/mattn/go-sqlite3"
+)
+
+// mysqlStandin plays a MySQL server for the tests: the statements of the
+// MySQL dialect are translated and run by SQLite, in the file named after the
+// database of the DSN in the temporary directory
+type mysqlStandin struct{}
+
+// mysqlRewrites turn the MySQL statements of the store into SQLite ones
+var mysqlRewrites = []struct {
+	pattern *regexp.Regexp
+	with    string
+}{
+	{regexp.MustCompile(`BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY`), "INTEGER PRIMARY KEY AUTOINCREMENT"},
+	{regexp.MustCompile(`,\s*KEY \w+ \([^)]*\)`), ""},
+	{regexp.MustCompile(`\)\s*ENGINE=.*$`), ")"},
+	{regexp.MustCompile(`ON DUPLICATE KEY UPDATE`), "ON CONFLICT DO UPDATE SET"},
+	{regexp.MustCompile(`VALUES\((\w+)\)`), "excluded.$1"},
+	{regexp.MustCompile(`UTC_TIMESTAMP\(\)`), "CURRENT_TIMESTAMP"},
+}
+
+func (mysqlStandin) Open(dsn string) (driver.Conn, error) {
+	conf, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := (&sqlite3.SQLiteDriver{}).Open(filepath.Join(os.TempDir(), conf.DBName))
+	if err != nil {
+		return nil, err
+	}
+	return mysqlStandinConn{conn}, nil
+}
+
+type mysqlStandinConn struct {
+	driver.Conn
+}
+
+func (c mysqlStandinConn) Prepare(query string) (driver.Stmt, error) {
+	for _, r := range mysqlRewrites {
+		query = r.pattern.ReplaceAllString(query, r.with)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func init() {
+	sql.Register("mysql-standin", mysqlStandin{})
+}
+
+// testBackends are the lease store backends the storage tests run against
+var testBackends = []string{storeSQLite, storeMySQL, storeMemory}
+
+// forEachBackend runs a test against every lease store backend, the local
+// database being initialized for the rest of the tables
+func forEachBackend(t *testing.T, test func(t *testing.T)) {
+	for _, backend := range testBackends {
+		t.Run(backend, func(t *testing.T) {
+			dbPath := setupTestDB(t)
+			defer teardownTestDB(t, dbPath)
+			if err := InitDatabase(dbPath); err != nil {
+				t.Fatalf("InitDatabase failed: %v", err)
+			}
+
+			conf := &databaseConfig{backend: backend}
+			if backend == storeMySQL {
+				prevDriver := mysqlDriver
+				defer func() { mysqlDriver = prevDriver }()
+				mysqlDriver = "mysql-standin"
+				conf.host, conf.port, conf.user, conf.name = "127.0.0.1", 3306, "godhcp", filepath.Base(dbPath)+".mysql"
+				defer os.Remove(filepath.Join(os.TempDir(), conf.name))
+			}
+			if err := openLeaseStore(conf); err != nil {
+				t.Fatalf("openLeaseStore failed: %v", err)
+			}
+			test(t)
+		})
+	}
+}
+
+func TestReadDatabaseConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "godhcp.ini")
+		os.WriteFile(path, []byte(content), 0644)
+		return path
+	}
+
+	conf, err := readDatabaseConfig(write("[interfaces]\nlisten=eth0\n"))
+	if err != nil || conf.backend != storeSQLite {
+		t.Errorf("Expected the sqlite backend by default, got %+v (%v)", conf, err)
+	}
+
+	conf, err = readDatabaseConfig(write("[database]\nbackend=mysql\nhost=db.example.com\nuser=godhcp\npassword=s3cr3t\nname=leases\n"))
+	if err != nil {
+		t.Fatalf("readDatabaseConfig failed: %v", err)
+	}
+	dsn, err := mysql.ParseDSN(conf.dsn())
+	if err != nil {
+		t.Fatalf("Invalid DSN %s: %v", conf.dsn(), err)
+	}
+	if dsn.Addr != "db.example.com:3306" || dsn.User != "godhcp" || dsn.Passwd != "s3cr3t" || dsn.DBName != "leases" || !dsn.ParseTime || dsn.Loc != time.UTC || dsn.Timeout != 5*time.Second {
+		t.Errorf("Unexpected DSN %+v", dsn)
+	}
+
+	for _, content := range []string{
+		"[database]\nbackend=postgres\n",
+		"[database]\nbackend=mysql\n",
+		"[database]\nbackend=mysql\nuser=godhcp\nport=0\n",
+		"[database]\nbackend=mysql\nuser=godhcp\ntimeout=never\n",
+	} {
+		if _, err := readDatabaseConfig(write(content)); err == nil {
+			t.Errorf("Expected %q to be refused", content)
+		}
+	}
+}
+
+func TestSharedOverrideCache(t *testing.T) {
+	forEachBackend(t, func(t *testing.T) {
+		if s, ok := store.(*sqlStore); !ok || s.local {
+			if overrideCacheTTL != 0 {
+				t.Errorf("Expected the overrides of a local store to be cached until they change, got %s", overrideCacheTTL)
+			}
+			return
+		}
+		if overrideCacheTTL != sharedOverrideCacheTTL {
+			t.Fatalf("Expected the overrides of a shared store to expire, got %s", overrideCacheTTL)
+		}
+
+		// Another server changes the override behind the cache
+		const mac = "aa:bb:cc:dd:ee:ff"
+		if o, err := cachedGetOptionOverride("mac", mac); err != nil || o != nil {
+			t.Fatalf("Expected no override, got %v err %v", o, err)
+		}
+		if err := store.SaveOptionOverride("mac", mac, []DHCPOption{{OptionCode: 51, OptionValue: "3600", OptionType: "uint32"}}); err != nil {
+			t.Fatalf("SaveOptionOverride failed: %v", err)
+		}
+		if o, _ := cachedGetOptionOverride("mac", mac); o != nil {
+			t.Fatalf("Expected the cached entry to be used, got %v", o)
+		}
+		overrideCacheMu.Lock()
+		entry := overrideCache[overrideCacheKey("mac", mac)]
+		entry.expires = time.Now().Add(-time.Second)
+		overrideCache[overrideCacheKey("mac", mac)] = entry
+		overrideCacheMu.Unlock()
+		if o, _ := cachedGetOptionOverride("mac", mac); o == nil || len(o.Options) != 1 {
+			t.Errorf("Expected the expired entry to be refreshed, got %v", o)
+		}
+	})
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/binary"
 	"math"
 	"math/rand"
 	"net"
@@ -22,13 +21,13 @@ type NodeInfo struct {
 func InterfaceScopeFromMac(MAC string) string {
 	var NetWork string
 	if index, found := GlobalMacCache.Get(MAC); found {
-		for _, v := range DHCPConfig.intsNet {
-			v := v
-			for network := range v.network {
-				if v.network[network].network.Contains(net.ParseIP(index.(string))) {
-					NetWork = v.network[network].network.String()
-					if x, found := v.network[network].dhcpHandler.hwcache.Get(MAC); found {
-						v.network[network].dhcpHandler.hwcache.Replace(MAC, x.(int), 3*time.Second)
+		for _, v := range DHCPConfig.interfaces() {
+			networks := v.networks()
+			for network := range networks {
+				if networks[network].network.Contains(net.ParseIP(index.(string))) {
+					NetWork = networks[network].network.String()
+					if x, found := networks[network].dhcpHandler.hwcache.Get(MAC); found {
+						networks[network].dhcpHandler.hwcache.Replace(MAC, x.(int), 3*time.Second)
 						log.LoggerWContext(ctx).Info(MAC + " removed")
 					}
 				}
@@ -120,17 +119,30 @@ func IPsFromRange(ip_range string) (r []net.IP, i int) {
 	return iplist, len(iplist)
 }
 
-// ExcludeIP remove IP from the pool
+// ExcludeIP remove IP from the pool, the ranges of the ip_reserved key of the
+// configuration file are addresses or start-end pairs separated by commas
 func ExcludeIP(dhcpHandler *DHCPHandler, ip_range string) {
-	excludeIPs, _ := IPsFromRange(ip_range)
-
-	for _, excludeIP := range excludeIPs {
-		if excludeIP != nil {
-			// Calculate the position for the dhcp pool
-			position := uint32(binary.BigEndian.Uint32(excludeIP.To4())) - uint32(binary.BigEndian.Uint32(dhcpHandler.start.To4()))
-
-			dhcpHandler.available.ReserveIPIndex(uint64(position), FakeMac)
+	for _, item := range strings.Split(ip_range, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		start, end, found := strings.Cut(item, "-")
+		if !found {
+			end = start
+		}
+		startIP, endIP := net.ParseIP(strings.TrimSpace(start)).To4(), net.ParseIP(strings.TrimSpace(end)).To4()
+		if startIP == nil || endIP == nil {
+			log.LoggerWContext(ctx).Error("Invalid excluded range " + item)
+			continue
+		}
+		first, last, ok := exclusionIndexes(dhcpHandler, startIP, endIP)
+		if !ok {
+			log.LoggerWContext(ctx).Error("Excluded range " + item + " is outside of the pool")
+			continue
 		}
+		dhcpHandler.exclusions.add(Exclusion{Start: startIP.String(), End: endIP.String(), Source: exclusionSourceConfig}, first, last)
+		excludeIndexes(dhcpHandler, first, last)
 	}
 }
 
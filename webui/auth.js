@@ -0,0 +1,86 @@
+// Login flow of the web UI: the API calls carry the session token and a
+// login form is shown when the API asks for credentials.
+(function () {
+    const storageKey = 'godhcpToken';
+    const originalFetch = window.fetch.bind(window);
+    let loginShown = false;
+
+    window.fetch = async function (input, init) {
+        init = init || {};
+        const token = sessionStorage.getItem(storageKey);
+        if (token) {
+            const headers = new Headers(init.headers || {});
+            if (!headers.has('Authorization')) {
+                headers.set('Authorization', 'Bearer ' + token);
+            }
+            init.headers = headers;
+        }
+        const response = await originalFetch(input, init);
+        if (response.status === 401 && !String(input).endsWith('/api/v1/auth/login')) {
+            sessionStorage.removeItem(storageKey);
+            showLogin();
+        }
+        return response;
+    };
+
+    function showLogin() {
+        if (loginShown) {
+            return;
+        }
+        loginShown = true;
+
+        const overlay = document.createElement('div');
+        overlay.style.cssText = 'position:fixed;inset:0;background:rgba(0,0,0,0.5);display:flex;align-items:center;justify-content:center;z-index:1000;';
+        overlay.innerHTML = `
+            <form style="background:white;padding:30px;border-radius:12px;width:320px;box-shadow:0 10px 40px rgba(0,0,0,0.2);font-family:inherit;">
+                <h2 style="margin-bottom:20px;font-size:20px;color:#333;">Sign in</h2>
+                <div class="login-error" style="display:none;color:#721c24;background:#f8d7da;padding:10px;border-radius:6px;margin-bottom:15px;font-size:14px;"></div>
+                <input name="username" placeholder="Username" autocomplete="username" required
+                    style="width:100%;padding:10px;margin-bottom:10px;border:1px solid #ced4da;border-radius:6px;font-size:14px;">
+                <input name="password" type="password" placeholder="Password" autocomplete="current-password" required
+                    style="width:100%;padding:10px;margin-bottom:20px;border:1px solid #ced4da;border-radius:6px;font-size:14px;">
+                <button type="submit" class="btn btn-primary" style="width:100%;">Sign in</button>
+            </form>
+        `;
+        const form = overlay.querySelector('form');
+        form.addEventListener('submit', async (event) => {
+            event.preventDefault();
+            const response = await originalFetch('/api/v1/auth/login', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ username: form.username.value, password: form.password.value })
+            });
+            const data = await response.json().catch(() => ({}));
+            if (!response.ok || !data.token) {
+                const error = overlay.querySelector('.login-error');
+                error.textContent = data.message || 'Invalid username or password';
+                error.style.display = 'block';
+                return;
+            }
+            sessionStorage.setItem(storageKey, data.token);
+            window.location.reload();
+        });
+        document.body.appendChild(overlay);
+        form.username.focus();
+    }
+
+    async function logout(event) {
+        event.preventDefault();
+        await window.fetch('/api/v1/auth/logout', { method: 'POST' });
+        sessionStorage.removeItem(storageKey);
+        window.location.reload();
+    }
+
+    document.addEventListener('DOMContentLoaded', () => {
+        const nav = document.querySelector('.nav');
+        if (!nav || !sessionStorage.getItem(storageKey)) {
+            return;
+        }
+        const link = document.createElement('a');
+        link.href = '#';
+        link.textContent = 'Logout';
+        link.style.float = 'right';
+        link.addEventListener('click', logout);
+        nav.appendChild(link);
+    });
+})();
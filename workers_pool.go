@@ -5,6 +5,7 @@ import (
 	_ "expvar"
 	"net"
 	"strconv"
+	"time"
 
 	"github.com/inverse-inc/packetfence/go/log"
 	dhcp "github.com/krolaw/dhcp4"
@@ -22,7 +23,11 @@ type job struct {
 
 func doWork(id int, element job) {
 	var ans Answer
-	if ans = element.handler.ServeDHCP(element.localCtx, element.DHCPpacket, element.msgType, element.clientAddr, element.srvAddr); ans.D != nil {
+	start := time.Now()
+	ans = element.handler.ServeDHCP(element.localCtx, element.DHCPpacket, element.msgType, element.clientAddr, element.srvAddr)
+	metrics.observeLatency(time.Since(start))
+	if ans.D != nil {
+		metrics.countSent(ans.D)
 		// DHCP Relay
 		if element.Int.isRelay() {
 			switch element.msgType {